@@ -2,18 +2,85 @@ package activity
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	db "encore.app/billing/db"
+	"encore.app/billing/fx"
+	"encore.app/billing/tax"
+	"encore.dev/beta/errs"
 	"github.com/shopspring/decimal"
+	"go.temporal.io/sdk/temporal"
 )
 
+// Activities holds the dependencies of the billing activities. Register a
+// *Activities with the worker to register all of its methods.
+type Activities struct {
+	FX fx.FXRateProvider
+	// HTTP sends webhook deliveries
+	HTTP *http.Client
+	// Tax calculates the tax of items, none is charged if nil
+	Tax tax.TaxCalculator
+}
+
 type AddLineItemSignalInput struct {
 	BillId      string
 	Reference   string
 	Description string
 	Amount      decimal.Decimal
 	Currency    string
+	// Type defaults to a charge
+	Type db.ItemType
+	// ReversesItemId is the item cancelled by a reversal
+	ReversesItemId int64
+	// ExchangeRate is set on reversals so they cancel the original exactly
+	ExchangeRate decimal.Decimal
+	// BillCurrency is the settlement currency the item is converted into
+	BillCurrency string
+	// PriceId, Quantity and UnitPrice are set on items priced from the
+	// catalog, whose Amount was computed from them
+	PriceId   string
+	Quantity  decimal.Decimal
+	UnitPrice decimal.Decimal
+}
+
+// AddLineItemsInput is a batch of items added to a bill together, delivered
+// with the AddLineItems update by bulk imports.
+type AddLineItemsInput struct {
+	BillId string
+	Items  []AddLineItemSignalInput
+}
+
+// LineItemResult is the outcome of one item of a batch: the item as
+// persisted, or the type and message of the error that kept it off the bill.
+type LineItemResult struct {
+	Reference string
+	Item      *db.DbBillItem
+	ErrorType string
+	Error     string
+	// Duplicate is set when the reference was already used on the bill, Item
+	// is then the existing item
+	Duplicate bool
+}
+
+// Err returns the error of an item that was not added, or nil.
+func (r LineItemResult) Err() error {
+	if r.Item != nil {
+		return nil
+	}
+	return temporal.NewApplicationError(r.Error, r.ErrorType)
+}
+
+// Fail records err as the reason the item was not added.
+func (r *LineItemResult) Fail(err error) {
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		r.ErrorType, r.Error = appErr.Type(), appErr.Message()
+		return
+	}
+	r.Error = err.Error()
 }
 
 type CreateBillInput struct {
@@ -22,41 +89,272 @@ type CreateBillInput struct {
 	Currency    string
 	PeriodStart time.Time
 	PeriodEnd   time.Time
+	// Status the bill is created in, defaults to open
+	Status db.Status
+	// SubscriptionId is set for the bills of recurring subscriptions
+	SubscriptionId string
 }
 
 type CloseBillInput struct {
 	BillId string
 }
 
-func CreateBillActivity(ctx context.Context, input CreateBillInput) (string, error) {
-	return db.InsertBill(ctx, input.BillId, db.StatusOpen, input.AccountId, input.Currency, input.PeriodStart, input.PeriodEnd)
+type UpdateBillStatusInput struct {
+	BillId string
+	Status db.Status
+}
+
+type VoidBillInput struct {
+	BillId string
+	Actor  string
+	Reason string
 }
 
-func AddLineItemActivity(
-	ctx context.Context,
-	input AddLineItemSignalInput,
-) error {
+type ReopenBillInput struct {
+	BillId string
+	Actor  string
+	Reason string
+	// PeriodEnd is the new end of the billing period, zero keeps the current one
+	PeriodEnd time.Time
+}
 
-	// TODO: fetch exchange rate from forex service
-	rate := decimal.NewFromInt(1)
-	_, err := db.InsertBillItem(ctx, input.BillId, input.Reference, input.Description, input.Amount, input.Currency, rate)
-	if err != nil {
+type LoadBillInput struct {
+	BillId string
+}
+
+type LoadBillResult struct {
+	Bill  db.DbBill
+	Items []db.DbBillItem
+}
+
+// nonRetryable marks precondition errors that cannot succeed on retry so that
+// Temporal surfaces them to the workflow instead of retrying forever.
+func nonRetryable(err error) error {
+	switch errs.Code(err) {
+	case errs.FailedPrecondition:
+		return temporal.NewNonRetryableApplicationError(err.Error(), FailedPreconditionError, err)
+	case errs.NotFound:
+		return temporal.NewNonRetryableApplicationError(err.Error(), NotFoundError, err)
+	default:
 		return err
 	}
+}
+
+func (a *Activities) CreateBillActivity(ctx context.Context, input CreateBillInput) (string, error) {
+	status := input.Status
+	if status == "" {
+		status = db.StatusOpen
+	}
+	var subscriptionId *string
+	if input.SubscriptionId != "" {
+		subscriptionId = &input.SubscriptionId
+	}
+	return db.InsertBillWithSubscription(ctx, input.BillId, status, input.AccountId, input.Currency, input.PeriodStart, input.PeriodEnd, subscriptionId)
+}
+
+func (a *Activities) UpdateBillStatusActivity(ctx context.Context, input UpdateBillStatusInput) error {
+	return nonRetryable(db.UpdateBillStatus(ctx, input.BillId, input.Status))
+}
+
+func (a *Activities) VoidBillActivity(ctx context.Context, input VoidBillInput) error {
+	return nonRetryable(db.ChangeBillStatus(ctx, input.BillId, db.StatusVoided, input.Actor, input.Reason))
+}
+
+// ReopenBillActivity reopens a closed bill, returning its items, which
+// include the item releasing the account credit applied when it closed.
+func (a *Activities) ReopenBillActivity(ctx context.Context, input ReopenBillInput) ([]db.DbBillItem, error) {
+	err := db.ReopenBill(ctx, input.BillId, input.PeriodEnd, input.Actor, input.Reason)
+	if err != nil {
+		return nil, nonRetryable(err)
+	}
+	return db.GetBillItems(ctx, input.BillId)
+}
+
+// LoadBillActivity reads an existing bill so a workflow resumed after the
+// bill closed can rebuild its state.
+func (a *Activities) LoadBillActivity(ctx context.Context, input LoadBillInput) (*LoadBillResult, error) {
+	bill, items, _, err := db.GetBillDetailsWithTotal(ctx, input.BillId)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadBillResult{Bill: *bill, Items: items}, nil
+}
+
+// AddLineItemsActivity inserts a batch of items in one transaction and
+// calculates their tax together, returning the outcome of each item in input
+// order. Items that cannot be added, such as those in a currency without an
+// exchange rate, fail on their own while the rest of the batch is added.
+func (a *Activities) AddLineItemsActivity(ctx context.Context, input AddLineItemsInput) ([]LineItemResult, error) {
+	rates := map[string]decimal.Decimal{}
+	results := make([]LineItemResult, len(input.Items))
+	var items []db.DbBillItem
+	for i, in := range input.Items {
+		results[i].Reference = in.Reference
+		item, err := a.newBillItem(ctx, in, rates)
+		var appErr *temporal.ApplicationError
+		if errors.As(err, &appErr) && appErr.NonRetryable() {
+			results[i].Fail(err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return results, nil
+	}
+	added, reversed, err := db.InsertBillItems(ctx, input.BillId, items)
+	if err != nil {
+		return nil, nonRetryable(err)
+	}
+	if err := a.taxItems(ctx, input.BillId, added); err != nil {
+		return nil, err
+	}
+
+	byReference := make(map[string]*db.DbBillItem, len(added))
+	for i := range added {
+		byReference[added[i].Reference] = &added[i]
+	}
+	for _, reference := range reversed {
+		byReference[reference] = nil
+	}
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		if item := byReference[results[i].Reference]; item != nil {
+			results[i].Item = item
+		} else {
+			results[i].Fail(temporal.NewApplicationError("Line item is already reversed", LineItemReversedError))
+		}
+	}
+	return results, nil
+}
+
+// newBillItem converts the input of an item into the item to persist. Exchange
+// rates are looked up once per currency through rates.
+func (a *Activities) newBillItem(ctx context.Context, input AddLineItemSignalInput, rates map[string]decimal.Decimal) (db.DbBillItem, error) {
+	itemType := input.Type
+	if itemType == "" {
+		itemType = db.ItemTypeCharge
+	}
+	var reversesItemId *int64
+	if input.ReversesItemId != 0 {
+		reversesItemId = &input.ReversesItemId
+	}
+
+	rate := input.ExchangeRate
+	if rate.IsZero() {
+		var ok bool
+		if rate, ok = rates[input.Currency]; !ok {
+			var err error
+			rate, err = a.exchangeRate(ctx, input.Currency, input.BillCurrency)
+			if err != nil {
+				return db.DbBillItem{}, err
+			}
+			rates[input.Currency] = rate
+		}
+	}
+	item := db.DbBillItem{
+		BillId:         input.BillId,
+		Reference:      input.Reference,
+		Description:    input.Description,
+		Type:           itemType,
+		Amount:         input.Amount,
+		Currency:       input.Currency,
+		ExchangeRate:   rate,
+		ReversesItemId: reversesItemId,
+	}
+	if input.PriceId != "" {
+		item.PriceId = &input.PriceId
+		item.Quantity = decimal.NewNullDecimal(input.Quantity)
+		item.UnitPrice = decimal.NewNullDecimal(input.UnitPrice)
+	}
+	return item, nil
+}
+
+// exchangeRate returns the current rate converting from into to. A missing
+// rate fails without retrying.
+func (a *Activities) exchangeRate(ctx context.Context, from, to string) (decimal.Decimal, error) {
+	rate, err := a.FX.Rate(ctx, from, to, time.Now())
+	if errors.Is(err, fx.ErrRateNotFound) {
+		return decimal.Zero, temporal.NewNonRetryableApplicationError(
+			fmt.Sprintf("No exchange rate from %s to %s", from, to),
+			ExchangeRateNotFoundError, err)
+	}
+	return rate, err
+}
+
+// CloseBillActivity closes the bill and persists its totals.
+func (a *Activities) CloseBillActivity(ctx context.Context, input CloseBillInput) error {
+	err := a.closeBill(ctx, input.BillId)
+	if err != nil {
+		return nonRetryable(err)
+	}
+
 	return nil
 }
 
-func CloseBillActivity(ctx context.Context, input CloseBillInput) error {
-	err := db.UpdateBillStatus(ctx, input.BillId, db.StatusClosed)
+// closeBill recalculates the tax of every item and the discounts of the
+// account's coupons, and closes the bill with them, so the persisted totals
+// use the rates, profile and coupons current at closing.
+func (a *Activities) closeBill(ctx context.Context, billId string) error {
+	bill, items, err := loadBill(ctx, billId)
 	if err != nil {
 		return err
 	}
+	taxLines, discounts, _, err := a.billTotals(ctx, bill, items)
+	if err != nil {
+		return err
+	}
+	_, err = db.CloseBill(ctx, billId, taxLines, discounts)
+	return err
+}
 
-	return nil
+func loadBill(ctx context.Context, billId string) (*db.DbBill, []db.DbBillItem, error) {
+	bill, err := db.GetBillByID(ctx, billId)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := db.GetBillItems(ctx, billId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bill, items, nil
+}
+
+// billTotals computes the tax lines, discounts and totals the bill would
+// close with. Discounts are computed on the subtotal before tax and split
+// across the items, which are then taxed on their discounted amounts.
+func (a *Activities) billTotals(ctx context.Context, bill *db.DbBill, items []db.DbBillItem) ([]db.DbTaxLine, []db.DbBillDiscount, *db.BillTotals, error) {
+	taxLines, err := a.calculateTax(ctx, bill, items, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	subtotal := db.NewBillTotals(bill.Currency, items, taxLines, nil).Subtotal
+	discounts, err := billDiscounts(ctx, bill, subtotal)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(discounts) > 0 {
+		itemDiscounts := map[int64]decimal.Decimal{}
+		for _, shares := range db.DiscountShares(bill.Currency, items, taxLines, discounts) {
+			for j, share := range shares {
+				itemDiscounts[items[j].Id] = itemDiscounts[items[j].Id].Add(share)
+			}
+		}
+		taxLines, err = a.calculateTax(ctx, bill, items, itemDiscounts)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	totals := db.NewBillTotals(bill.Currency, items, taxLines, discounts)
+	return taxLines, discounts, &totals, nil
 }
 
-func TimerCloseBillActivity(ctx context.Context, input CloseBillInput) error {
-	err := db.UpdateBillStatus(ctx, input.BillId, db.StatusClosed)
+func (a *Activities) TimerCloseBillActivity(ctx context.Context, input CloseBillInput) error {
+	err := a.closeBill(ctx, input.BillId)
 	if err != nil {
 		return err
 	}
@@ -3,3 +3,25 @@ package activity
 const CreateBillSignal = "CreateBill"
 const CloseBillSignal = "CloseBill"
 const AddLineItemSignal = "AddLineItem"
+const VoidBillSignal = "VoidBill"
+const ReopenBillSignal = "ReopenBill"
+const CancelSubscriptionSignal = "CancelSubscription"
+
+const AddLineItemUpdate = "AddLineItemUpdate"
+const AddLineItemsUpdate = "AddLineItemsUpdate"
+
+const GetBillStateQuery = "GetBillState"
+
+// Application error types returned by workflow update validators.
+const BillNotOpenError = "BillNotOpen"
+const InvalidLineItemError = "InvalidLineItem"
+const LineItemNotFoundError = "LineItemNotFound"
+const LineItemReversedError = "LineItemReversed"
+
+// Application error types for lifecycle violations and for activity
+// failures that cannot succeed on retry.
+const IllegalTransitionError = "IllegalTransition"
+const FailedPreconditionError = "FailedPrecondition"
+const NotFoundError = "NotFound"
+const ExchangeRateNotFoundError = "ExchangeRateNotFound"
+const InvalidScheduleError = "InvalidSchedule"
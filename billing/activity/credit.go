@@ -0,0 +1,38 @@
+package activity
+
+import (
+	"context"
+
+	db "encore.app/billing/db"
+)
+
+type ApplyCreditInput struct {
+	BillId string
+}
+
+// ApplyCreditActivity draws the account's available credit onto the bill, up
+// to the total it would close with. It returns the account credit item, or
+// nil if no credit was applied. A failure leaves the bill closing, and the
+// close is retried by the workflow.
+func (a *Activities) ApplyCreditActivity(ctx context.Context, input ApplyCreditInput) (*db.DbBillItem, error) {
+	bill, items, err := loadBill(ctx, input.BillId)
+	if err != nil {
+		return nil, err
+	}
+	_, _, totals, err := a.billTotals(ctx, bill, items)
+	if err != nil {
+		return nil, err
+	}
+
+	// credit already applied is part of the totals; the item is returned as
+	// is when applied again
+	limit := totals.TotalAmount.Add(totals.CreditAmount)
+	if !limit.IsPositive() {
+		return nil, nil
+	}
+	item, err := db.ApplyAccountCredit(ctx, bill.Id, limit)
+	if err != nil {
+		return nil, nonRetryable(err)
+	}
+	return item, nil
+}
@@ -0,0 +1,45 @@
+package activity
+
+import (
+	"context"
+
+	db "encore.app/billing/db"
+	"encore.app/billing/discount"
+	"github.com/shopspring/decimal"
+)
+
+// billDiscounts computes the discounts of the coupons redeemed by the bill's
+// account on the bill's subtotal. Coupons granting nothing, such as those
+// restricted to another currency, are left out so they do not use up a bill
+// of their duration.
+func billDiscounts(ctx context.Context, bill *db.DbBill, subtotal decimal.Decimal) ([]db.DbBillDiscount, error) {
+	redemptions, err := db.GetActiveRedemptions(ctx, bill.Id)
+	if err != nil || len(redemptions) == 0 {
+		return nil, err
+	}
+
+	coupons := make([]discount.Coupon, len(redemptions))
+	for i, r := range redemptions {
+		coupons[i] = r.Coupon.Discount()
+	}
+	amounts := discount.Apply(bill.Currency, subtotal, coupons)
+
+	var discounts []db.DbBillDiscount
+	for i, r := range redemptions {
+		if amounts[i].IsZero() {
+			continue
+		}
+		description := r.Coupon.Name
+		if description == "" {
+			description = r.Coupon.Code
+		}
+		discounts = append(discounts, db.DbBillDiscount{
+			BillId:       bill.Id,
+			RedemptionId: r.Redemption.Id,
+			CouponCode:   r.Coupon.Code,
+			Description:  description,
+			Amount:       amounts[i],
+		})
+	}
+	return discounts, nil
+}
@@ -0,0 +1,79 @@
+package activity
+
+import (
+	"context"
+
+	db "encore.app/billing/db"
+	"encore.app/billing/tax"
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+// calculateTax returns the tax lines of items on bill, taxing each item net
+// of its part of the bill's discounts, if any. Accounts without a tax
+// profile, and workers without a calculator, are not charged tax.
+func (a *Activities) calculateTax(ctx context.Context, bill *db.DbBill, items []db.DbBillItem, discounts map[int64]decimal.Decimal) ([]db.DbTaxLine, error) {
+	if a.Tax == nil {
+		return nil, nil
+	}
+	profile, err := db.GetTaxProfile(ctx, bill.AccountId)
+	if errs.Code(err) == errs.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := tax.Request{
+		AccountId: bill.AccountId,
+		Address:   tax.Address{Country: profile.Country, Region: profile.Region},
+		Exempt:    profile.Exempt,
+		Currency:  bill.Currency,
+	}
+	for _, item := range items {
+		if item.Type == db.ItemTypeAccountCredit {
+			// credit settles the taxed total rather than reducing it
+			continue
+		}
+		req.Items = append(req.Items, tax.Item{ItemId: item.Id, Amount: item.Amount.Mul(item.ExchangeRate), Discount: discounts[item.Id]})
+	}
+
+	if len(req.Items) == 0 {
+		return nil, nil
+	}
+	lines, err := a.Tax.Calculate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	taxLines := make([]db.DbTaxLine, len(lines))
+	for i, l := range lines {
+		taxLines[i] = db.DbTaxLine{
+			BillId:        bill.Id,
+			ItemId:        l.ItemId,
+			Jurisdiction:  l.Jurisdiction,
+			Rate:          l.Rate,
+			Inclusive:     l.Inclusive,
+			TaxableAmount: l.TaxableAmount,
+			Amount:        l.Amount,
+		}
+	}
+	return taxLines, nil
+}
+
+// taxItems calculates the tax of items as they are added, so open bills show
+// their running tax.
+func (a *Activities) taxItems(ctx context.Context, billId string, items []db.DbBillItem) error {
+	bill, err := db.GetBillByID(ctx, billId)
+	if err != nil {
+		return err
+	}
+	lines, err := a.calculateTax(ctx, bill, items, nil)
+	if err != nil {
+		return err
+	}
+	itemIds := make([]int64, len(items))
+	for i, item := range items {
+		itemIds[i] = item.Id
+	}
+	return db.ReplaceItemTaxLines(ctx, billId, itemIds, lines)
+}
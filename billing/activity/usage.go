@@ -0,0 +1,132 @@
+package activity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	db "encore.app/billing/db"
+	"encore.app/billing/metering"
+	"github.com/shopspring/decimal"
+)
+
+type MaterializeUsageInput struct {
+	BillId string
+}
+
+// maxUsageReads bounds how often MaterializeUsageActivity re-reads usage
+// billed concurrently on another bill before leaving it to the retry policy.
+const maxUsageReads = 3
+
+// MaterializeUsageActivity prices the unbilled usage of the bill's account
+// and subscription up to the end of its period into one usage item per meter
+// and period, returning all items of the bill. Usage reported late for an
+// earlier, already closed period is billed on this bill as items of its own. When some of the events are
+// billed on another bill meanwhile, the usage is read and priced again
+// without them.
+func (a *Activities) MaterializeUsageActivity(ctx context.Context, input MaterializeUsageInput) ([]db.DbBillItem, error) {
+	bill, err := db.GetBillByID(ctx, input.BillId)
+	if err != nil {
+		return nil, err
+	}
+
+	for read := 1; ; read++ {
+		usage, err := db.GetUnbilledUsage(ctx, bill)
+		if err != nil {
+			return nil, err
+		}
+		if len(usage) == 0 {
+			break
+		}
+
+		items, eventIds, err := a.priceUsage(ctx, bill, usage)
+		if err != nil {
+			return nil, err
+		}
+		err = db.InsertUsageItems(ctx, bill.Id, items, eventIds)
+		if errors.Is(err, db.ErrUsageBilled) && read < maxUsageReads {
+			continue
+		}
+		if err != nil {
+			return nil, nonRetryable(err)
+		}
+		break
+	}
+
+	return db.GetBillItems(ctx, bill.Id)
+}
+
+// priceUsage aggregates the events of each meter per period they belong to,
+// so late usage of an earlier period is billed on its own item rather than
+// absorbed into the current period's max, last or unique count.
+func (a *Activities) priceUsage(ctx context.Context, bill *db.DbBill, usage []db.DbUsageEvent) ([]db.DbBillItem, []int64, error) {
+	type group struct {
+		meterKey    string
+		periodStart time.Time
+	}
+	byGroup := map[group][]db.DbUsageEvent{}
+	var groups []group
+	for _, e := range usage {
+		g := group{e.MeterKey, e.PeriodStart}
+		if _, ok := byGroup[g]; !ok {
+			groups = append(groups, g)
+		}
+		byGroup[g] = append(byGroup[g], e)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].meterKey != groups[j].meterKey {
+			return groups[i].meterKey < groups[j].meterKey
+		}
+		return groups[i].periodStart.Before(groups[j].periodStart)
+	})
+
+	meters := map[string]*db.DbMeter{}
+	rates := map[string]decimal.Decimal{}
+	var items []db.DbBillItem
+	var eventIds []int64
+	for _, g := range groups {
+		meter, ok := meters[g.meterKey]
+		if !ok {
+			var err error
+			if meter, err = db.GetMeter(ctx, g.meterKey); err != nil {
+				return nil, nil, err
+			}
+			meters[g.meterKey] = meter
+		}
+		rate, ok := rates[meter.Currency]
+		if !ok {
+			var err error
+			if rate, err = a.exchangeRate(ctx, meter.Currency, bill.Currency); err != nil {
+				return nil, nil, err
+			}
+			rates[meter.Currency] = rate
+		}
+
+		events := make([]metering.Event, len(byGroup[g]))
+		for i, e := range byGroup[g] {
+			events[i] = metering.Event{Quantity: e.Quantity, Value: e.Value, Timestamp: e.Timestamp}
+			eventIds = append(eventIds, e.Id)
+		}
+		quantity := metering.Aggregate(metering.Aggregation(meter.Aggregation), events)
+
+		description := fmt.Sprintf("%s: %s", meter.Name, quantity)
+		if g.periodStart.Before(bill.PeriodStart) {
+			description = fmt.Sprintf("%s, period from %s: %s", meter.Name, g.periodStart.Format(time.DateOnly), quantity)
+		}
+		// the first event identifies the batch, so a retried activity
+		// reuses the item and a later batch on a reopened bill does not
+		items = append(items, db.DbBillItem{
+			Reference:    fmt.Sprintf("usage:%s:%d", g.meterKey, byGroup[g][0].Id),
+			Description:  description,
+			Type:         db.ItemTypeUsage,
+			Amount:       quantity.Mul(meter.UnitPrice),
+			Currency:     meter.Currency,
+			ExchangeRate: rate,
+			Quantity:     decimal.NewNullDecimal(quantity),
+			UnitPrice:    decimal.NewNullDecimal(meter.UnitPrice),
+		})
+	}
+	return items, eventIds, nil
+}
@@ -0,0 +1,78 @@
+package activity
+
+import (
+	"context"
+	"errors"
+
+	db "encore.app/billing/db"
+	"encore.app/billing/webhook"
+	"encore.dev/beta/errs"
+	"go.temporal.io/sdk/temporal"
+)
+
+type DeliverWebhookInput struct {
+	DeliveryId int64
+}
+
+// DeliverWebhookActivity sends a delivery to its endpoint, logging the
+// attempt. It fails while the endpoint does not accept the delivery, so the
+// activity retry policy drives the retry schedule.
+func (a *Activities) DeliverWebhookActivity(ctx context.Context, input DeliverWebhookInput) error {
+	delivery, err := db.GetWebhookDelivery(ctx, input.DeliveryId)
+	if err != nil {
+		return nonRetryable(err)
+	}
+	if delivery.Status == db.DeliverySucceeded {
+		return nil
+	}
+	endpoint, err := db.GetWebhookEndpoint(ctx, delivery.EndpointId)
+	if err != nil {
+		return nonRetryable(err)
+	}
+	// deleted endpoints stop receiving retries
+	if !endpoint.Active {
+		return nonRetryable(&errs.Error{Code: errs.FailedPrecondition, Message: "Webhook endpoint is inactive"})
+	}
+	// endpoints created before https was required are not sent to
+	if err := webhook.ValidateURL(endpoint.URL); err != nil {
+		if recordErr := db.RecordWebhookAttempt(ctx, delivery.Id, nil, err.Error(), false); recordErr != nil {
+			return recordErr
+		}
+		return temporal.NewNonRetryableApplicationError(err.Error(), FailedPreconditionError, err)
+	}
+
+	result, sendErr := webhook.Send(ctx, a.HTTP, webhook.Delivery{
+		URL:       endpoint.URL,
+		Secret:    endpoint.Secret,
+		EventId:   delivery.EventId,
+		EventType: delivery.EventType,
+		Payload:   []byte(delivery.Payload),
+	})
+
+	var statusCode *int
+	attemptErr := ""
+	if result != nil {
+		statusCode = &result.StatusCode
+	}
+	if sendErr != nil {
+		attemptErr = sendErr.Error()
+		if result != nil && result.Body != "" {
+			attemptErr += ": " + result.Body
+		}
+	}
+
+	err = db.RecordWebhookAttempt(ctx, delivery.Id, statusCode, attemptErr, sendErr == nil)
+	if err != nil {
+		return err
+	}
+	if errors.Is(sendErr, webhook.ErrForbiddenAddress) {
+		return temporal.NewNonRetryableApplicationError(sendErr.Error(), FailedPreconditionError, sendErr)
+	}
+	return sendErr
+}
+
+// FailWebhookDeliveryActivity marks a delivery failed once its retries are
+// exhausted, so it can be replayed.
+func (a *Activities) FailWebhookDeliveryActivity(ctx context.Context, input DeliverWebhookInput) error {
+	return db.SetWebhookDeliveryStatus(ctx, input.DeliveryId, db.DeliveryFailed)
+}
@@ -2,16 +2,23 @@ package billing
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"encore.app/billing/activity"
+	"encore.app/billing/currency"
 	"encore.app/billing/db"
 	billing "encore.app/billing/workflow"
 	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
 	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
 )
 
 // ==================================================================
@@ -32,6 +39,11 @@ type CreateBillRequest struct {
 
 //encore:api public method=POST path=/bills
 func (s *Service) CreateBill(ctx context.Context, req *CreateBillRequest) (*Response, error) {
+	settlement, ok := currency.Lookup(req.Currency)
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+	}
+
 	billId := uuid.New().String()
 	options := client.StartWorkflowOptions{
 		ID:        billId,
@@ -40,7 +52,7 @@ func (s *Service) CreateBill(ctx context.Context, req *CreateBillRequest) (*Resp
 	we, err := s.client.ExecuteWorkflow(ctx, options, billing.CreateBillWorkflow, billing.CreateBillWorkflowInput{
 		BillId:      billId,
 		AccountId:   req.AccountId,
-		Currency:    req.Currency,
+		Currency:    settlement.Code,
 		PeriodStart: req.PeriodStart,
 		PeriodEnd:   req.PeriodEnd,
 	})
@@ -59,35 +71,226 @@ type AddLineItemRequest struct {
 	Description string          `json:"description"`
 	Amount      decimal.Decimal `json:"amount"`
 	Currency    string          `json:"currency"`
+	// PriceId prices Quantity units from the catalog instead of taking a
+	// hand-computed Amount; the item is in the price's currency
+	PriceId  string          `json:"price_id"`
+	Quantity decimal.Decimal `json:"quantity"`
+}
+
+type AddLineItemResponse struct {
+	Message  string         `json:"message"`
+	LineItem *db.DbBillItem `json:"line_item"`
 }
 
 //encore:api public method=POST path=/bills/:billId/item
-func (s *Service) AddLineItem(ctx context.Context, billId string, req *AddLineItemRequest) (*Response, error) {
-	// check closed
-	bill, err := db.GetBillByID(ctx, billId)
-	if err != nil {
+func (s *Service) AddLineItem(ctx context.Context, billId string, req *AddLineItemRequest) (*AddLineItemResponse, error) {
+	if err := lineItemReference(req.Reference); err != nil {
 		return nil, err
 	}
-	if bill.Status == db.StatusClosed {
-		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is already closed"}
+	if req.PriceId != "" {
+		input, err := pricedLineItem(ctx, billId, req)
+		if err != nil {
+			return nil, err
+		}
+		return s.addBillItem(ctx, *input)
 	}
-
-	if req.Amount.IsNegative() {
-		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount is negative"}
+	itemCurrency, err := lineItemCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
 
-	err = s.client.SignalWorkflow(ctx, billId, "", activity.AddLineItemSignal, activity.AddLineItemSignalInput{
+	return s.addBillItem(ctx, activity.AddLineItemSignalInput{
 		BillId:      billId,
 		Reference:   req.Reference,
 		Description: req.Description,
 		Amount:      req.Amount,
-		Currency:    req.Currency,
+		Currency:    itemCurrency,
+		Type:        db.ItemTypeCharge,
+	})
+}
+
+// pricedLineItem computes the amount of an item from its catalog price.
+func pricedLineItem(ctx context.Context, billId string, req *AddLineItemRequest) (*activity.AddLineItemSignalInput, error) {
+	if !req.Amount.IsZero() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount cannot be set with a price"}
+	}
+	price, err := db.GetPrice(ctx, req.PriceId)
+	if err != nil {
+		return nil, err
+	}
+	if !price.Active {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Price is archived"}
+	}
+	if req.Currency != "" && !strings.EqualFold(req.Currency, price.Currency) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Price is in " + price.Currency}
+	}
+
+	amount, err := price.Pricing().Amount(req.Quantity)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	unitPrice := decimal.Zero
+	if !req.Quantity.IsZero() {
+		unitPrice = amount.DivRound(req.Quantity, 18)
+	}
+
+	description := req.Description
+	if description == "" {
+		product, err := db.GetProduct(ctx, price.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		description = product.Name
+	}
+
+	return &activity.AddLineItemSignalInput{
+		BillId:      billId,
+		Reference:   req.Reference,
+		Description: description,
+		Amount:      amount,
+		Currency:    price.Currency,
+		Type:        db.ItemTypeCharge,
+		PriceId:     price.Id,
+		Quantity:    req.Quantity,
+		UnitPrice:   unitPrice,
+	}, nil
+}
+
+type ReverseLineItemRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ReverseLineItem cancels a line item by adding a linked negative adjustment.
+// An item can only be reversed once.
+//
+//encore:api public method=POST path=/bills/:billId/items/:itemId/reverse
+func (s *Service) ReverseLineItem(ctx context.Context, billId string, itemId int64, req *ReverseLineItemRequest) (*AddLineItemResponse, error) {
+	if req.Reason == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Reason is required"}
+	}
+
+	// amount and currency are taken from the original item by the workflow
+	return s.addBillItem(ctx, activity.AddLineItemSignalInput{
+		BillId:         billId,
+		Reference:      fmt.Sprintf("reversal:%d", itemId),
+		Description:    req.Reason,
+		Type:           db.ItemTypeReversal,
+		ReversesItemId: itemId,
 	})
+}
+
+type AddCreditRequest struct {
+	Reference   string `json:"reference"`
+	Description string `json:"description"`
+	// Amount is the positive amount credited to the bill
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+//encore:api public method=POST path=/bills/:billId/credits
+func (s *Service) AddCredit(ctx context.Context, billId string, req *AddCreditRequest) (*AddLineItemResponse, error) {
+	if err := lineItemReference(req.Reference); err != nil {
+		return nil, err
+	}
+	if !req.Amount.IsPositive() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount must be positive"}
+	}
+	itemCurrency, err := lineItemCurrency(req.Currency)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Response{Message: "Line item added to workflow"}, nil
+	return s.addBillItem(ctx, activity.AddLineItemSignalInput{
+		BillId:      billId,
+		Reference:   req.Reference,
+		Description: req.Description,
+		Amount:      req.Amount.Neg(),
+		Currency:    itemCurrency,
+		Type:        db.ItemTypeCredit,
+	})
+}
+
+// reservedReferencePrefixes start the references of the items the service
+// adds itself: reversals, usage and applied account credit.
+var reservedReferencePrefixes = []string{"reversal:", "usage:", "account-credit"}
+
+// lineItemReference validates the reference of an item given by a client,
+// which must not collide with the references the service adds items with.
+func lineItemReference(reference string) error {
+	if reference == "" {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "Reference is required"}
+	}
+	for _, prefix := range reservedReferencePrefixes {
+		if strings.HasPrefix(reference, prefix) {
+			return &errs.Error{Code: errs.InvalidArgument, Message: "Reference cannot start with " + prefix}
+		}
+	}
+	return nil
+}
+
+// lineItemCurrency validates the currency of an item. An empty currency
+// defaults to the bill's currency in the workflow.
+func lineItemCurrency(code string) (string, error) {
+	if code == "" {
+		return "", nil
+	}
+	c, ok := currency.Lookup(code)
+	if !ok {
+		return "", &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + code}
+	}
+	return c.Code, nil
+}
+
+// addBillItem adds an item through the bill's workflow update, returning the
+// persisted item.
+func (s *Service) addBillItem(ctx context.Context, input activity.AddLineItemSignalInput) (*AddLineItemResponse, error) {
+	handle, err := s.client.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+		WorkflowID:   input.BillId,
+		UpdateName:   activity.AddLineItemUpdate,
+		WaitForStage: client.WorkflowUpdateStageCompleted,
+		Args:         []interface{}{input},
+	})
+	if err == nil {
+		var item db.DbBillItem
+		err = handle.Get(ctx, &item)
+		if err == nil {
+			return &AddLineItemResponse{Message: "Line item added", LineItem: &item}, nil
+		}
+	}
+
+	var notFound *serviceerror.NotFound
+	if !errors.As(err, &notFound) {
+		return nil, updateError(err)
+	}
+
+	// the workflow has completed, so the bill is closed or does not exist
+	item, lookupErr := db.GetBillItemByReference(ctx, input.BillId, input.Reference)
+	if lookupErr == nil {
+		return &AddLineItemResponse{Message: "Line item already added", LineItem: item}, nil
+	}
+	if _, lookupErr = db.GetBillByID(ctx, input.BillId); errors.Is(lookupErr, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is already closed"}
+}
+
+// updateError maps application errors raised by workflow update validators
+// and handlers to API errors.
+func updateError(err error) error {
+	var appErr *temporal.ApplicationError
+	if !errors.As(err, &appErr) {
+		return err
+	}
+	switch appErr.Type() {
+	case activity.BillNotOpenError, activity.LineItemReversedError, activity.IllegalTransitionError, activity.FailedPreconditionError, activity.ExchangeRateNotFoundError:
+		return &errs.Error{Code: errs.FailedPrecondition, Message: appErr.Message()}
+	case activity.InvalidLineItemError:
+		return &errs.Error{Code: errs.InvalidArgument, Message: appErr.Message()}
+	case activity.LineItemNotFoundError, activity.NotFoundError:
+		return &errs.Error{Code: errs.NotFound, Message: appErr.Message()}
+	default:
+		return err
+	}
 }
 
 // ==================================================================
@@ -97,11 +300,29 @@ type CloseBillRequest struct {
 }
 
 type BillDetailsResponse struct {
-	Bill        *db.DbBill      `json:"bill"`
-	LineItems   []db.DbBillItem `json:"line_items"`
-	TotalAmount decimal.Decimal `json:"total_amount"`
+	Bill      *db.DbBill      `json:"bill"`
+	LineItems []db.DbBillItem `json:"line_items"`
+	Subtotal  decimal.Decimal `json:"subtotal"`
+	TaxAmount decimal.Decimal `json:"tax_amount"`
+	// Taxes break the tax amount down by jurisdiction
+	Taxes          []db.JurisdictionTax `json:"taxes"`
+	DiscountAmount decimal.Decimal      `json:"discount_amount"`
+	// Discounts are the coupon discounts applied when the bill closed
+	Discounts []db.DbBillDiscount `json:"discounts"`
+	// CreditAmount is the account credit applied when the bill closed
+	CreditAmount decimal.Decimal `json:"credit_amount"`
+	TotalAmount  decimal.Decimal `json:"total_amount"`
+	AmountPaid   decimal.Decimal `json:"amount_paid"`
+	AmountDue    decimal.Decimal `json:"amount_due"`
 }
 
+// closeWaitTimeout bounds how long CloseBill waits for the bill to close.
+const closeWaitTimeout = 30 * time.Second
+
+// CloseBill closes a bill and returns it once closed. A bill that takes
+// longer to close, e.g. one whose close is retried after a failure, is
+// returned while still closing.
+//
 //encore:api public method=POST path=/bills/:billId/close
 func (s *Service) CloseBill(ctx context.Context, billId string, req *CloseBillRequest) (*BillDetailsResponse, error) {
 	// check closed
@@ -109,8 +330,9 @@ func (s *Service) CloseBill(ctx context.Context, billId string, req *CloseBillRe
 	if err != nil {
 		return nil, err
 	}
-	if bill.Status == db.StatusClosed {
-		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is already closed"}
+	// a bill left closing by a failed close can be closed again
+	if bill.Status != db.StatusOpen && bill.Status != db.StatusClosing {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
 	}
 
 	// trigger close
@@ -121,58 +343,356 @@ func (s *Service) CloseBill(ctx context.Context, billId string, req *CloseBillRe
 		return nil, err
 	}
 
-	// wait for workflow to complete
-	we := s.client.GetWorkflow(ctx, req.BillId, "")
-	var result any
+	// wait for workflow to complete, returning the bill still closing when
+	// the close takes longer, e.g. after a failed attempt
+	waitCtx, cancel := context.WithTimeout(ctx, closeWaitTimeout)
+	defer cancel()
+	err = s.client.GetWorkflow(waitCtx, billId, "").Get(waitCtx, nil)
+	if err != nil && (waitCtx.Err() == nil || ctx.Err() != nil) {
+		return nil, err
+	}
+
+	return getBillDetails(ctx, billId)
+}
 
-	err = we.Get(ctx, &result) // Blocking until the workflow is finished
+// ==================================================================
+
+type FinalizeBillRequest struct{}
+
+// FinalizeBill issues the invoice for a closed bill, starting its payment
+// terms. The invoice is numbered and rendered as HTML and PDF.
+//
+//encore:api public method=POST path=/bills/:billId/finalize
+func (s *Service) FinalizeBill(ctx context.Context, billId string, req *FinalizeBillRequest) (*BillDetailsResponse, error) {
+	dueAt := time.Now().AddDate(0, 0, cfg.PaymentTermsDays())
+	err := db.FinalizeBill(ctx, billId, dueAt, db.InvoiceNumbering(cfg.InvoiceNumbering()), cfg.Seller.Name())
 	if err != nil {
 		return nil, err
 	}
+	issueInvoiceDocuments(ctx, billId)
 
-	return getBillDetails(ctx, req.BillId)
+	return getBillDetails(ctx, billId)
+}
+
+// ==================================================================
+
+type VoidBillRequest struct {
+	Reason string `json:"reason"`
+}
+
+// VoidBill cancels a bill created by mistake, on behalf of the authenticated
+// operator. The bill's workflow is resumed if it has already completed.
+//
+//encore:api auth method=POST path=/bills/:billId/void
+func (s *Service) VoidBill(ctx context.Context, billId string, req *VoidBillRequest) (*BillDetailsResponse, error) {
+	if req.Reason == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Reason is required"}
+	}
+	actor, err := currentActor()
+	if err != nil {
+		return nil, err
+	}
+
+	bill, err := db.GetBillByID(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if !bill.Status.CanTransitionTo(db.StatusVoided) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	we, err := s.signalBill(ctx, bill, activity.VoidBillSignal, activity.VoidBillInput{
+		BillId: billId,
+		Actor:  actor,
+		Reason: req.Reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// voiding completes the workflow
+	err = we.Get(ctx, nil)
+	if err != nil {
+		return nil, updateError(err)
+	}
+
+	details, err := getBillDetails(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	// the workflow may have completed for another reason, e.g. a concurrent
+	// close
+	if details.Bill.Status != db.StatusVoided {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(details.Bill.Status)}
+	}
+	return details, nil
+}
+
+type ReopenBillRequest struct {
+	Reason string `json:"reason"`
+	// PeriodEnd extends the billing period, required when it has already ended
+	PeriodEnd *time.Time `json:"period_end,omitempty"`
+}
+
+// ReopenBill reopens a bill closed early, on behalf of the authenticated
+// operator. Bills can only be reopened before they are finalized.
+//
+//encore:api auth method=POST path=/bills/:billId/reopen
+func (s *Service) ReopenBill(ctx context.Context, billId string, req *ReopenBillRequest) (*Response, error) {
+	if req.Reason == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Reason is required"}
+	}
+	actor, err := currentActor()
+	if err != nil {
+		return nil, err
+	}
+
+	bill, err := db.GetBillByID(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if bill.Status != db.StatusClosed {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	periodEnd := bill.PeriodEnd
+	if req.PeriodEnd != nil {
+		periodEnd = *req.PeriodEnd
+	}
+	if !periodEnd.After(time.Now()) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Period end must be in the future to reopen the bill"}
+	}
+
+	we, err := s.signalBill(ctx, bill, activity.ReopenBillSignal, activity.ReopenBillInput{
+		BillId:    billId,
+		Actor:     actor,
+		Reason:    req.Reason,
+		PeriodEnd: periodEnd,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{Message: "Reopen requested for workflow with ID: " + we.GetID()}, nil
+}
+
+// signalBill delivers a signal to the bill's workflow, resuming it from the
+// database if the workflow has already completed.
+func (s *Service) signalBill(ctx context.Context, bill *db.DbBill, signalName string, signalArg interface{}) (client.WorkflowRun, error) {
+	options := client.StartWorkflowOptions{
+		ID:        bill.Id,
+		TaskQueue: BillingTaskQueue,
+	}
+	return s.client.SignalWithStartWorkflow(ctx, bill.Id, signalName, signalArg, options, billing.CreateBillWorkflow, billing.CreateBillWorkflowInput{
+		BillId:      bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		PeriodStart: bill.PeriodStart,
+		PeriodEnd:   bill.PeriodEnd,
+		Resume:      true,
+	})
+}
+
+type BillHistoryResponse struct {
+	History []db.DbBillHistory `json:"history"`
+}
+
+//encore:api public method=GET path=/bills/:billId/history
+func (s *Service) GetBillHistory(ctx context.Context, billId string) (*BillHistoryResponse, error) {
+	history, err := db.GetBillHistory(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	return &BillHistoryResponse{History: history}, nil
 }
 
 // ==================================================================
 
 type ListBillsResponse struct {
 	Bills []db.DbBill `json:"bills"`
+	// NextCursor continues with the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type ListBillsRequest struct {
-	Status    string `query:"status"`
-	AccountId string `query:"account_id"`
+	Status    []string `query:"status"`
+	AccountId string   `query:"account_id"`
+	Currency  string   `query:"currency"`
+	// PeriodFrom and PeriodTo select bills whose period overlaps the range
+	PeriodFrom  time.Time `query:"period_from"`
+	PeriodTo    time.Time `query:"period_to"`
+	CreatedFrom time.Time `query:"created_from"`
+	CreatedTo   time.Time `query:"created_to"`
+	// MinTotal and MaxTotal only match closed bills
+	MinTotal string `query:"min_total"`
+	MaxTotal string `query:"max_total"`
+	// Sort is created_at, period_start or period_end, prefixed with - for
+	// descending order. Defaults to -created_at.
+	Sort   string `query:"sort"`
+	Limit  int    `query:"limit"`
+	Cursor string `query:"cursor"`
 }
 
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
 //encore:api public method=GET path=/bills
 func (s *Service) ListBills(ctx context.Context, req *ListBillsRequest) (*ListBillsResponse, error) {
-	bills, err := db.GetBillsByAccountAndStatus(ctx, req.AccountId, db.Status(req.Status))
-	if err != nil {
-		return nil, &errs.Error{
-			Code:    errs.Internal,
-			Message: "Failed to retrieve bills.",
+	filter := db.BillFilter{
+		AccountId:   req.AccountId,
+		Currency:    strings.ToUpper(req.Currency),
+		PeriodFrom:  req.PeriodFrom,
+		PeriodTo:    req.PeriodTo,
+		CreatedFrom: req.CreatedFrom,
+		CreatedTo:   req.CreatedTo,
+		SortBy:      db.SortByCreatedAt,
+		Descending:  true,
+		Limit:       req.Limit,
+	}
+
+	for _, status := range req.Status {
+		if !db.Status(status).IsValid() {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown status " + status}
 		}
+		filter.Statuses = append(filter.Statuses, db.Status(status))
 	}
 
-	return &ListBillsResponse{Bills: bills}, nil
+	var err error
+	if filter.MinTotal, err = parseAmount("min_total", req.MinTotal); err != nil {
+		return nil, err
+	}
+	if filter.MaxTotal, err = parseAmount("max_total", req.MaxTotal); err != nil {
+		return nil, err
+	}
+
+	if req.Sort != "" {
+		filter.Descending = strings.HasPrefix(req.Sort, "-")
+		filter.SortBy = db.BillSortField(strings.TrimPrefix(req.Sort, "-"))
+		if !filter.SortBy.IsValid() {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown sort " + req.Sort}
+		}
+	}
+
+	switch {
+	case filter.Limit == 0:
+		filter.Limit = defaultListLimit
+	case filter.Limit < 0 || filter.Limit > maxListLimit:
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Limit must be between 1 and %d", maxListLimit)}
+	}
+
+	if req.Cursor != "" {
+		if filter.After, err = db.DecodeBillCursor(req.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	bills, next, err := db.ListBills(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ListBillsResponse{Bills: bills}
+	if next != nil {
+		resp.NextCursor = next.Encode()
+	}
+	return resp, nil
+}
+
+func parseAmount(name, value string) (*decimal.Decimal, error) {
+	if value == "" {
+		return nil, nil
+	}
+	amount, err := decimal.NewFromString(value)
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Invalid " + name}
+	}
+	return &amount, nil
 }
 
 // ==================================================================
 
+type GetBillRequest struct {
+	// Consistent reads the bill from its workflow instead of the database,
+	// so items added during the open period are visible immediately.
+	Consistent bool `query:"consistent"`
+}
+
 //encore:api public method=GET path=/bill/:billId
-func (s *Service) GetBill(ctx context.Context, billId string) (*BillDetailsResponse, error) {
-	return getBillDetails(ctx, billId)
+func (s *Service) GetBill(ctx context.Context, billId string, req *GetBillRequest) (*BillDetailsResponse, error) {
+	if !req.Consistent {
+		return getBillDetails(ctx, billId)
+	}
+
+	value, err := s.client.QueryWorkflow(ctx, billId, "", activity.GetBillStateQuery)
+	if err != nil {
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			// workflow no longer available, the database is authoritative
+			return getBillDetails(ctx, billId)
+		}
+		return nil, err
+	}
+
+	var state billing.BillState
+	if err := value.Get(&state); err != nil {
+		return nil, err
+	}
+
+	// tax lines are written by the activity adding each item
+	taxLines, err := db.GetBillTaxLines(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	totals := db.NewBillTotals(state.Currency, state.Items, taxLines, nil)
+
+	return &BillDetailsResponse{
+		Bill: &db.DbBill{
+			Id:          state.BillId,
+			Status:      state.Status,
+			Currency:    state.Currency,
+			AccountId:   state.AccountId,
+			PeriodStart: state.PeriodStart,
+			PeriodEnd:   state.PeriodEnd,
+			CreatedAt:   state.CreatedAt,
+		},
+		LineItems:   state.Items,
+		Subtotal:    totals.Subtotal,
+		TaxAmount:   totals.TaxAmount,
+		Taxes:       totals.Taxes,
+		TotalAmount: totals.TotalAmount,
+	}, nil
 }
 
 func getBillDetails(ctx context.Context, billId string) (*BillDetailsResponse, error) {
-	bill, lineItems, totalAmount, err := db.GetBillDetailsWithTotal(ctx, billId)
+	bill, lineItems, totals, err := db.GetBillDetailsWithTotal(ctx, billId)
 	if err != nil {
 		return nil, err
 	}
 
 	return &BillDetailsResponse{
-		Bill:        bill,
-		LineItems:   lineItems,
-		TotalAmount: totalAmount,
+		Bill:           bill,
+		LineItems:      lineItems,
+		Subtotal:       totals.Subtotal,
+		TaxAmount:      totals.TaxAmount,
+		Taxes:          totals.Taxes,
+		DiscountAmount: totals.DiscountAmount,
+		Discounts:      totals.Discounts,
+		CreditAmount:   totals.CreditAmount,
+		TotalAmount:    settle(bill.Currency, totals.TotalAmount),
+		AmountPaid:     bill.AmountPaid,
+		AmountDue:      settle(bill.Currency, totals.TotalAmount).Sub(bill.AmountPaid),
 	}, nil
 }
+
+// settle rounds a bill total to the precision of the bill's currency. Totals
+// of bills in unregistered currencies, created before the registry existed,
+// are returned as is.
+func settle(code string, total decimal.Decimal) decimal.Decimal {
+	c, ok := currency.Lookup(code)
+	if !ok {
+		return total
+	}
+	return c.Round(total)
+}
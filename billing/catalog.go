@@ -0,0 +1,82 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.app/billing/pricing"
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type CreateProductRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+//encore:api public method=POST path=/products
+func (s *Service) CreateProduct(ctx context.Context, req *CreateProductRequest) (*db.DbProduct, error) {
+	if req.Name == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Name is required"}
+	}
+	return db.InsertProduct(ctx, uuid.New().String(), req.Name, req.Description)
+}
+
+type CreatePriceRequest struct {
+	Currency string `json:"currency"`
+	// Model is flat, per_unit, graduated, volume or package
+	Model      string          `json:"model"`
+	UnitAmount decimal.Decimal `json:"unit_amount"`
+	// PackageSize is the number of units in a package
+	PackageSize decimal.Decimal `json:"package_size"`
+	// Tiers price graduated and volume prices, the last tier without up_to
+	Tiers []pricing.Tier `json:"tiers"`
+}
+
+//encore:api public method=POST path=/products/:productId/prices
+func (s *Service) CreatePrice(ctx context.Context, productId string, req *CreatePriceRequest) (*db.DbPrice, error) {
+	c, ok := currency.Lookup(req.Currency)
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+	}
+	price := pricing.Price{
+		Model:       pricing.Model(req.Model),
+		UnitAmount:  req.UnitAmount,
+		PackageSize: req.PackageSize,
+		Tiers:       req.Tiers,
+	}
+	if err := price.Validate(); err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	return db.InsertPrice(ctx, uuid.New().String(), productId, c.Code, price)
+}
+
+type ListPricesResponse struct {
+	Prices []db.DbPrice `json:"prices"`
+}
+
+//encore:api public method=GET path=/products/:productId/prices
+func (s *Service) ListPrices(ctx context.Context, productId string) (*ListPricesResponse, error) {
+	if _, err := db.GetProduct(ctx, productId); err != nil {
+		return nil, err
+	}
+	prices, err := db.GetProductPrices(ctx, productId)
+	if err != nil {
+		return nil, err
+	}
+	return &ListPricesResponse{Prices: prices}, nil
+}
+
+//encore:api public method=GET path=/prices/:priceId
+func (s *Service) GetPrice(ctx context.Context, priceId string) (*db.DbPrice, error) {
+	return db.GetPrice(ctx, priceId)
+}
+
+// ArchivePrice stops a price from being used for new line items.
+//
+//encore:api public method=POST path=/prices/:priceId/archive
+func (s *Service) ArchivePrice(ctx context.Context, priceId string) (*db.DbPrice, error) {
+	return db.ArchivePrice(ctx, priceId)
+}
@@ -1 +1,13 @@
-TemporalHost:"127.0.0.1:7233"
\ No newline at end of file
+TemporalHost:"127.0.0.1:7233"
+PaymentTermsDays:30
+InvoiceNumbering:"global"
+Seller: {
+	Name:""
+	VatId:""
+	EndpointId:""
+	EndpointScheme:""
+	Street:""
+	City:""
+	PostalCode:""
+	Country:""
+}
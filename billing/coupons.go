@@ -0,0 +1,94 @@
+package billing
+
+import (
+	"context"
+	"strings"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.app/billing/discount"
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+type CreateCouponRequest struct {
+	// Code is the promo code customers enter, stored in upper case
+	Code string `json:"code"`
+	Name string `json:"name"`
+	// Type is percent or fixed
+	Type       string          `json:"type"`
+	PercentOff decimal.Decimal `json:"percent_off"`
+	AmountOff  decimal.Decimal `json:"amount_off"`
+	// Currency restricts the coupon to bills in the currency, required for
+	// fixed coupons
+	Currency string `json:"currency"`
+	// Duration is once, repeating or forever
+	Duration        string `json:"duration"`
+	DurationInBills int    `json:"duration_in_bills"`
+	// MaxRedemptions limits the accounts that can redeem the coupon, 0 for
+	// no limit
+	MaxRedemptions int `json:"max_redemptions"`
+}
+
+//encore:api public method=POST path=/coupons
+func (s *Service) CreateCoupon(ctx context.Context, req *CreateCouponRequest) (*db.DbCoupon, error) {
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Code is required"}
+	}
+	terms := discount.Coupon{
+		Type:            discount.Type(req.Type),
+		PercentOff:      req.PercentOff,
+		AmountOff:       req.AmountOff,
+		Duration:        discount.Duration(req.Duration),
+		DurationInBills: req.DurationInBills,
+	}
+	if req.Currency != "" {
+		c, ok := currency.Lookup(req.Currency)
+		if !ok {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+		}
+		terms.Currency = c.Code
+	}
+	if err := terms.Validate(); err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: err.Error()}
+	}
+	if req.MaxRedemptions < 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Max redemptions cannot be negative"}
+	}
+	var maxRedemptions *int
+	if req.MaxRedemptions > 0 {
+		maxRedemptions = &req.MaxRedemptions
+	}
+
+	return db.InsertCoupon(ctx, code, req.Name, terms, maxRedemptions)
+}
+
+//encore:api public method=GET path=/coupons/:code
+func (s *Service) GetCoupon(ctx context.Context, code string) (*db.DbCoupon, error) {
+	return db.GetCoupon(ctx, strings.ToUpper(code))
+}
+
+// DeactivateCoupon ends a promotion. Accounts that already redeemed the
+// coupon keep their discount for its duration.
+//
+//encore:api public method=POST path=/coupons/:code/deactivate
+func (s *Service) DeactivateCoupon(ctx context.Context, code string) (*db.DbCoupon, error) {
+	return db.DeactivateCoupon(ctx, strings.ToUpper(code))
+}
+
+type ApplyCouponRequest struct {
+	Code string `json:"code"`
+}
+
+// ApplyCoupon redeems a coupon on an open bill. The discount is computed
+// when the bill closes.
+//
+//encore:api public method=POST path=/bills/:billId/coupons
+func (s *Service) ApplyCoupon(ctx context.Context, billId string, req *ApplyCouponRequest) (*db.DbCouponRedemption, error) {
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	if code == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Code is required"}
+	}
+	return db.RedeemCoupon(ctx, billId, code)
+}
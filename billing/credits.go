@@ -0,0 +1,108 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"github.com/shopspring/decimal"
+)
+
+type GrantCreditRequest struct {
+	Amount      decimal.Decimal `json:"amount"`
+	Currency    string          `json:"currency"`
+	Description string          `json:"description"`
+	// ExpiresAt is when unused credit expires, never if omitted
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// GrantCredit adds prepaid or promotional credit to an account. Credit is
+// applied to the account's bills in the same currency when they close.
+//
+//encore:api public method=POST path=/accounts/:accountId/credit/grants
+func (s *Service) GrantCredit(ctx context.Context, accountId string, req *GrantCreditRequest) (*db.DbCreditEntry, error) {
+	if !req.Amount.IsPositive() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount must be positive"}
+	}
+	c, ok := currency.Lookup(req.Currency)
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Expiry must be in the future"}
+	}
+	return db.GrantCredit(ctx, accountId, c.Code, req.Amount, req.Description, req.ExpiresAt)
+}
+
+type GetCreditBalanceRequest struct {
+	Currency string `query:"currency"`
+}
+
+type CreditBalanceResponse struct {
+	AccountId string          `json:"account_id"`
+	Currency  string          `json:"currency"`
+	Balance   decimal.Decimal `json:"balance"`
+}
+
+//encore:api public method=GET path=/accounts/:accountId/credit
+func (s *Service) GetCreditBalance(ctx context.Context, accountId string, req *GetCreditBalanceRequest) (*CreditBalanceResponse, error) {
+	if req.Currency == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Currency is required"}
+	}
+	code := strings.ToUpper(req.Currency)
+	balance, err := db.GetCreditBalance(ctx, accountId, code)
+	if err != nil {
+		return nil, err
+	}
+	return &CreditBalanceResponse{AccountId: accountId, Currency: code, Balance: balance}, nil
+}
+
+type ListCreditEntriesRequest struct {
+	Limit int `query:"limit"`
+}
+
+type ListCreditEntriesResponse struct {
+	Entries []db.DbCreditEntry `json:"entries"`
+}
+
+// ListCreditEntries returns the account's credit ledger, newest first.
+//
+//encore:api public method=GET path=/accounts/:accountId/credit/entries
+func (s *Service) ListCreditEntries(ctx context.Context, accountId string, req *ListCreditEntriesRequest) (*ListCreditEntriesResponse, error) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit < 0 || limit > maxListLimit {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Limit must be between 1 and %d", maxListLimit)}
+	}
+	entries, err := db.GetCreditEntries(ctx, accountId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &ListCreditEntriesResponse{Entries: entries}, nil
+}
+
+var _ = cron.NewJob("expire-credits", cron.JobConfig{
+	Title:    "Expire unused account credit past its expiry",
+	Every:    1 * cron.Hour,
+	Endpoint: ExpireCredits,
+})
+
+//encore:api private
+func ExpireCredits(ctx context.Context) error {
+	expired, err := db.ExpireCredits(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		rlog.Info("expired account credit", "grants", expired)
+	}
+	return nil
+}
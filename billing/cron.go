@@ -0,0 +1,32 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+)
+
+var _ = cron.NewJob("mark-overdue-bills", cron.JobConfig{
+	Title:    "Mark unpaid bills past their due date as overdue",
+	Every:    1 * cron.Hour,
+	Endpoint: MarkOverdueBills,
+})
+
+//encore:api private
+func MarkOverdueBills(ctx context.Context) error {
+	billIds, err := db.GetOverdueBillIds(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, billId := range billIds {
+		err := db.UpdateBillStatus(ctx, billId, db.StatusOverdue)
+		if err != nil {
+			rlog.Error("failed to mark bill overdue", "bill_id", billId, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Package currency is the registry of currencies bills and line items may be
+// denominated in, with the precision and rounding used to settle amounts.
+package currency
+
+import (
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+type RoundingMode string
+
+const (
+	// RoundHalfUp rounds halves away from zero.
+	RoundHalfUp RoundingMode = "half_up"
+	// RoundHalfEven rounds halves to the nearest even digit (banker's rounding).
+	RoundHalfEven RoundingMode = "half_even"
+)
+
+type Currency struct {
+	// Code is the ISO 4217 code, or the ticker for crypto currencies
+	Code string `json:"code"`
+	// MinorUnits is the number of decimal places amounts are settled in
+	MinorUnits int32        `json:"minor_units"`
+	Rounding   RoundingMode `json:"rounding"`
+	Crypto     bool         `json:"crypto"`
+}
+
+var registry = map[string]Currency{}
+
+func init() {
+	for _, c := range []Currency{
+		{Code: "USD", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "EUR", MinorUnits: 2, Rounding: RoundHalfEven},
+		{Code: "GBP", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "CHF", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "CAD", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "AUD", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "SGD", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "HKD", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "CNY", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "INR", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "SEK", MinorUnits: 2, Rounding: RoundHalfEven},
+		{Code: "NOK", MinorUnits: 2, Rounding: RoundHalfEven},
+		{Code: "DKK", MinorUnits: 2, Rounding: RoundHalfEven},
+		{Code: "JPY", MinorUnits: 0, Rounding: RoundHalfUp},
+		{Code: "KRW", MinorUnits: 0, Rounding: RoundHalfUp},
+		{Code: "IDR", MinorUnits: 2, Rounding: RoundHalfUp},
+		{Code: "BHD", MinorUnits: 3, Rounding: RoundHalfUp},
+		{Code: "KWD", MinorUnits: 3, Rounding: RoundHalfUp},
+		{Code: "BTC", MinorUnits: 8, Rounding: RoundHalfEven, Crypto: true},
+		{Code: "ETH", MinorUnits: 18, Rounding: RoundHalfEven, Crypto: true},
+	} {
+		registry[c.Code] = c
+	}
+}
+
+// Lookup returns the registered currency for code, ignoring case.
+func Lookup(code string) (Currency, bool) {
+	c, ok := registry[strings.ToUpper(code)]
+	return c, ok
+}
+
+// IsValid reports whether code is a registered currency.
+func IsValid(code string) bool {
+	_, ok := Lookup(code)
+	return ok
+}
+
+// Round rounds amount to the currency's minor units using its rounding mode.
+func (c Currency) Round(amount decimal.Decimal) decimal.Decimal {
+	if c.Rounding == RoundHalfEven {
+		return amount.RoundBank(c.MinorUnits)
+	}
+	return amount.Round(c.MinorUnits)
+}
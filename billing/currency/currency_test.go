@@ -0,0 +1,46 @@
+package currency_test
+
+import (
+	"testing"
+
+	"encore.app/billing/currency"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	c, ok := currency.Lookup("usd")
+	require.True(t, ok, "USD should be registered")
+	require.Equal(t, "USD", c.Code)
+	require.Equal(t, int32(2), c.MinorUnits)
+
+	eth, ok := currency.Lookup("ETH")
+	require.True(t, ok, "ETH should be registered")
+	require.True(t, eth.Crypto)
+	require.Equal(t, int32(18), eth.MinorUnits)
+
+	require.False(t, currency.IsValid("XXX"))
+	require.False(t, currency.IsValid(""))
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		code   string
+		amount string
+		want   string
+	}{
+		{"USD", "10.125", "10.13"},
+		{"USD", "-10.125", "-10.13"},
+		{"EUR", "10.125", "10.12"},
+		{"EUR", "10.135", "10.14"},
+		{"JPY", "100.5", "101"},
+		{"KWD", "1.23456", "1.235"},
+		{"ETH", "0.1234567890123456785", "0.123456789012345678"},
+	}
+	for _, tt := range tests {
+		c, ok := currency.Lookup(tt.code)
+		require.True(t, ok, tt.code)
+		got := c.Round(decimal.RequireFromString(tt.amount))
+		require.True(t, decimal.RequireFromString(tt.want).Equal(got), "%s %s: got %s, want %s", tt.code, tt.amount, got, tt.want)
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/billing/pricing"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type DbProduct struct {
+	Id          string    `db:"id,pk"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type DbPrice struct {
+	Id          string          `db:"id,pk"`
+	ProductId   string          `db:"product_id"` // index
+	Currency    string          `db:"currency"`
+	Model       pricing.Model   `db:"model"`
+	UnitAmount  decimal.Decimal `db:"unit_amount"`
+	PackageSize decimal.Decimal `db:"package_size"`
+	Tiers       PriceTiers      `db:"tiers"`
+	// Active prices can be added to bills
+	Active    bool      `db:"active"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Pricing returns the model computing amounts for the price.
+func (p DbPrice) Pricing() pricing.Price {
+	return pricing.Price{
+		Model:       p.Model,
+		UnitAmount:  p.UnitAmount,
+		PackageSize: p.PackageSize,
+		Tiers:       p.Tiers,
+	}
+}
+
+// PriceTiers are stored as a JSONB array.
+type PriceTiers []pricing.Tier
+
+func (t PriceTiers) Value() (driver.Value, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(t)
+}
+
+func (t *PriceTiers) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, t)
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	default:
+		return fmt.Errorf("cannot scan %T into PriceTiers", src)
+	}
+}
+
+const productColumns = `id, name, description, created_at`
+
+func scanProduct(row rowScanner) (*DbProduct, error) {
+	var p DbProduct
+	err := row.Scan(&p.Id, &p.Name, &p.Description, &p.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Product not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+const priceColumns = `id, product_id, currency, model, unit_amount, package_size, tiers, active, created_at`
+
+func scanPrice(row rowScanner) (*DbPrice, error) {
+	var p DbPrice
+	err := row.Scan(&p.Id, &p.ProductId, &p.Currency, &p.Model, &p.UnitAmount, &p.PackageSize, &p.Tiers, &p.Active, &p.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Price not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func InsertProduct(ctx context.Context, id, name, description string) (*DbProduct, error) {
+	query := `
+		INSERT INTO product (id, name, description, created_at)
+		VALUES ($1, $2, $3, now())
+		RETURNING ` + productColumns
+	return scanProduct(db.QueryRow(ctx, query, id, name, description))
+}
+
+func GetProduct(ctx context.Context, id string) (*DbProduct, error) {
+	return scanProduct(db.QueryRow(ctx, `SELECT `+productColumns+` FROM product WHERE id = $1`, id))
+}
+
+// InsertPrice adds a price to a product. The price is validated by the
+// caller.
+func InsertPrice(ctx context.Context, id, productId, currency string, price pricing.Price) (*DbPrice, error) {
+	query := `
+		INSERT INTO price (id, product_id, currency, model, unit_amount, package_size, tiers, active, created_at)
+		SELECT $1, id, $3, $4, $5, $6, $7, TRUE, now()
+		FROM product
+		WHERE id = $2
+		RETURNING ` + priceColumns
+	p, err := scanPrice(db.QueryRow(ctx, query, id, productId, currency, price.Model, price.UnitAmount, price.PackageSize, PriceTiers(price.Tiers)))
+	if errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Product not found"}
+	}
+	return p, err
+}
+
+func GetPrice(ctx context.Context, id string) (*DbPrice, error) {
+	return scanPrice(db.QueryRow(ctx, `SELECT `+priceColumns+` FROM price WHERE id = $1`, id))
+}
+
+func GetProductPrices(ctx context.Context, productId string) ([]DbPrice, error) {
+	rows, err := db.Query(ctx, `SELECT `+priceColumns+` FROM price WHERE product_id = $1 ORDER BY created_at, id`, productId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []DbPrice
+	for rows.Next() {
+		p, err := scanPrice(rows)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, *p)
+	}
+	return prices, rows.Err()
+}
+
+// ArchivePrice stops a price from being added to bills. Items already
+// priced with it keep their amounts.
+func ArchivePrice(ctx context.Context, id string) (*DbPrice, error) {
+	query := `UPDATE price SET active = FALSE WHERE id = $1 RETURNING ` + priceColumns
+	return scanPrice(db.QueryRow(ctx, query, id))
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/discount"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type DbCoupon struct {
+	Code            string            `db:"code,pk"`
+	Name            string            `db:"name"`
+	Type            discount.Type     `db:"type"`
+	PercentOff      decimal.Decimal   `db:"percent_off"`
+	AmountOff       decimal.Decimal   `db:"amount_off"`
+	Currency        string            `db:"currency"`
+	Duration        discount.Duration `db:"duration"`
+	DurationInBills int               `db:"duration_in_bills"`
+	// MaxRedemptions is nil for coupons redeemable by any number of accounts
+	MaxRedemptions *int      `db:"max_redemptions"`
+	TimesRedeemed  int       `db:"times_redeemed"`
+	Active         bool      `db:"active"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+// Discount returns the terms computing the coupon's discounts.
+func (c DbCoupon) Discount() discount.Coupon {
+	return discount.Coupon{
+		Type:            c.Type,
+		PercentOff:      c.PercentOff,
+		AmountOff:       c.AmountOff,
+		Currency:        c.Currency,
+		Duration:        c.Duration,
+		DurationInBills: c.DurationInBills,
+	}
+}
+
+// DbCouponRedemption is a coupon applied to an account, starting with a bill.
+type DbCouponRedemption struct {
+	Id         int64     `db:"id,pk,auto"`
+	CouponCode string    `db:"coupon_code"`
+	AccountId  string    `db:"account_id"` // index
+	BillId     string    `db:"bill_id"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// DbBillDiscount is the discount a redemption granted on a bill when it
+// closed.
+type DbBillDiscount struct {
+	Id           int64           `db:"id,pk,auto"`
+	BillId       string          `db:"bill_id"`
+	RedemptionId int64           `db:"redemption_id"`
+	CouponCode   string          `db:"coupon_code"`
+	Description  string          `db:"description"`
+	Amount       decimal.Decimal `db:"amount"`
+	CreatedAt    time.Time       `db:"created_at"`
+}
+
+const couponColumns = `code, name, type, percent_off, amount_off, currency, duration, duration_in_bills, max_redemptions, times_redeemed, active, created_at`
+
+func scanCoupon(row rowScanner) (*DbCoupon, error) {
+	var c DbCoupon
+	err := row.Scan(&c.Code, &c.Name, &c.Type, &c.PercentOff, &c.AmountOff, &c.Currency, &c.Duration, &c.DurationInBills, &c.MaxRedemptions, &c.TimesRedeemed, &c.Active, &c.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Coupon not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// InsertCoupon defines a coupon. Its terms are validated by the caller.
+func InsertCoupon(ctx context.Context, code, name string, terms discount.Coupon, maxRedemptions *int) (*DbCoupon, error) {
+	query := `
+		INSERT INTO coupon (code, name, type, percent_off, amount_off, currency, duration, duration_in_bills, max_redemptions, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+		RETURNING ` + couponColumns
+	c, err := scanCoupon(db.QueryRow(ctx, query, code, name, terms.Type, terms.PercentOff, terms.AmountOff, terms.Currency, terms.Duration, terms.Bills(), maxRedemptions))
+	if isUniqueViolation(err, "coupon_pkey") {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "Coupon " + code + " already exists"}
+	}
+	return c, err
+}
+
+func GetCoupon(ctx context.Context, code string) (*DbCoupon, error) {
+	return scanCoupon(db.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupon WHERE code = $1`, code))
+}
+
+// DeactivateCoupon stops a coupon from being redeemed. Existing redemptions
+// keep discounting their bills.
+func DeactivateCoupon(ctx context.Context, code string) (*DbCoupon, error) {
+	query := `UPDATE coupon SET active = FALSE WHERE code = $1 RETURNING ` + couponColumns
+	return scanCoupon(db.QueryRow(ctx, query, code))
+}
+
+// RedeemCoupon applies a coupon to an open bill and the account's following
+// bills for the coupon's duration. An account can redeem a coupon once.
+func RedeemCoupon(ctx context.Context, billId, code string) (*DbCouponRedemption, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if bill.Status != StatusOpen {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	// locked so concurrent redemptions cannot exceed max_redemptions
+	coupon, err := scanCoupon(tx.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupon WHERE code = $1 FOR UPDATE`, code))
+	if err != nil {
+		return nil, err
+	}
+	if !coupon.Active {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Coupon is no longer active"}
+	}
+	if coupon.MaxRedemptions != nil && coupon.TimesRedeemed >= *coupon.MaxRedemptions {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Coupon has reached its maximum redemptions"}
+	}
+
+	if !coupon.Discount().AppliesTo(bill.Currency) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Coupon only applies to bills in " + coupon.Currency}
+	}
+
+	const query = `
+		INSERT INTO coupon_redemption (coupon_code, account_id, bill_id, created_at)
+		VALUES ($1, $2, $3, now())
+		RETURNING id, coupon_code, account_id, bill_id, created_at
+	`
+	var r DbCouponRedemption
+	err = tx.QueryRow(ctx, query, coupon.Code, bill.AccountId, billId).Scan(&r.Id, &r.CouponCode, &r.AccountId, &r.BillId, &r.CreatedAt)
+	if isUniqueViolation(err, "idx_coupon_redemption_coupon_code_account_id") {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "Coupon already redeemed by the account"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE coupon SET times_redeemed = times_redeemed + 1 WHERE code = $1`, coupon.Code)
+	if err != nil {
+		return nil, err
+	}
+	return &r, tx.Commit()
+}
+
+// ActiveRedemption is a redemption with the coupon it redeemed.
+type ActiveRedemption struct {
+	Redemption DbCouponRedemption
+	Coupon     DbCoupon
+}
+
+// GetActiveRedemptions returns the redemptions discounting a bill: those of
+// the bill's account first applied to it or an earlier bill, that have not
+// yet discounted as many other bills as their coupon allows. A once coupon
+// only discounts the bill it was applied to, and discounts of voided bills do
+// not count. Redemptions are returned in the order they were made.
+func GetActiveRedemptions(ctx context.Context, billId string) ([]ActiveRedemption, error) {
+	const query = `
+		SELECT r.id, r.coupon_code, r.account_id, r.bill_id, r.created_at,
+			c.code, c.name, c.type, c.percent_off, c.amount_off, c.currency, c.duration, c.duration_in_bills,
+			c.max_redemptions, c.times_redeemed, c.active, c.created_at
+		FROM bill b
+		JOIN coupon_redemption r ON r.account_id = b.account_id
+		JOIN bill f ON f.id = r.bill_id
+		JOIN coupon c ON c.code = r.coupon_code
+		WHERE b.id = $1
+			AND f.period_start <= b.period_start
+			AND (c.duration <> 'once' OR r.bill_id = b.id)
+			AND (c.duration_in_bills = 0 OR (
+				SELECT count(*)
+				FROM bill_discount d
+				JOIN bill o ON o.id = d.bill_id
+				WHERE d.redemption_id = r.id AND d.bill_id <> b.id AND o.status <> 'voided'
+			) < c.duration_in_bills)
+		ORDER BY r.id
+	`
+	rows, err := db.Query(ctx, query, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var active []ActiveRedemption
+	for rows.Next() {
+		var a ActiveRedemption
+		r, c := &a.Redemption, &a.Coupon
+		err := rows.Scan(&r.Id, &r.CouponCode, &r.AccountId, &r.BillId, &r.CreatedAt,
+			&c.Code, &c.Name, &c.Type, &c.PercentOff, &c.AmountOff, &c.Currency, &c.Duration, &c.DurationInBills, &c.MaxRedemptions, &c.TimesRedeemed, &c.Active, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, a)
+	}
+	return active, rows.Err()
+}
+
+// GetBillDiscounts returns the discounts granted on a closed bill.
+func GetBillDiscounts(ctx context.Context, billId string) ([]DbBillDiscount, error) {
+	const query = `
+		SELECT id, bill_id, redemption_id, coupon_code, description, amount, created_at
+		FROM bill_discount
+		WHERE bill_id = $1
+		ORDER BY redemption_id
+	`
+	rows, err := db.Query(ctx, query, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []DbBillDiscount
+	for rows.Next() {
+		var d DbBillDiscount
+		err := rows.Scan(&d.Id, &d.BillId, &d.RedemptionId, &d.CouponCode, &d.Description, &d.Amount, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+func insertBillDiscounts(ctx context.Context, tx *sqldb.Tx, billId string, discounts []DbBillDiscount) error {
+	const query = `
+		INSERT INTO bill_discount (bill_id, redemption_id, coupon_code, description, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+	`
+	for _, d := range discounts {
+		_, err := tx.Exec(ctx, query, billId, d.RedemptionId, d.CouponCode, d.Description, d.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
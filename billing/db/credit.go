@@ -0,0 +1,414 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/billing/ledger"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type CreditEntryType string
+
+const (
+	// CreditGrant is prepaid or promotional credit, optionally expiring
+	CreditGrant CreditEntryType = "grant"
+	// CreditOverpayment is the excess of a payment over the amount due
+	CreditOverpayment CreditEntryType = "overpayment"
+	// CreditConsumption is credit applied to a bill
+	CreditConsumption CreditEntryType = "consumption"
+	// CreditExpiration is the unused part of a grant removed when it expires
+	CreditExpiration CreditEntryType = "expiration"
+	// CreditRelease returns a consumption to the entry it drew from when
+	// its bill is voided or reopened
+	CreditRelease CreditEntryType = "release"
+)
+
+// accountCreditReference is the reference of the item applying account
+// credit to a bill. Credit is applied once per close of the bill; the items
+// of later closes of a reopened bill are numbered after it.
+const accountCreditReference = "account-credit"
+
+// DbCreditEntry is a movement of an account's credit balance. Grants and
+// over-payments add credit, which consumption and expiration entries draw
+// from; the balance is the sum of all entries.
+type DbCreditEntry struct {
+	Id        int64           `db:"id,pk,auto"`
+	AccountId string          `db:"account_id"` // index
+	Currency  string          `db:"currency"`
+	Amount    decimal.Decimal `db:"amount"`
+	// Remaining is the part of a grant or over-payment not yet drawn
+	Remaining   decimal.Decimal `db:"remaining"`
+	Type        CreditEntryType `db:"type"`
+	Description string          `db:"description"`
+	// ExpiresAt is when the remaining credit of a grant expires, nil if never
+	ExpiresAt *time.Time `db:"expires_at"`
+	// SourceEntryId is the entry a consumption or expiration drew from, or
+	// the consumption a release returns
+	SourceEntryId *int64    `db:"source_entry_id"`
+	BillId        *string   `db:"bill_id"`
+	PaymentId     *int64    `db:"payment_id"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+const creditEntryColumns = `id, account_id, currency, amount, remaining, type, description, expires_at, source_entry_id, bill_id, payment_id, created_at`
+
+func scanCreditEntry(row rowScanner) (*DbCreditEntry, error) {
+	var e DbCreditEntry
+	err := row.Scan(&e.Id, &e.AccountId, &e.Currency, &e.Amount, &e.Remaining, &e.Type, &e.Description, &e.ExpiresAt, &e.SourceEntryId, &e.BillId, &e.PaymentId, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func insertCreditEntry(ctx context.Context, tx *sqldb.Tx, entry DbCreditEntry) (*DbCreditEntry, error) {
+	query := `
+		INSERT INTO credit_entry (account_id, currency, amount, remaining, type, description, expires_at, source_entry_id, bill_id, payment_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, now())
+		RETURNING ` + creditEntryColumns
+	return scanCreditEntry(tx.QueryRow(ctx, query, entry.AccountId, entry.Currency, entry.Amount, entry.Remaining, entry.Type, entry.Description, entry.ExpiresAt, entry.SourceEntryId, entry.BillId, entry.PaymentId))
+}
+
+// GrantCredit adds credit to an account, expiring at expiresAt if not nil.
+func GrantCredit(ctx context.Context, accountId, currency string, amount decimal.Decimal, description string, expiresAt *time.Time) (*DbCreditEntry, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	entry, err := insertCreditEntry(ctx, tx, DbCreditEntry{
+		AccountId:   accountId,
+		Currency:    currency,
+		Amount:      amount,
+		Remaining:   amount,
+		Type:        CreditGrant,
+		Description: description,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// granted credit is a promotion rather than money received, so it is
+	// held against revenue until used or expired
+	err = postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourceGrant,
+		AccountId:   accountId,
+		Currency:    currency,
+		Description: description,
+		Entries:     ledger.Transfer(ledger.Revenue, ledger.DeferredRevenue, amount),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, tx.Commit()
+}
+
+// GetCreditBalance returns the credit an account can use in a currency,
+// excluding grants past their expiry that have not been expired yet.
+func GetCreditBalance(ctx context.Context, accountId, currency string) (decimal.Decimal, error) {
+	const query = `
+		SELECT COALESCE(SUM(remaining), 0)
+		FROM credit_entry
+		WHERE account_id = $1 AND currency = $2 AND remaining > 0 AND (expires_at IS NULL OR expires_at > now())
+	`
+	var balance decimal.Decimal
+	err := db.QueryRow(ctx, query, accountId, currency).Scan(&balance)
+	return balance, err
+}
+
+// GetCreditEntries returns an account's credit ledger, newest first.
+func GetCreditEntries(ctx context.Context, accountId string, limit int) ([]DbCreditEntry, error) {
+	query := `SELECT ` + creditEntryColumns + ` FROM credit_entry WHERE account_id = $1 ORDER BY id DESC LIMIT $2`
+	rows, err := db.Query(ctx, query, accountId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []DbCreditEntry
+	for rows.Next() {
+		e, err := scanCreditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// ApplyAccountCredit draws up to limit of the account's credit in the bill's
+// currency onto the bill, as an account credit item and consumption entries,
+// in one transaction. Credit expiring soonest is drawn first. It returns the
+// item, or nil if the account has no credit. Credit is applied once per
+// close; applying it again returns the existing item until the bill is
+// reopened, which releases it so it is drawn again against the new total.
+func ApplyAccountCredit(ctx context.Context, billId string, limit decimal.Decimal) (*DbBillItem, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	existing, applications, err := appliedAccountCredit(ctx, tx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	if !acceptsItems(bill.Status) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	const available = `
+		SELECT ` + creditEntryColumns + `
+		FROM credit_entry
+		WHERE account_id = $1 AND currency = $2 AND remaining > 0 AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY expires_at NULLS LAST, id
+		FOR UPDATE
+	`
+	rows, err := tx.Query(ctx, available, bill.AccountId, bill.Currency)
+	if err != nil {
+		return nil, err
+	}
+	var sources []DbCreditEntry
+	for rows.Next() {
+		e, err := scanCreditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sources = append(sources, *e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	applied := decimal.Zero
+	for _, source := range sources {
+		if !applied.LessThan(limit) {
+			break
+		}
+		drawn := decimal.Min(source.Remaining, limit.Sub(applied))
+		_, err = tx.Exec(ctx, `UPDATE credit_entry SET remaining = remaining - $1 WHERE id = $2`, drawn, source.Id)
+		if err != nil {
+			return nil, err
+		}
+		_, err = insertCreditEntry(ctx, tx, DbCreditEntry{
+			AccountId:     bill.AccountId,
+			Currency:      bill.Currency,
+			Amount:        drawn.Neg(),
+			Type:          CreditConsumption,
+			SourceEntryId: &source.Id,
+			BillId:        &billId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		applied = applied.Add(drawn)
+	}
+	if applied.IsZero() {
+		return nil, nil
+	}
+
+	reference := accountCreditReference
+	if applications > 0 {
+		reference = fmt.Sprintf("%s:%d", accountCreditReference, applications+1)
+	}
+	id, err := insertBillItem(ctx, tx, bill, DbBillItem{
+		BillId:       billId,
+		Reference:    reference,
+		Description:  "Account credit",
+		Type:         ItemTypeAccountCredit,
+		Amount:       applied.Neg(),
+		Currency:     bill.Currency,
+		ExchangeRate: decimal.NewFromInt(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	item, err := scanBillItem(tx.QueryRow(ctx, `SELECT `+billItemColumns+` FROM bill_item WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	return item, tx.Commit()
+}
+
+// appliedAccountCredit returns the account credit item of the bill's
+// current close, nil if credit was not applied since the bill was last
+// reopened, along with the number of items that ever applied credit to it.
+func appliedAccountCredit(ctx context.Context, tx *sqldb.Tx, billId string) (*DbBillItem, int, error) {
+	const query = `
+		SELECT ` + billItemColumns + `
+		FROM bill_item
+		WHERE bill_id = $1 AND type = $2 AND reverses_item_id IS NULL
+		ORDER BY id
+	`
+	rows, err := tx.Query(ctx, query, billId, ItemTypeAccountCredit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var applied []DbBillItem
+	for rows.Next() {
+		item, err := scanBillItem(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		applied = append(applied, *item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(applied) == 0 {
+		return nil, 0, nil
+	}
+
+	last := applied[len(applied)-1]
+	var released bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM bill_item WHERE reverses_item_id = $1)`, last.Id).Scan(&released)
+	if err != nil || released {
+		return nil, len(applied), err
+	}
+	return &last, len(applied), nil
+}
+
+// releaseAccountCredit returns the account credit applied to a bill to the
+// entries it was drawn from, and cancels its item with a linked account
+// credit item, reversing its postings. It is a no-op for bills without
+// applied credit.
+func releaseAccountCredit(ctx context.Context, tx *sqldb.Tx, bill *DbBill) error {
+	item, _, err := appliedAccountCredit(ctx, tx, bill.Id)
+	if err != nil || item == nil {
+		return err
+	}
+
+	const consumed = `
+		SELECT ` + creditEntryColumns + `
+		FROM credit_entry c
+		WHERE bill_id = $1 AND type = $2
+			AND NOT EXISTS (SELECT 1 FROM credit_entry r WHERE r.source_entry_id = c.id AND r.type = $3)
+		ORDER BY id
+	`
+	rows, err := tx.Query(ctx, consumed, bill.Id, CreditConsumption, CreditRelease)
+	if err != nil {
+		return err
+	}
+	var consumptions []DbCreditEntry
+	for rows.Next() {
+		e, err := scanCreditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		consumptions = append(consumptions, *e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range consumptions {
+		// released credit of a grant expired since is expired again by
+		// the next ExpireCredits
+		_, err = tx.Exec(ctx, `UPDATE credit_entry SET remaining = remaining - $1 WHERE id = $2`, c.Amount, *c.SourceEntryId)
+		if err != nil {
+			return err
+		}
+		_, err = insertCreditEntry(ctx, tx, DbCreditEntry{
+			AccountId:     c.AccountId,
+			Currency:      c.Currency,
+			Amount:        c.Amount.Neg(),
+			Type:          CreditRelease,
+			SourceEntryId: &c.Id,
+			BillId:        &bill.Id,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = insertBillItem(ctx, tx, bill, DbBillItem{
+		BillId:         bill.Id,
+		Reference:      fmt.Sprintf("%s:release:%d", accountCreditReference, item.Id),
+		Description:    "Account credit released",
+		Type:           ItemTypeAccountCredit,
+		Amount:         item.Amount.Neg(),
+		Currency:       item.Currency,
+		ExchangeRate:   item.ExchangeRate,
+		ReversesItemId: &item.Id,
+	})
+	return err
+}
+
+// ExpireCredits records the expiration of the unused credit of grants past
+// their expiry, returning the number of grants expired.
+func ExpireCredits(ctx context.Context, now time.Time) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const expired = `
+		UPDATE credit_entry e
+		SET remaining = 0
+		FROM (
+			SELECT id, remaining FROM credit_entry
+			WHERE remaining > 0 AND expires_at <= $1
+			FOR UPDATE
+		) x
+		WHERE e.id = x.id
+		RETURNING e.id, e.account_id, e.currency, x.remaining
+	`
+	rows, err := tx.Query(ctx, expired, now)
+	if err != nil {
+		return 0, err
+	}
+	var expirations []DbCreditEntry
+	for rows.Next() {
+		var sourceId int64
+		var e DbCreditEntry
+		if err := rows.Scan(&sourceId, &e.AccountId, &e.Currency, &e.Amount); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.Amount = e.Amount.Neg()
+		e.Type = CreditExpiration
+		e.SourceEntryId = &sourceId
+		expirations = append(expirations, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range expirations {
+		if _, err := insertCreditEntry(ctx, tx, e); err != nil {
+			return 0, err
+		}
+		err = postJournal(ctx, tx, journalTransaction{
+			Source:      ledger.SourceExpiration,
+			AccountId:   e.AccountId,
+			Currency:    e.Currency,
+			Description: "Expired credit",
+			Entries:     ledger.Transfer(ledger.DeferredRevenue, ledger.Revenue, e.Amount.Neg()),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expirations), tx.Commit()
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type DbExchangeRate struct {
+	Id            int64           `db:"id,pk,auto"`
+	BaseCurrency  string          `db:"base_currency"`
+	QuoteCurrency string          `db:"quote_currency"`
+	Rate          decimal.Decimal `db:"rate"`
+	EffectiveAt   time.Time       `db:"effective_at"`
+	CreatedAt     time.Time       `db:"created_at"`
+}
+
+// InsertExchangeRate stores the rate converting one unit of base into quote
+// from effectiveAt onwards. Re-inserting a pair and time replaces the rate.
+func InsertExchangeRate(ctx context.Context, base, quote string, rate decimal.Decimal, effectiveAt time.Time) (int64, error) {
+	const query = `
+		INSERT INTO exchange_rate (base_currency, quote_currency, rate, effective_at, created_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (base_currency, quote_currency, effective_at) DO UPDATE SET rate = EXCLUDED.rate
+		RETURNING id
+	`
+	var id int64
+	err := db.QueryRow(ctx, query, base, quote, rate, effectiveAt).Scan(&id)
+	return id, err
+}
+
+// GetExchangeRate returns the latest rate for base -> quote effective at the
+// given time, or sqldb.ErrNoRows if there is none.
+func GetExchangeRate(ctx context.Context, base, quote string, at time.Time) (decimal.Decimal, error) {
+	const query = `
+		SELECT rate
+		FROM exchange_rate
+		WHERE base_currency = $1 AND quote_currency = $2 AND effective_at <= $3
+		ORDER BY effective_at DESC
+		LIMIT 1
+	`
+	var rate decimal.Decimal
+	err := db.QueryRow(ctx, query, base, quote, at).Scan(&rate)
+	return rate, err
+}
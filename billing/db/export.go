@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// BillExportRow is a line item joined with its bill. Bills without items are
+// exported as one row with the item fields null.
+type BillExportRow struct {
+	BillId       string              `json:"bill_id"`
+	AccountId    string              `json:"account_id"`
+	Status       Status              `json:"status"`
+	BillCurrency string              `json:"bill_currency"`
+	PeriodStart  time.Time           `json:"period_start"`
+	PeriodEnd    time.Time           `json:"period_end"`
+	TotalAmount  decimal.NullDecimal `json:"total_amount"`
+
+	ItemId       *int64              `json:"item_id"`
+	Reference    *string             `json:"reference"`
+	Description  *string             `json:"description"`
+	Type         *ItemType           `json:"type"`
+	Amount       decimal.NullDecimal `json:"amount"`
+	Currency     *string             `json:"currency"`
+	ExchangeRate decimal.NullDecimal `json:"exchange_rate"`
+	// ConvertedAmount is the item amount in the bill's currency
+	ConvertedAmount decimal.NullDecimal `json:"converted_amount"`
+	Quantity        decimal.NullDecimal `json:"quantity"`
+	UnitPrice       decimal.NullDecimal `json:"unit_price"`
+	ItemCreatedAt   *time.Time          `json:"item_created_at"`
+}
+
+// ExportBills calls fn with the items of the bills matching filter, ordered
+// by bill creation and item id. Rows are read from the database as fn
+// consumes them rather than loaded at once, so exports of any size run in
+// constant memory. The sort and pagination fields of filter are ignored.
+func ExportBills(ctx context.Context, filter BillFilter, fn func(BillExportRow) error) error {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	bills := `SELECT id, account_id, status, currency, period_start, period_end, total_amount, created_at FROM bill`
+	if where := filter.conditions(arg); len(where) > 0 {
+		bills += ` WHERE ` + strings.Join(where, " AND ")
+	}
+
+	query := `
+		SELECT b.id, b.account_id, b.status, b.currency, b.period_start, b.period_end, b.total_amount,
+			i.id, i.reference, i.description, i.type, i.amount, i.currency, i.exchange_rate, i.amount * i.exchange_rate,
+			i.quantity, i.unit_price, i.created_at
+		FROM (` + bills + `) b
+		LEFT JOIN bill_item i ON i.bill_id = b.id
+		ORDER BY b.created_at, b.id, i.id
+	`
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r BillExportRow
+		err := rows.Scan(&r.BillId, &r.AccountId, &r.Status, &r.BillCurrency, &r.PeriodStart, &r.PeriodEnd, &r.TotalAmount,
+			&r.ItemId, &r.Reference, &r.Description, &r.Type, &r.Amount, &r.Currency, &r.ExchangeRate, &r.ConvertedAmount,
+			&r.Quantity, &r.UnitPrice, &r.ItemCreatedAt)
+		if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
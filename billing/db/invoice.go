@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// InvoiceNumbering is how invoice numbers are drawn.
+type InvoiceNumbering string
+
+const (
+	// NumberingGlobal numbers all invoices in one series, INV-000001
+	NumberingGlobal InvoiceNumbering = "global"
+	// NumberingAccount numbers each account's invoices in its own series,
+	// <account>-000001
+	NumberingAccount InvoiceNumbering = "account"
+)
+
+// DbInvoice is the legal invoice issued for a finalized bill.
+type DbInvoice struct {
+	BillId   string `db:"bill_id,pk"`
+	Number   string `db:"number"` // unique
+	Series   string `db:"series"`
+	Sequence int64  `db:"sequence"`
+	// IssuedAt is when the number was assigned
+	IssuedAt   time.Time  `db:"issued_at"`
+	HTML       []byte     `db:"html"`
+	PDF        []byte     `db:"pdf"`
+	RenderedAt *time.Time `db:"rendered_at"`
+
+	// Content is null on invoices issued before content was captured
+	Content *InvoiceContent `db:"content"`
+}
+
+// InvoiceContent is what an invoice states, captured in the transaction that
+// issues it so its documents keep that content whatever later happens to the
+// bill. Payments are not part of it.
+type InvoiceContent struct {
+	Issuer string
+	Bill   DbBill
+	Items  []DbBillItem
+	Totals BillTotals
+}
+
+func (c InvoiceContent) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (c *InvoiceContent) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, c)
+	case string:
+		return json.Unmarshal([]byte(src), c)
+	default:
+		return fmt.Errorf("cannot scan %T into InvoiceContent", src)
+	}
+}
+
+// issueInvoice assigns the next number of its series to a bill being
+// finalized in tx, once, and captures the invoice's content as issuer states
+// it. The series row stays locked until tx ends, so numbers are issued in
+// commit order without gaps.
+func issueInvoice(ctx context.Context, tx *sqldb.Tx, bill *DbBill, numbering InvoiceNumbering, issuer string) error {
+	var exists bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM invoice WHERE bill_id = $1)`, bill.Id).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	series, prefix := "global", "INV"
+	if numbering == NumberingAccount {
+		series, prefix = "account:"+bill.AccountId, bill.AccountId
+	}
+
+	const next = `
+		INSERT INTO invoice_series (series, last_number) VALUES ($1, 1)
+		ON CONFLICT (series) DO UPDATE SET last_number = invoice_series.last_number + 1
+		RETURNING last_number
+	`
+	var sequence int64
+	if err := tx.QueryRow(ctx, next, series).Scan(&sequence); err != nil {
+		return err
+	}
+
+	content, err := invoiceContent(ctx, tx, bill, issuer)
+	if err != nil {
+		return err
+	}
+
+	const query = `
+		INSERT INTO invoice (bill_id, number, series, sequence, issued_at, content)
+		VALUES ($1, $2, $3, $4, now(), $5)
+	`
+	_, err = tx.Exec(ctx, query, bill.Id, fmt.Sprintf("%s-%06d", prefix, sequence), series, sequence, content)
+	return err
+}
+
+// invoiceContent reads the items and the totals persisted when the bill
+// closed, in tx.
+func invoiceContent(ctx context.Context, tx *sqldb.Tx, bill *DbBill, issuer string) (*InvoiceContent, error) {
+	rows, err := tx.Query(ctx, `SELECT `+billItemColumns+` FROM bill_item WHERE bill_id = $1 ORDER BY id`, bill.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []DbBillItem
+	for rows.Next() {
+		item, err := scanBillItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	taxRows, err := tx.Query(ctx, `SELECT `+taxLineColumns+` FROM tax_line WHERE bill_id = $1 ORDER BY item_id, jurisdiction`, bill.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer taxRows.Close()
+	taxLines, err := scanTaxLines(taxRows)
+	if err != nil {
+		return nil, err
+	}
+
+	const discountQuery = `
+		SELECT id, bill_id, redemption_id, coupon_code, description, amount, created_at
+		FROM bill_discount
+		WHERE bill_id = $1
+		ORDER BY redemption_id
+	`
+	discountRows, err := tx.Query(ctx, discountQuery, bill.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer discountRows.Close()
+	var discounts []DbBillDiscount
+	for discountRows.Next() {
+		var d DbBillDiscount
+		err := discountRows.Scan(&d.Id, &d.BillId, &d.RedemptionId, &d.CouponCode, &d.Description, &d.Amount, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	if err := discountRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &InvoiceContent{
+		Issuer: issuer,
+		Bill:   *bill,
+		Items:  items,
+		Totals: BillTotals{
+			Subtotal:       bill.Subtotal.Decimal,
+			TaxAmount:      bill.TaxAmount.Decimal,
+			DiscountAmount: bill.DiscountAmount.Decimal,
+			CreditAmount:   bill.CreditAmount.Decimal,
+			TotalAmount:    bill.TotalAmount.Decimal,
+			ExchangeRates:  bill.ExchangeRates,
+			Taxes:          TaxesByJurisdiction(taxLines),
+			Discounts:      discounts,
+		},
+	}, nil
+}
+
+// GetInvoice returns the invoice issued for a bill.
+func GetInvoice(ctx context.Context, billId string) (*DbInvoice, error) {
+	const query = `
+		SELECT bill_id, number, series, sequence, issued_at, content, html, pdf, rendered_at
+		FROM invoice
+		WHERE bill_id = $1
+	`
+	var inv DbInvoice
+	var content, html *string
+	err := db.QueryRow(ctx, query, billId).Scan(&inv.BillId, &inv.Number, &inv.Series, &inv.Sequence, &inv.IssuedAt, &content, &html, &inv.PDF, &inv.RenderedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Invoice not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		inv.Content = &InvoiceContent{}
+		if err := inv.Content.Scan(*content); err != nil {
+			return nil, err
+		}
+	}
+	if html != nil {
+		inv.HTML = []byte(*html)
+	}
+	return &inv, nil
+}
+
+// SaveInvoiceDocuments stores the rendered documents of an invoice.
+func SaveInvoiceDocuments(ctx context.Context, billId string, html, pdf []byte) error {
+	const query = `
+		UPDATE invoice
+		SET html = $1, pdf = $2, rendered_at = now()
+		WHERE bill_id = $3
+	`
+	_, err := db.Exec(ctx, query, string(html), pdf, billId)
+	return err
+}
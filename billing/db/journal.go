@@ -0,0 +1,284 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/ledger"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// DbJournalEntry is one line of a balanced general ledger transaction.
+type DbJournalEntry struct {
+	Id            int64           `db:"id,pk,auto"`
+	TransactionId string          `db:"transaction_id"` // index
+	Source        ledger.Source   `db:"source"`
+	BillId        *string         `db:"bill_id"` // index
+	AccountId     string          `db:"account_id"`
+	LedgerAccount ledger.Account  `db:"ledger_account"`
+	Currency      string          `db:"currency"`
+	Debit         decimal.Decimal `db:"debit"`
+	Credit        decimal.Decimal `db:"credit"`
+	Description   string          `db:"description"`
+	CreatedAt     time.Time       `db:"created_at"`
+}
+
+// journalTransaction is a movement posted to the general ledger.
+type journalTransaction struct {
+	Source      ledger.Source
+	BillId      *string
+	AccountId   string
+	Currency    string
+	Description string
+	Entries     []ledger.Entry
+}
+
+// postJournal records a balanced transaction in tx, so the ledger changes
+// with the movement it records. Unbalanced transactions fail the whole
+// database transaction. Transactions of a zero amount are not posted.
+func postJournal(ctx context.Context, tx *sqldb.Tx, t journalTransaction) error {
+	var entries []ledger.Entry
+	for _, e := range t.Entries {
+		if !e.Debit.IsZero() || !e.Credit.IsZero() {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := ledger.Validate(entries); err != nil {
+		return err
+	}
+
+	const query = `
+		INSERT INTO journal_entry (transaction_id, source, bill_id, account_id, ledger_account, currency, debit, credit, description, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+	`
+	transactionId := uuid.NewString()
+	for _, e := range entries {
+		_, err := tx.Exec(ctx, query, transactionId, t.Source, t.BillId, t.AccountId, e.Account, t.Currency, e.Debit, e.Credit, t.Description)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postedBalance returns the credit balance of a ledger account from the
+// postings of one source on a bill, used to post only the change when a
+// reopened bill closes again.
+func postedBalance(ctx context.Context, tx *sqldb.Tx, billId string, source ledger.Source, account ledger.Account) (decimal.Decimal, error) {
+	const query = `
+		SELECT COALESCE(SUM(credit - debit), 0)
+		FROM journal_entry
+		WHERE bill_id = $1 AND source = $2 AND ledger_account = $3
+	`
+	var balance decimal.Decimal
+	err := tx.QueryRow(ctx, query, billId, source, account).Scan(&balance)
+	return balance, err
+}
+
+// postCloseJournal posts the tax and discounts of a closing bill. Items
+// were posted as they were added, and only the change from an earlier close
+// of a reopened bill is posted, so the ledger always matches the latest
+// totals.
+func postCloseJournal(ctx context.Context, tx *sqldb.Tx, bill *DbBill, items []DbBillItem, taxLines []DbTaxLine, totals BillTotals) error {
+	// exclusive tax is billed on top of the items, while inclusive tax was
+	// posted to revenue with the item it is part of
+	var exclusive, inclusive decimal.Decimal
+	for _, l := range taxLines {
+		if l.Inclusive {
+			inclusive = inclusive.Add(l.Amount)
+		} else {
+			exclusive = exclusive.Add(l.Amount)
+		}
+	}
+
+	postedExclusive, err := postedBalance(ctx, tx, bill.Id, ledger.SourceTax, ledger.AccountsReceivable)
+	if err != nil {
+		return err
+	}
+	postedInclusive, err := postedBalance(ctx, tx, bill.Id, ledger.SourceTax, ledger.Revenue)
+	if err != nil {
+		return err
+	}
+	var entries []ledger.Entry
+	entries = append(entries, ledger.Transfer(ledger.AccountsReceivable, ledger.TaxPayable, exclusive.Add(postedExclusive))...)
+	entries = append(entries, ledger.Transfer(ledger.Revenue, ledger.TaxPayable, inclusive.Add(postedInclusive))...)
+	err = postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourceTax,
+		BillId:      &bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Description: "Tax",
+		Entries:     entries,
+	})
+	if err != nil {
+		return err
+	}
+
+	// inclusive prices were posted with the tax of their undiscounted
+	// amounts, and the tax the discounts remove from them is discounted too
+	gross := decimal.Zero
+	for _, item := range items {
+		if item.Type != ItemTypeAccountCredit {
+			gross = gross.Add(item.Amount.Mul(item.ExchangeRate))
+		}
+	}
+	discounted := totals.DiscountAmount.Add(gross.Sub(totals.Subtotal).Sub(inclusive))
+
+	postedDiscount, err := postedBalance(ctx, tx, bill.Id, ledger.SourceDiscount, ledger.Revenue)
+	if err != nil {
+		return err
+	}
+	return postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourceDiscount,
+		BillId:      &bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Description: "Discounts",
+		Entries:     ledger.Transfer(ledger.Revenue, ledger.AccountsReceivable, discounted.Add(postedDiscount)),
+	})
+}
+
+// reverseBillJournal posts the reversal of a voided bill's net balance on
+// each ledger account, so it leaves nothing owed, earned or payable. Payments
+// are kept, as the money was received; their balance stays on accounts
+// receivable until it is refunded.
+func reverseBillJournal(ctx context.Context, tx *sqldb.Tx, bill *DbBill) error {
+	const query = `
+		SELECT ledger_account, SUM(credit - debit)
+		FROM journal_entry
+		WHERE bill_id = $1 AND source <> $2
+		GROUP BY ledger_account
+		ORDER BY ledger_account
+	`
+	rows, err := tx.Query(ctx, query, bill.Id, ledger.SourcePayment)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var entries []ledger.Entry
+	for rows.Next() {
+		var account ledger.Account
+		var balance decimal.Decimal
+		if err := rows.Scan(&account, &balance); err != nil {
+			return err
+		}
+		switch {
+		case balance.IsPositive():
+			entries = append(entries, ledger.Entry{Account: account, Debit: balance, Credit: decimal.Zero})
+		case balance.IsNegative():
+			entries = append(entries, ledger.Entry{Account: account, Debit: decimal.Zero, Credit: balance.Neg()})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourceVoid,
+		BillId:      &bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Description: "Bill voided",
+		Entries:     entries,
+	})
+}
+
+// GetBillJournal returns the general ledger entries of a bill.
+func GetBillJournal(ctx context.Context, billId string) ([]DbJournalEntry, error) {
+	const query = `
+		SELECT id, transaction_id, source, bill_id, account_id, ledger_account, currency, debit, credit, description, created_at
+		FROM journal_entry
+		WHERE bill_id = $1
+		ORDER BY id
+	`
+	rows, err := db.Query(ctx, query, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []DbJournalEntry
+	for rows.Next() {
+		var e DbJournalEntry
+		err := rows.Scan(&e.Id, &e.TransactionId, &e.Source, &e.BillId, &e.AccountId, &e.LedgerAccount, &e.Currency, &e.Debit, &e.Credit, &e.Description, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// TrialBalanceRow is the total debits and credits of a ledger account.
+type TrialBalanceRow struct {
+	Currency      string          `json:"currency"`
+	LedgerAccount ledger.Account  `json:"ledger_account"`
+	Debit         decimal.Decimal `json:"debit"`
+	Credit        decimal.Decimal `json:"credit"`
+	// Balance is Debit - Credit
+	Balance decimal.Decimal `json:"balance"`
+}
+
+// GetTrialBalance sums the postings made before asOf per currency and
+// ledger account.
+func GetTrialBalance(ctx context.Context, asOf time.Time) ([]TrialBalanceRow, error) {
+	const query = `
+		SELECT currency, ledger_account, SUM(debit), SUM(credit)
+		FROM journal_entry
+		WHERE created_at < $1
+		GROUP BY currency, ledger_account
+		ORDER BY currency, ledger_account
+	`
+	rows, err := db.Query(ctx, query, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balance []TrialBalanceRow
+	for rows.Next() {
+		var r TrialBalanceRow
+		if err := rows.Scan(&r.Currency, &r.LedgerAccount, &r.Debit, &r.Credit); err != nil {
+			return nil, err
+		}
+		r.Balance = r.Debit.Sub(r.Credit)
+		balance = append(balance, r)
+	}
+	return balance, rows.Err()
+}
+
+// GetUnbalancedTransactions returns the ids of transactions whose debits do
+// not equal their credits. Posting rejects them, so any result points at
+// entries written outside postJournal.
+func GetUnbalancedTransactions(ctx context.Context, asOf time.Time) ([]string, error) {
+	const query = `
+		SELECT transaction_id
+		FROM journal_entry
+		WHERE created_at < $1
+		GROUP BY transaction_id
+		HAVING SUM(debit) <> SUM(credit)
+		ORDER BY transaction_id
+	`
+	rows, err := db.Query(ctx, query, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
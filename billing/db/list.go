@@ -0,0 +1,188 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+type BillSortField string
+
+const (
+	SortByCreatedAt   BillSortField = "created_at"
+	SortByPeriodStart BillSortField = "period_start"
+	SortByPeriodEnd   BillSortField = "period_end"
+)
+
+// IsValid reports whether bills can be sorted by f.
+func (f BillSortField) IsValid() bool {
+	return f == SortByCreatedAt || f == SortByPeriodStart || f == SortByPeriodEnd
+}
+
+// BillFilter selects a page of bills. Zero-valued fields do not filter.
+type BillFilter struct {
+	Statuses       []Status
+	AccountId      string
+	Currency       string
+	SubscriptionId string
+	// PeriodFrom and PeriodTo select bills whose period overlaps the range
+	PeriodFrom  time.Time
+	PeriodTo    time.Time
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// MinTotal and MaxTotal filter on the persisted total, so they only
+	// match bills that have closed
+	MinTotal *decimal.Decimal
+	MaxTotal *decimal.Decimal
+
+	SortBy     BillSortField
+	Descending bool
+	// After continues a previous page
+	After *BillCursor
+	Limit int
+}
+
+// BillCursor is the position of the last bill of a page in the sort order.
+type BillCursor struct {
+	Value time.Time `json:"v"`
+	Id    string    `json:"id"`
+}
+
+// Encode returns the cursor as an opaque token.
+func (c BillCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeBillCursor parses a token returned by BillCursor.Encode.
+func DecodeBillCursor(token string) (*BillCursor, error) {
+	invalid := &errs.Error{Code: errs.InvalidArgument, Message: "Invalid cursor"}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+	var c BillCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Id == "" {
+		return nil, invalid
+	}
+	return &c, nil
+}
+
+func (f BillFilter) sortValue(bill DbBill) time.Time {
+	switch f.SortBy {
+	case SortByPeriodStart:
+		return bill.PeriodStart
+	case SortByPeriodEnd:
+		return bill.PeriodEnd
+	default:
+		return bill.CreatedAt
+	}
+}
+
+// conditions returns the SQL conditions on the bill table selecting the
+// bills matching f, with arguments bound by arg. The sort and pagination
+// fields are not included.
+func (f BillFilter) conditions(arg func(v interface{}) string) []string {
+	var where []string
+	if len(f.Statuses) > 0 {
+		statuses := make([]string, len(f.Statuses))
+		for i, status := range f.Statuses {
+			statuses[i] = string(status)
+		}
+		where = append(where, "status = ANY("+arg(statuses)+")")
+	}
+	if f.AccountId != "" {
+		where = append(where, "account_id = "+arg(f.AccountId))
+	}
+	if f.Currency != "" {
+		where = append(where, "currency = "+arg(f.Currency))
+	}
+	if f.SubscriptionId != "" {
+		where = append(where, "subscription_id = "+arg(f.SubscriptionId))
+	}
+	if !f.PeriodFrom.IsZero() {
+		where = append(where, "period_end > "+arg(f.PeriodFrom))
+	}
+	if !f.PeriodTo.IsZero() {
+		where = append(where, "period_start < "+arg(f.PeriodTo))
+	}
+	if !f.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= "+arg(f.CreatedFrom))
+	}
+	if !f.CreatedTo.IsZero() {
+		where = append(where, "created_at < "+arg(f.CreatedTo))
+	}
+	if f.MinTotal != nil {
+		where = append(where, "total_amount >= "+arg(*f.MinTotal))
+	}
+	if f.MaxTotal != nil {
+		where = append(where, "total_amount <= "+arg(*f.MaxTotal))
+	}
+	return where
+}
+
+// ListBills returns a page of bills matching filter, ordered by the sort
+// field and id. The returned cursor continues with the next page and is nil
+// on the last page.
+func ListBills(ctx context.Context, filter BillFilter) ([]DbBill, *BillCursor, error) {
+	if filter.SortBy == "" {
+		filter.SortBy = SortByCreatedAt
+	}
+	if !filter.SortBy.IsValid() {
+		return nil, nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown sort field " + string(filter.SortBy)}
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	where := filter.conditions(arg)
+
+	direction, cmp := "ASC", ">"
+	if filter.Descending {
+		direction, cmp = "DESC", "<"
+	}
+	column := string(filter.SortBy)
+	if filter.After != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, cmp, arg(filter.After.Value), arg(filter.After.Id)))
+	}
+
+	query := `SELECT ` + billColumns + ` FROM bill`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	// fetch one extra row to know whether there is a next page
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", column, direction, direction, arg(filter.Limit+1))
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var bills []DbBill
+	for rows.Next() {
+		bill, err := scanBill(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		bills = append(bills, *bill)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(bills) <= filter.Limit {
+		return bills, nil, nil
+	}
+	bills = bills[:filter.Limit]
+	last := bills[len(bills)-1]
+	return bills, &BillCursor{Value: filter.sortValue(last), Id: last.Id}, nil
+}
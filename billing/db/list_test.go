@@ -0,0 +1,84 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillCursorRoundTrip(t *testing.T) {
+	cursor := db.BillCursor{Value: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), Id: "bill-1"}
+
+	decoded, err := db.DecodeBillCursor(cursor.Encode())
+	require.NoError(t, err)
+	require.Equal(t, cursor.Id, decoded.Id)
+	require.True(t, cursor.Value.Equal(decoded.Value))
+
+	_, err = db.DecodeBillCursor("not a cursor")
+	require.Error(t, err)
+}
+
+func TestListBillsPaginates(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	for i := 0; i < 5; i++ {
+		start := periodStart.Add(time.Duration(i) * time.Hour)
+		_, err := db.InsertBill(ctx, fmt.Sprintf("page-bill-%d", i), db.StatusOpen, "accountPages", "USD", start, start.Add(24*time.Hour))
+		require.NoError(t, err, "failed to insert bill")
+	}
+
+	filter := db.BillFilter{
+		AccountId:  "accountPages",
+		Statuses:   []db.Status{db.StatusOpen},
+		SortBy:     db.SortByPeriodStart,
+		Descending: true,
+		Limit:      2,
+	}
+
+	var ids []string
+	for {
+		bills, next, err := db.ListBills(ctx, filter)
+		require.NoError(t, err, "failed to list bills")
+		for _, bill := range bills {
+			ids = append(ids, bill.Id)
+		}
+		if next == nil {
+			break
+		}
+		filter.After = next
+	}
+	require.Equal(t, []string{"page-bill-4", "page-bill-3", "page-bill-2", "page-bill-1", "page-bill-0"}, ids)
+}
+
+func TestExportBills(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	_, err := db.InsertBill(ctx, "export-bill-0", db.StatusOpen, "accountExport", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, err = db.InsertBillItem(ctx, "export-bill-0", "REF001", "Seats", decimal.NewFromInt(10), "EUR", decimal.RequireFromString("1.1"))
+	require.NoError(t, err)
+	_, err = db.InsertBillItem(ctx, "export-bill-0", "REF002", "Support", decimal.NewFromInt(5), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+	_, err = db.InsertBill(ctx, "export-bill-1", db.StatusOpen, "accountExport", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+
+	var rows []db.BillExportRow
+	err = db.ExportBills(ctx, db.BillFilter{AccountId: "accountExport"}, func(r db.BillExportRow) error {
+		rows = append(rows, r)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	require.Equal(t, "export-bill-0", rows[0].BillId)
+	require.True(t, decimal.NewFromInt(11).Equal(rows[0].ConvertedAmount.Decimal))
+	// bills without items are exported once
+	require.Equal(t, "export-bill-1", rows[2].BillId)
+	require.Nil(t, rows[2].ItemId)
+}
@@ -0,0 +1,30 @@
+CREATE TABLE webhook_endpoint (
+    id BIGSERIAL PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    url TEXT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    -- empty subscribes to every event type
+    event_types TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_webhook_endpoint_account_id ON webhook_endpoint(account_id);
+
+CREATE TABLE webhook_delivery (
+    id BIGSERIAL PRIMARY KEY,
+    endpoint_id BIGINT NOT NULL REFERENCES webhook_endpoint(id) ON DELETE CASCADE,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_status_code INT,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ
+);
+
+-- an event is delivered to an endpoint once, however often it is published
+CREATE UNIQUE INDEX idx_webhook_delivery_endpoint_id_event_id ON webhook_delivery(endpoint_id, event_id);
@@ -0,0 +1,18 @@
+CREATE TABLE subscription (
+    id VARCHAR(255) PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    cadence VARCHAR(255) NOT NULL,
+    interval_days INT NOT NULL DEFAULT 0,
+    anchor TIMESTAMPTZ NOT NULL,
+    time_zone VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    cancelled_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_subscription_account_id ON subscription(account_id);
+
+ALTER TABLE bill ADD COLUMN subscription_id VARCHAR(255) REFERENCES subscription(id);
+
+CREATE INDEX idx_bills_subscription_id ON bill(subscription_id, period_start);
@@ -0,0 +1,25 @@
+CREATE TABLE meter (
+    key VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    aggregation VARCHAR(255) NOT NULL,
+    unit_price DECIMAL(38, 18) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE usage_event (
+    id BIGSERIAL PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    meter_key VARCHAR(255) NOT NULL REFERENCES meter(key),
+    quantity DECIMAL(38, 18) NOT NULL,
+    value VARCHAR(255) NOT NULL DEFAULT '',
+    timestamp TIMESTAMPTZ NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    -- set once the event is billed
+    bill_id VARCHAR(255) REFERENCES bill(id),
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_usage_event_account_id_idempotency_key ON usage_event(account_id, idempotency_key);
+CREATE INDEX idx_usage_event_unbilled ON usage_event(account_id, timestamp) WHERE bill_id IS NULL;
+CREATE INDEX idx_usage_event_bill_id ON usage_event(bill_id);
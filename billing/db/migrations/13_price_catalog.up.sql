@@ -0,0 +1,25 @@
+CREATE TABLE product (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE price (
+    id VARCHAR(255) PRIMARY KEY,
+    product_id VARCHAR(255) NOT NULL REFERENCES product(id),
+    currency VARCHAR(255) NOT NULL,
+    model VARCHAR(255) NOT NULL,
+    unit_amount DECIMAL(38, 18) NOT NULL DEFAULT 0,
+    package_size DECIMAL(38, 18) NOT NULL DEFAULT 0,
+    tiers JSONB NOT NULL DEFAULT '[]',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_price_product_id ON price(product_id);
+
+-- set on items priced from the catalog or a meter
+ALTER TABLE bill_item ADD COLUMN quantity DECIMAL(38, 18);
+ALTER TABLE bill_item ADD COLUMN unit_price DECIMAL(38, 18);
+ALTER TABLE bill_item ADD COLUMN price_id VARCHAR(255) REFERENCES price(id);
@@ -0,0 +1,35 @@
+CREATE TABLE tax_rule (
+    id BIGSERIAL PRIMARY KEY,
+    jurisdiction VARCHAR(255) NOT NULL,
+    country VARCHAR(2) NOT NULL,
+    -- empty applies to the whole country
+    region VARCHAR(255) NOT NULL DEFAULT '',
+    rate DECIMAL(38, 18) NOT NULL,
+    inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_tax_rule_country ON tax_rule(country);
+
+CREATE TABLE tax_profile (
+    account_id VARCHAR(255) PRIMARY KEY,
+    country VARCHAR(2) NOT NULL,
+    region VARCHAR(255) NOT NULL DEFAULT '',
+    exempt BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE tax_line (
+    id BIGSERIAL PRIMARY KEY,
+    bill_id VARCHAR(255) NOT NULL REFERENCES bill(id),
+    item_id BIGINT NOT NULL REFERENCES bill_item(id),
+    jurisdiction VARCHAR(255) NOT NULL,
+    rate DECIMAL(38, 18) NOT NULL,
+    inclusive BOOLEAN NOT NULL,
+    taxable_amount DECIMAL(38, 18) NOT NULL,
+    amount DECIMAL(38, 18) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_tax_line_bill_id ON tax_line(bill_id);
+CREATE UNIQUE INDEX idx_tax_line_item_id_jurisdiction ON tax_line(item_id, jurisdiction);
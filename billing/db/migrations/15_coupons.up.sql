@@ -0,0 +1,41 @@
+CREATE TABLE coupon (
+    code VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    percent_off DECIMAL(38, 18) NOT NULL DEFAULT 0,
+    amount_off DECIMAL(38, 18) NOT NULL DEFAULT 0,
+    -- empty applies to bills in any currency
+    currency VARCHAR(255) NOT NULL DEFAULT '',
+    duration VARCHAR(255) NOT NULL,
+    -- bills discounted per redemption, 0 for forever
+    duration_in_bills INT NOT NULL DEFAULT 0,
+    -- null allows unlimited redemptions
+    max_redemptions INT,
+    times_redeemed INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE coupon_redemption (
+    id BIGSERIAL PRIMARY KEY,
+    coupon_code VARCHAR(255) NOT NULL REFERENCES coupon(code),
+    account_id VARCHAR(255) NOT NULL,
+    -- the first bill discounted
+    bill_id VARCHAR(255) NOT NULL REFERENCES bill(id),
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_coupon_redemption_coupon_code_account_id ON coupon_redemption(coupon_code, account_id);
+CREATE INDEX idx_coupon_redemption_account_id ON coupon_redemption(account_id);
+
+CREATE TABLE bill_discount (
+    id BIGSERIAL PRIMARY KEY,
+    bill_id VARCHAR(255) NOT NULL REFERENCES bill(id),
+    redemption_id BIGINT NOT NULL REFERENCES coupon_redemption(id),
+    coupon_code VARCHAR(255) NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    amount DECIMAL(38, 18) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_bill_discount_bill_id_redemption_id ON bill_discount(bill_id, redemption_id);
@@ -0,0 +1,31 @@
+ALTER TABLE bill ADD COLUMN amount_paid DECIMAL(38, 18) NOT NULL DEFAULT 0;
+
+CREATE TABLE payment (
+    id BIGSERIAL PRIMARY KEY,
+    bill_id VARCHAR(255) NOT NULL REFERENCES bill(id),
+    -- negative for refunds
+    amount DECIMAL(38, 18) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    exchange_rate DECIMAL(38, 18) NOT NULL,
+    -- the part of the payment applied to the bill, in its currency
+    applied_amount DECIMAL(38, 18) NOT NULL,
+    method VARCHAR(255) NOT NULL,
+    reference VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_payment_bill_id_reference ON payment(bill_id, reference);
+
+CREATE TABLE credit_entry (
+    id BIGSERIAL PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    -- positive adds to the account's credit balance
+    amount DECIMAL(38, 18) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    bill_id VARCHAR(255) REFERENCES bill(id),
+    payment_id BIGINT REFERENCES payment(id),
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_credit_entry_account_id_currency ON credit_entry(account_id, currency);
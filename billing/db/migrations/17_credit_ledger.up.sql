@@ -0,0 +1,12 @@
+-- grants and over-payments are drawn down through remaining; consumption and
+-- expiration entries reference the entry they drew from
+ALTER TABLE credit_entry ADD COLUMN remaining DECIMAL(38, 18) NOT NULL DEFAULT 0;
+ALTER TABLE credit_entry ADD COLUMN expires_at TIMESTAMPTZ;
+ALTER TABLE credit_entry ADD COLUMN source_entry_id BIGINT REFERENCES credit_entry(id);
+ALTER TABLE credit_entry ADD COLUMN description TEXT NOT NULL DEFAULT '';
+
+UPDATE credit_entry SET remaining = amount WHERE amount > 0;
+
+CREATE INDEX idx_credit_entry_available ON credit_entry(account_id, currency, expires_at) WHERE remaining > 0;
+
+ALTER TABLE bill ADD COLUMN credit_amount DECIMAL(38, 18);
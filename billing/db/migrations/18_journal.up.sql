@@ -0,0 +1,18 @@
+CREATE TABLE journal_entry (
+    id BIGSERIAL PRIMARY KEY,
+    -- entries of a transaction balance: their debits equal their credits
+    transaction_id VARCHAR(255) NOT NULL,
+    source VARCHAR(255) NOT NULL,
+    bill_id VARCHAR(255) REFERENCES bill(id),
+    account_id VARCHAR(255) NOT NULL,
+    ledger_account VARCHAR(255) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    debit DECIMAL(38, 18) NOT NULL DEFAULT 0 CHECK (debit >= 0),
+    credit DECIMAL(38, 18) NOT NULL DEFAULT 0 CHECK (credit >= 0),
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_journal_entry_transaction_id ON journal_entry(transaction_id);
+CREATE INDEX idx_journal_entry_bill_id ON journal_entry(bill_id, source);
+CREATE INDEX idx_journal_entry_ledger_account ON journal_entry(currency, ledger_account, created_at);
@@ -0,0 +1,19 @@
+-- numbers are drawn from a series row rather than a sequence, which would
+-- leave gaps on rollback
+CREATE TABLE invoice_series (
+    series VARCHAR(255) PRIMARY KEY,
+    last_number BIGINT NOT NULL
+);
+
+CREATE TABLE invoice (
+    bill_id VARCHAR(255) PRIMARY KEY REFERENCES bill(id),
+    number VARCHAR(255) NOT NULL UNIQUE,
+    series VARCHAR(255) NOT NULL,
+    sequence BIGINT NOT NULL,
+    issued_at TIMESTAMPTZ NOT NULL,
+    -- the rendered documents, null until rendered
+    html TEXT,
+    pdf BYTEA,
+    rendered_at TIMESTAMPTZ,
+    UNIQUE (series, sequence)
+);
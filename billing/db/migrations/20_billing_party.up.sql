@@ -0,0 +1,13 @@
+-- the legal details of an account printed on its e-invoices
+CREATE TABLE billing_party (
+    account_id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    vat_id VARCHAR(255) NOT NULL DEFAULT '',
+    endpoint_id VARCHAR(255) NOT NULL DEFAULT '',
+    endpoint_scheme VARCHAR(255) NOT NULL DEFAULT '',
+    street VARCHAR(255) NOT NULL DEFAULT '',
+    city VARCHAR(255) NOT NULL DEFAULT '',
+    postal_code VARCHAR(255) NOT NULL DEFAULT '',
+    country VARCHAR(2) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,11 @@
+-- failed publications are retried with backoff and parked once they are
+-- unlikely to succeed, so one event cannot hold up the rest of the outbox
+ALTER TABLE outbox
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN last_error TEXT,
+    ADD COLUMN next_attempt_at TIMESTAMPTZ,
+    ADD COLUMN locked_until TIMESTAMPTZ,
+    ADD COLUMN parked_at TIMESTAMPTZ;
+
+DROP INDEX idx_outbox_unpublished;
+CREATE INDEX idx_outbox_pending ON outbox(id) WHERE published_at IS NULL AND parked_at IS NULL;
@@ -0,0 +1,6 @@
+-- usage is billed on the bills of the subscription it was reported for, or
+-- on the account's bills outside subscriptions when it has none
+ALTER TABLE usage_event ADD COLUMN subscription_id VARCHAR(255) REFERENCES subscription(id);
+
+DROP INDEX idx_usage_event_unbilled;
+CREATE INDEX idx_usage_event_unbilled ON usage_event(account_id, subscription_id, timestamp) WHERE bill_id IS NULL;
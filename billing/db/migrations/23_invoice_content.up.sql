@@ -0,0 +1,3 @@
+-- what an invoice states is captured when it is issued, so its documents
+-- do not change with the bill afterwards
+ALTER TABLE invoice ADD COLUMN content JSONB;
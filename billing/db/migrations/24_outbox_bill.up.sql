@@ -0,0 +1,7 @@
+-- events of a bill are published in the order they were written, so a
+-- failed event holds up the later events of its bill until it is published
+-- or parked
+ALTER TABLE outbox ADD COLUMN bill_id VARCHAR(255);
+UPDATE outbox SET bill_id = payload->>'bill_id';
+
+CREATE INDEX idx_outbox_bill_pending ON outbox(bill_id, id) WHERE published_at IS NULL AND parked_at IS NULL;
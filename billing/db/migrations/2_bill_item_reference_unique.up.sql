@@ -0,0 +1,9 @@
+-- Drop duplicate items produced by retried signals/activities, keeping the
+-- first row inserted for each reference.
+DELETE FROM bill_item a
+USING bill_item b
+WHERE a.bill_id = b.bill_id
+  AND a.reference = b.reference
+  AND a.id > b.id;
+
+CREATE UNIQUE INDEX idx_bill_item_bill_id_reference ON bill_item(bill_id, reference);
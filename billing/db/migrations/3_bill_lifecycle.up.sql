@@ -0,0 +1,4 @@
+ALTER TABLE bill ADD COLUMN finalized_at TIMESTAMPTZ;
+ALTER TABLE bill ADD COLUMN due_at TIMESTAMPTZ;
+
+CREATE INDEX idx_bills_status_due_at ON bill(status, due_at);
@@ -0,0 +1,11 @@
+CREATE TABLE bill_history (
+    id BIGSERIAL PRIMARY KEY,
+    bill_id VARCHAR(255) REFERENCES bill(id) ON DELETE CASCADE,
+    from_status VARCHAR(255) NOT NULL,
+    to_status VARCHAR(255) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_bill_history_bill_id ON bill_history(bill_id);
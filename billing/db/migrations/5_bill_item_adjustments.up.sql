@@ -0,0 +1,5 @@
+ALTER TABLE bill_item ADD COLUMN type VARCHAR(255) NOT NULL DEFAULT 'charge';
+ALTER TABLE bill_item ADD COLUMN reverses_item_id BIGINT REFERENCES bill_item(id);
+
+-- an item can only be reversed once
+CREATE UNIQUE INDEX idx_bill_item_reverses_item_id ON bill_item(reverses_item_id) WHERE reverses_item_id IS NOT NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE exchange_rate (
+    id BIGSERIAL PRIMARY KEY,
+    base_currency VARCHAR(255) NOT NULL,
+    quote_currency VARCHAR(255) NOT NULL,
+    rate DECIMAL(30, 10) NOT NULL,
+    effective_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX idx_exchange_rate_pair_effective_at ON exchange_rate(base_currency, quote_currency, effective_at);
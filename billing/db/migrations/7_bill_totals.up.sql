@@ -0,0 +1,6 @@
+-- totals are persisted when a bill closes
+ALTER TABLE bill ADD COLUMN subtotal DECIMAL(38, 18);
+ALTER TABLE bill ADD COLUMN tax_amount DECIMAL(38, 18);
+ALTER TABLE bill ADD COLUMN discount_amount DECIMAL(38, 18);
+ALTER TABLE bill ADD COLUMN total_amount DECIMAL(38, 18);
+ALTER TABLE bill ADD COLUMN exchange_rates JSONB;
@@ -0,0 +1,9 @@
+-- keyset pagination of bills per account, optionally narrowed by status
+CREATE INDEX idx_bills_account_id_created_at ON bill(account_id, created_at, id);
+CREATE INDEX idx_bills_account_id_status_created_at ON bill(account_id, status, created_at, id);
+CREATE INDEX idx_bills_account_id_period_start ON bill(account_id, period_start, id);
+CREATE INDEX idx_bills_account_id_period_end ON bill(account_id, period_end, id);
+CREATE INDEX idx_bills_status_created_at ON bill(status, created_at, id);
+
+-- superseded by the composite indexes above
+DROP INDEX idx_bills_account_id;
@@ -0,0 +1,11 @@
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    published_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX idx_outbox_event_id ON outbox(event_id);
+CREATE INDEX idx_outbox_unpublished ON outbox(id) WHERE published_at IS NULL;
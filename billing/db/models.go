@@ -2,91 +2,385 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
+	"encore.app/billing/events"
+	"encore.app/billing/ledger"
+	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
+	"encore.dev/storage/sqldb/sqlerr"
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 )
 
-type Status string
+type DbBill struct {
+	Id          string     `db:"id,pk,auto"`
+	Status      Status     `db:"status"` // index
+	Currency    string     `db:"currency"`
+	AccountId   string     `db:"account_id"` // index
+	PeriodStart time.Time  `db:"period_start"`
+	PeriodEnd   time.Time  `db:"period_end"`
+	FinalizedAt *time.Time `db:"finalized_at"`
+	DueAt       *time.Time `db:"due_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	// SubscriptionId is set on the bills of recurring subscriptions
+	SubscriptionId *string `db:"subscription_id"` // index
 
-const (
-	StatusOpen   Status = "open"
-	StatusClosed Status = "closed"
-)
+	// Totals are persisted when the bill closes and are null until then
+	Subtotal       decimal.NullDecimal `db:"subtotal"`
+	TaxAmount      decimal.NullDecimal `db:"tax_amount"`
+	DiscountAmount decimal.NullDecimal `db:"discount_amount"`
+	CreditAmount   decimal.NullDecimal `db:"credit_amount"`
+	TotalAmount    decimal.NullDecimal `db:"total_amount"`
+	ExchangeRates  AppliedRates        `db:"exchange_rates"`
 
-type DbBill struct {
-	Id          string    `db:"id,pk,auto"`
-	Status      Status    `db:"status"` // index
-	Currency    string    `db:"currency"`
-	AccountId   string    `db:"account_id"` // index
-	PeriodStart time.Time `db:"end_at"`
-	PeriodEnd   time.Time `db:"end_at"`
-	CreatedAt   time.Time `db:"created_at"`
+	// AmountPaid is the net of the payments and refunds applied to the bill
+	AmountPaid decimal.Decimal `db:"amount_paid"`
 }
 
-type DbBillItem struct {
-	Id           int64           `db:"id,pk,auto"`
-	BillId       string          `db:"bill_id"` // index
-	Reference    string          `db:"reference"`
-	Description  string          `db:"description"`
-	Amount       decimal.Decimal `db:"amount"`
-	Currency     string          `db:"currency"`
-	ExchangeRate decimal.Decimal `db:"exchange_rate"`
-	CreatedAt    time.Time       `db:"created_at"`
+// AmountDue is the balance left to pay on a closed bill.
+func (b DbBill) AmountDue() decimal.Decimal {
+	return b.TotalAmount.Decimal.Sub(b.AmountPaid)
 }
 
-type BillingDaoInterface interface {
-	InsertBill(ctx context.Context, status Status, accountId, currency string, periodStart, periodEnd time.Time) (int64, error)
-	InsertBillItem(ctx context.Context, billId int64, reference, description string, amount decimal.Decimal, currency string, exchangeRate decimal.Decimal) (int64, error)
-	GetBillByID(ctx context.Context, billId int64) (*DbBill, error)
-	GetBillItems(ctx context.Context, billId int64) ([]DbBillItem, error)
-	UpdateBillTotal(ctx context.Context, billId int64, amount decimal.Decimal) error
-	UpdateBillStatus(ctx context.Context, billId int64, status Status) error
+type ItemType string
+
+const (
+	// ItemTypeCharge is a regular, non-negative line item
+	ItemTypeCharge ItemType = "charge"
+	// ItemTypeReversal cancels a previous item with the negated amount
+	ItemTypeReversal ItemType = "reversal"
+	// ItemTypeCredit is a standalone negative adjustment
+	ItemTypeCredit ItemType = "credit"
+	// ItemTypeAccountCredit draws down the account's credit balance when
+	// the bill closes; it is not taxed or discounted
+	ItemTypeAccountCredit ItemType = "account_credit"
+	// ItemTypeUsage is metered usage priced when the bill closes
+	ItemTypeUsage ItemType = "usage"
+)
+
+type DbBillItem struct {
+	Id             int64           `db:"id,pk,auto"`
+	BillId         string          `db:"bill_id"` // index
+	Reference      string          `db:"reference"`
+	Description    string          `db:"description"`
+	Type           ItemType        `db:"type"`
+	Amount         decimal.Decimal `db:"amount"`
+	Currency       string          `db:"currency"`
+	ExchangeRate   decimal.Decimal `db:"exchange_rate"`
+	ReversesItemId *int64          `db:"reverses_item_id"` // unique
+	// Quantity and UnitPrice are set on items priced from the catalog or a
+	// meter; UnitPrice is the average for tiered prices
+	Quantity  decimal.NullDecimal `db:"quantity"`
+	UnitPrice decimal.NullDecimal `db:"unit_price"`
+	// PriceId is the catalog price the item was priced with
+	PriceId   *string   `db:"price_id"`
+	CreatedAt time.Time `db:"created_at"`
 }
 
-type BillingDao struct {
-	Db *sqldb.Database
+type DbBillHistory struct {
+	Id         int64     `db:"id,pk,auto"`
+	BillId     string    `db:"bill_id"` // index
+	FromStatus Status    `db:"from_status"`
+	ToStatus   Status    `db:"to_status"`
+	Actor      string    `db:"actor"`
+	Reason     string    `db:"reason"`
+	CreatedAt  time.Time `db:"created_at"`
 }
 
+// SystemActor is recorded in the bill history for transitions driven by the
+// billing workflow rather than a user.
+const SystemActor = "system"
+
 var db = sqldb.NewDatabase("billing", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
+// InsertBill creates a bill. Creating an open bill publishes BillOpened.
 func InsertBill(ctx context.Context, id string, status Status, accountId string, currency string, periodStart, periodEnd time.Time) (string, error) {
-	const query = `
-		INSERT INTO bill (id, status, account_id, currency, period_start, period_end, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, now())
-		RETURNING id
-	`
-	err := db.QueryRow(ctx, query, id, status, accountId, currency, periodStart, periodEnd).Scan(&id)
-	return id, err
+	return InsertBillWithSubscription(ctx, id, status, accountId, currency, periodStart, periodEnd, nil)
+}
+
+// InsertBillWithSubscription is InsertBill for a bill of a recurring
+// subscription.
+func InsertBillWithSubscription(ctx context.Context, id string, status Status, accountId string, currency string, periodStart, periodEnd time.Time, subscriptionId *string) (string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO bill (id, status, account_id, currency, period_start, period_end, subscription_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+		RETURNING ` + billColumns
+	bill, err := scanBill(tx.QueryRow(ctx, query, id, status, accountId, currency, periodStart, periodEnd, subscriptionId))
+	if err != nil {
+		return "", err
+	}
+
+	if status == StatusOpen {
+		err = enqueueBillOpened(ctx, tx, bill)
+		if err != nil {
+			return "", err
+		}
+	}
+	return bill.Id, tx.Commit()
 }
 
+// InsertBillItem is idempotent on (billId, reference): inserting a reference
+// that already exists on the bill leaves the original row untouched and
+// returns its id.
 func InsertBillItem(ctx context.Context, billId string, reference, description string, amount decimal.Decimal, currency string, exchangeRate decimal.Decimal) (int64, error) {
+	return InsertTypedBillItem(ctx, billId, reference, description, ItemTypeCharge, amount, currency, exchangeRate, nil)
+}
+
+// InsertTypedBillItem is InsertBillItem for adjustments. An item can only be
+// reversed once; a second reversal of the same item fails with
+// errs.FailedPrecondition.
+//
+// Items can only be added while the bill is open or closing, so the items
+// of a closed bill match its persisted totals.
+func InsertTypedBillItem(ctx context.Context, billId string, reference, description string, itemType ItemType, amount decimal.Decimal, currency string, exchangeRate decimal.Decimal, reversesItemId *int64) (int64, error) {
+	return InsertPricedBillItem(ctx, DbBillItem{
+		BillId:         billId,
+		Reference:      reference,
+		Description:    description,
+		Type:           itemType,
+		Amount:         amount,
+		Currency:       currency,
+		ExchangeRate:   exchangeRate,
+		ReversesItemId: reversesItemId,
+	})
+}
+
+// InsertPricedBillItem is InsertTypedBillItem for an item carrying the
+// quantity and unit price it was priced with.
+func InsertPricedBillItem(ctx context.Context, item DbBillItem) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, item.BillId)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	if !acceptsItems(bill.Status) {
+		// a replayed reference still resolves to the original item
+		err = tx.QueryRow(ctx, `SELECT id FROM bill_item WHERE bill_id = $1 AND reference = $2`, item.BillId, item.Reference).Scan(&id)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return 0, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+		}
+		return id, err
+	}
+
+	id, err = insertBillItem(ctx, tx, bill, item)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// InsertBillItems inserts items on a bill in one transaction, idempotently
+// on their references, and returns them as persisted. Reversals of items
+// already reversed are skipped and their references returned in reversed, so
+// one of them does not fail the batch. A batch replayed after the bill stopped
+// accepting items returns the items it added.
+func InsertBillItems(ctx context.Context, billId string, items []DbBillItem) (added []DbBillItem, reversed []string, err error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the references reversing each item, including the batch's own
+	reversals := map[int64]string{}
+	var reversedIds []int64
+	for _, item := range items {
+		if item.ReversesItemId != nil {
+			reversedIds = append(reversedIds, *item.ReversesItemId)
+		}
+	}
+	if len(reversedIds) > 0 {
+		rows, err := tx.Query(ctx, `SELECT reverses_item_id, reference FROM bill_item WHERE reverses_item_id = ANY($1)`, reversedIds)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var reference string
+			if err := rows.Scan(&id, &reference); err != nil {
+				return nil, nil, err
+			}
+			reversals[id] = reference
+		}
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var references []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if seen[item.Reference] {
+			continue
+		}
+		seen[item.Reference] = true
+		if item.ReversesItemId != nil {
+			// a replayed reversal resolves to itself
+			if reference, ok := reversals[*item.ReversesItemId]; ok && reference != item.Reference {
+				reversed = append(reversed, item.Reference)
+				continue
+			}
+			reversals[*item.ReversesItemId] = item.Reference
+		}
+		references = append(references, item.Reference)
+		if acceptsItems(bill.Status) {
+			item.BillId = billId
+			if _, err := insertBillItem(ctx, tx, bill, item); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	rows, err := tx.Query(ctx, `SELECT `+billItemColumns+` FROM bill_item WHERE bill_id = $1 AND reference = ANY($2) ORDER BY id`, billId, references)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanBillItem(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		added = append(added, *item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(added) < len(references) {
+		return nil, nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+	return added, reversed, tx.Commit()
+}
+
+// lockBillForItems locks a bill against status changes while items are added
+// to it in tx. The lock is shared with other inserts.
+func lockBillForItems(ctx context.Context, tx *sqldb.Tx, billId string) (*DbBill, error) {
+	bill, err := scanBill(tx.QueryRow(ctx, `SELECT `+billColumns+` FROM bill WHERE id = $1 FOR SHARE`, billId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	return bill, err
+}
+
+// acceptsItems reports whether items may be persisted on a bill in status.
+// Closing bills still accept the items in flight when closing started.
+func acceptsItems(status Status) bool {
+	return status == StatusOpen || status == StatusClosing
+}
+
+// insertBillItem inserts item in tx, idempotently on its reference, and
+// publishes LineItemAdded for a new item.
+func insertBillItem(ctx context.Context, tx *sqldb.Tx, bill *DbBill, item DbBillItem) (int64, error) {
+	// xmax is only zero for a row this statement inserted, not one it
+	// updated on conflict
 	const query = `
-		INSERT INTO bill_item (bill_id, reference, description, amount, currency, exchange_rate, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, now())
-		RETURNING id
+		INSERT INTO bill_item (bill_id, reference, description, type, amount, currency, exchange_rate, reverses_item_id, quantity, unit_price, price_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, now())
+		ON CONFLICT (bill_id, reference) DO UPDATE SET reference = EXCLUDED.reference
+		RETURNING id, xmax = 0
 	`
 	var id int64
-	err := db.QueryRow(ctx, query, billId, reference, description, amount, currency, exchangeRate).Scan(&id)
+	var inserted bool
+	err := tx.QueryRow(ctx, query, item.BillId, item.Reference, item.Description, item.Type, item.Amount, item.Currency, item.ExchangeRate, item.ReversesItemId, item.Quantity, item.UnitPrice, item.PriceId).Scan(&id, &inserted)
+	if isUniqueViolation(err, "idx_bill_item_reverses_item_id") {
+		return 0, &errs.Error{Code: errs.FailedPrecondition, Message: "Line item is already reversed"}
+	}
+	if err != nil || !inserted {
+		return id, err
+	}
+
+	// account credit draws down deferred revenue already received rather
+	// than earning revenue
+	revenue := ledger.Revenue
+	if item.Type == ItemTypeAccountCredit {
+		revenue = ledger.DeferredRevenue
+	}
+	err = postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourceItem,
+		BillId:      &item.BillId,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Description: item.Description,
+		Entries:     ledger.Transfer(ledger.AccountsReceivable, revenue, item.Amount.Mul(item.ExchangeRate)),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	eventId := uuid.NewString()
+	err = enqueueEvent(ctx, tx, eventId, item.BillId, events.LineItemAddedTopic, events.LineItemAdded{
+		EventId:      eventId,
+		BillId:       item.BillId,
+		AccountId:    bill.AccountId,
+		ItemId:       id,
+		Reference:    item.Reference,
+		Description:  item.Description,
+		Type:         string(item.Type),
+		Amount:       item.Amount,
+		Currency:     item.Currency,
+		ExchangeRate: item.ExchangeRate,
+		OccurredAt:   time.Now(),
+	})
 	return id, err
 }
 
-func GetBillByID(ctx context.Context, billId string) (*DbBill, error) {
-	const query = `
-		SELECT id, status, currency, account_id, created_at
-		FROM bill
-		WHERE id = $1
-	`
+func isUniqueViolation(err error, constraint string) bool {
+	var dbErr *sqldb.Error
+	return errors.As(err, &dbErr) && dbErr.Code == sqlerr.UniqueViolation && dbErr.ConstraintName == constraint
+}
+
+const billColumns = `id, status, currency, account_id, period_start, period_end, finalized_at, due_at, created_at,
+	subscription_id, subtotal, tax_amount, discount_amount, credit_amount, total_amount, exchange_rates, amount_paid`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBill(row rowScanner) (*DbBill, error) {
 	var bill DbBill
-	err := db.QueryRow(ctx, query, billId).Scan(
+	err := row.Scan(
 		&bill.Id,
 		&bill.Status,
 		&bill.Currency,
 		&bill.AccountId,
+		&bill.PeriodStart,
+		&bill.PeriodEnd,
+		&bill.FinalizedAt,
+		&bill.DueAt,
 		&bill.CreatedAt,
+		&bill.SubscriptionId,
+		&bill.Subtotal,
+		&bill.TaxAmount,
+		&bill.DiscountAmount,
+		&bill.CreditAmount,
+		&bill.TotalAmount,
+		&bill.ExchangeRates,
+		&bill.AmountPaid,
 	)
 	if err != nil {
 		return nil, err
@@ -94,11 +388,32 @@ func GetBillByID(ctx context.Context, billId string) (*DbBill, error) {
 	return &bill, nil
 }
 
+func GetBillByID(ctx context.Context, billId string) (*DbBill, error) {
+	query := `
+		SELECT ` + billColumns + `
+		FROM bill
+		WHERE id = $1
+	`
+	return scanBill(db.QueryRow(ctx, query, billId))
+}
+
+const billItemColumns = `id, bill_id, reference, description, type, amount, currency, exchange_rate, reverses_item_id, quantity, unit_price, price_id, created_at`
+
+func scanBillItem(row rowScanner) (*DbBillItem, error) {
+	var item DbBillItem
+	err := row.Scan(&item.Id, &item.BillId, &item.Reference, &item.Description, &item.Type, &item.Amount, &item.Currency, &item.ExchangeRate, &item.ReversesItemId, &item.Quantity, &item.UnitPrice, &item.PriceId, &item.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
 func GetBillItems(ctx context.Context, billId string) ([]DbBillItem, error) {
-	const query = `
-		SELECT id, bill_id, reference, description, amount, currency, exchange_rate, created_at
+	query := `
+		SELECT ` + billItemColumns + `
 		FROM bill_item
 		WHERE bill_id = $1
+		ORDER BY id
 	`
 	rows, err := db.Query(ctx, query, billId)
 	if err != nil {
@@ -108,74 +423,262 @@ func GetBillItems(ctx context.Context, billId string) ([]DbBillItem, error) {
 
 	var items []DbBillItem
 	for rows.Next() {
-		var item DbBillItem
-		err := rows.Scan(&item.Id, &item.BillId, &item.Reference, &item.Description, &item.Amount, &item.Currency, &item.ExchangeRate, &item.CreatedAt)
+		item, err := scanBillItem(rows)
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, item)
+		items = append(items, *item)
 	}
 	return items, nil
 }
 
+func GetBillItemByReference(ctx context.Context, billId string, reference string) (*DbBillItem, error) {
+	query := `
+		SELECT ` + billItemColumns + `
+		FROM bill_item
+		WHERE bill_id = $1 AND reference = $2
+	`
+	return scanBillItem(db.QueryRow(ctx, query, billId, reference))
+}
+
+// UpdateBillStatus moves a bill to status, rejecting transitions not allowed
+// by the bill lifecycle with errs.FailedPrecondition. Setting the status a
+// bill already has is a no-op so retried calls succeed.
 func UpdateBillStatus(ctx context.Context, billId string, status Status) error {
+	return ChangeBillStatus(ctx, billId, status, SystemActor, "")
+}
+
+// ChangeBillStatus is UpdateBillStatus recording who requested the change and why.
+func ChangeBillStatus(ctx context.Context, billId string, status Status, actor, reason string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = transitionBillStatus(ctx, tx, billId, status, actor, reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionBillStatus moves the bill to status in tx, reporting whether its
+// status changed. Opening and voiding a bill publish BillOpened and
+// BillVoided; BillClosed is published by CloseBill along with the totals.
+// Voiding and reopening a bill release the account credit applied to it, and
+// voiding reverses what the bill posted to the ledger.
+func transitionBillStatus(ctx context.Context, tx *sqldb.Tx, billId string, status Status, actor, reason string) (bool, error) {
+	bill, err := scanBill(tx.QueryRow(ctx, `SELECT `+billColumns+` FROM bill WHERE id = $1 FOR UPDATE`, billId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return false, &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	if err != nil {
+		return false, err
+	}
+	current := bill.Status
+	if current == status {
+		return false, nil
+	}
+	if !current.CanTransitionTo(status) {
+		return false, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("Bill cannot move from %s to %s", current, status),
+		}
+	}
+
 	const query = `
 		UPDATE bill
 		SET status = $1
 		WHERE id = $2
 	`
-	_, err := db.Exec(ctx, query, status, billId)
-	return err
+	_, err = tx.Exec(ctx, query, status, billId)
+	if err != nil {
+		return false, err
+	}
+
+	const historyQuery = `
+		INSERT INTO bill_history (bill_id, from_status, to_status, actor, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+	`
+	_, err = tx.Exec(ctx, historyQuery, billId, current, status, actor, reason)
+	if err != nil {
+		return false, err
+	}
+
+	// a voided bill no longer draws on the account's credit, and a reopened
+	// one draws it again against its new total when it closes
+	if status == StatusVoided || current == StatusClosed && status == StatusOpen {
+		if err := releaseAccountCredit(ctx, tx, bill); err != nil {
+			return false, err
+		}
+	}
+
+	switch status {
+	case StatusOpen:
+		err = enqueueBillOpened(ctx, tx, bill)
+	case StatusVoided:
+		if err := reverseBillJournal(ctx, tx, bill); err != nil {
+			return false, err
+		}
+		eventId := uuid.NewString()
+		err = enqueueEvent(ctx, tx, eventId, bill.Id, events.BillVoidedTopic, events.BillVoided{
+			EventId:    eventId,
+			BillId:     bill.Id,
+			AccountId:  bill.AccountId,
+			Actor:      actor,
+			Reason:     reason,
+			OccurredAt: time.Now(),
+		})
+	}
+	return true, err
 }
 
-func GetBillDetailsWithTotal(ctx context.Context, billId string) (*DbBill, []DbBillItem, decimal.Decimal, error) {
-	bill, err := GetBillByID(ctx, billId)
+// ReopenBill moves a closed bill back to open with a new period end.
+func ReopenBill(ctx context.Context, billId string, periodEnd time.Time, actor, reason string) error {
+	tx, err := db.Begin(ctx)
 	if err != nil {
-		return nil, nil, decimal.Zero, err
+		return err
 	}
+	defer tx.Rollback()
 
-	lineItems, err := GetBillItems(ctx, billId)
+	// updated before the transition so BillOpened carries the new period end;
+	// the totals are recomputed when the bill closes again
+	const query = `
+		UPDATE bill
+		SET period_end = $1, subtotal = NULL, tax_amount = NULL, discount_amount = NULL, credit_amount = NULL, total_amount = NULL, exchange_rates = NULL
+		WHERE id = $2 AND status = $3
+	`
+	_, err = tx.Exec(ctx, query, periodEnd, billId, StatusClosed)
+	if err != nil {
+		return err
+	}
+
+	_, err = transitionBillStatus(ctx, tx, billId, StatusOpen, actor, reason)
 	if err != nil {
-		return nil, nil, decimal.Zero, err
+		return err
 	}
+	return tx.Commit()
+}
 
-	totalAmount := decimal.Zero
-	for _, item := range lineItems {
-		totalAmount = totalAmount.Add(item.Amount.Mul(item.ExchangeRate))
+func GetBillHistory(ctx context.Context, billId string) ([]DbBillHistory, error) {
+	const query = `
+		SELECT id, bill_id, from_status, to_status, actor, reason, created_at
+		FROM bill_history
+		WHERE bill_id = $1
+		ORDER BY id
+	`
+	rows, err := db.Query(ctx, query, billId)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return bill, lineItems, totalAmount, nil
+	var history []DbBillHistory
+	for rows.Next() {
+		var entry DbBillHistory
+		err := rows.Scan(&entry.Id, &entry.BillId, &entry.FromStatus, &entry.ToStatus, &entry.Actor, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
 }
 
-func GetBillsByAccountAndStatus(ctx context.Context, accountId string, status Status) ([]DbBill, error) {
+// FinalizeBill issues the invoice for a closed bill, payable by dueAt, and
+// numbers it in the series of numbering.
+func FinalizeBill(ctx context.Context, billId string, dueAt time.Time, numbering InvoiceNumbering, issuer string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = transitionBillStatus(ctx, tx, billId, StatusInvoiced, SystemActor, "")
+	if err != nil {
+		return err
+	}
+
 	const query = `
-		SELECT id, status, currency, account_id, period_start, period_end, created_at
+		UPDATE bill
+		SET finalized_at = COALESCE(finalized_at, now()), due_at = COALESCE(due_at, $1)
+		WHERE id = $2
+	`
+	_, err = tx.Exec(ctx, query, dueAt, billId)
+	if err != nil {
+		return err
+	}
+
+	bill, err := scanBill(tx.QueryRow(ctx, `SELECT `+billColumns+` FROM bill WHERE id = $1`, billId))
+	if err != nil {
+		return err
+	}
+	if err := issueInvoice(ctx, tx, bill, numbering, issuer); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetOverdueBillIds returns unpaid invoiced bills whose due date has passed.
+func GetOverdueBillIds(ctx context.Context, now time.Time) ([]string, error) {
+	const query = `
+		SELECT id
 		FROM bill
-		WHERE status = $1 AND account_id= $2
+		WHERE status IN ($1, $2) AND due_at < $3
 	`
-	rows, err := db.Query(ctx, query, status, accountId)
+	rows, err := db.Query(ctx, query, StatusInvoiced, StatusPartiallyPaid, now)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var bills []DbBill
+	var ids []string
 	for rows.Next() {
-		var bill DbBill
-		err := rows.Scan(
-			&bill.Id,
-			&bill.Status,
-			&bill.Currency,
-			&bill.AccountId,
-			&bill.PeriodStart,
-			&bill.PeriodEnd,
-			&bill.CreatedAt,
-		)
-		if err != nil {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		bills = append(bills, bill)
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetBillDetailsWithTotal returns the bill, its items and its totals. The
+// totals persisted when the bill closed are returned as is; those of an open
+// bill are summed from its current items.
+func GetBillDetailsWithTotal(ctx context.Context, billId string) (*DbBill, []DbBillItem, *BillTotals, error) {
+	bill, err := GetBillByID(ctx, billId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lineItems, err := GetBillItems(ctx, billId)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return bills, nil
+	taxLines, err := GetBillTaxLines(ctx, billId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if bill.TotalAmount.Valid {
+		discounts, err := GetBillDiscounts(ctx, billId)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return bill, lineItems, &BillTotals{
+			Subtotal:       bill.Subtotal.Decimal,
+			TaxAmount:      bill.TaxAmount.Decimal,
+			DiscountAmount: bill.DiscountAmount.Decimal,
+			CreditAmount:   bill.CreditAmount.Decimal,
+			TotalAmount:    bill.TotalAmount.Decimal,
+			ExchangeRates:  bill.ExchangeRates,
+			Taxes:          TaxesByJurisdiction(taxLines),
+			Discounts:      discounts,
+		}, nil
+	}
+	totals := NewBillTotals(bill.Currency, lineItems, taxLines, nil)
+	return bill, lineItems, &totals, nil
 }
@@ -6,6 +6,9 @@ import (
 	"time"
 
 	"encore.app/billing/db"
+	"encore.app/billing/discount"
+	"encore.app/billing/ledger"
+	"encore.app/billing/pricing"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 )
@@ -58,6 +61,104 @@ func TestInsertBillItemAndRetrieve(t *testing.T) {
 	require.Equal(t, rate.Round(10), item.ExchangeRate.Round(10), "exchange rate should match")
 }
 
+func TestInsertBillItemIdempotentOnReference(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	periodEnd := periodStart.Add(24 * time.Hour)
+	billID, err := db.InsertBill(ctx, "bill3", db.StatusOpen, "account789", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+
+	// Insert the same reference twice, as a retried activity would
+	rate := decimal.NewFromInt(1)
+	firstID, err := db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.NewFromInt(10), "USD", rate)
+	require.NoError(t, err, "failed to insert bill item")
+	secondID, err := db.InsertBillItem(ctx, billID, "REF001", "Usage retried", decimal.NewFromInt(20), "USD", rate)
+	require.NoError(t, err, "failed to insert duplicate bill item")
+	require.Equal(t, firstID, secondID, "duplicate reference should return the original item ID")
+
+	// Only the original item is kept
+	items, err := db.GetBillItems(ctx, billID)
+	require.NoError(t, err, "failed to get bill items")
+	require.Len(t, items, 1, "there should be one bill item")
+	require.Equal(t, "Usage", items[0].Description, "original item should be kept")
+
+	item, err := db.GetBillItemByReference(ctx, billID, "REF001")
+	require.NoError(t, err, "failed to get bill item by reference")
+	require.Equal(t, firstID, item.Id, "item ID should match")
+}
+
+func TestInsertBillItemsBatch(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	periodEnd := periodStart.Add(24 * time.Hour)
+	billID, err := db.InsertBill(ctx, "bill-batch", db.StatusOpen, "accountBatch", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+
+	rate := decimal.NewFromInt(1)
+	firstID, err := db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.NewFromInt(10), "USD", rate)
+	require.NoError(t, err, "failed to insert bill item")
+
+	// REF001 is already on the bill, REF002 is repeated in the batch and
+	// REF005 reverses the item REF004 reverses
+	batch := []db.DbBillItem{
+		{Reference: "REF001", Description: "Usage again", Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(99), Currency: "USD", ExchangeRate: rate},
+		{Reference: "REF002", Description: "Seats", Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(20), Currency: "USD", ExchangeRate: rate},
+		{Reference: "REF002", Description: "Seats", Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(20), Currency: "USD", ExchangeRate: rate},
+		{Reference: "REF003", Description: "Storage", Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(5), Currency: "USD", ExchangeRate: rate},
+		{Reference: "REF004", Description: "Usage reversed", Type: db.ItemTypeReversal, Amount: decimal.NewFromInt(-10), Currency: "USD", ExchangeRate: rate, ReversesItemId: &firstID},
+		{Reference: "REF005", Description: "Usage reversed", Type: db.ItemTypeReversal, Amount: decimal.NewFromInt(-10), Currency: "USD", ExchangeRate: rate, ReversesItemId: &firstID},
+	}
+	items, reversed, err := db.InsertBillItems(ctx, billID, batch)
+	require.NoError(t, err, "failed to insert bill items")
+	require.Len(t, items, 4, "each reference should be returned once")
+	require.Equal(t, []string{"REF005"}, reversed, "an item is only reversed once")
+
+	all, err := db.GetBillItems(ctx, billID)
+	require.NoError(t, err, "failed to get bill items")
+	require.Len(t, all, 4, "there should be four bill items")
+	require.Equal(t, "Usage", all[0].Description, "original item should be kept")
+
+	// replaying the batch returns the same items
+	items, reversed, err = db.InsertBillItems(ctx, billID, batch)
+	require.NoError(t, err, "failed to replay bill items")
+	require.Len(t, items, 4)
+	require.Equal(t, []string{"REF005"}, reversed)
+}
+
+func TestReversalAndCreditTotals(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	periodEnd := periodStart.Add(24 * time.Hour)
+	billID, err := db.InsertBill(ctx, "bill5", db.StatusOpen, "account321", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+
+	rate := decimal.NewFromInt(1)
+	chargeID, err := db.InsertBillItem(ctx, billID, "REF001", "Wrong charge", decimal.NewFromInt(100), "USD", rate)
+	require.NoError(t, err, "failed to insert charge")
+	_, err = db.InsertBillItem(ctx, billID, "REF002", "Usage", decimal.NewFromInt(40), "USD", rate)
+	require.NoError(t, err, "failed to insert charge")
+
+	// Reverse the wrong charge and add a credit
+	_, err = db.InsertTypedBillItem(ctx, billID, "reversal:1", "Wrong charge", db.ItemTypeReversal, decimal.NewFromInt(-100), "USD", rate, &chargeID)
+	require.NoError(t, err, "failed to insert reversal")
+	_, err = db.InsertTypedBillItem(ctx, billID, "CREDIT001", "Goodwill", db.ItemTypeCredit, decimal.NewFromInt(-15), "USD", rate, nil)
+	require.NoError(t, err, "failed to insert credit")
+
+	// A second reversal of the same item is rejected
+	_, err = db.InsertTypedBillItem(ctx, billID, "reversal:again", "Wrong charge", db.ItemTypeReversal, decimal.NewFromInt(-100), "USD", rate, &chargeID)
+	require.Error(t, err, "item should not be reversed twice")
+
+	_, items, total, err := db.GetBillDetailsWithTotal(ctx, billID)
+	require.NoError(t, err, "failed to get bill details")
+	require.Len(t, items, 4, "there should be four bill items")
+	require.Equal(t, db.ItemTypeReversal, items[2].Type, "reversal type should be stored")
+	require.Equal(t, chargeID, *items[2].ReversesItemId, "reversal should link to the original item")
+	require.True(t, decimal.NewFromInt(25).Equal(total.TotalAmount), "total should include reversal and credit")
+}
+
 func TestUpdateBillStatus(t *testing.T) {
 	ctx := context.Background()
 
@@ -67,7 +168,13 @@ func TestUpdateBillStatus(t *testing.T) {
 	billID, err := db.InsertBill(ctx, "bill4", db.StatusOpen, "account999", "USD", periodStart, periodEnd)
 	require.NoError(t, err, "failed to insert bill")
 
+	// Closing an open bill directly skips the closing step
+	err = db.UpdateBillStatus(ctx, billID, db.StatusClosed)
+	require.Error(t, err, "open bill should not close without closing first")
+
 	// Update the bill status to 'closed'
+	err = db.UpdateBillStatus(ctx, billID, db.StatusClosing)
+	require.NoError(t, err, "failed to update bill status to closing")
 	err = db.UpdateBillStatus(ctx, billID, db.StatusClosed)
 	require.NoError(t, err, "failed to update bill status")
 
@@ -76,3 +183,585 @@ func TestUpdateBillStatus(t *testing.T) {
 	require.NoError(t, err, "failed to get updated bill")
 	require.Equal(t, db.StatusClosed, bill.Status, "bill status should be 'closed'")
 }
+
+func TestGetExchangeRateEffectiveDated(t *testing.T) {
+	ctx := context.Background()
+
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	_, err := db.InsertExchangeRate(ctx, "GBP", "USD", decimal.RequireFromString("1.27"), jan)
+	require.NoError(t, err, "failed to insert exchange rate")
+	_, err = db.InsertExchangeRate(ctx, "GBP", "USD", decimal.RequireFromString("1.26"), feb)
+	require.NoError(t, err, "failed to insert exchange rate")
+
+	rate, err := db.GetExchangeRate(ctx, "GBP", "USD", jan.Add(24*time.Hour))
+	require.NoError(t, err, "failed to get exchange rate")
+	require.True(t, decimal.RequireFromString("1.27").Equal(rate), "january rate should apply")
+
+	rate, err = db.GetExchangeRate(ctx, "GBP", "USD", feb.Add(24*time.Hour))
+	require.NoError(t, err, "failed to get exchange rate")
+	require.True(t, decimal.RequireFromString("1.26").Equal(rate), "february rate should apply")
+}
+
+func TestCloseBillPersistsTotals(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	periodEnd := periodStart.Add(24 * time.Hour)
+	billID, err := db.InsertBill(ctx, "bill6", db.StatusOpen, "account654", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.RequireFromString("10.005"), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err, "failed to insert bill item")
+	_, err = db.InsertBillItem(ctx, billID, "REF002", "Usage", decimal.NewFromInt(20), "EUR", decimal.RequireFromString("1.1"))
+	require.NoError(t, err, "failed to insert bill item")
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	totals, err := db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err, "failed to close bill")
+	require.True(t, decimal.RequireFromString("32.01").Equal(totals.TotalAmount), "total is %s", totals.TotalAmount)
+
+	bill, err := db.GetBillByID(ctx, billID)
+	require.NoError(t, err, "failed to get bill")
+	require.Equal(t, db.StatusClosed, bill.Status)
+	require.True(t, bill.TotalAmount.Valid, "total should be persisted")
+	require.True(t, totals.TotalAmount.Equal(bill.TotalAmount.Decimal))
+	require.Len(t, bill.ExchangeRates, 1)
+	require.Equal(t, "EUR", bill.ExchangeRates[0].Currency)
+
+	// closed bills are immutable, but replays still resolve
+	_, err = db.InsertBillItem(ctx, billID, "REF003", "Late usage", decimal.NewFromInt(5), "USD", decimal.NewFromInt(1))
+	require.Error(t, err, "items cannot be added to a closed bill")
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.RequireFromString("10.005"), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err, "replayed reference should resolve to the original item")
+}
+
+func TestClosedBillKeepsItsTaxLines(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now().Add(-time.Hour)
+	billID, err := db.InsertBill(ctx, "tax-guard-bill", db.StatusOpen, "accountTaxGuard", "USD", periodStart, periodStart.Add(2*time.Hour))
+	require.NoError(t, err, "failed to insert bill")
+	itemID, err := db.InsertBillItem(ctx, billID, "REF001", "Consulting", decimal.NewFromInt(100), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err, "failed to insert bill item")
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	closeLines := []db.DbTaxLine{{ItemId: itemID, Jurisdiction: "US-NY", Rate: decimal.RequireFromString("0.08"), TaxableAmount: decimal.NewFromInt(100), Amount: decimal.NewFromInt(8)}}
+	_, err = db.CloseBill(ctx, billID, closeLines, nil)
+	require.NoError(t, err, "failed to close bill")
+
+	// running tax calculated before the bill closed arrives late
+	runningLines := []db.DbTaxLine{{ItemId: itemID, Jurisdiction: "US-NY", Rate: decimal.RequireFromString("0.04"), TaxableAmount: decimal.NewFromInt(100), Amount: decimal.NewFromInt(4)}}
+	require.NoError(t, db.ReplaceItemTaxLines(ctx, billID, []int64{itemID}, runningLines))
+
+	lines, err := db.GetBillTaxLines(ctx, billID)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.True(t, decimal.NewFromInt(8).Equal(lines[0].Amount), "tax lines of a closed bill should not be replaced")
+}
+
+func TestUsageIsBilledOnce(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := db.InsertMeter(ctx, "api_calls", "API calls", "sum", decimal.RequireFromString("0.01"), "USD")
+	require.NoError(t, err, "failed to insert meter")
+
+	periodStart := time.Now().Add(-time.Hour)
+	periodEnd := periodStart.Add(2 * time.Hour)
+	billID, err := db.InsertBill(ctx, "usage-bill", db.StatusOpen, "accountUsage", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+	bill, err := db.GetBillByID(ctx, billID)
+	require.NoError(t, err)
+
+	inserted, err := db.InsertUsageEvent(ctx, "accountUsage", nil, "api_calls", decimal.NewFromInt(100), "", time.Now(), "evt-1")
+	require.NoError(t, err, "failed to insert usage")
+	require.True(t, inserted)
+	inserted, err = db.InsertUsageEvent(ctx, "accountUsage", nil, "api_calls", decimal.NewFromInt(100), "", time.Now(), "evt-1")
+	require.NoError(t, err, "failed to insert duplicate usage")
+	require.False(t, inserted, "duplicate idempotency key should be ignored")
+
+	usage, err := db.GetUnbilledUsage(ctx, bill)
+	require.NoError(t, err, "failed to get usage")
+	require.Len(t, usage, 1)
+
+	item := db.DbBillItem{Reference: "usage:api_calls:1", Type: db.ItemTypeUsage, Amount: decimal.NewFromInt(1), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)}
+	require.NoError(t, db.InsertUsageItems(ctx, billID, []db.DbBillItem{item}, []int64{usage[0].Id}))
+
+	usage, err = db.GetUnbilledUsage(ctx, bill)
+	require.NoError(t, err, "failed to get usage")
+	require.Empty(t, usage, "billed usage should not be billed again")
+
+	item.Reference = "usage:api_calls:retry"
+	err = db.InsertUsageItems(ctx, billID, []db.DbBillItem{item}, []int64{usage[0].Id})
+	require.ErrorIs(t, err, db.ErrUsageBilled, "usage billed concurrently should be reported")
+}
+
+func TestUsageIsScopedToSubscription(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := db.InsertMeter(ctx, "storage", "Storage", "max", decimal.NewFromInt(1), "USD")
+	require.NoError(t, err, "failed to insert meter")
+	sub, err := db.InsertSubscription(ctx, "sub-usage", "accountScoped", "USD", "monthly", 0, time.Now(), "UTC")
+	require.NoError(t, err, "failed to insert subscription")
+
+	periodStart := time.Now().Add(-time.Hour)
+	periodEnd := periodStart.Add(2 * time.Hour)
+	subBillID, err := db.InsertBillWithSubscription(ctx, "usage-sub-bill", db.StatusOpen, "accountScoped", "USD", periodStart, periodEnd, &sub.Id)
+	require.NoError(t, err)
+	subBill, err := db.GetBillByID(ctx, subBillID)
+	require.NoError(t, err)
+	oneOffID, err := db.InsertBill(ctx, "usage-one-off-bill", db.StatusOpen, "accountScoped", "EUR", periodStart, periodEnd)
+	require.NoError(t, err)
+	oneOff, err := db.GetBillByID(ctx, oneOffID)
+	require.NoError(t, err)
+
+	_, err = db.InsertUsageEvent(ctx, "accountScoped", &sub.Id, "storage", decimal.NewFromInt(5), "", time.Now(), "evt-sub")
+	require.NoError(t, err)
+	_, err = db.InsertUsageEvent(ctx, "accountScoped", nil, "storage", decimal.NewFromInt(7), "", time.Now(), "evt-one-off")
+	require.NoError(t, err)
+
+	usage, err := db.GetUnbilledUsage(ctx, subBill)
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	require.Equal(t, "evt-sub", usage[0].IdempotencyKey, "subscription bills should only bill their subscription's usage")
+
+	usage, err = db.GetUnbilledUsage(ctx, oneOff)
+	require.NoError(t, err)
+	require.Len(t, usage, 1)
+	require.Equal(t, "evt-one-off", usage[0].IdempotencyKey, "other bills should only bill usage outside subscriptions")
+}
+
+func TestLateUsageKeepsItsPeriod(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := db.InsertMeter(ctx, "seats", "Seats", "max", decimal.NewFromInt(10), "USD")
+	require.NoError(t, err, "failed to insert meter")
+
+	periodStart := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	nextPeriodStart := periodStart.Add(24 * time.Hour)
+	_, err = db.InsertBill(ctx, "late-usage-closed", db.StatusClosed, "accountLate", "USD", periodStart, nextPeriodStart)
+	require.NoError(t, err)
+	usdID, err := db.InsertBill(ctx, "late-usage-usd", db.StatusOpen, "accountLate", "USD", nextPeriodStart, nextPeriodStart.Add(48*time.Hour))
+	require.NoError(t, err)
+	usd, err := db.GetBillByID(ctx, usdID)
+	require.NoError(t, err)
+	eurID, err := db.InsertBill(ctx, "late-usage-eur", db.StatusOpen, "accountLate", "EUR", nextPeriodStart.Add(time.Hour), nextPeriodStart.Add(48*time.Hour))
+	require.NoError(t, err)
+	eur, err := db.GetBillByID(ctx, eurID)
+	require.NoError(t, err)
+
+	_, err = db.InsertUsageEvent(ctx, "accountLate", nil, "seats", decimal.NewFromInt(8), "", periodStart.Add(time.Minute), "evt-late")
+	require.NoError(t, err)
+	_, err = db.InsertUsageEvent(ctx, "accountLate", nil, "seats", decimal.NewFromInt(3), "", nextPeriodStart.Add(time.Minute), "evt-current")
+	require.NoError(t, err)
+
+	usage, err := db.GetUnbilledUsage(ctx, usd)
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+	require.Equal(t, "evt-late", usage[0].IdempotencyKey)
+	require.True(t, periodStart.Equal(usage[0].PeriodStart), "late usage should keep the period it happened in")
+	require.True(t, nextPeriodStart.Equal(usage[1].PeriodStart))
+
+	usage, err = db.GetUnbilledUsage(ctx, eur)
+	require.NoError(t, err)
+	require.Empty(t, usage, "a bill in another currency should not take the usage of other bills")
+}
+
+func TestPricedBillItem(t *testing.T) {
+	ctx := context.Background()
+
+	product, err := db.InsertProduct(ctx, "product-api", "API calls", "")
+	require.NoError(t, err)
+	upTo := decimal.NewFromInt(1000)
+	price, err := db.InsertPrice(ctx, "price-api", product.Id, "USD", pricing.Price{
+		Model: pricing.Graduated,
+		Tiers: []pricing.Tier{
+			{UpTo: &upTo, UnitAmount: decimal.RequireFromString("0.01")},
+			{UnitAmount: decimal.RequireFromString("0.005")},
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, price.Active)
+
+	stored, err := db.GetPrice(ctx, price.Id)
+	require.NoError(t, err)
+	require.Len(t, stored.Tiers, 2)
+	require.Nil(t, stored.Tiers[1].UpTo)
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-priced", db.StatusOpen, "account-priced", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+
+	quantity := decimal.NewFromInt(3000)
+	amount, err := stored.Pricing().Amount(quantity)
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(20).Equal(amount))
+
+	_, err = db.InsertPricedBillItem(ctx, db.DbBillItem{
+		BillId:       billID,
+		Reference:    "api-calls",
+		Description:  product.Name,
+		Type:         db.ItemTypeCharge,
+		Amount:       amount,
+		Currency:     "USD",
+		ExchangeRate: decimal.NewFromInt(1),
+		Quantity:     decimal.NewNullDecimal(quantity),
+		UnitPrice:    decimal.NewNullDecimal(amount.Div(quantity)),
+		PriceId:      &price.Id,
+	})
+	require.NoError(t, err)
+
+	item, err := db.GetBillItemByReference(ctx, billID, "api-calls")
+	require.NoError(t, err)
+	require.Equal(t, price.Id, *item.PriceId)
+	require.True(t, quantity.Equal(item.Quantity.Decimal))
+	require.True(t, amount.Equal(item.Amount))
+
+	archived, err := db.ArchivePrice(ctx, price.Id)
+	require.NoError(t, err)
+	require.False(t, archived.Active)
+}
+
+func TestRedeemCoupon(t *testing.T) {
+	ctx := context.Background()
+
+	maxRedemptions := 1
+	_, err := db.InsertCoupon(ctx, "Q1PROMO", "Q1 promo", discount.Coupon{
+		Type:       discount.Percent,
+		PercentOff: decimal.NewFromInt(10),
+		Duration:   discount.Once,
+	}, &maxRedemptions)
+	require.NoError(t, err)
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-coupon", db.StatusOpen, "account-coupon", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Seats", decimal.NewFromInt(200), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+
+	redemption, err := db.RedeemCoupon(ctx, billID, "Q1PROMO")
+	require.NoError(t, err)
+	require.Equal(t, "account-coupon", redemption.AccountId)
+
+	// the only redemption is used up
+	otherID, err := db.InsertBill(ctx, "bill-coupon-other", db.StatusOpen, "account-other", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, err = db.RedeemCoupon(ctx, otherID, "Q1PROMO")
+	require.Error(t, err)
+
+	active, err := db.GetActiveRedemptions(ctx, billID)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	totals, err := db.CloseBill(ctx, billID, nil, []db.DbBillDiscount{{
+		RedemptionId: redemption.Id,
+		CouponCode:   "Q1PROMO",
+		Description:  "Q1 promo",
+		Amount:       decimal.NewFromInt(20),
+	}})
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(180).Equal(totals.TotalAmount))
+
+	// a once coupon does not discount the account's next bill
+	nextID, err := db.InsertBill(ctx, "bill-coupon-next", db.StatusOpen, "account-coupon", "USD", periodStart.Add(24*time.Hour), periodStart.Add(48*time.Hour))
+	require.NoError(t, err)
+	active, err = db.GetActiveRedemptions(ctx, nextID)
+	require.NoError(t, err)
+	require.Empty(t, active)
+}
+
+func TestRedemptionsWithBillsClosingOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := db.InsertCoupon(ctx, "WELCOME", "Welcome", discount.Coupon{
+		Type:       discount.Percent,
+		PercentOff: decimal.NewFromInt(10),
+		Duration:   discount.Once,
+	}, nil)
+	require.NoError(t, err)
+	_, err = db.InsertCoupon(ctx, "TWOBILLS", "Two bills", discount.Coupon{
+		Type:            discount.Percent,
+		PercentOff:      decimal.NewFromInt(5),
+		Duration:        discount.Repeating,
+		DurationInBills: 2,
+	}, nil)
+	require.NoError(t, err)
+
+	periodStart := time.Now()
+	firstID, err := db.InsertBill(ctx, "bill-order-first", db.StatusOpen, "account-order", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	welcome, err := db.RedeemCoupon(ctx, firstID, "WELCOME")
+	require.NoError(t, err)
+	twoBills, err := db.RedeemCoupon(ctx, firstID, "TWOBILLS")
+	require.NoError(t, err)
+	secondID, err := db.InsertBill(ctx, "bill-order-second", db.StatusOpen, "account-order", "USD", periodStart.Add(24*time.Hour), periodStart.Add(48*time.Hour))
+	require.NoError(t, err)
+	thirdID, err := db.InsertBill(ctx, "bill-order-third", db.StatusOpen, "account-order", "USD", periodStart.Add(48*time.Hour), periodStart.Add(72*time.Hour))
+	require.NoError(t, err)
+
+	// the later bill closes first and only takes the repeating coupon
+	active, err := db.GetActiveRedemptions(ctx, secondID)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	require.Equal(t, twoBills.Id, active[0].Redemption.Id)
+	require.NoError(t, db.UpdateBillStatus(ctx, secondID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, secondID, nil, []db.DbBillDiscount{{RedemptionId: twoBills.Id, CouponCode: "TWOBILLS", Description: "Two bills", Amount: decimal.Zero}})
+	require.NoError(t, err)
+
+	active, err = db.GetActiveRedemptions(ctx, firstID)
+	require.NoError(t, err)
+	require.Len(t, active, 2, "the once coupon should still discount the bill it was applied to")
+	require.Equal(t, welcome.Id, active[0].Redemption.Id)
+
+	// the repeating coupon's bills are used up until one of them is voided
+	require.NoError(t, db.UpdateBillStatus(ctx, firstID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, firstID, nil, []db.DbBillDiscount{{RedemptionId: twoBills.Id, CouponCode: "TWOBILLS", Description: "Two bills", Amount: decimal.Zero}})
+	require.NoError(t, err)
+	active, err = db.GetActiveRedemptions(ctx, thirdID)
+	require.NoError(t, err)
+	require.Empty(t, active)
+
+	require.NoError(t, db.ChangeBillStatus(ctx, secondID, db.StatusVoided, "admin", "duplicate"))
+	active, err = db.GetActiveRedemptions(ctx, thirdID)
+	require.NoError(t, err)
+	require.Len(t, active, 1, "discounts of voided bills should not count")
+}
+
+func TestRecordPayment(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-payment", db.StatusOpen, "account-payment", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Seats", decimal.NewFromInt(100), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err)
+
+	payment := func(reference string, amount int64) db.DbPayment {
+		return db.DbPayment{
+			BillId:       billID,
+			Amount:       decimal.NewFromInt(amount),
+			Currency:     "USD",
+			ExchangeRate: decimal.NewFromInt(1),
+			Method:       db.PaymentMethodCard,
+			Reference:    reference,
+		}
+	}
+
+	// bills are paid once invoiced
+	_, err = db.RecordPayment(ctx, payment("ch_1", 40))
+	require.Error(t, err)
+	require.NoError(t, db.FinalizeBill(ctx, billID, time.Now().Add(24*time.Hour), db.NumberingGlobal, "Acme Inc"))
+
+	result, err := db.RecordPayment(ctx, payment("ch_1", 40))
+	require.NoError(t, err)
+	require.Equal(t, db.StatusPartiallyPaid, result.Bill.Status)
+	require.True(t, decimal.NewFromInt(60).Equal(result.Bill.AmountDue()))
+
+	// replaying a reference does not pay twice
+	result, err = db.RecordPayment(ctx, payment("ch_1", 40))
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(40).Equal(result.Bill.AmountPaid))
+
+	// the over-payment is credited to the account
+	result, err = db.RecordPayment(ctx, payment("ch_2", 75))
+	require.NoError(t, err)
+	require.Equal(t, db.StatusPaid, result.Bill.Status)
+	require.True(t, decimal.NewFromInt(60).Equal(result.Payment.AppliedAmount))
+	require.NotNil(t, result.Credit)
+	balance, err := db.GetCreditBalance(ctx, "account-payment", "USD")
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(15).Equal(balance))
+
+	// refunds reopen the balance but cannot exceed the amount paid
+	result, err = db.RecordPayment(ctx, payment("re_1", -30))
+	require.NoError(t, err)
+	require.Equal(t, db.StatusPartiallyPaid, result.Bill.Status)
+	_, err = db.RecordPayment(ctx, payment("re_2", -100))
+	require.Error(t, err)
+}
+
+func TestApplyAccountCredit(t *testing.T) {
+	ctx := context.Background()
+
+	soon := time.Now().Add(time.Hour)
+	_, err := db.GrantCredit(ctx, "account-credit", "USD", decimal.NewFromInt(50), "Prepaid", nil)
+	require.NoError(t, err)
+	_, err = db.GrantCredit(ctx, "account-credit", "USD", decimal.NewFromInt(20), "Promo", &soon)
+	require.NoError(t, err)
+	_, err = db.GrantCredit(ctx, "account-credit", "EUR", decimal.NewFromInt(100), "Other currency", nil)
+	require.NoError(t, err)
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-credit", db.StatusOpen, "account-credit", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Seats", decimal.NewFromInt(30), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+
+	item, err := db.ApplyAccountCredit(ctx, billID, decimal.NewFromInt(30))
+	require.NoError(t, err)
+	require.Equal(t, db.ItemTypeAccountCredit, item.Type)
+	require.True(t, decimal.NewFromInt(-30).Equal(item.Amount))
+
+	// applying again returns the same item without drawing more credit
+	again, err := db.ApplyAccountCredit(ctx, billID, decimal.NewFromInt(30))
+	require.NoError(t, err)
+	require.Equal(t, item.Id, again.Id)
+
+	// the expiring promo is drawn first
+	balance, err := db.GetCreditBalance(ctx, "account-credit", "USD")
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(40).Equal(balance), "balance is %s", balance)
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	totals, err := db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err)
+	require.True(t, totals.TotalAmount.IsZero())
+
+	entries, err := db.GetCreditEntries(ctx, "account-credit", 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 5, "three grants and two consumptions")
+
+	// reopening releases the credit, which is drawn again against the
+	// new total when the bill closes
+	require.NoError(t, db.ReopenBill(ctx, billID, time.Now().Add(48*time.Hour), "ops@example.com", "closed early"))
+	balance, err = db.GetCreditBalance(ctx, "account-credit", "USD")
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(70).Equal(balance), "balance is %s", balance)
+
+	_, err = db.InsertTypedBillItem(ctx, billID, "REF002", "Seat removed", db.ItemTypeCredit, decimal.NewFromInt(-20), "USD", decimal.NewFromInt(1), nil)
+	require.NoError(t, err)
+	reapplied, err := db.ApplyAccountCredit(ctx, billID, decimal.NewFromInt(10))
+	require.NoError(t, err)
+	require.NotEqual(t, item.Id, reapplied.Id)
+	require.True(t, decimal.NewFromInt(-10).Equal(reapplied.Amount))
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	totals, err = db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err)
+	require.True(t, totals.TotalAmount.IsZero(), "total is %s", totals.TotalAmount)
+	require.True(t, decimal.NewFromInt(10).Equal(totals.CreditAmount))
+
+	// voiding returns the credit to the account
+	require.NoError(t, db.ChangeBillStatus(ctx, billID, db.StatusVoided, "ops@example.com", "duplicate"))
+	balance, err = db.GetCreditBalance(ctx, "account-credit", "USD")
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(70).Equal(balance), "balance is %s", balance)
+}
+
+func TestBillJournal(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-journal", db.StatusOpen, "account-journal", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	itemID, err := db.InsertBillItem(ctx, billID, "REF001", "Seats", decimal.NewFromInt(100), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	taxLines := []db.DbTaxLine{{ItemId: itemID, Jurisdiction: "US-NY", Rate: decimal.RequireFromString("0.08"), TaxableAmount: decimal.NewFromInt(100), Amount: decimal.NewFromInt(8)}}
+	_, err = db.CloseBill(ctx, billID, taxLines, nil)
+	require.NoError(t, err)
+
+	// closing again posts nothing more
+	_, err = db.CloseBill(ctx, billID, taxLines, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, db.FinalizeBill(ctx, billID, time.Now().Add(24*time.Hour), db.NumberingGlobal, "Acme Inc"))
+	_, err = db.RecordPayment(ctx, db.DbPayment{
+		BillId:       billID,
+		Amount:       decimal.NewFromInt(108),
+		Currency:     "USD",
+		ExchangeRate: decimal.NewFromInt(1),
+		Method:       db.PaymentMethodCard,
+		Reference:    "ch_journal",
+	})
+	require.NoError(t, err)
+
+	entries, err := db.GetBillJournal(ctx, billID)
+	require.NoError(t, err)
+	balances := make(map[ledger.Account]decimal.Decimal)
+	var debits, credits decimal.Decimal
+	for _, e := range entries {
+		balances[e.LedgerAccount] = balances[e.LedgerAccount].Add(e.Debit).Sub(e.Credit)
+		debits, credits = debits.Add(e.Debit), credits.Add(e.Credit)
+	}
+	require.True(t, debits.Equal(credits))
+	require.True(t, balances[ledger.AccountsReceivable].IsZero())
+	require.True(t, decimal.NewFromInt(-100).Equal(balances[ledger.Revenue]))
+	require.True(t, decimal.NewFromInt(-8).Equal(balances[ledger.TaxPayable]))
+	require.True(t, decimal.NewFromInt(108).Equal(balances[ledger.Cash]))
+
+	unbalanced, err := db.GetUnbalancedTransactions(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, unbalanced)
+}
+
+func TestVoidReversesBillJournal(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "bill-void-journal", db.StatusOpen, "account-void-journal", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err)
+	itemID, err := db.InsertBillItem(ctx, billID, "REF001", "Seats", decimal.NewFromInt(100), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err)
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	taxLines := []db.DbTaxLine{{ItemId: itemID, Jurisdiction: "US-NY", Rate: decimal.RequireFromString("0.08"), TaxableAmount: decimal.NewFromInt(100), Amount: decimal.NewFromInt(8)}}
+	_, err = db.CloseBill(ctx, billID, taxLines, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, db.ChangeBillStatus(ctx, billID, db.StatusVoided, "ops@example.com", "duplicate"))
+
+	entries, err := db.GetBillJournal(ctx, billID)
+	require.NoError(t, err)
+	balances := make(map[ledger.Account]decimal.Decimal)
+	for _, e := range entries {
+		balances[e.LedgerAccount] = balances[e.LedgerAccount].Add(e.Debit).Sub(e.Credit)
+	}
+	for account, balance := range balances {
+		require.True(t, balance.IsZero(), "%s balance is %s", account, balance)
+	}
+	require.Equal(t, ledger.SourceVoid, entries[len(entries)-1].Source)
+}
+
+func TestInvoiceNumbering(t *testing.T) {
+	ctx := context.Background()
+
+	finalize := func(billID string) *db.DbInvoice {
+		periodStart := time.Now()
+		_, err := db.InsertBill(ctx, billID, db.StatusOpen, "account-invoice", "USD", periodStart, periodStart.Add(24*time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+		_, err = db.CloseBill(ctx, billID, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, db.FinalizeBill(ctx, billID, time.Now().Add(24*time.Hour), db.NumberingAccount, "Acme Inc"))
+		inv, err := db.GetInvoice(ctx, billID)
+		require.NoError(t, err)
+		return inv
+	}
+
+	first := finalize("bill-invoice-1")
+	require.Equal(t, "account-invoice-000001", first.Number)
+	require.Nil(t, first.RenderedAt)
+	require.NotNil(t, first.Content)
+	require.Equal(t, "Acme Inc", first.Content.Issuer)
+	require.Equal(t, db.StatusInvoiced, first.Content.Bill.Status)
+	require.NotNil(t, first.Content.Bill.DueAt)
+
+	// finalizing again keeps the number
+	require.NoError(t, db.FinalizeBill(ctx, "bill-invoice-1", time.Now(), db.NumberingAccount, "Acme Inc"))
+	again, err := db.GetInvoice(ctx, "bill-invoice-1")
+	require.NoError(t, err)
+	require.Equal(t, first.Number, again.Number)
+
+	second := finalize("bill-invoice-2")
+	require.Equal(t, "account-invoice-000002", second.Number)
+
+	require.NoError(t, db.SaveInvoiceDocuments(ctx, "bill-invoice-2", []byte("<html></html>"), []byte("%PDF-1.4")))
+	second, err = db.GetInvoice(ctx, "bill-invoice-2")
+	require.NoError(t, err)
+	require.NotNil(t, second.RenderedAt)
+	require.Equal(t, []byte("%PDF-1.4"), second.PDF)
+}
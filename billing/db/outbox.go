@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"encore.app/billing/events"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+)
+
+type DbOutboxEvent struct {
+	Id          int64      `db:"id,pk,auto"`
+	EventId     string     `db:"event_id"` // unique
+	Topic       string     `db:"topic"`
+	BillId      string     `db:"bill_id"`
+	Payload     []byte     `db:"payload"`
+	CreatedAt   time.Time  `db:"created_at"`
+	PublishedAt *time.Time `db:"published_at"` // index
+	// Attempts and LastError record failed publications; ParkedAt is set
+	// once the event is no longer retried
+	Attempts  int        `db:"attempts"`
+	LastError *string    `db:"last_error"`
+	ParkedAt  *time.Time `db:"parked_at"`
+}
+
+// enqueueEvent writes an event of a bill to the outbox in tx, so it is
+// published if and only if tx commits.
+func enqueueEvent(ctx context.Context, tx *sqldb.Tx, eventId, billId, topic string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	const query = `
+		INSERT INTO outbox (event_id, bill_id, topic, payload, created_at)
+		VALUES ($1, $2, $3, $4, now())
+	`
+	_, err = tx.Exec(ctx, query, eventId, billId, topic, string(payload))
+	return err
+}
+
+func enqueueBillOpened(ctx context.Context, tx *sqldb.Tx, bill *DbBill) error {
+	eventId := uuid.NewString()
+	return enqueueEvent(ctx, tx, eventId, bill.Id, events.BillOpenedTopic, events.BillOpened{
+		EventId:     eventId,
+		BillId:      bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		PeriodStart: bill.PeriodStart,
+		PeriodEnd:   bill.PeriodEnd,
+		OccurredAt:  time.Now(),
+	})
+}
+
+const (
+	// outboxLease is how long claimed events are hidden from other relays
+	// while they are published
+	outboxLease = 5 * time.Minute
+	// maxOutboxAttempts is the number of failed publications after which an
+	// event is parked
+	maxOutboxAttempts = 10
+	// maxOutboxBackoff bounds the delay between attempts
+	maxOutboxBackoff = time.Hour
+)
+
+// ErrUnpublishable marks publish errors that retrying cannot fix, such as an
+// unknown topic or a malformed payload. The event is parked at once.
+var ErrUnpublishable = errors.New("outbox: event cannot be published")
+
+// OutboxRun counts the events handled by one PublishOutbox call.
+type OutboxRun struct {
+	Published int
+	// Failed events are retried after a backoff; Parked ones are not
+	// retried until requeued
+	Failed int
+	Parked int
+	// Held events follow a failed event of their bill and are left for a
+	// later run
+	Held int
+}
+
+// Claimed is the number of events the run took from the outbox.
+func (r OutboxRun) Claimed() int {
+	return r.Published + r.Failed + r.Parked + r.Held
+}
+
+// PublishOutbox publishes up to limit pending events in the order they were
+// written. Events are claimed with a short lease and published outside any
+// transaction, so concurrent calls publish disjoint events and a crashed
+// relay's events are picked up once the lease expires. A failed event does
+// not stop the run: its attempt and error are recorded and it is retried
+// after an exponential backoff, until it is parked after maxOutboxAttempts
+// attempts or at once when the error wraps ErrUnpublishable. The events of a
+// bill are published in order: the events following a failed one are held
+// until it is published or parked, while other bills' events go on.
+func PublishOutbox(ctx context.Context, limit int, publish func(ctx context.Context, topic string, payload []byte) error) (OutboxRun, error) {
+	var run OutboxRun
+	const claim = `
+		UPDATE outbox SET locked_until = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM outbox o
+			WHERE published_at IS NULL AND parked_at IS NULL
+				AND (next_attempt_at IS NULL OR next_attempt_at <= now())
+				AND (locked_until IS NULL OR locked_until < now())
+				-- an earlier event of the bill waiting for a retry or
+				-- claimed by another relay holds it
+				AND NOT EXISTS (
+					SELECT 1 FROM outbox p
+					WHERE p.bill_id = o.bill_id AND p.id < o.id
+						AND p.published_at IS NULL AND p.parked_at IS NULL
+						AND (p.next_attempt_at > now() OR p.locked_until >= now())
+				)
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, bill_id, topic, payload, attempts
+	`
+	rows, err := db.Query(ctx, claim, limit, int(outboxLease.Seconds()))
+	if err != nil {
+		return run, err
+	}
+
+	type claimed struct {
+		DbOutboxEvent
+		attempts int
+	}
+	var pending []claimed
+	for rows.Next() {
+		var event claimed
+		var payload string
+		var billId *string
+		if err := rows.Scan(&event.Id, &billId, &event.Topic, &payload, &event.attempts); err != nil {
+			rows.Close()
+			return run, err
+		}
+		event.Payload = []byte(payload)
+		if billId != nil {
+			event.BillId = *billId
+		}
+		pending = append(pending, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return run, err
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Id < pending[j].Id })
+
+	// bills with an event that failed in this run
+	held := map[string]bool{}
+	for _, event := range pending {
+		if event.BillId != "" && held[event.BillId] {
+			_, err := db.Exec(ctx, `UPDATE outbox SET locked_until = NULL WHERE id = $1`, event.Id)
+			if err != nil {
+				return run, err
+			}
+			run.Held++
+			continue
+		}
+
+		publishErr := publish(ctx, event.Topic, event.Payload)
+		if publishErr == nil {
+			_, err := db.Exec(ctx, `UPDATE outbox SET published_at = now(), locked_until = NULL WHERE id = $1`, event.Id)
+			if err != nil {
+				return run, err
+			}
+			run.Published++
+			continue
+		}
+
+		attempts := event.attempts + 1
+		park := attempts >= maxOutboxAttempts || errors.Is(publishErr, ErrUnpublishable)
+		const failed = `
+			UPDATE outbox
+			SET attempts = $2, last_error = $3, locked_until = NULL,
+				next_attempt_at = now() + $4 * interval '1 second',
+				parked_at = CASE WHEN $5 THEN now() END
+			WHERE id = $1
+		`
+		_, err := db.Exec(ctx, failed, event.Id, attempts, publishErr.Error(), int(outboxBackoff(attempts).Seconds()), park)
+		if err != nil {
+			return run, err
+		}
+		if park {
+			run.Parked++
+		} else {
+			run.Failed++
+			held[event.BillId] = true
+		}
+	}
+	return run, nil
+}
+
+// outboxBackoff is the delay before the next attempt at an event that failed
+// attempts times. The first retry is immediate, for failures that were only
+// transient, and the delay then doubles from a minute.
+func outboxBackoff(attempts int) time.Duration {
+	delay := time.Duration(1<<min(attempts-1, 16)-1) * time.Minute
+	return min(delay, maxOutboxBackoff)
+}
+
+// RequeueOutboxEvent makes a parked event pending again with a fresh attempt
+// count, once the cause of its failures has been fixed.
+func RequeueOutboxEvent(ctx context.Context, eventId string) error {
+	const query = `
+		UPDATE outbox
+		SET parked_at = NULL, attempts = 0, next_attempt_at = NULL
+		WHERE event_id = $1 AND parked_at IS NOT NULL
+	`
+	result, err := db.Exec(ctx, query, eventId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "Parked event not found"}
+	}
+	return nil
+}
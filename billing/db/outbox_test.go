@@ -0,0 +1,160 @@
+package db_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/events"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxPublishesBillEvents(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	periodEnd := periodStart.Add(24 * time.Hour)
+	billID, err := db.InsertBill(ctx, "outbox-bill", db.StatusOpen, "accountOutbox", "USD", periodStart, periodEnd)
+	require.NoError(t, err, "failed to insert bill")
+
+	rate := decimal.NewFromInt(1)
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.NewFromInt(10), "USD", rate)
+	require.NoError(t, err, "failed to insert bill item")
+	// a replayed reference does not publish again
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.NewFromInt(10), "USD", rate)
+	require.NoError(t, err, "failed to replay bill item")
+
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err, "failed to close bill")
+
+	// a failed publish leaves the event in the outbox for an immediate retry
+	run, err := db.PublishOutbox(ctx, 100, func(ctx context.Context, topic string, payload []byte) error {
+		return errors.New("broker unavailable")
+	})
+	require.NoError(t, err)
+	require.Zero(t, run.Published)
+	require.NotZero(t, run.Failed)
+
+	var topics []string
+	eventIds := map[string]bool{}
+	for {
+		run, err := db.PublishOutbox(ctx, 100, func(ctx context.Context, topic string, payload []byte) error {
+			var event struct {
+				EventId string `json:"event_id"`
+				BillId  string `json:"bill_id"`
+			}
+			require.NoError(t, json.Unmarshal(payload, &event))
+			require.False(t, eventIds[event.EventId], "event published twice")
+			eventIds[event.EventId] = true
+			if event.BillId == billID {
+				topics = append(topics, topic)
+			}
+			return nil
+		})
+		require.NoError(t, err, "failed to publish outbox")
+		if run.Claimed() == 0 {
+			break
+		}
+	}
+	require.Equal(t, []string{events.BillOpenedTopic, events.LineItemAddedTopic, events.BillClosedTopic}, topics)
+}
+
+func TestOutboxParksUnpublishableEvents(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "outbox-poison", db.StatusOpen, "accountOutbox", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err, "failed to insert bill")
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err, "failed to close bill")
+
+	// events of one topic can never be published, the others still are
+	var opened string
+	var closed []string
+	for {
+		run, err := db.PublishOutbox(ctx, 100, func(ctx context.Context, topic string, payload []byte) error {
+			var event struct {
+				EventId string `json:"event_id"`
+				BillId  string `json:"bill_id"`
+			}
+			require.NoError(t, json.Unmarshal(payload, &event))
+			if event.BillId != billID {
+				return nil
+			}
+			if topic == events.BillOpenedTopic {
+				opened = event.EventId
+				return fmt.Errorf("%w: unknown topic", db.ErrUnpublishable)
+			}
+			closed = append(closed, topic)
+			return nil
+		})
+		require.NoError(t, err, "failed to publish outbox")
+		if run.Claimed() == 0 {
+			break
+		}
+	}
+	require.Equal(t, []string{events.BillClosedTopic}, closed)
+	require.NotEmpty(t, opened)
+
+	// a parked event is published again once requeued
+	require.NoError(t, db.RequeueOutboxEvent(ctx, opened))
+	run, err := db.PublishOutbox(ctx, 100, func(ctx context.Context, topic string, payload []byte) error { return nil })
+	require.NoError(t, err)
+	require.NotZero(t, run.Published)
+	require.Error(t, db.RequeueOutboxEvent(ctx, opened))
+}
+
+func TestOutboxKeepsBillEventsInOrder(t *testing.T) {
+	ctx := context.Background()
+
+	periodStart := time.Now()
+	billID, err := db.InsertBill(ctx, "outbox-order", db.StatusOpen, "accountOutbox", "USD", periodStart, periodStart.Add(24*time.Hour))
+	require.NoError(t, err, "failed to insert bill")
+	_, err = db.InsertBillItem(ctx, billID, "REF001", "Usage", decimal.NewFromInt(10), "USD", decimal.NewFromInt(1))
+	require.NoError(t, err, "failed to insert bill item")
+	require.NoError(t, db.UpdateBillStatus(ctx, billID, db.StatusClosing))
+	_, err = db.CloseBill(ctx, billID, nil, nil)
+	require.NoError(t, err, "failed to close bill")
+	require.NoError(t, db.ChangeBillStatus(ctx, billID, db.StatusVoided, "admin", "duplicate"))
+
+	// the item event fails once, holding the bill's later events back
+	var topics []string
+	failed := false
+	publish := func(ctx context.Context, topic string, payload []byte) error {
+		var event struct {
+			BillId string `json:"bill_id"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &event))
+		if event.BillId != billID {
+			return nil
+		}
+		if topic == events.LineItemAddedTopic && !failed {
+			failed = true
+			return errors.New("broker unavailable")
+		}
+		topics = append(topics, topic)
+		return nil
+	}
+	for !failed {
+		run, err := db.PublishOutbox(ctx, 1000, publish)
+		require.NoError(t, err, "failed to publish outbox")
+		require.NotZero(t, run.Claimed(), "the bill's events should be claimed")
+	}
+	require.Equal(t, []string{events.BillOpenedTopic}, topics, "events after the failed one should be held")
+
+	for {
+		run, err := db.PublishOutbox(ctx, 100, publish)
+		require.NoError(t, err, "failed to publish outbox")
+		if run.Claimed() == 0 {
+			break
+		}
+	}
+	require.Equal(t, []string{events.BillOpenedTopic, events.LineItemAddedTopic, events.BillClosedTopic, events.BillVoidedTopic}, topics)
+}
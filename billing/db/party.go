@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// DbBillingParty is the legal name, address and electronic address of an
+// account as the buyer on its e-invoices.
+type DbBillingParty struct {
+	AccountId string `db:"account_id,pk"`
+	Name      string `db:"name"`
+	VatId     string `db:"vat_id"`
+	// EndpointId is the Peppol electronic address in the ICD scheme
+	// EndpointScheme
+	EndpointId     string    `db:"endpoint_id"`
+	EndpointScheme string    `db:"endpoint_scheme"`
+	Street         string    `db:"street"`
+	City           string    `db:"city"`
+	PostalCode     string    `db:"postal_code"`
+	Country        string    `db:"country"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+const billingPartyColumns = `account_id, name, vat_id, endpoint_id, endpoint_scheme, street, city, postal_code, country, updated_at`
+
+func scanBillingParty(row rowScanner) (*DbBillingParty, error) {
+	var p DbBillingParty
+	err := row.Scan(&p.AccountId, &p.Name, &p.VatId, &p.EndpointId, &p.EndpointScheme, &p.Street, &p.City, &p.PostalCode, &p.Country, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func UpsertBillingParty(ctx context.Context, party DbBillingParty) (*DbBillingParty, error) {
+	query := `
+		INSERT INTO billing_party (account_id, name, vat_id, endpoint_id, endpoint_scheme, street, city, postal_code, country, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+		ON CONFLICT (account_id) DO UPDATE
+		SET name = EXCLUDED.name, vat_id = EXCLUDED.vat_id, endpoint_id = EXCLUDED.endpoint_id, endpoint_scheme = EXCLUDED.endpoint_scheme,
+			street = EXCLUDED.street, city = EXCLUDED.city, postal_code = EXCLUDED.postal_code, country = EXCLUDED.country, updated_at = EXCLUDED.updated_at
+		RETURNING ` + billingPartyColumns
+	return scanBillingParty(db.QueryRow(ctx, query, party.AccountId, party.Name, party.VatId, party.EndpointId, party.EndpointScheme, party.Street, party.City, party.PostalCode, party.Country))
+}
+
+func GetBillingParty(ctx context.Context, accountId string) (*DbBillingParty, error) {
+	p, err := scanBillingParty(db.QueryRow(ctx, `SELECT `+billingPartyColumns+` FROM billing_party WHERE account_id = $1`, accountId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Billing party not found"}
+	}
+	return p, err
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/ledger"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type PaymentMethod string
+
+const (
+	PaymentMethodCard         PaymentMethod = "card"
+	PaymentMethodBankTransfer PaymentMethod = "bank_transfer"
+	PaymentMethodDirectDebit  PaymentMethod = "direct_debit"
+	PaymentMethodCheck        PaymentMethod = "check"
+	PaymentMethodCash         PaymentMethod = "cash"
+	PaymentMethodOther        PaymentMethod = "other"
+)
+
+func (m PaymentMethod) IsValid() bool {
+	switch m {
+	case PaymentMethodCard, PaymentMethodBankTransfer, PaymentMethodDirectDebit, PaymentMethodCheck, PaymentMethodCash, PaymentMethodOther:
+		return true
+	}
+	return false
+}
+
+type DbPayment struct {
+	Id     int64  `db:"id,pk,auto"`
+	BillId string `db:"bill_id"`
+	// Amount is negative for refunds
+	Amount       decimal.Decimal `db:"amount"`
+	Currency     string          `db:"currency"`
+	ExchangeRate decimal.Decimal `db:"exchange_rate"`
+	// AppliedAmount is the part of the payment applied to the bill, in its
+	// currency; the rest of an over-payment is credited to the account
+	AppliedAmount decimal.Decimal `db:"applied_amount"`
+	Method        PaymentMethod   `db:"method"`
+	// Reference is the payment's id at the processor or bank, unique per bill
+	Reference string    `db:"reference"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// PaymentResult is a recorded payment and the bill balance after it.
+type PaymentResult struct {
+	Payment DbPayment
+	Bill    DbBill
+	// Credit is the excess of an over-payment credited to the account
+	Credit *DbCreditEntry
+}
+
+const paymentColumns = `id, bill_id, amount, currency, exchange_rate, applied_amount, method, reference, created_at`
+
+func scanPayment(row rowScanner) (*DbPayment, error) {
+	var p DbPayment
+	err := row.Scan(&p.Id, &p.BillId, &p.Amount, &p.Currency, &p.ExchangeRate, &p.AppliedAmount, &p.Method, &p.Reference, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// RecordPayment applies a payment, or a refund if its amount is negative, to
+// an invoiced bill and moves the bill to the status matching its balance.
+// The excess of a payment over the amount due is credited to the account.
+// Refunds cannot exceed the amount paid. Recording a reference again returns
+// the original payment.
+func RecordPayment(ctx context.Context, payment DbPayment) (*PaymentResult, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bill, err := scanBill(tx.QueryRow(ctx, `SELECT `+billColumns+` FROM bill WHERE id = $1 FOR UPDATE`, payment.BillId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := scanPayment(tx.QueryRow(ctx, `SELECT `+paymentColumns+` FROM payment WHERE bill_id = $1 AND reference = $2`, payment.BillId, payment.Reference))
+	if err == nil {
+		return &PaymentResult{Payment: *existing, Bill: *bill}, nil
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+
+	if !bill.Status.AcceptsPayments() {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	settled := payment.Amount.Mul(payment.ExchangeRate)
+	if c, ok := currency.Lookup(bill.Currency); ok {
+		settled = c.Round(settled)
+	}
+	applied := settled
+	var excess decimal.Decimal
+	if settled.IsNegative() {
+		if settled.Neg().GreaterThan(bill.AmountPaid) {
+			return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Refund exceeds the amount paid"}
+		}
+	} else if due := decimal.Max(bill.AmountDue(), decimal.Zero); settled.GreaterThan(due) {
+		applied, excess = due, settled.Sub(due)
+	}
+	payment.AppliedAmount = applied
+
+	query := `
+		INSERT INTO payment (bill_id, amount, currency, exchange_rate, applied_amount, method, reference, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+		RETURNING ` + paymentColumns
+	recorded, err := scanPayment(tx.QueryRow(ctx, query, payment.BillId, payment.Amount, payment.Currency, payment.ExchangeRate, payment.AppliedAmount, payment.Method, payment.Reference))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PaymentResult{Payment: *recorded}
+	if excess.IsPositive() {
+		result.Credit, err = insertCreditEntry(ctx, tx, DbCreditEntry{
+			AccountId: bill.AccountId,
+			Currency:  bill.Currency,
+			Amount:    excess,
+			Remaining: excess,
+			Type:      CreditOverpayment,
+			BillId:    &bill.Id,
+			PaymentId: &recorded.Id,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a refund's negative applied amount reverses the receipt
+	entries := ledger.Transfer(ledger.Cash, ledger.AccountsReceivable, applied)
+	entries = append(entries, ledger.Transfer(ledger.Cash, ledger.DeferredRevenue, excess)...)
+	err = postJournal(ctx, tx, journalTransaction{
+		Source:      ledger.SourcePayment,
+		BillId:      &bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Description: "Payment " + recorded.Reference,
+		Entries:     entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE bill SET amount_paid = amount_paid + $1 WHERE id = $2`, applied, bill.Id)
+	if err != nil {
+		return nil, err
+	}
+	bill.AmountPaid = bill.AmountPaid.Add(applied)
+
+	status := balanceStatus(*bill, time.Now())
+	if status != bill.Status {
+		_, err = transitionBillStatus(ctx, tx, bill.Id, status, SystemActor, "payment "+recorded.Reference)
+		if err != nil {
+			return nil, err
+		}
+		bill.Status = status
+	}
+	result.Bill = *bill
+	return result, tx.Commit()
+}
+
+// balanceStatus is the status of an invoiced bill given its balance. Overdue
+// bills stay overdue until paid in full.
+func balanceStatus(bill DbBill, now time.Time) Status {
+	switch {
+	case !bill.AmountDue().IsPositive():
+		return StatusPaid
+	case bill.DueAt != nil && bill.DueAt.Before(now):
+		return StatusOverdue
+	case bill.AmountPaid.IsPositive():
+		return StatusPartiallyPaid
+	default:
+		return StatusInvoiced
+	}
+}
+
+func GetBillPayments(ctx context.Context, billId string) ([]DbPayment, error) {
+	rows, err := db.Query(ctx, `SELECT `+paymentColumns+` FROM payment WHERE bill_id = $1 ORDER BY id`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []DbPayment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *p)
+	}
+	return payments, rows.Err()
+}
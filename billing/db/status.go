@@ -0,0 +1,72 @@
+package db
+
+type Status string
+
+const (
+	StatusDraft         Status = "draft"
+	StatusOpen          Status = "open"
+	StatusClosing       Status = "closing"
+	StatusClosed        Status = "closed"
+	StatusInvoiced      Status = "invoiced"
+	StatusPaid          Status = "paid"
+	StatusPartiallyPaid Status = "partially_paid"
+	StatusOverdue       Status = "overdue"
+	StatusVoided        Status = "voided"
+)
+
+// transitions lists the statuses a bill may move to from each status.
+//
+//	draft -> open -> closing -> closed -> invoiced -> partially_paid/paid/overdue
+//
+// A closed period is not yet an issued invoice, and an issued invoice is not
+// settled until it is paid. Closed bills may be reopened until they are
+// invoiced. Refunds move paid bills back to partially_paid, or to invoiced
+// or overdue once fully refunded. Voided bills are terminal.
+var transitions = map[Status][]Status{
+	StatusDraft:         {StatusOpen, StatusVoided},
+	StatusOpen:          {StatusClosing, StatusVoided},
+	StatusClosing:       {StatusClosed},
+	StatusClosed:        {StatusOpen, StatusInvoiced, StatusVoided},
+	StatusInvoiced:      {StatusPartiallyPaid, StatusPaid, StatusOverdue, StatusVoided},
+	StatusPartiallyPaid: {StatusPaid, StatusOverdue, StatusInvoiced},
+	StatusOverdue:       {StatusPartiallyPaid, StatusPaid, StatusVoided},
+	StatusPaid:          {StatusPartiallyPaid, StatusInvoiced, StatusOverdue},
+	StatusVoided:        {},
+}
+
+// IsValid reports whether s is a known bill status.
+func (s Status) IsValid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// CanTransitionTo reports whether a bill in status s may move to next.
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsPayments reports whether payments and refunds may be recorded on a
+// bill in status s, i.e. once it is invoiced.
+func (s Status) AcceptsPayments() bool {
+	switch s {
+	case StatusInvoiced, StatusPartiallyPaid, StatusOverdue, StatusPaid:
+		return true
+	}
+	return false
+}
+
+// IsActive reports whether the billing period of a bill in status s is still
+// running, i.e. its workflow is waiting for items or the period end.
+func (s Status) IsActive() bool {
+	return s == StatusDraft || s == StatusOpen || s == StatusClosing
+}
+
+// AcceptsLineItems reports whether items may be added to a bill in status s.
+func (s Status) AcceptsLineItems() bool {
+	return s == StatusOpen
+}
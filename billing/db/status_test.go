@@ -0,0 +1,54 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	// The happy path from draft to settled is allowed
+	path := []Status{StatusDraft, StatusOpen, StatusClosing, StatusClosed, StatusInvoiced, StatusPartiallyPaid, StatusPaid}
+	for i := 0; i < len(path)-1; i++ {
+		require.True(t, path[i].CanTransitionTo(path[i+1]), "%s -> %s should be allowed", path[i], path[i+1])
+	}
+
+	// Skipping steps or leaving terminal statuses is rejected
+	require.False(t, StatusOpen.CanTransitionTo(StatusClosed), "open bills must go through closing")
+	require.False(t, StatusClosed.CanTransitionTo(StatusPaid), "closed bills must be invoiced before payment")
+	require.False(t, StatusPaid.CanTransitionTo(StatusVoided), "paid bills cannot be voided")
+	require.False(t, StatusVoided.CanTransitionTo(StatusOpen), "voided bills are terminal")
+	require.True(t, StatusClosed.CanTransitionTo(StatusOpen), "closed bills can be reopened")
+	require.False(t, StatusInvoiced.CanTransitionTo(StatusOpen), "invoiced bills cannot be reopened")
+	require.True(t, StatusPaid.CanTransitionTo(StatusPartiallyPaid), "refunds reopen the balance of paid bills")
+	require.False(t, StatusPaid.CanTransitionTo(StatusClosed), "paid bills cannot be reopened")
+}
+
+func TestStatusAcceptsPayments(t *testing.T) {
+	require.True(t, StatusInvoiced.AcceptsPayments())
+	require.True(t, StatusPaid.AcceptsPayments(), "refunds are recorded on paid bills")
+	require.False(t, StatusClosed.AcceptsPayments(), "bills are invoiced before payment")
+	require.False(t, StatusVoided.AcceptsPayments())
+}
+
+func TestStatusIsValid(t *testing.T) {
+	require.True(t, StatusPartiallyPaid.IsValid())
+	require.False(t, Status("pending").IsValid())
+	require.False(t, Status("").IsValid())
+}
+
+func TestBalanceStatus(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	bill := func(paid int64, dueAt *time.Time) DbBill {
+		return DbBill{TotalAmount: decimal.NewNullDecimal(decimal.NewFromInt(100)), AmountPaid: decimal.NewFromInt(paid), DueAt: dueAt}
+	}
+
+	require.Equal(t, StatusInvoiced, balanceStatus(bill(0, &future), now))
+	require.Equal(t, StatusPartiallyPaid, balanceStatus(bill(40, &future), now))
+	require.Equal(t, StatusPaid, balanceStatus(bill(100, &future), now))
+	require.Equal(t, StatusOverdue, balanceStatus(bill(40, &past), now), "overdue bills stay overdue until paid")
+	require.Equal(t, StatusPaid, balanceStatus(bill(100, &past), now))
+}
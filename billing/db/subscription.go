@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive    SubscriptionStatus = "active"
+	SubscriptionCancelled SubscriptionStatus = "cancelled"
+)
+
+type DbSubscription struct {
+	Id           string             `db:"id,pk"`
+	AccountId    string             `db:"account_id"` // index
+	Currency     string             `db:"currency"`
+	Cadence      string             `db:"cadence"`
+	IntervalDays int                `db:"interval_days"`
+	Anchor       time.Time          `db:"anchor"`
+	TimeZone     string             `db:"time_zone"`
+	Status       SubscriptionStatus `db:"status"`
+	CreatedAt    time.Time          `db:"created_at"`
+	CancelledAt  *time.Time         `db:"cancelled_at"`
+}
+
+const subscriptionColumns = `id, account_id, currency, cadence, interval_days, anchor, time_zone, status, created_at, cancelled_at`
+
+func scanSubscription(row rowScanner) (*DbSubscription, error) {
+	var sub DbSubscription
+	err := row.Scan(&sub.Id, &sub.AccountId, &sub.Currency, &sub.Cadence, &sub.IntervalDays, &sub.Anchor, &sub.TimeZone, &sub.Status, &sub.CreatedAt, &sub.CancelledAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Subscription not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func InsertSubscription(ctx context.Context, id, accountId, currency, cadence string, intervalDays int, anchor time.Time, timeZone string) (*DbSubscription, error) {
+	query := `
+		INSERT INTO subscription (id, account_id, currency, cadence, interval_days, anchor, time_zone, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now())
+		RETURNING ` + subscriptionColumns
+	return scanSubscription(db.QueryRow(ctx, query, id, accountId, currency, cadence, intervalDays, anchor, timeZone, SubscriptionActive))
+}
+
+func GetSubscription(ctx context.Context, id string) (*DbSubscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM subscription WHERE id = $1`
+	return scanSubscription(db.QueryRow(ctx, query, id))
+}
+
+// CancelSubscription stops a subscription from opening further bills.
+// Cancelling a cancelled subscription is a no-op.
+func CancelSubscription(ctx context.Context, id string) (*DbSubscription, error) {
+	query := `
+		UPDATE subscription
+		SET status = $2, cancelled_at = COALESCE(cancelled_at, now())
+		WHERE id = $1
+		RETURNING ` + subscriptionColumns
+	return scanSubscription(db.QueryRow(ctx, query, id, SubscriptionCancelled))
+}
+
+// GetActiveSubscriptionIds returns the ids of the account's active
+// subscriptions.
+func GetActiveSubscriptionIds(ctx context.Context, accountId string) ([]string, error) {
+	const query = `SELECT id FROM subscription WHERE account_id = $1 AND status = $2 ORDER BY id`
+	rows, err := db.Query(ctx, query, accountId, SubscriptionActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
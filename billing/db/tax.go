@@ -0,0 +1,211 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type DbTaxRule struct {
+	Id           int64           `db:"id,pk,auto"`
+	Jurisdiction string          `db:"jurisdiction"`
+	Country      string          `db:"country"` // index
+	Region       string          `db:"region"`
+	Rate         decimal.Decimal `db:"rate"`
+	Inclusive    bool            `db:"inclusive"`
+	CreatedAt    time.Time       `db:"created_at"`
+}
+
+// DbTaxProfile is where an account is taxed. Accounts without a profile are
+// not charged tax.
+type DbTaxProfile struct {
+	AccountId string    `db:"account_id,pk"`
+	Country   string    `db:"country"`
+	Region    string    `db:"region"`
+	Exempt    bool      `db:"exempt"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// DbTaxLine is the tax one jurisdiction levies on an item, in the bill's
+// currency.
+type DbTaxLine struct {
+	Id            int64           `db:"id,pk,auto"`
+	BillId        string          `db:"bill_id"` // index
+	ItemId        int64           `db:"item_id"`
+	Jurisdiction  string          `db:"jurisdiction"`
+	Rate          decimal.Decimal `db:"rate"`
+	Inclusive     bool            `db:"inclusive"`
+	TaxableAmount decimal.Decimal `db:"taxable_amount"`
+	Amount        decimal.Decimal `db:"amount"`
+	CreatedAt     time.Time       `db:"created_at"`
+}
+
+// JurisdictionTax is the tax of a bill owed to one jurisdiction.
+type JurisdictionTax struct {
+	Jurisdiction string          `json:"jurisdiction"`
+	Amount       decimal.Decimal `json:"amount"`
+}
+
+// TaxesByJurisdiction sums tax lines per jurisdiction.
+func TaxesByJurisdiction(lines []DbTaxLine) []JurisdictionTax {
+	byJurisdiction := map[string]decimal.Decimal{}
+	for _, line := range lines {
+		byJurisdiction[line.Jurisdiction] = byJurisdiction[line.Jurisdiction].Add(line.Amount)
+	}
+
+	var taxes []JurisdictionTax
+	for jurisdiction, amount := range byJurisdiction {
+		taxes = append(taxes, JurisdictionTax{Jurisdiction: jurisdiction, Amount: amount})
+	}
+	sort.Slice(taxes, func(i, j int) bool { return taxes[i].Jurisdiction < taxes[j].Jurisdiction })
+	return taxes
+}
+
+func InsertTaxRule(ctx context.Context, jurisdiction, country, region string, rate decimal.Decimal, inclusive bool) (*DbTaxRule, error) {
+	const query = `
+		INSERT INTO tax_rule (jurisdiction, country, region, rate, inclusive, created_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		RETURNING id, jurisdiction, country, region, rate, inclusive, created_at
+	`
+	var r DbTaxRule
+	err := db.QueryRow(ctx, query, jurisdiction, country, region, rate, inclusive).
+		Scan(&r.Id, &r.Jurisdiction, &r.Country, &r.Region, &r.Rate, &r.Inclusive, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetTaxRules returns the rules of a country, or of every country if country
+// is empty.
+func GetTaxRules(ctx context.Context, country string) ([]DbTaxRule, error) {
+	const query = `
+		SELECT id, jurisdiction, country, region, rate, inclusive, created_at
+		FROM tax_rule
+		WHERE $1 = '' OR country = upper($1)
+		ORDER BY country, region, jurisdiction, id
+	`
+	rows, err := db.Query(ctx, query, country)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []DbTaxRule
+	for rows.Next() {
+		var r DbTaxRule
+		err := rows.Scan(&r.Id, &r.Jurisdiction, &r.Country, &r.Region, &r.Rate, &r.Inclusive, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func UpsertTaxProfile(ctx context.Context, accountId, country, region string, exempt bool) (*DbTaxProfile, error) {
+	const query = `
+		INSERT INTO tax_profile (account_id, country, region, exempt, updated_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (account_id) DO UPDATE
+		SET country = EXCLUDED.country, region = EXCLUDED.region, exempt = EXCLUDED.exempt, updated_at = EXCLUDED.updated_at
+		RETURNING account_id, country, region, exempt, updated_at
+	`
+	var p DbTaxProfile
+	err := db.QueryRow(ctx, query, accountId, country, region, exempt).
+		Scan(&p.AccountId, &p.Country, &p.Region, &p.Exempt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func GetTaxProfile(ctx context.Context, accountId string) (*DbTaxProfile, error) {
+	const query = `
+		SELECT account_id, country, region, exempt, updated_at
+		FROM tax_profile
+		WHERE account_id = $1
+	`
+	var p DbTaxProfile
+	err := db.QueryRow(ctx, query, accountId).Scan(&p.AccountId, &p.Country, &p.Region, &p.Exempt, &p.UpdatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Tax profile not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+const taxLineColumns = `id, bill_id, item_id, jurisdiction, rate, inclusive, taxable_amount, amount, created_at`
+
+// GetBillTaxLines returns the tax lines of a bill's items.
+func GetBillTaxLines(ctx context.Context, billId string) ([]DbTaxLine, error) {
+	rows, err := db.Query(ctx, `SELECT `+taxLineColumns+` FROM tax_line WHERE bill_id = $1 ORDER BY item_id, jurisdiction`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanTaxLines(rows)
+}
+
+func scanTaxLines(rows *sqldb.Rows) ([]DbTaxLine, error) {
+	var lines []DbTaxLine
+	for rows.Next() {
+		var l DbTaxLine
+		err := rows.Scan(&l.Id, &l.BillId, &l.ItemId, &l.Jurisdiction, &l.Rate, &l.Inclusive, &l.TaxableAmount, &l.Amount, &l.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// ReplaceItemTaxLines sets the tax lines of items, replacing any calculated
+// before. Bills that no longer accept items are left as they are: closing a
+// bill calculates the tax of all its items, which must not be overwritten by
+// running tax calculated before it closed.
+func ReplaceItemTaxLines(ctx context.Context, billId string, itemIds []int64, lines []DbTaxLine) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return err
+	}
+	if !acceptsItems(bill.Status) {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tax_line WHERE item_id = ANY($1)`, itemIds)
+	if err != nil {
+		return err
+	}
+	if err := insertTaxLines(ctx, tx, billId, lines); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertTaxLines(ctx context.Context, tx *sqldb.Tx, billId string, lines []DbTaxLine) error {
+	const query = `
+		INSERT INTO tax_line (bill_id, item_id, jurisdiction, rate, inclusive, taxable_amount, amount, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+	`
+	for _, l := range lines {
+		_, err := tx.Exec(ctx, query, billId, l.ItemId, l.Jurisdiction, l.Rate, l.Inclusive, l.TaxableAmount, l.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/discount"
+	"encore.app/billing/events"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// AppliedRate is an exchange rate used to convert items of a currency into
+// the bill's currency.
+type AppliedRate struct {
+	Currency string          `json:"currency"`
+	Rate     decimal.Decimal `json:"rate"`
+}
+
+// AppliedRates is the snapshot of exchange rates frozen when a bill closes,
+// stored as JSON.
+type AppliedRates []AppliedRate
+
+func (r AppliedRates) Value() (driver.Value, error) {
+	if r == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *AppliedRates) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(src, r)
+	case string:
+		return json.Unmarshal([]byte(src), r)
+	default:
+		return fmt.Errorf("cannot scan %T into AppliedRates", src)
+	}
+}
+
+// BillTotals are the amounts of a bill in its own currency.
+type BillTotals struct {
+	Subtotal       decimal.Decimal
+	TaxAmount      decimal.Decimal
+	DiscountAmount decimal.Decimal
+	// Taxes break TaxAmount down by jurisdiction
+	Taxes []JurisdictionTax
+	// Discounts make up DiscountAmount
+	Discounts []DbBillDiscount
+	// CreditAmount is the account credit applied to the bill
+	CreditAmount decimal.Decimal
+	// TotalAmount is Subtotal - DiscountAmount + TaxAmount - CreditAmount,
+	// rounded to the precision of the bill's currency
+	TotalAmount   decimal.Decimal
+	ExchangeRates AppliedRates
+}
+
+// NewBillTotals sums items, their tax lines and the bill's discounts into the
+// totals of a bill in billCurrency. The subtotal excludes tax, including the
+// inclusive tax that is part of the item amounts, and is before discounts;
+// the tax lines are calculated on the discounted amounts.
+func NewBillTotals(billCurrency string, items []DbBillItem, taxLines []DbTaxLine, discounts []DbBillDiscount) BillTotals {
+	totals := BillTotals{
+		Subtotal:       decimal.Zero,
+		TaxAmount:      decimal.Zero,
+		DiscountAmount: decimal.Zero,
+		CreditAmount:   decimal.Zero,
+	}
+
+	linesByItem := taxLinesByItem(taxLines)
+	seen := map[string]bool{}
+	for _, item := range items {
+		if item.Type == ItemTypeAccountCredit {
+			totals.CreditAmount = totals.CreditAmount.Sub(item.Amount.Mul(item.ExchangeRate))
+			continue
+		}
+		totals.Subtotal = totals.Subtotal.Add(item.NetAmount(billCurrency, linesByItem[item.Id]))
+
+		key := item.Currency + "/" + item.ExchangeRate.String()
+		if item.Currency != billCurrency && !seen[key] {
+			seen[key] = true
+			totals.ExchangeRates = append(totals.ExchangeRates, AppliedRate{Currency: item.Currency, Rate: item.ExchangeRate})
+		}
+	}
+	sort.Slice(totals.ExchangeRates, func(i, j int) bool {
+		a, b := totals.ExchangeRates[i], totals.ExchangeRates[j]
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		return a.Rate.LessThan(b.Rate)
+	})
+
+	for _, line := range taxLines {
+		totals.TaxAmount = totals.TaxAmount.Add(line.Amount)
+	}
+	totals.Taxes = TaxesByJurisdiction(taxLines)
+	for _, d := range discounts {
+		totals.DiscountAmount = totals.DiscountAmount.Add(d.Amount)
+	}
+	totals.Discounts = discounts
+
+	totals.TotalAmount = totals.Subtotal.Sub(totals.DiscountAmount).Add(totals.TaxAmount).Sub(totals.CreditAmount)
+	if c, ok := currency.Lookup(billCurrency); ok {
+		totals.TotalAmount = c.Round(totals.TotalAmount)
+	}
+	return totals
+}
+
+func taxLinesByItem(lines []DbTaxLine) map[int64][]DbTaxLine {
+	byItem := map[int64][]DbTaxLine{}
+	for _, l := range lines {
+		byItem[l.ItemId] = append(byItem[l.ItemId], l)
+	}
+	return byItem
+}
+
+// NetAmount returns the item's amount in billCurrency before discounts, net
+// of the inclusive rates among lines, its tax lines. The inclusive rates are
+// backed out of the amount the way the tax calculator does, so the net is the
+// same whether or not the lines were calculated on a discounted amount.
+func (item DbBillItem) NetAmount(billCurrency string, lines []DbTaxLine) decimal.Decimal {
+	converted := item.Amount.Mul(item.ExchangeRate)
+	inclusiveRate := decimal.Zero
+	for _, l := range lines {
+		if l.Inclusive {
+			inclusiveRate = inclusiveRate.Add(l.Rate)
+		}
+	}
+	if !inclusiveRate.IsPositive() {
+		return converted
+	}
+
+	round := func(d decimal.Decimal) decimal.Decimal { return d }
+	if c, ok := currency.Lookup(billCurrency); ok {
+		round = c.Round
+	}
+	net := converted.DivRound(decimal.NewFromInt(1).Add(inclusiveRate), 18)
+	for _, l := range lines {
+		if l.Inclusive {
+			converted = converted.Sub(round(net.Mul(l.Rate)))
+		}
+	}
+	return converted
+}
+
+// DiscountShares splits each discount across the items in proportion to
+// their net amounts, rounded to billCurrency, so tax is calculated on the
+// discounted amounts. Account credit is not discounted. shares[i][j] is the
+// part of discounts[i] taken off items[j].
+func DiscountShares(billCurrency string, items []DbBillItem, taxLines []DbTaxLine, discounts []DbBillDiscount) [][]decimal.Decimal {
+	linesByItem := taxLinesByItem(taxLines)
+	var nets []decimal.Decimal
+	var indexes []int
+	for j, item := range items {
+		if item.Type == ItemTypeAccountCredit {
+			continue
+		}
+		net := item.NetAmount(billCurrency, linesByItem[item.Id])
+		if c, ok := currency.Lookup(billCurrency); ok {
+			net = c.Round(net)
+		}
+		nets = append(nets, net)
+		indexes = append(indexes, j)
+	}
+
+	shares := make([][]decimal.Decimal, len(discounts))
+	for i, d := range discounts {
+		shares[i] = make([]decimal.Decimal, len(items))
+		for k, share := range discount.Allocate(billCurrency, d.Amount, nets) {
+			shares[i][indexes[k]] = share
+		}
+	}
+	return shares
+}
+
+// CloseBill moves a bill to closed, persisting the totals summed from its
+// items and publishing BillClosed in the same transaction. taxLines replace
+// the tax lines calculated as items were added, and discounts those of an
+// earlier close of a reopened bill. No items can be added once it commits.
+func CloseBill(ctx context.Context, billId string, taxLines []DbTaxLine, discounts []DbBillDiscount) (*BillTotals, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	closed, err := transitionBillStatus(ctx, tx, billId, StatusClosed, SystemActor, "")
+	if err != nil {
+		return nil, err
+	}
+
+	bill, err := scanBill(tx.QueryRow(ctx, `SELECT `+billColumns+` FROM bill WHERE id = $1`, billId))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT `+billItemColumns+` FROM bill_item WHERE bill_id = $1 ORDER BY id`, billId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []DbBillItem
+	for rows.Next() {
+		item, err := scanBillItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM tax_line WHERE bill_id = $1`, billId)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertTaxLines(ctx, tx, billId, taxLines); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM bill_discount WHERE bill_id = $1`, billId)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertBillDiscounts(ctx, tx, billId, discounts); err != nil {
+		return nil, err
+	}
+
+	totals := NewBillTotals(bill.Currency, items, taxLines, discounts)
+	const query = `
+		UPDATE bill
+		SET subtotal = $1, tax_amount = $2, discount_amount = $3, credit_amount = $4, total_amount = $5, exchange_rates = $6
+		WHERE id = $7
+	`
+	_, err = tx.Exec(ctx, query, totals.Subtotal, totals.TaxAmount, totals.DiscountAmount, totals.CreditAmount, totals.TotalAmount, totals.ExchangeRates, billId)
+	if err != nil {
+		return nil, err
+	}
+	if err := postCloseJournal(ctx, tx, bill, items, taxLines, totals); err != nil {
+		return nil, err
+	}
+
+	if closed {
+		eventId := uuid.NewString()
+		err = enqueueEvent(ctx, tx, eventId, bill.Id, events.BillClosedTopic, events.BillClosed{
+			EventId:     eventId,
+			BillId:      bill.Id,
+			AccountId:   bill.AccountId,
+			Currency:    bill.Currency,
+			TotalAmount: totals.TotalAmount,
+			OccurredAt:  time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &totals, tx.Commit()
+}
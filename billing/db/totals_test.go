@@ -0,0 +1,109 @@
+package db_test
+
+import (
+	"testing"
+
+	"encore.app/billing/db"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBillTotals(t *testing.T) {
+	items := []db.DbBillItem{
+		{Type: db.ItemTypeCharge, Amount: decimal.RequireFromString("10.005"), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+		{Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(20), Currency: "EUR", ExchangeRate: decimal.RequireFromString("1.1")},
+		{Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(5), Currency: "EUR", ExchangeRate: decimal.RequireFromString("1.1")},
+		{Type: db.ItemTypeCredit, Amount: decimal.NewFromInt(-3), Currency: "GBP", ExchangeRate: decimal.RequireFromString("1.25")},
+	}
+
+	totals := db.NewBillTotals("USD", items, nil, nil)
+	require.True(t, decimal.RequireFromString("33.755").Equal(totals.Subtotal), "subtotal is %s", totals.Subtotal)
+	require.True(t, decimal.RequireFromString("33.76").Equal(totals.TotalAmount), "total is %s", totals.TotalAmount)
+	require.True(t, totals.TaxAmount.IsZero())
+	require.True(t, totals.DiscountAmount.IsZero())
+
+	// one entry per currency and rate, excluding the bill currency
+	require.Len(t, totals.ExchangeRates, 2)
+	require.Equal(t, "EUR", totals.ExchangeRates[0].Currency)
+	require.True(t, decimal.RequireFromString("1.1").Equal(totals.ExchangeRates[0].Rate))
+	require.Equal(t, "GBP", totals.ExchangeRates[1].Currency)
+}
+
+func TestNewBillTotalsEmpty(t *testing.T) {
+	totals := db.NewBillTotals("USD", nil, nil, nil)
+	require.True(t, totals.TotalAmount.IsZero())
+	require.Nil(t, totals.ExchangeRates)
+}
+
+func TestNewBillTotalsWithTax(t *testing.T) {
+	items := []db.DbBillItem{
+		{Id: 1, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(100), Currency: "CAD", ExchangeRate: decimal.NewFromInt(1)},
+		{Id: 2, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(119), Currency: "CAD", ExchangeRate: decimal.NewFromInt(1)},
+	}
+	taxLines := []db.DbTaxLine{
+		{ItemId: 1, Jurisdiction: "CA", Rate: decimal.RequireFromString("0.05"), Amount: decimal.NewFromInt(5)},
+		{ItemId: 1, Jurisdiction: "CA-QC", Rate: decimal.RequireFromString("0.09975"), Amount: decimal.RequireFromString("9.98")},
+		{ItemId: 2, Jurisdiction: "CA", Rate: decimal.RequireFromString("0.19"), Amount: decimal.NewFromInt(19), Inclusive: true},
+	}
+
+	totals := db.NewBillTotals("CAD", items, taxLines, nil)
+	// the inclusive tax is backed out of the subtotal
+	require.True(t, decimal.NewFromInt(200).Equal(totals.Subtotal), "subtotal is %s", totals.Subtotal)
+	require.True(t, decimal.RequireFromString("33.98").Equal(totals.TaxAmount), "tax is %s", totals.TaxAmount)
+	require.True(t, decimal.RequireFromString("233.98").Equal(totals.TotalAmount), "total is %s", totals.TotalAmount)
+
+	require.Len(t, totals.Taxes, 2)
+	require.Equal(t, "CA", totals.Taxes[0].Jurisdiction)
+	require.True(t, decimal.NewFromInt(24).Equal(totals.Taxes[0].Amount))
+	require.Equal(t, "CA-QC", totals.Taxes[1].Jurisdiction)
+}
+
+func TestNewBillTotalsWithDiscount(t *testing.T) {
+	items := []db.DbBillItem{
+		{Id: 1, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(100), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+	}
+	// tax is calculated on the discounted amount
+	taxLines := []db.DbTaxLine{{ItemId: 1, Jurisdiction: "US-NY", Rate: decimal.RequireFromString("0.08"), TaxableAmount: decimal.NewFromInt(90), Amount: decimal.RequireFromString("7.2")}}
+	discounts := []db.DbBillDiscount{{CouponCode: "Q1", Amount: decimal.NewFromInt(10)}}
+
+	totals := db.NewBillTotals("USD", items, taxLines, discounts)
+	require.True(t, decimal.NewFromInt(100).Equal(totals.Subtotal))
+	require.True(t, decimal.NewFromInt(10).Equal(totals.DiscountAmount))
+	require.True(t, decimal.RequireFromString("97.2").Equal(totals.TotalAmount), "total is %s", totals.TotalAmount)
+	require.Len(t, totals.Discounts, 1)
+}
+
+func TestDiscountShares(t *testing.T) {
+	items := []db.DbBillItem{
+		{Id: 1, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(100), Currency: "EUR", ExchangeRate: decimal.NewFromInt(1)},
+		{Id: 2, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(119), Currency: "EUR", ExchangeRate: decimal.NewFromInt(1)},
+		{Id: 3, Type: db.ItemTypeAccountCredit, Amount: decimal.NewFromInt(-50), Currency: "EUR", ExchangeRate: decimal.NewFromInt(1)},
+	}
+	// the inclusive tax was calculated on the discounted amount, but the
+	// shares follow the net amounts before discounts
+	taxLines := []db.DbTaxLine{{ItemId: 2, Jurisdiction: "DE", Rate: decimal.RequireFromString("0.19"), Amount: decimal.RequireFromString("17.1"), Inclusive: true}}
+	discounts := []db.DbBillDiscount{{CouponCode: "Q1", Amount: decimal.NewFromInt(20)}}
+
+	shares := db.DiscountShares("EUR", items, taxLines, discounts)
+	require.Len(t, shares, 1)
+	require.True(t, decimal.NewFromInt(10).Equal(shares[0][0]), "share is %s", shares[0][0])
+	require.True(t, decimal.NewFromInt(10).Equal(shares[0][1]), "share is %s", shares[0][1])
+	require.True(t, shares[0][2].IsZero(), "account credit is not discounted")
+
+	totals := db.NewBillTotals("EUR", items, taxLines, discounts)
+	require.True(t, decimal.NewFromInt(200).Equal(totals.Subtotal), "subtotal is %s", totals.Subtotal)
+}
+
+func TestNewBillTotalsWithAccountCredit(t *testing.T) {
+	items := []db.DbBillItem{
+		{Id: 1, Type: db.ItemTypeCharge, Amount: decimal.NewFromInt(100), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+		{Id: 2, Type: db.ItemTypeAccountCredit, Amount: decimal.NewFromInt(-30), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+	}
+	taxLines := []db.DbTaxLine{{ItemId: 1, Jurisdiction: "US-NY", Amount: decimal.NewFromInt(8)}}
+
+	totals := db.NewBillTotals("USD", items, taxLines, nil)
+	// credit settles the taxed total rather than reducing the subtotal
+	require.True(t, decimal.NewFromInt(100).Equal(totals.Subtotal))
+	require.True(t, decimal.NewFromInt(30).Equal(totals.CreditAmount))
+	require.True(t, decimal.NewFromInt(78).Equal(totals.TotalAmount), "total is %s", totals.TotalAmount)
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type DbMeter struct {
+	Key         string          `db:"key,pk"`
+	Name        string          `db:"name"`
+	Aggregation string          `db:"aggregation"`
+	UnitPrice   decimal.Decimal `db:"unit_price"`
+	Currency    string          `db:"currency"`
+	CreatedAt   time.Time       `db:"created_at"`
+}
+
+type DbUsageEvent struct {
+	Id        int64           `db:"id,pk,auto"`
+	AccountId string          `db:"account_id"` // index
+	MeterKey  string          `db:"meter_key"`
+	Quantity  decimal.Decimal `db:"quantity"`
+	// Value is counted by unique_count meters
+	Value          string    `db:"value"`
+	Timestamp      time.Time `db:"timestamp"`
+	IdempotencyKey string    `db:"idempotency_key"` // unique per account
+	// SubscriptionId is the subscription whose bills bill the event, nil for
+	// the account's bills outside subscriptions
+	SubscriptionId *string `db:"subscription_id"`
+	// BillId is the bill the event was billed on, nil until then
+	BillId    *string   `db:"bill_id"`
+	CreatedAt time.Time `db:"created_at"`
+	// PeriodStart is the start of the billing period the event belongs to,
+	// set by GetUnbilledUsage
+	PeriodStart time.Time `db:"-"`
+}
+
+// ErrUsageBilled is returned by InsertUsageItems when some of the events were
+// billed on another bill since they were read.
+var ErrUsageBilled = &errs.Error{Code: errs.Aborted, Message: "Usage events were billed concurrently"}
+
+const meterColumns = `key, name, aggregation, unit_price, currency, created_at`
+
+func scanMeter(row rowScanner) (*DbMeter, error) {
+	var m DbMeter
+	err := row.Scan(&m.Key, &m.Name, &m.Aggregation, &m.UnitPrice, &m.Currency, &m.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Meter not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func InsertMeter(ctx context.Context, key, name, aggregation string, unitPrice decimal.Decimal, currency string) (*DbMeter, error) {
+	query := `
+		INSERT INTO meter (key, name, aggregation, unit_price, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		RETURNING ` + meterColumns
+	meter, err := scanMeter(db.QueryRow(ctx, query, key, name, aggregation, unitPrice, currency))
+	if isUniqueViolation(err, "meter_pkey") {
+		return nil, &errs.Error{Code: errs.AlreadyExists, Message: "Meter " + key + " already exists"}
+	}
+	return meter, err
+}
+
+func GetMeter(ctx context.Context, key string) (*DbMeter, error) {
+	return scanMeter(db.QueryRow(ctx, `SELECT `+meterColumns+` FROM meter WHERE key = $1`, key))
+}
+
+func GetMeters(ctx context.Context) ([]DbMeter, error) {
+	rows, err := db.Query(ctx, `SELECT `+meterColumns+` FROM meter ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var meters []DbMeter
+	for rows.Next() {
+		meter, err := scanMeter(rows)
+		if err != nil {
+			return nil, err
+		}
+		meters = append(meters, *meter)
+	}
+	return meters, rows.Err()
+}
+
+// InsertUsageEvent records a usage event, reporting false if an event with
+// the same idempotency key was already recorded for the account.
+func InsertUsageEvent(ctx context.Context, accountId string, subscriptionId *string, meterKey string, quantity decimal.Decimal, value string, timestamp time.Time, idempotencyKey string) (bool, error) {
+	const query = `
+		INSERT INTO usage_event (account_id, subscription_id, meter_key, quantity, value, timestamp, idempotency_key, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+		ON CONFLICT (account_id, idempotency_key) DO NOTHING
+	`
+	result, err := db.Exec(ctx, query, accountId, subscriptionId, meterKey, quantity, value, timestamp, idempotencyKey)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// GetUnbilledUsage returns the events not yet billed that the bill bills,
+// with the start of the period each belongs to. An event belongs to the
+// period of the latest bill of its subscription, or of its account's bills
+// outside subscriptions, that starts by its timestamp, and to the earliest
+// bill for events before all of them. Subscription bills bill their
+// subscription's events up to the end of their period, including late events
+// of earlier periods. Bills outside subscriptions bill the events of their
+// own period and the late events of closed bills in the same currency, so
+// a bill in another currency never takes them.
+func GetUnbilledUsage(ctx context.Context, bill *DbBill) ([]DbUsageEvent, error) {
+	query := `
+		SELECT e.id, e.account_id, e.subscription_id, e.meter_key, e.quantity, e.value, e.timestamp, e.idempotency_key, e.bill_id, e.created_at,
+			COALESCE(o.period_start, $3)
+		FROM usage_event e
+		LEFT JOIN LATERAL (
+			SELECT o.id, o.status, o.currency, o.period_start
+			FROM bill o
+			WHERE o.account_id = e.account_id AND o.subscription_id IS NOT DISTINCT FROM e.subscription_id AND o.status <> 'voided'
+			ORDER BY o.period_start <= e.timestamp DESC,
+				CASE WHEN o.period_start <= e.timestamp THEN o.period_start END DESC,
+				o.period_start, o.id
+			LIMIT 1
+		) o ON true
+		WHERE e.account_id = $1 AND e.bill_id IS NULL AND e.timestamp < $2 AND `
+	args := []any{bill.AccountId, bill.PeriodEnd, bill.PeriodStart}
+	if bill.SubscriptionId != nil {
+		query += `e.subscription_id = $4`
+		args = append(args, *bill.SubscriptionId)
+	} else {
+		query += `e.subscription_id IS NULL AND (o.id = $4 OR (
+			o.status NOT IN ('draft', 'open', 'closing') AND o.currency = $5 AND o.period_start < $3))`
+		args = append(args, bill.Id, bill.Currency)
+	}
+	query += ` ORDER BY e.id`
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []DbUsageEvent
+	for rows.Next() {
+		var e DbUsageEvent
+		err := rows.Scan(&e.Id, &e.AccountId, &e.SubscriptionId, &e.MeterKey, &e.Quantity, &e.Value, &e.Timestamp, &e.IdempotencyKey, &e.BillId, &e.CreatedAt, &e.PeriodStart)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, e)
+	}
+	return usage, rows.Err()
+}
+
+// InsertUsageItems adds the items pricing usage events to a bill and marks
+// the events billed on it, in one transaction. Events billed concurrently on
+// another bill fail the transaction with ErrUsageBilled so they are never
+// billed twice.
+func InsertUsageItems(ctx context.Context, billId string, items []DbBillItem, eventIds []int64) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bill, err := lockBillForItems(ctx, tx, billId)
+	if err != nil {
+		return err
+	}
+	if !acceptsItems(bill.Status) {
+		return &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+
+	for _, item := range items {
+		item.BillId = billId
+		if _, err := insertBillItem(ctx, tx, bill, item); err != nil {
+			return err
+		}
+	}
+
+	const query = `
+		UPDATE usage_event
+		SET bill_id = $1
+		WHERE id = ANY($2) AND bill_id IS NULL
+	`
+	result, err := tx.Exec(ctx, query, billId, eventIds)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() != int64(len(eventIds)) {
+		return ErrUsageBilled
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type DbWebhookEndpoint struct {
+	Id        int64  `db:"id,pk,auto"`
+	AccountId string `db:"account_id"` // index
+	URL       string `db:"url"`
+	Secret    string `db:"secret" json:"-"`
+	// EventTypes are the topics delivered to the endpoint, empty for all
+	EventTypes []string  `db:"event_types"`
+	Active     bool      `db:"active"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	// DeliveryFailed deliveries have exhausted their retries and can be
+	// replayed
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+type DbWebhookDelivery struct {
+	Id             int64          `db:"id,pk,auto"`
+	EndpointId     int64          `db:"endpoint_id"`
+	EventId        string         `db:"event_id"`
+	EventType      string         `db:"event_type"`
+	Payload        string         `db:"payload"`
+	Status         DeliveryStatus `db:"status"`
+	Attempts       int            `db:"attempts"`
+	LastStatusCode *int           `db:"last_status_code"`
+	LastError      string         `db:"last_error"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	DeliveredAt    *time.Time     `db:"delivered_at"`
+}
+
+const webhookEndpointColumns = `id, account_id, url, secret, event_types, active, created_at`
+
+func scanWebhookEndpoint(row rowScanner) (*DbWebhookEndpoint, error) {
+	var e DbWebhookEndpoint
+	err := row.Scan(&e.Id, &e.AccountId, &e.URL, &e.Secret, &e.EventTypes, &e.Active, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func InsertWebhookEndpoint(ctx context.Context, accountId, url, secret string, eventTypes []string) (*DbWebhookEndpoint, error) {
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+	query := `
+		INSERT INTO webhook_endpoint (account_id, url, secret, event_types, created_at)
+		VALUES ($1, $2, $3, $4, now())
+		RETURNING ` + webhookEndpointColumns
+	return scanWebhookEndpoint(db.QueryRow(ctx, query, accountId, url, secret, eventTypes))
+}
+
+func GetWebhookEndpoint(ctx context.Context, id int64) (*DbWebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoint WHERE id = $1`
+	endpoint, err := scanWebhookEndpoint(db.QueryRow(ctx, query, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Webhook endpoint not found"}
+	}
+	return endpoint, err
+}
+
+func GetWebhookEndpoints(ctx context.Context, accountId string) ([]DbWebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoint WHERE account_id = $1 ORDER BY id`
+	return queryWebhookEndpoints(ctx, query, accountId)
+}
+
+// GetWebhookEndpointsForEvent returns the active endpoints of an account
+// subscribed to eventType.
+func GetWebhookEndpointsForEvent(ctx context.Context, accountId, eventType string) ([]DbWebhookEndpoint, error) {
+	query := `
+		SELECT ` + webhookEndpointColumns + `
+		FROM webhook_endpoint
+		WHERE account_id = $1 AND active AND (cardinality(event_types) = 0 OR $2 = ANY(event_types))
+		ORDER BY id
+	`
+	return queryWebhookEndpoints(ctx, query, accountId, eventType)
+}
+
+func queryWebhookEndpoints(ctx context.Context, query string, args ...interface{}) ([]DbWebhookEndpoint, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []DbWebhookEndpoint
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, *endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+// DeactivateWebhookEndpoint stops new deliveries to an endpoint. Its
+// delivery log is kept.
+func DeactivateWebhookEndpoint(ctx context.Context, id int64) error {
+	result, err := db.Exec(ctx, `UPDATE webhook_endpoint SET active = FALSE WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return &errs.Error{Code: errs.NotFound, Message: "Webhook endpoint not found"}
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event_type, payload, status, attempts, last_status_code, last_error, created_at, updated_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*DbWebhookDelivery, error) {
+	var d DbWebhookDelivery
+	err := row.Scan(&d.Id, &d.EndpointId, &d.EventId, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// InsertWebhookDelivery records a pending delivery of an event to an
+// endpoint. It is idempotent on (endpointId, eventId), returning the existing
+// delivery for a redelivered event.
+func InsertWebhookDelivery(ctx context.Context, endpointId int64, eventId, eventType string, payload []byte) (*DbWebhookDelivery, error) {
+	query := `
+		INSERT INTO webhook_delivery (endpoint_id, event_id, event_type, payload, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, now(), now())
+		ON CONFLICT (endpoint_id, event_id) DO UPDATE SET event_id = EXCLUDED.event_id
+		RETURNING ` + webhookDeliveryColumns
+	return scanWebhookDelivery(db.QueryRow(ctx, query, endpointId, eventId, eventType, string(payload), DeliveryPending))
+}
+
+func GetWebhookDelivery(ctx context.Context, id int64) (*DbWebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_delivery WHERE id = $1`
+	delivery, err := scanWebhookDelivery(db.QueryRow(ctx, query, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Webhook delivery not found"}
+	}
+	return delivery, err
+}
+
+// GetWebhookDeliveries returns the delivery log of an endpoint, newest first.
+func GetWebhookDeliveries(ctx context.Context, endpointId int64, limit int) ([]DbWebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_delivery
+		WHERE endpoint_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`
+	rows, err := db.Query(ctx, query, endpointId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []DbWebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt logs an attempt to deliver. statusCode is nil when the
+// endpoint could not be reached.
+func RecordWebhookAttempt(ctx context.Context, id int64, statusCode *int, attemptErr string, succeeded bool) error {
+	const query = `
+		UPDATE webhook_delivery
+		SET attempts = attempts + 1,
+			last_status_code = $2,
+			last_error = $3,
+			status = CASE WHEN $4 THEN $5 ELSE status END,
+			delivered_at = CASE WHEN $4 THEN now() ELSE delivered_at END,
+			updated_at = now()
+		WHERE id = $1
+	`
+	_, err := db.Exec(ctx, query, id, statusCode, attemptErr, succeeded, DeliverySucceeded)
+	return err
+}
+
+// SetWebhookDeliveryStatus moves a delivery to status, e.g. failed once its
+// retries are exhausted or back to pending when it is replayed.
+func SetWebhookDeliveryStatus(ctx context.Context, id int64, status DeliveryStatus) error {
+	_, err := db.Exec(ctx, `UPDATE webhook_delivery SET status = $2, updated_at = now() WHERE id = $1`, id, status)
+	return err
+}
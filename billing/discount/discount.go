@@ -0,0 +1,157 @@
+// Package discount computes the discounts coupons grant on bills.
+package discount
+
+import (
+	"errors"
+	"strings"
+
+	"encore.app/billing/currency"
+	"github.com/shopspring/decimal"
+)
+
+type Type string
+
+const (
+	// Percent takes PercentOff percent off the bill subtotal
+	Percent Type = "percent"
+	// Fixed takes AmountOff off the bill subtotal, in the coupon's currency
+	Fixed Type = "fixed"
+)
+
+type Duration string
+
+const (
+	// Once discounts the bill the coupon is applied to
+	Once Duration = "once"
+	// Repeating discounts DurationInBills bills of the account, starting
+	// with the bill the coupon is applied to
+	Repeating Duration = "repeating"
+	// Forever discounts every bill of the account from the one the coupon
+	// is applied to
+	Forever Duration = "forever"
+)
+
+type Coupon struct {
+	Type       Type
+	PercentOff decimal.Decimal
+	AmountOff  decimal.Decimal
+	// Currency restricts the coupon to bills in the currency, required for
+	// fixed coupons
+	Currency        string
+	Duration        Duration
+	DurationInBills int
+}
+
+var (
+	ErrUnknownType     = errors.New("discount: unknown coupon type")
+	ErrUnknownDuration = errors.New("discount: unknown coupon duration")
+	ErrPercentOff      = errors.New("discount: percent off must be between 0 and 100")
+	ErrAmountOff       = errors.New("discount: amount off must be positive")
+	ErrCurrency        = errors.New("discount: fixed coupons require a currency")
+	ErrDurationInBills = errors.New("discount: repeating coupons require a positive duration in bills")
+)
+
+func (c Coupon) Validate() error {
+	switch c.Type {
+	case Percent:
+		if !c.PercentOff.IsPositive() || c.PercentOff.GreaterThan(decimal.NewFromInt(100)) {
+			return ErrPercentOff
+		}
+	case Fixed:
+		if !c.AmountOff.IsPositive() {
+			return ErrAmountOff
+		}
+		if c.Currency == "" {
+			return ErrCurrency
+		}
+	default:
+		return ErrUnknownType
+	}
+
+	switch c.Duration {
+	case Once, Forever:
+	case Repeating:
+		if c.DurationInBills <= 0 {
+			return ErrDurationInBills
+		}
+	default:
+		return ErrUnknownDuration
+	}
+	return nil
+}
+
+// Bills returns the number of bills the coupon discounts, 0 for forever.
+func (c Coupon) Bills() int {
+	switch c.Duration {
+	case Once:
+		return 1
+	case Repeating:
+		return c.DurationInBills
+	default:
+		return 0
+	}
+}
+
+// AppliesTo reports whether the coupon can discount a bill in billCurrency.
+func (c Coupon) AppliesTo(billCurrency string) bool {
+	return c.Currency == "" || strings.EqualFold(c.Currency, billCurrency)
+}
+
+// Apply returns the discount each coupon grants on a subtotal in
+// billCurrency, in order. Percentages apply to the subtotal before any
+// discount, and the discounts never exceed the subtotal. Amounts are rounded
+// to the precision of the currency.
+func Apply(billCurrency string, subtotal decimal.Decimal, coupons []Coupon) []decimal.Decimal {
+	round := func(d decimal.Decimal) decimal.Decimal { return d }
+	if c, ok := currency.Lookup(billCurrency); ok {
+		round = c.Round
+	}
+
+	remaining := decimal.Max(subtotal, decimal.Zero)
+	amounts := make([]decimal.Decimal, len(coupons))
+	for i, c := range coupons {
+		var amount decimal.Decimal
+		switch {
+		case !c.AppliesTo(billCurrency):
+			amount = decimal.Zero
+		case c.Type == Percent:
+			amount = round(subtotal.Mul(c.PercentOff).Div(decimal.NewFromInt(100)))
+		default:
+			amount = c.AmountOff
+		}
+		amount = decimal.Max(decimal.Min(amount, remaining), decimal.Zero)
+		remaining = remaining.Sub(amount)
+		amounts[i] = amount
+	}
+	return amounts
+}
+
+// Allocate splits a discount across amounts in proportion to them, so it can
+// be taken off each before tax. Shares are rounded to the precision of
+// billCurrency and the last amount takes the rounding difference, so the
+// shares always sum to the discount.
+func Allocate(billCurrency string, discount decimal.Decimal, amounts []decimal.Decimal) []decimal.Decimal {
+	round := func(d decimal.Decimal) decimal.Decimal { return d }
+	if c, ok := currency.Lookup(billCurrency); ok {
+		round = c.Round
+	}
+
+	total := decimal.Zero
+	for _, a := range amounts {
+		total = total.Add(a)
+	}
+	shares := make([]decimal.Decimal, len(amounts))
+	allocated := decimal.Zero
+	for i, a := range amounts {
+		share := decimal.Zero
+		switch {
+		case i == len(amounts)-1:
+			share = round(discount).Sub(allocated)
+		case !total.IsZero():
+			share = round(discount.Mul(a).Div(total))
+		}
+		shares[i] = share
+		allocated = allocated.Add(share)
+	}
+	return shares
+}
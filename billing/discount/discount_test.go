@@ -0,0 +1,68 @@
+package discount_test
+
+import (
+	"testing"
+
+	"encore.app/billing/discount"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func TestApply(t *testing.T) {
+	coupons := []discount.Coupon{
+		{Type: discount.Percent, PercentOff: d("12.5"), Duration: discount.Once},
+		{Type: discount.Fixed, AmountOff: d("20"), Currency: "USD", Duration: discount.Forever},
+		{Type: discount.Fixed, AmountOff: d("5"), Currency: "EUR", Duration: discount.Forever},
+	}
+	amounts := discount.Apply("USD", d("99.99"), coupons)
+	require.Len(t, amounts, 3)
+	require.True(t, d("12.5").Equal(amounts[0]), "got %s", amounts[0])
+	require.True(t, d("20").Equal(amounts[1]))
+	// restricted to another currency
+	require.True(t, amounts[2].IsZero())
+}
+
+func TestApplyNeverExceedsSubtotal(t *testing.T) {
+	coupons := []discount.Coupon{
+		{Type: discount.Percent, PercentOff: d("50"), Duration: discount.Once},
+		{Type: discount.Fixed, AmountOff: d("100"), Currency: "USD", Duration: discount.Once},
+	}
+	amounts := discount.Apply("USD", d("30"), coupons)
+	require.True(t, d("15").Equal(amounts[0]))
+	require.True(t, d("15").Equal(amounts[1]))
+
+	amounts = discount.Apply("USD", d("-10"), coupons)
+	require.True(t, amounts[0].IsZero())
+	require.True(t, amounts[1].IsZero())
+}
+
+func TestValidate(t *testing.T) {
+	require.ErrorIs(t, discount.Coupon{Type: "bogo", Duration: discount.Once}.Validate(), discount.ErrUnknownType)
+	require.ErrorIs(t, discount.Coupon{Type: discount.Percent, PercentOff: d("101"), Duration: discount.Once}.Validate(), discount.ErrPercentOff)
+	require.ErrorIs(t, discount.Coupon{Type: discount.Fixed, AmountOff: d("5"), Duration: discount.Once}.Validate(), discount.ErrCurrency)
+	require.ErrorIs(t, discount.Coupon{Type: discount.Percent, PercentOff: d("5"), Duration: discount.Repeating}.Validate(), discount.ErrDurationInBills)
+	require.ErrorIs(t, discount.Coupon{Type: discount.Percent, PercentOff: d("5"), Duration: "weekly"}.Validate(), discount.ErrUnknownDuration)
+	require.NoError(t, discount.Coupon{Type: discount.Percent, PercentOff: d("5"), Duration: discount.Repeating, DurationInBills: 3}.Validate())
+
+	require.Equal(t, 1, discount.Coupon{Duration: discount.Once}.Bills())
+	require.Equal(t, 0, discount.Coupon{Duration: discount.Forever}.Bills())
+}
+
+func TestAllocate(t *testing.T) {
+	shares := discount.Allocate("USD", d("10"), []decimal.Decimal{d("100"), d("50"), d("50")})
+	require.Len(t, shares, 3)
+	require.True(t, d("5").Equal(shares[0]), "got %s", shares[0])
+	require.True(t, d("2.5").Equal(shares[1]))
+	require.True(t, d("2.5").Equal(shares[2]))
+
+	// the last amount takes the rounding difference
+	shares = discount.Allocate("USD", d("10"), []decimal.Decimal{d("1"), d("1"), d("1")})
+	require.True(t, d("3.33").Equal(shares[0]))
+	require.True(t, d("3.34").Equal(shares[2]), "got %s", shares[2])
+
+	require.Empty(t, discount.Allocate("USD", d("10"), nil))
+}
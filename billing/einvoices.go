@@ -0,0 +1,150 @@
+package billing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"encore.app/billing/db"
+	"encore.app/billing/ubl"
+	"encore.dev"
+	"encore.dev/beta/errs"
+)
+
+type SetBillingPartyRequest struct {
+	Name  string `json:"name"`
+	VatId string `json:"vat_id"`
+	// EndpointId is the account's Peppol electronic address in the ICD
+	// scheme EndpointScheme, e.g. 0088 for a GLN or 9930 for a German VAT id
+	EndpointId     string `json:"endpoint_id"`
+	EndpointScheme string `json:"endpoint_scheme"`
+	Street         string `json:"street"`
+	City           string `json:"city"`
+	PostalCode     string `json:"postal_code"`
+	Country        string `json:"country"`
+}
+
+// SetBillingParty sets the legal details of an account, identifying it as
+// the buyer on its e-invoices.
+//
+//encore:api public method=PUT path=/accounts/:accountId/billing-party
+func (s *Service) SetBillingParty(ctx context.Context, accountId string, req *SetBillingPartyRequest) (*db.DbBillingParty, error) {
+	if req.Name == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Name is required"}
+	}
+	if (req.EndpointId == "") != (req.EndpointScheme == "") {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Endpoint id and scheme must be set together"}
+	}
+	country, err := countryCode(req.Country)
+	if err != nil {
+		return nil, err
+	}
+	return db.UpsertBillingParty(ctx, db.DbBillingParty{
+		AccountId:      accountId,
+		Name:           req.Name,
+		VatId:          strings.ToUpper(req.VatId),
+		EndpointId:     req.EndpointId,
+		EndpointScheme: req.EndpointScheme,
+		Street:         req.Street,
+		City:           req.City,
+		PostalCode:     req.PostalCode,
+		Country:        country,
+	})
+}
+
+//encore:api public method=GET path=/accounts/:accountId/billing-party
+func (s *Service) GetBillingParty(ctx context.Context, accountId string) (*db.DbBillingParty, error) {
+	return db.GetBillingParty(ctx, accountId)
+}
+
+// DownloadInvoiceUBL returns the invoice of a finalized bill as a UBL 2.1
+// e-invoice conforming to Peppol BIS Billing 3.0. Bills that cannot be
+// expressed conformantly, such as those missing the buyer's billing party,
+// are rejected with the rules they break.
+//
+//encore:api public raw method=GET path=/bills/:billId/invoice.xml
+func (s *Service) DownloadInvoiceUBL(w http.ResponseWriter, req *http.Request) {
+	doc, err := exportUBL(req.Context(), encore.CurrentRequest().PathParams.Get("billId"))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(doc)
+}
+
+func exportUBL(ctx context.Context, billId string) ([]byte, error) {
+	inv, err := db.GetInvoice(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	bill, items, _, err := db.GetBillDetailsWithTotal(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	taxLines, err := db.GetBillTaxLines(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	discounts, err := db.GetBillDiscounts(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+
+	// a missing party or profile is reported by validation instead
+	var buyer ubl.PartyDetails
+	party, err := db.GetBillingParty(ctx, bill.AccountId)
+	if err == nil {
+		buyer = ubl.PartyDetails{
+			Name:           party.Name,
+			VatId:          party.VatId,
+			EndpointId:     party.EndpointId,
+			EndpointScheme: party.EndpointScheme,
+			Street:         party.Street,
+			City:           party.City,
+			PostalCode:     party.PostalCode,
+			Country:        party.Country,
+		}
+	} else if errs.Code(err) != errs.NotFound {
+		return nil, err
+	}
+	var exempt bool
+	profile, err := db.GetTaxProfile(ctx, bill.AccountId)
+	if err == nil {
+		exempt = profile.Exempt
+	} else if errs.Code(err) != errs.NotFound {
+		return nil, err
+	}
+
+	doc := ubl.New(ubl.Bill{
+		Bill:      *bill,
+		Items:     items,
+		TaxLines:  taxLines,
+		Discounts: discounts,
+		Number:    inv.Number,
+		IssuedAt:  inv.IssuedAt,
+		Seller: ubl.PartyDetails{
+			Name:           cfg.Seller.Name(),
+			VatId:          cfg.Seller.VatId(),
+			EndpointId:     cfg.Seller.EndpointId(),
+			EndpointScheme: cfg.Seller.EndpointScheme(),
+			Street:         cfg.Seller.Street(),
+			City:           cfg.Seller.City(),
+			PostalCode:     cfg.Seller.PostalCode(),
+			Country:        cfg.Seller.Country(),
+		},
+		Buyer:  buyer,
+		Exempt: exempt,
+	})
+	if violations := ubl.Validate(doc); len(violations) > 0 {
+		details := make([]string, len(violations))
+		for i, v := range violations {
+			details[i] = v.Error()
+		}
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "Bill does not conform to Peppol BIS Billing 3.0: " + strings.Join(details, "; "),
+		}
+	}
+	return ubl.Marshal(doc)
+}
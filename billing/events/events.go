@@ -0,0 +1,66 @@
+// Package events defines the bill events published to other services.
+//
+// Events are written to the outbox in the same transaction as the change
+// they describe and published by the outbox relay, so every committed change
+// is published at least once. Consumers should deduplicate on EventId, which
+// is stable across redeliveries. The events of a bill are published in the
+// order they happened, unless one of them is parked after failing to publish
+// and requeued later.
+package events
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type BillOpened struct {
+	EventId     string    `json:"event_id"`
+	BillId      string    `json:"bill_id"`
+	AccountId   string    `json:"account_id"`
+	Currency    string    `json:"currency"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+type LineItemAdded struct {
+	EventId      string          `json:"event_id"`
+	BillId       string          `json:"bill_id"`
+	AccountId    string          `json:"account_id"`
+	ItemId       int64           `json:"item_id"`
+	Reference    string          `json:"reference"`
+	Description  string          `json:"description"`
+	Type         string          `json:"type"`
+	Amount       decimal.Decimal `json:"amount"`
+	Currency     string          `json:"currency"`
+	ExchangeRate decimal.Decimal `json:"exchange_rate"`
+	OccurredAt   time.Time       `json:"occurred_at"`
+}
+
+type BillClosed struct {
+	EventId     string          `json:"event_id"`
+	BillId      string          `json:"bill_id"`
+	AccountId   string          `json:"account_id"`
+	Currency    string          `json:"currency"`
+	TotalAmount decimal.Decimal `json:"total_amount"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+}
+
+type BillVoided struct {
+	EventId    string    `json:"event_id"`
+	BillId     string    `json:"bill_id"`
+	AccountId  string    `json:"account_id"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Topic names, as stored in the outbox. They match the names the topics are
+// declared with.
+const (
+	BillOpenedTopic    = "bill-opened"
+	LineItemAddedTopic = "line-item-added"
+	BillClosedTopic    = "bill-closed"
+	BillVoidedTopic    = "bill-voided"
+)
@@ -0,0 +1,41 @@
+package billing
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+type PutExchangeRateRequest struct {
+	BaseCurrency  string          `json:"base_currency"`
+	QuoteCurrency string          `json:"quote_currency"`
+	Rate          decimal.Decimal `json:"rate"`
+	EffectiveAt   time.Time       `json:"effective_at"`
+}
+
+type PutExchangeRateResponse struct {
+	Id int64 `json:"id"`
+}
+
+// PutExchangeRate records the rate converting one unit of the base currency
+// into the quote currency from effective_at onwards.
+//
+//encore:api public method=POST path=/exchange-rates
+func (s *Service) PutExchangeRate(ctx context.Context, req *PutExchangeRateRequest) (*PutExchangeRateResponse, error) {
+	if req.BaseCurrency == "" || req.QuoteCurrency == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Base and quote currencies are required"}
+	}
+	if !req.Rate.IsPositive() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Rate must be positive"}
+	}
+
+	id, err := db.InsertExchangeRate(ctx, strings.ToUpper(req.BaseCurrency), strings.ToUpper(req.QuoteCurrency), req.Rate, req.EffectiveAt)
+	if err != nil {
+		return nil, err
+	}
+	return &PutExchangeRateResponse{Id: id}, nil
+}
@@ -0,0 +1,169 @@
+package billing
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/shopspring/decimal"
+)
+
+// exportFlushRows is how many rows are written between flushes to the client.
+const exportFlushRows = 500
+
+var exportColumns = []string{
+	"bill_id", "account_id", "status", "bill_currency", "period_start", "period_end", "total_amount",
+	"item_id", "reference", "description", "type", "amount", "currency", "exchange_rate", "converted_amount",
+	"quantity", "unit_price", "item_created_at",
+}
+
+// ExportBills streams the line items of the bills matching the query, joined
+// with their bill and converted to the bill's currency, as CSV or JSON lines
+// (format=csv or format=jsonl, CSV by default). Bills are filtered by
+// account_id, status (repeated or comma separated), currency, and period_from
+// and period_to selecting bills whose period overlaps the range.
+//
+//encore:api public raw method=GET path=/exports/bills
+func (s *Service) ExportBills(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter, err := exportFilter(query)
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	var write func(db.BillExportRow) error
+	var flush func() error
+	switch format := query.Get("format"); format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="bills.csv"`)
+		out := csv.NewWriter(w)
+		if err := out.Write(exportColumns); err != nil {
+			rlog.Error("failed to export bills", "rows", 0, "error", err)
+			return
+		}
+		write = func(r db.BillExportRow) error { return out.Write(exportRecord(r)) }
+		flush = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="bills.jsonl"`)
+		enc := json.NewEncoder(w)
+		write = func(r db.BillExportRow) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	default:
+		errs.HTTPError(w, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown format " + format})
+		return
+	}
+
+	rows := 0
+	flusher, _ := w.(http.Flusher)
+	err = db.ExportBills(req.Context(), filter, func(r db.BillExportRow) error {
+		if err := write(r); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	// the status was sent with the first rows, so the export is cut short
+	if err != nil && !errors.Is(err, context.Canceled) {
+		rlog.Error("failed to export bills", "rows", rows, "error", err)
+	}
+}
+
+func exportFilter(query url.Values) (db.BillFilter, error) {
+	filter := db.BillFilter{
+		AccountId: query.Get("account_id"),
+		Currency:  strings.ToUpper(query.Get("currency")),
+	}
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if !db.Status(status).IsValid() {
+				return filter, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown status " + status}
+			}
+			filter.Statuses = append(filter.Statuses, db.Status(status))
+		}
+	}
+	var err error
+	if filter.PeriodFrom, err = parseTime("period_from", query.Get("period_from")); err != nil {
+		return filter, err
+	}
+	if filter.PeriodTo, err = parseTime("period_to", query.Get("period_to")); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, &errs.Error{Code: errs.InvalidArgument, Message: "Invalid " + name + ", expected an RFC 3339 time"}
+	}
+	return t, nil
+}
+
+// exportRecord formats a row as CSV fields in the order of exportColumns.
+// Null values are empty and free text is neutralised with csvText.
+func exportRecord(r db.BillExportRow) []string {
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return csvText(*s)
+	}
+	dec := func(d decimal.NullDecimal) string {
+		if !d.Valid {
+			return ""
+		}
+		return d.Decimal.String()
+	}
+	var itemId, itemType, itemCreatedAt string
+	if r.ItemId != nil {
+		itemId = strconv.FormatInt(*r.ItemId, 10)
+	}
+	if r.Type != nil {
+		itemType = string(*r.Type)
+	}
+	if r.ItemCreatedAt != nil {
+		itemCreatedAt = r.ItemCreatedAt.Format(time.RFC3339)
+	}
+	return []string{
+		csvText(r.BillId), csvText(r.AccountId), string(r.Status), r.BillCurrency, r.PeriodStart.Format(time.RFC3339), r.PeriodEnd.Format(time.RFC3339), dec(r.TotalAmount),
+		itemId, str(r.Reference), str(r.Description), itemType, dec(r.Amount), str(r.Currency), dec(r.ExchangeRate), dec(r.ConvertedAmount),
+		dec(r.Quantity), dec(r.UnitPrice), itemCreatedAt,
+	}
+}
+
+// csvText keeps a value from being run as a formula when the export is opened
+// in a spreadsheet, by prefixing the characters that start one with a quote.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,23 @@
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LoadFile reads a JSON array of rates into a StaticProvider.
+//
+//	[{"base": "EUR", "quote": "USD", "rate": "1.08", "effective_at": "2024-01-01T00:00:00Z"}]
+func LoadFile(path string) (*StaticProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rates file: %w", err)
+	}
+
+	var rates []Rate
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("parse rates file: %w", err)
+	}
+	return NewStaticProvider(rates...), nil
+}
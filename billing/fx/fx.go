@@ -0,0 +1,92 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrRateNotFound is returned when no rate is effective for a currency pair.
+var ErrRateNotFound = errors.New("fx: exchange rate not found")
+
+// FXRateProvider returns the rate converting one unit of from into to,
+// effective at the given time.
+type FXRateProvider interface {
+	Rate(ctx context.Context, from, to string, at time.Time) (decimal.Decimal, error)
+}
+
+// Rate is an exchange rate from Base to Quote effective from EffectiveAt
+// until superseded by a later rate for the same pair.
+type Rate struct {
+	Base        string          `json:"base"`
+	Quote       string          `json:"quote"`
+	Rate        decimal.Decimal `json:"rate"`
+	EffectiveAt time.Time       `json:"effective_at"`
+}
+
+// lookup resolves from -> to using find for a single direct pair. When no
+// direct rate exists the inverse pair is tried.
+func lookup(ctx context.Context, from, to string, at time.Time, find func(ctx context.Context, base, quote string, at time.Time) (decimal.Decimal, error)) (decimal.Decimal, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == to {
+		return decimal.NewFromInt(1), nil
+	}
+
+	rate, err := find(ctx, from, to, at)
+	if err == nil {
+		return rate, nil
+	}
+	if !errors.Is(err, ErrRateNotFound) {
+		return decimal.Zero, err
+	}
+
+	inverse, err := find(ctx, to, from, at)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if inverse.IsZero() {
+		return decimal.Zero, ErrRateNotFound
+	}
+	return decimal.NewFromInt(1).DivRound(inverse, 10), nil
+}
+
+// StaticProvider serves rates from memory.
+type StaticProvider struct {
+	rates map[string][]Rate
+}
+
+var _ FXRateProvider = (*StaticProvider)(nil)
+
+func NewStaticProvider(rates ...Rate) *StaticProvider {
+	p := &StaticProvider{rates: map[string][]Rate{}}
+	for _, r := range rates {
+		key := pairKey(r.Base, r.Quote)
+		p.rates[key] = append(p.rates[key], r)
+	}
+	// newest first, so the first rate effective at a time wins
+	for _, rates := range p.rates {
+		sort.Slice(rates, func(i, j int) bool { return rates[i].EffectiveAt.After(rates[j].EffectiveAt) })
+	}
+	return p
+}
+
+func (p *StaticProvider) Rate(ctx context.Context, from, to string, at time.Time) (decimal.Decimal, error) {
+	return lookup(ctx, from, to, at, p.find)
+}
+
+func (p *StaticProvider) find(ctx context.Context, base, quote string, at time.Time) (decimal.Decimal, error) {
+	for _, r := range p.rates[pairKey(base, quote)] {
+		if !r.EffectiveAt.After(at) {
+			return r.Rate, nil
+		}
+	}
+	return decimal.Zero, ErrRateNotFound
+}
+
+func pairKey(base, quote string) string {
+	return strings.ToUpper(base) + "/" + strings.ToUpper(quote)
+}
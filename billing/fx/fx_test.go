@@ -0,0 +1,67 @@
+package fx_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"encore.app/billing/fx"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticProviderEffectiveDatedRates(t *testing.T) {
+	ctx := context.Background()
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	provider := fx.NewStaticProvider(
+		fx.Rate{Base: "EUR", Quote: "USD", Rate: decimal.RequireFromString("1.10"), EffectiveAt: jan},
+		fx.Rate{Base: "EUR", Quote: "USD", Rate: decimal.RequireFromString("1.08"), EffectiveAt: feb},
+	)
+
+	// The latest rate effective at the time is used
+	rate, err := provider.Rate(ctx, "EUR", "USD", jan.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.True(t, decimal.RequireFromString("1.10").Equal(rate), "january rate should apply")
+
+	rate, err = provider.Rate(ctx, "eur", "usd", feb.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.True(t, decimal.RequireFromString("1.08").Equal(rate), "february rate should apply")
+
+	// No rate is effective before the first one
+	_, err = provider.Rate(ctx, "EUR", "USD", jan.Add(-time.Hour))
+	require.ErrorIs(t, err, fx.ErrRateNotFound)
+}
+
+func TestStaticProviderSameCurrencyAndInverse(t *testing.T) {
+	ctx := context.Background()
+	provider := fx.NewStaticProvider(
+		fx.Rate{Base: "USD", Quote: "SGD", Rate: decimal.RequireFromString("1.25"), EffectiveAt: time.Time{}},
+	)
+
+	rate, err := provider.Rate(ctx, "ETH", "ETH", time.Now())
+	require.NoError(t, err)
+	require.True(t, decimal.NewFromInt(1).Equal(rate), "same currency should convert at 1")
+
+	rate, err = provider.Rate(ctx, "SGD", "USD", time.Now())
+	require.NoError(t, err)
+	require.True(t, decimal.RequireFromString("0.8").Equal(rate), "inverse pair should be used")
+
+	_, err = provider.Rate(ctx, "USD", "JPY", time.Now())
+	require.ErrorIs(t, err, fx.ErrRateNotFound)
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	data := `[{"base": "ETH", "quote": "USD", "rate": "3000.123456789", "effective_at": "2024-01-01T00:00:00Z"}]`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	provider, err := fx.LoadFile(path)
+	require.NoError(t, err)
+
+	rate, err := provider.Rate(context.Background(), "ETH", "USD", time.Now())
+	require.NoError(t, err)
+	require.True(t, decimal.RequireFromString("3000.123456789").Equal(rate))
+}
@@ -0,0 +1,26 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+// PostgresProvider serves effective-dated rates from the exchange_rate table.
+type PostgresProvider struct{}
+
+var _ FXRateProvider = PostgresProvider{}
+
+func (PostgresProvider) Rate(ctx context.Context, from, to string, at time.Time) (decimal.Decimal, error) {
+	return lookup(ctx, from, to, at, func(ctx context.Context, base, quote string, at time.Time) (decimal.Decimal, error) {
+		rate, err := db.GetExchangeRate(ctx, base, quote, at)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return decimal.Zero, ErrRateNotFound
+		}
+		return rate, err
+	})
+}
@@ -0,0 +1,382 @@
+package billing
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"encore.app/billing/activity"
+	"encore.app/billing/db"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	// importMaxBytes and importMaxRows bound the size of an import file
+	importMaxBytes = 64 << 20
+	importMaxRows  = 100000
+	// importBatchSize is how many items are delivered in one workflow update
+	importBatchSize = 500
+)
+
+const (
+	ImportAccepted  = "accepted"
+	ImportDuplicate = "duplicate"
+	ImportRejected  = "rejected"
+)
+
+// importRow is one line item of an import file.
+type importRow struct {
+	BillId      string `json:"bill_id"`
+	Reference   string `json:"reference"`
+	Description string `json:"description"`
+	Amount      string `json:"amount"`
+	Currency    string `json:"currency"`
+}
+
+type ImportRowResult struct {
+	// Row is the 1-based position of the item in the file, not counting the
+	// CSV header
+	Row       int    `json:"row"`
+	BillId    string `json:"bill_id"`
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ImportItemsResponse struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Rejected   int               `json:"rejected"`
+	Rows       []ImportRowResult `json:"rows"`
+}
+
+// ImportLineItems adds charges for one or many bills from a CSV file (with a
+// bill_id, reference, description, amount and currency header) or JSON lines
+// with the same fields, chosen by format=csv|jsonl or the Content-Type. Each
+// row is validated on its own and reported as accepted, duplicate (its
+// reference is already used on the bill) or rejected. Items are added through
+// each bill's workflow in batched updates, and rows whose item could not be
+// added, such as those in a currency without an exchange rate, are rejected.
+//
+//encore:api public raw method=POST path=/imports/items
+func (s *Service) ImportLineItems(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, importMaxBytes)
+	rows, err := readImport(body, importFormat(req))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+
+	ctx := req.Context()
+	resp := &ImportItemsResponse{Rows: make([]ImportRowResult, len(rows))}
+	inputs := make([]activity.AddLineItemSignalInput, len(rows))
+	bills := map[string]*db.DbBill{}
+	seen := map[[2]string]bool{}
+	var billIds []string
+	billSeen := map[string]bool{}
+	for i, row := range rows {
+		result := &resp.Rows[i]
+		*result = ImportRowResult{Row: i + 1, BillId: row.BillId, Reference: row.Reference, Status: ImportAccepted}
+
+		input, err := importLineItem(row)
+		if err == nil {
+			err = importBill(ctx, bills, row.BillId)
+		}
+		if err != nil {
+			var rowErr *errs.Error
+			if !errors.As(err, &rowErr) {
+				errs.HTTPError(w, err)
+				return
+			}
+			result.Status, result.Error = ImportRejected, rowErr.Message
+			continue
+		}
+		key := [2]string{row.BillId, row.Reference}
+		if seen[key] {
+			result.Status, result.Error = ImportDuplicate, "Reference is repeated in the file"
+			continue
+		}
+		if !billSeen[row.BillId] {
+			billSeen[row.BillId] = true
+			billIds = append(billIds, row.BillId)
+		}
+		seen[key] = true
+		inputs[i] = *input
+	}
+
+	for _, billId := range billIds {
+		s.deliverImport(ctx, billId, resp.Rows, inputs)
+	}
+
+	for _, result := range resp.Rows {
+		switch result.Status {
+		case ImportAccepted:
+			resp.Accepted++
+		case ImportDuplicate:
+			resp.Duplicates++
+		case ImportRejected:
+			resp.Rejected++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		rlog.Error("failed to write import report", "error", err)
+	}
+}
+
+// deliverImport adds the accepted rows of a bill through its workflow in
+// batched updates and reports each row from the outcome of its item.
+func (s *Service) deliverImport(ctx context.Context, billId string, results []ImportRowResult, inputs []activity.AddLineItemSignalInput) {
+	var pending []int
+	for i, result := range results {
+		if result.BillId == billId && result.Status == ImportAccepted {
+			pending = append(pending, i)
+		}
+	}
+
+	for len(pending) > 0 {
+		n := min(len(pending), importBatchSize)
+		batch, rest := pending[:n], pending[n:]
+		input := activity.AddLineItemsInput{BillId: billId, Items: make([]activity.AddLineItemSignalInput, n)}
+		for j, i := range batch {
+			input.Items[j] = inputs[i]
+		}
+
+		var items []activity.LineItemResult
+		handle, err := s.client.UpdateWorkflow(ctx, client.UpdateWorkflowOptions{
+			WorkflowID:   billId,
+			UpdateName:   activity.AddLineItemsUpdate,
+			WaitForStage: client.WorkflowUpdateStageCompleted,
+			Args:         []interface{}{input},
+		})
+		if err == nil {
+			err = handle.Get(ctx, &items)
+		}
+		var notFound *serviceerror.NotFound
+		var appErr *temporal.ApplicationError
+		switch {
+		case errors.As(err, &notFound):
+			// the workflow has completed since the bill was read
+			rejectImport(results, pending, "Bill is already closed")
+			return
+		case errors.As(err, &appErr):
+			rejectImport(results, pending, appErr.Message())
+			return
+		case err != nil:
+			rlog.Error("failed to deliver imported items", "bill_id", billId, "items", len(pending), "error", err)
+			rejectImport(results, pending, "Items could not be delivered to the bill")
+			return
+		}
+
+		for j, i := range batch {
+			switch item := items[j]; {
+			case item.Err() != nil:
+				results[i].Status, results[i].Error = ImportRejected, item.Error
+			case item.Duplicate:
+				results[i].Status, results[i].Error = ImportDuplicate, "Reference is already used on the bill"
+			}
+		}
+		pending = rest
+	}
+}
+
+func rejectImport(results []ImportRowResult, rows []int, message string) {
+	for _, i := range rows {
+		results[i].Status, results[i].Error = ImportRejected, message
+	}
+}
+
+// importLineItem validates the fields of a row.
+func importLineItem(row importRow) (*activity.AddLineItemSignalInput, error) {
+	if row.BillId == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Bill id is required"}
+	}
+	if err := lineItemReference(row.Reference); err != nil {
+		return nil, err
+	}
+	amount, err := decimal.NewFromString(strings.TrimSpace(row.Amount))
+	if err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Invalid amount " + row.Amount}
+	}
+	if amount.IsNegative() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount is negative"}
+	}
+	itemCurrency, err := lineItemCurrency(strings.TrimSpace(row.Currency))
+	if err != nil {
+		return nil, err
+	}
+	return &activity.AddLineItemSignalInput{
+		BillId:      row.BillId,
+		Reference:   row.Reference,
+		Description: row.Description,
+		Amount:      amount,
+		Currency:    itemCurrency,
+		Type:        db.ItemTypeCharge,
+	}, nil
+}
+
+// importBill checks that a bill accepts items, caching the bills read.
+func importBill(ctx context.Context, bills map[string]*db.DbBill, billId string) error {
+	bill, ok := bills[billId]
+	if !ok {
+		var err error
+		bill, err = db.GetBillByID(ctx, billId)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			bill = nil
+		} else if err != nil {
+			return err
+		}
+		bills[billId] = bill
+	}
+	if bill == nil {
+		return &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	if !bill.Status.AcceptsLineItems() {
+		return &errs.Error{Code: errs.FailedPrecondition, Message: "Bill is " + string(bill.Status)}
+	}
+	return nil
+}
+
+// importFormat picks the file format from the query, falling back to the
+// Content-Type and then CSV.
+func importFormat(req *http.Request) string {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/json":
+		return "jsonl"
+	default:
+		return "csv"
+	}
+}
+
+// readImport parses the rows of an import file. Malformed files are rejected
+// as a whole; the values of well-formed rows are validated by the caller.
+func readImport(r io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+	add := func(row importRow) error {
+		if len(rows) == importMaxRows {
+			return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Import is limited to %d rows", importMaxRows)}
+		}
+		rows = append(rows, row)
+		return nil
+	}
+
+	var err error
+	switch format {
+	case "csv":
+		err = readImportCSV(r, add)
+	case "jsonl":
+		err = readImportJSONL(r, add)
+	default:
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown format " + format}
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Import is limited to %d bytes", tooLarge.Limit)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Import has no rows"}
+	}
+	return rows, nil
+}
+
+func readImportCSV(r io.Reader, add func(importRow) error) error {
+	in := csv.NewReader(r)
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return csvError(err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"bill_id", "reference", "amount"} {
+		if _, ok := columns[name]; !ok {
+			return &errs.Error{Code: errs.InvalidArgument, Message: "Missing column " + name}
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return csvError(err)
+		}
+		err = add(importRow{
+			BillId:      field(record, "bill_id"),
+			Reference:   field(record, "reference"),
+			Description: field(record, "description"),
+			Amount:      field(record, "amount"),
+			Currency:    field(record, "currency"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) && !errors.As(err, new(*http.MaxBytesError)) {
+		return &errs.Error{Code: errs.InvalidArgument, Message: "Invalid CSV: " + parseErr.Error()}
+	}
+	return err
+}
+
+func readImportJSONL(r io.Reader, add func(importRow) error) error {
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var row struct {
+			importRow
+			// amounts may be given as JSON numbers or strings
+			Amount json.Number `json:"amount"`
+		}
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			return nil
+		}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			return &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Invalid JSON on row %d: %s", line, err)}
+		}
+		if err != nil {
+			return err
+		}
+		row.importRow.Amount = row.Amount.String()
+		if err := add(row.importRow); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package invoice renders the legal invoice document of a finalized bill as
+// HTML and PDF from templates.
+package invoice
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+
+	"encore.app/billing/currency"
+	"github.com/shopspring/decimal"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// Invoice is the content of an invoice document. Amounts are in the
+// invoice's currency.
+type Invoice struct {
+	Number      string
+	Issuer      string
+	BillId      string
+	AccountId   string
+	Currency    string
+	IssuedAt    time.Time
+	DueAt       *time.Time
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Lines       []Line
+	Subtotal    decimal.Decimal
+	Discounts   []Adjustment
+	Taxes       []Adjustment
+	// CreditAmount is the account credit applied to the invoice
+	CreditAmount decimal.Decimal
+	TotalAmount  decimal.Decimal
+}
+
+// Line is an item of the invoice. Quantity and UnitPrice are only set on
+// items priced per unit.
+type Line struct {
+	Description string
+	Quantity    decimal.NullDecimal
+	UnitPrice   decimal.NullDecimal
+	Amount      decimal.Decimal
+}
+
+// Adjustment is a discount or tax applied to the invoice subtotal.
+type Adjustment struct {
+	Label  string
+	Amount decimal.Decimal
+}
+
+// funcs are the helpers available to both templates.
+func (inv Invoice) funcs() map[string]any {
+	return map[string]any{
+		"money": inv.money,
+		"date":  func(t time.Time) string { return t.Format("2006-01-02") },
+		"truncate": func(n int, s string) string {
+			if r := []rune(s); len(r) > n {
+				return string(r[:n-1]) + "~"
+			}
+			return s
+		},
+	}
+}
+
+// money formats amount at the precision of the invoice's currency.
+func (inv Invoice) money(amount decimal.Decimal) string {
+	c, ok := currency.Lookup(inv.Currency)
+	if !ok {
+		return amount.String()
+	}
+	return c.Round(amount).StringFixed(c.MinorUnits)
+}
+
+// RenderHTML renders the invoice as an HTML page.
+func RenderHTML(inv Invoice) ([]byte, error) {
+	t, err := htmltemplate.New("invoice.html.tmpl").Funcs(inv.funcs()).ParseFS(templates, "templates/invoice.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, inv); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderPDF renders the invoice as a PDF document, laid out by a plain
+// text template in a monospaced font.
+func RenderPDF(inv Invoice) ([]byte, error) {
+	t, err := template.New("invoice.txt.tmpl").Funcs(inv.funcs()).ParseFS(templates, "templates/invoice.txt.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, inv); err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	return writePDF("Invoice "+inv.Number, lines), nil
+}
@@ -0,0 +1,94 @@
+package invoice_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/billing/invoice"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func sample() invoice.Invoice {
+	issued := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	due := issued.AddDate(0, 0, 30)
+	return invoice.Invoice{
+		Number:      "INV-000042",
+		Issuer:      "Example Ltd",
+		BillId:      "bill-1",
+		AccountId:   "acme",
+		Currency:    "USD",
+		IssuedAt:    issued,
+		DueAt:       &due,
+		PeriodStart: issued.AddDate(0, -1, 0),
+		PeriodEnd:   issued,
+		Lines: []invoice.Line{
+			{Description: "Seats", Quantity: decimal.NewNullDecimal(d("3")), UnitPrice: decimal.NewNullDecimal(d("10")), Amount: d("30")},
+			{Description: "Support <priority>", Amount: d("70")},
+		},
+		Subtotal:     d("100"),
+		Discounts:    []invoice.Adjustment{{Label: "SPRING", Amount: d("10")}},
+		Taxes:        []invoice.Adjustment{{Label: "US-NY", Amount: d("7.2")}},
+		CreditAmount: d("5"),
+		TotalAmount:  d("92.2"),
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	html, err := invoice.RenderHTML(sample())
+	require.NoError(t, err)
+	s := string(html)
+	require.Contains(t, s, "Invoice INV-000042")
+	require.Contains(t, s, "2024-03-31")
+	// amounts are shown at the currency's precision
+	require.Contains(t, s, "92.20")
+	require.Contains(t, s, "-10.00")
+	// content is escaped
+	require.Contains(t, s, "Support &lt;priority&gt;")
+	// payments are not part of the invoice
+	require.NotContains(t, s, "Paid")
+}
+
+func TestRenderPDF(t *testing.T) {
+	pdf, err := invoice.RenderPDF(sample())
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")))
+	require.True(t, bytes.HasSuffix(pdf, []byte("%%EOF\n")))
+	require.Contains(t, string(pdf), "(INVOICE INV-000042) '")
+	require.Contains(t, string(pdf), "/Count 1")
+
+	// the cross-reference table points at each object
+	xref := bytes.Index(pdf, []byte("\nxref\n")) + 1
+	var start int
+	_, err = fmt.Sscanf(string(pdf[bytes.LastIndex(pdf, []byte("startxref\n")):]), "startxref\n%d", &start)
+	require.NoError(t, err)
+	require.Equal(t, xref, start)
+	for i, line := range strings.Split(string(pdf[xref:]), "\n")[3:] {
+		if !strings.HasSuffix(line, " n ") {
+			break
+		}
+		var offset int
+		_, err := fmt.Sscanf(line, "%d", &offset)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(pdf[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))))
+	}
+}
+
+func TestRenderPDFPages(t *testing.T) {
+	inv := sample()
+	for i := 0; i < 150; i++ {
+		inv.Lines = append(inv.Lines, invoice.Line{Description: "Usage (café)", Amount: d("1")})
+	}
+	pdf, err := invoice.RenderPDF(inv)
+	require.NoError(t, err)
+	require.Contains(t, string(pdf), "/Count 3")
+	// parentheses are escaped and Latin-1 kept
+	require.Contains(t, string(pdf), `(Usage \(caf\351\)`)
+}
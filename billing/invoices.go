@@ -0,0 +1,161 @@
+package billing
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/invoice"
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+type InvoiceResponse struct {
+	BillId     string     `json:"bill_id"`
+	Number     string     `json:"number"`
+	IssuedAt   time.Time  `json:"issued_at"`
+	RenderedAt *time.Time `json:"rendered_at"`
+}
+
+// GetInvoice returns the number of the invoice issued when a bill was
+// finalized. The documents are downloaded from /bills/:billId/invoice.pdf
+// and /bills/:billId/invoice.html.
+//
+//encore:api public method=GET path=/bills/:billId/invoice
+func (s *Service) GetInvoice(ctx context.Context, billId string) (*InvoiceResponse, error) {
+	inv, err := db.GetInvoice(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	return &InvoiceResponse{BillId: inv.BillId, Number: inv.Number, IssuedAt: inv.IssuedAt, RenderedAt: inv.RenderedAt}, nil
+}
+
+// DownloadInvoicePDF returns the invoice of a finalized bill as a PDF.
+//
+//encore:api public raw method=GET path=/bills/:billId/invoice.pdf
+func (s *Service) DownloadInvoicePDF(w http.ResponseWriter, req *http.Request) {
+	inv, err := renderedInvoice(req.Context(), encore.CurrentRequest().PathParams.Get("billId"))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": inv.Number + ".pdf"}))
+	w.Write(inv.PDF)
+}
+
+// DownloadInvoiceHTML returns the invoice of a finalized bill as HTML.
+//
+//encore:api public raw method=GET path=/bills/:billId/invoice.html
+func (s *Service) DownloadInvoiceHTML(w http.ResponseWriter, req *http.Request) {
+	inv, err := renderedInvoice(req.Context(), encore.CurrentRequest().PathParams.Get("billId"))
+	if err != nil {
+		errs.HTTPError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(inv.HTML)
+}
+
+// renderedInvoice returns a bill's invoice, rendering its documents if
+// rendering failed when the bill was finalized.
+func renderedInvoice(ctx context.Context, billId string) (*db.DbInvoice, error) {
+	inv, err := db.GetInvoice(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	if inv.RenderedAt != nil {
+		return inv, nil
+	}
+	return renderInvoice(ctx, inv)
+}
+
+// renderInvoice renders and stores the documents of an issued invoice from
+// the content captured when it was issued, so the documents state what the
+// invoice did whenever they are rendered.
+func renderInvoice(ctx context.Context, inv *db.DbInvoice) (*db.DbInvoice, error) {
+	content := inv.Content
+	if content == nil {
+		// invoices issued before content was captured render from the bill
+		bill, items, totals, err := db.GetBillDetailsWithTotal(ctx, inv.BillId)
+		if err != nil {
+			return nil, err
+		}
+		content = &db.InvoiceContent{Issuer: cfg.Seller.Name(), Bill: *bill, Items: items, Totals: *totals}
+	}
+	doc := newInvoice(inv, content)
+
+	html, err := invoice.RenderHTML(doc)
+	if err != nil {
+		return nil, err
+	}
+	pdf, err := invoice.RenderPDF(doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SaveInvoiceDocuments(ctx, inv.BillId, html, pdf); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	inv.HTML, inv.PDF, inv.RenderedAt = html, pdf, &now
+	return inv, nil
+}
+
+// newInvoice builds the document of an invoice. Payments are left off, as
+// they are made against the invoice after it is issued.
+func newInvoice(inv *db.DbInvoice, content *db.InvoiceContent) invoice.Invoice {
+	bill, totals := content.Bill, content.Totals
+	doc := invoice.Invoice{
+		Number:       inv.Number,
+		Issuer:       content.Issuer,
+		BillId:       bill.Id,
+		AccountId:    bill.AccountId,
+		Currency:     bill.Currency,
+		IssuedAt:     inv.IssuedAt,
+		DueAt:        bill.DueAt,
+		PeriodStart:  bill.PeriodStart,
+		PeriodEnd:    bill.PeriodEnd,
+		Subtotal:     totals.Subtotal,
+		CreditAmount: totals.CreditAmount,
+		TotalAmount:  totals.TotalAmount,
+	}
+	for _, item := range content.Items {
+		// applied credit is shown below the subtotal
+		if item.Type == db.ItemTypeAccountCredit {
+			continue
+		}
+		doc.Lines = append(doc.Lines, invoice.Line{
+			Description: item.Description,
+			Quantity:    item.Quantity,
+			UnitPrice:   item.UnitPrice,
+			Amount:      item.Amount.Mul(item.ExchangeRate),
+		})
+	}
+	for _, d := range totals.Discounts {
+		label := d.Description
+		if label == "" {
+			label = d.CouponCode
+		}
+		doc.Discounts = append(doc.Discounts, invoice.Adjustment{Label: label, Amount: d.Amount})
+	}
+	for _, t := range totals.Taxes {
+		doc.Taxes = append(doc.Taxes, invoice.Adjustment{Label: "Tax " + t.Jurisdiction, Amount: t.Amount})
+	}
+	return doc
+}
+
+// issueInvoiceDocuments renders the invoice of a bill just finalized. A
+// failure is logged rather than failing finalization, as the documents are
+// rendered again when first downloaded.
+func issueInvoiceDocuments(ctx context.Context, billId string) {
+	inv, err := db.GetInvoice(ctx, billId)
+	if err == nil && inv.RenderedAt == nil {
+		_, err = renderInvoice(ctx, inv)
+	}
+	if err != nil {
+		rlog.Error("failed to render invoice", "bill_id", billId, "error", err)
+	}
+}
@@ -0,0 +1,68 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"encore.app/billing/db"
+	"github.com/shopspring/decimal"
+)
+
+type GetTrialBalanceRequest struct {
+	// AsOf limits the balance to postings made before it, now if omitted
+	AsOf time.Time `query:"as_of"`
+}
+
+type TrialBalanceResponse struct {
+	AsOf     time.Time            `json:"as_of"`
+	Accounts []db.TrialBalanceRow `json:"accounts"`
+	// Balanced is whether every transaction, and so every currency, has
+	// equal debits and credits
+	Balanced bool `json:"balanced"`
+	// Unbalanced lists the transactions breaking the invariant
+	Unbalanced []string `json:"unbalanced,omitempty"`
+}
+
+// GetTrialBalance returns the debits and credits of each general ledger
+// account per currency, for reconciling billing with accounting.
+//
+//encore:api public method=GET path=/ledger/trial-balance
+func (s *Service) GetTrialBalance(ctx context.Context, req *GetTrialBalanceRequest) (*TrialBalanceResponse, error) {
+	asOf := req.AsOf
+	if asOf.IsZero() {
+		asOf = time.Now()
+	}
+	accounts, err := db.GetTrialBalance(ctx, asOf)
+	if err != nil {
+		return nil, err
+	}
+	unbalanced, err := db.GetUnbalancedTransactions(ctx, asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	balanced := len(unbalanced) == 0
+	net := make(map[string]decimal.Decimal)
+	for _, a := range accounts {
+		net[a.Currency] = net[a.Currency].Add(a.Balance)
+	}
+	for _, n := range net {
+		balanced = balanced && n.IsZero()
+	}
+	return &TrialBalanceResponse{AsOf: asOf, Accounts: accounts, Balanced: balanced, Unbalanced: unbalanced}, nil
+}
+
+type BillJournalResponse struct {
+	Entries []db.DbJournalEntry `json:"entries"`
+}
+
+// GetBillJournal returns the general ledger entries posted for a bill.
+//
+//encore:api public method=GET path=/bills/:billId/journal
+func (s *Service) GetBillJournal(ctx context.Context, billId string) (*BillJournalResponse, error) {
+	entries, err := db.GetBillJournal(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	return &BillJournalResponse{Entries: entries}, nil
+}
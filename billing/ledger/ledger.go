@@ -0,0 +1,97 @@
+// Package ledger builds the balanced double-entry postings of billing
+// movements.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// Account is a general ledger account.
+type Account string
+
+const (
+	// AccountsReceivable is owed by customers on their bills
+	AccountsReceivable Account = "accounts_receivable"
+	// Revenue is earned from bill items, net of discounts
+	Revenue Account = "revenue"
+	// TaxPayable is tax collected on behalf of jurisdictions
+	TaxPayable Account = "tax_payable"
+	// DeferredRevenue is customer credit not yet applied to a bill
+	DeferredRevenue Account = "deferred_revenue"
+	// Cash is received from payments and paid out by refunds
+	Cash Account = "cash"
+)
+
+// Source is the kind of movement a transaction records.
+type Source string
+
+const (
+	SourceItem       Source = "item"
+	SourceTax        Source = "tax"
+	SourceDiscount   Source = "discount"
+	SourcePayment    Source = "payment"
+	SourceGrant      Source = "grant"
+	SourceExpiration Source = "expiration"
+	// SourceVoid reverses what a voided bill posted
+	SourceVoid Source = "void"
+)
+
+// Entry is one line of a transaction. Exactly one of Debit and Credit is
+// non-zero.
+type Entry struct {
+	Account Account
+	Debit   decimal.Decimal
+	Credit  decimal.Decimal
+}
+
+// Transfer moves amount from the credited account to the debited one. A
+// negative amount moves it the other way.
+func Transfer(debit, credit Account, amount decimal.Decimal) []Entry {
+	if amount.IsNegative() {
+		debit, credit, amount = credit, debit, amount.Neg()
+	}
+	return []Entry{
+		{Account: debit, Debit: amount, Credit: decimal.Zero},
+		{Account: credit, Debit: decimal.Zero, Credit: amount},
+	}
+}
+
+var (
+	ErrUnbalanced     = errors.New("ledger: debits do not equal credits")
+	ErrInvalidEntry   = errors.New("ledger: an entry must have exactly one positive side")
+	ErrNoEntries      = errors.New("ledger: transaction has no entries")
+	ErrUnknownAccount = errors.New("ledger: unknown account")
+)
+
+// Validate checks that entries form a balanced transaction.
+func Validate(entries []Entry) error {
+	if len(entries) == 0 {
+		return ErrNoEntries
+	}
+	debits, credits := decimal.Zero, decimal.Zero
+	for _, e := range entries {
+		if !e.Account.IsValid() {
+			return fmt.Errorf("%w %q", ErrUnknownAccount, e.Account)
+		}
+		if e.Debit.IsNegative() || e.Credit.IsNegative() || e.Debit.IsPositive() == e.Credit.IsPositive() {
+			return ErrInvalidEntry
+		}
+		debits = debits.Add(e.Debit)
+		credits = credits.Add(e.Credit)
+	}
+	if !debits.Equal(credits) {
+		return fmt.Errorf("%w: %s != %s", ErrUnbalanced, debits, credits)
+	}
+	return nil
+}
+
+func (a Account) IsValid() bool {
+	switch a {
+	case AccountsReceivable, Revenue, TaxPayable, DeferredRevenue, Cash:
+		return true
+	}
+	return false
+}
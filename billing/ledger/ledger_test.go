@@ -0,0 +1,48 @@
+package ledger_test
+
+import (
+	"testing"
+
+	"encore.app/billing/ledger"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransfer(t *testing.T) {
+	entries := ledger.Transfer(ledger.AccountsReceivable, ledger.Revenue, decimal.NewFromInt(100))
+	require.NoError(t, ledger.Validate(entries))
+	require.Equal(t, ledger.AccountsReceivable, entries[0].Account)
+	require.True(t, decimal.NewFromInt(100).Equal(entries[0].Debit))
+	require.Equal(t, ledger.Revenue, entries[1].Account)
+	require.True(t, decimal.NewFromInt(100).Equal(entries[1].Credit))
+
+	// a negative amount, e.g. a reversal, flips the sides
+	entries = ledger.Transfer(ledger.AccountsReceivable, ledger.Revenue, decimal.NewFromInt(-40))
+	require.NoError(t, ledger.Validate(entries))
+	require.Equal(t, ledger.Revenue, entries[0].Account)
+	require.True(t, decimal.NewFromInt(40).Equal(entries[0].Debit))
+	require.Equal(t, ledger.AccountsReceivable, entries[1].Account)
+}
+
+func TestValidate(t *testing.T) {
+	require.ErrorIs(t, ledger.Validate(nil), ledger.ErrNoEntries)
+
+	unbalanced := []ledger.Entry{
+		{Account: ledger.Cash, Debit: decimal.NewFromInt(100)},
+		{Account: ledger.AccountsReceivable, Credit: decimal.NewFromInt(90)},
+	}
+	require.ErrorIs(t, ledger.Validate(unbalanced), ledger.ErrUnbalanced)
+
+	bothSides := []ledger.Entry{{Account: ledger.Cash, Debit: decimal.NewFromInt(1), Credit: decimal.NewFromInt(1)}}
+	require.ErrorIs(t, ledger.Validate(bothSides), ledger.ErrInvalidEntry)
+
+	unknown := []ledger.Entry{{Account: "suspense", Debit: decimal.NewFromInt(1)}}
+	require.ErrorIs(t, ledger.Validate(unknown), ledger.ErrUnknownAccount)
+
+	// one payment split between the bill and the account's credit
+	split := append(
+		ledger.Transfer(ledger.Cash, ledger.AccountsReceivable, decimal.NewFromInt(60)),
+		ledger.Transfer(ledger.Cash, ledger.DeferredRevenue, decimal.NewFromInt(15))...,
+	)
+	require.NoError(t, ledger.Validate(split))
+}
@@ -0,0 +1,79 @@
+// Package metering aggregates raw usage events into billable quantities.
+package metering
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type Aggregation string
+
+const (
+	// Sum adds up the quantities of all events
+	Sum Aggregation = "sum"
+	// Max is the largest quantity reported
+	Max Aggregation = "max"
+	// Last is the quantity of the latest event, e.g. for seat counts
+	Last Aggregation = "last"
+	// UniqueCount counts the distinct values reported, e.g. active users
+	UniqueCount Aggregation = "unique_count"
+)
+
+// IsValid reports whether a is a known aggregation.
+func (a Aggregation) IsValid() bool {
+	switch a {
+	case Sum, Max, Last, UniqueCount:
+		return true
+	default:
+		return false
+	}
+}
+
+// Event is a usage event reported for a meter.
+type Event struct {
+	Quantity decimal.Decimal
+	// Value is the value counted by UniqueCount
+	Value     string
+	Timestamp time.Time
+}
+
+// Aggregate reduces events to the quantity billed. It is zero when there are
+// no events.
+func Aggregate(aggregation Aggregation, events []Event) decimal.Decimal {
+	if len(events) == 0 {
+		return decimal.Zero
+	}
+
+	switch aggregation {
+	case Max:
+		max := events[0].Quantity
+		for _, e := range events[1:] {
+			if e.Quantity.GreaterThan(max) {
+				max = e.Quantity
+			}
+		}
+		return max
+	case Last:
+		// ties keep the event reported last
+		last := events[0]
+		for _, e := range events[1:] {
+			if !e.Timestamp.Before(last.Timestamp) {
+				last = e
+			}
+		}
+		return last.Quantity
+	case UniqueCount:
+		seen := map[string]bool{}
+		for _, e := range events {
+			seen[e.Value] = true
+		}
+		return decimal.NewFromInt(int64(len(seen)))
+	default:
+		sum := decimal.Zero
+		for _, e := range events {
+			sum = sum.Add(e.Quantity)
+		}
+		return sum
+	}
+}
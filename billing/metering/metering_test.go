@@ -0,0 +1,44 @@
+package metering_test
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/billing/metering"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregate(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events := []metering.Event{
+		{Quantity: decimal.NewFromInt(3), Value: "alice", Timestamp: t0.Add(2 * time.Hour)},
+		{Quantity: decimal.RequireFromString("7.5"), Value: "bob", Timestamp: t0},
+		{Quantity: decimal.NewFromInt(2), Value: "alice", Timestamp: t0.Add(time.Hour)},
+	}
+
+	tests := []struct {
+		aggregation metering.Aggregation
+		want        string
+	}{
+		{metering.Sum, "12.5"},
+		{metering.Max, "7.5"},
+		{metering.Last, "3"},
+		{metering.UniqueCount, "2"},
+	}
+	for _, tt := range tests {
+		got := metering.Aggregate(tt.aggregation, events)
+		require.True(t, decimal.RequireFromString(tt.want).Equal(got), "%s: got %s, want %s", tt.aggregation, got, tt.want)
+	}
+}
+
+func TestAggregateEmpty(t *testing.T) {
+	for _, aggregation := range []metering.Aggregation{metering.Sum, metering.Max, metering.Last, metering.UniqueCount} {
+		require.True(t, metering.Aggregate(aggregation, nil).IsZero(), aggregation)
+	}
+}
+
+func TestAggregationIsValid(t *testing.T) {
+	require.True(t, metering.UniqueCount.IsValid())
+	require.False(t, metering.Aggregation("avg").IsValid())
+}
@@ -0,0 +1,49 @@
+package billing
+
+import (
+	"context"
+
+	"encore.app/billing/db"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+)
+
+// outboxBatchSize bounds the events published by one relay run.
+const outboxBatchSize = 500
+
+var _ = cron.NewJob("relay-outbox", cron.JobConfig{
+	Title:    "Publish bill events written to the outbox",
+	Every:    1 * cron.Minute,
+	Endpoint: RelayOutbox,
+})
+
+// RelayOutbox publishes pending outbox events to their topics until the
+// outbox is drained. Events are published at least once: an event whose
+// publication is not recorded is published again by a later run. Events that
+// fail are retried with backoff by later runs, and parked when they keep
+// failing; the later events of their bill wait for them.
+//
+//encore:api private
+func RelayOutbox(ctx context.Context) error {
+	for {
+		run, err := db.PublishOutbox(ctx, outboxBatchSize, publishEvent)
+		if err != nil {
+			rlog.Error("failed to relay outbox", "published", run.Published, "error", err)
+			return err
+		}
+		if run.Failed > 0 || run.Parked > 0 {
+			rlog.Error("failed to publish outbox events", "failed", run.Failed, "parked", run.Parked)
+		}
+		if run.Claimed() < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// RequeueOutboxEvent retries a parked outbox event, e.g. once the topic it
+// failed on has been deployed.
+//
+//encore:api private method=POST path=/outbox/:eventId/requeue
+func RequeueOutboxEvent(ctx context.Context, eventId string) error {
+	return db.RequeueOutboxEvent(ctx, eventId)
+}
@@ -0,0 +1,108 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.app/billing/fx"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"github.com/shopspring/decimal"
+)
+
+type RecordPaymentRequest struct {
+	// Amount is negative for refunds
+	Amount decimal.Decimal `json:"amount"`
+	// Currency defaults to the bill's; other currencies are converted at
+	// the current exchange rate
+	Currency string `json:"currency"`
+	// Method is card, bank_transfer, direct_debit, check, cash or other
+	Method string `json:"method"`
+	// Reference is the payment's id at the processor or bank; recording it
+	// again returns the original payment
+	Reference string `json:"reference"`
+}
+
+type RecordPaymentResponse struct {
+	Payment    db.DbPayment    `json:"payment"`
+	Status     db.Status       `json:"status"`
+	AmountPaid decimal.Decimal `json:"amount_paid"`
+	AmountDue  decimal.Decimal `json:"amount_due"`
+	// Credit is the excess of an over-payment credited to the account
+	Credit *db.DbCreditEntry `json:"credit"`
+}
+
+// RecordPayment records a payment or refund against an invoiced bill and
+// updates its balance and status.
+//
+//encore:api public method=POST path=/bills/:billId/payments
+func (s *Service) RecordPayment(ctx context.Context, billId string, req *RecordPaymentRequest) (*RecordPaymentResponse, error) {
+	if req.Reference == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Reference is required"}
+	}
+	if req.Amount.IsZero() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Amount cannot be zero"}
+	}
+	method := db.PaymentMethod(req.Method)
+	if !method.IsValid() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown payment method " + req.Method}
+	}
+
+	bill, err := db.GetBillByID(ctx, billId)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{Code: errs.NotFound, Message: "Bill not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	paymentCurrency := bill.Currency
+	if req.Currency != "" {
+		c, ok := currency.Lookup(req.Currency)
+		if !ok {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+		}
+		paymentCurrency = c.Code
+	}
+	rate, err := fx.PostgresProvider{}.Rate(ctx, paymentCurrency, bill.Currency, time.Now())
+	if errors.Is(err, fx.ErrRateNotFound) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "No exchange rate from " + paymentCurrency + " to " + bill.Currency}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.RecordPayment(ctx, db.DbPayment{
+		BillId:       billId,
+		Amount:       req.Amount,
+		Currency:     paymentCurrency,
+		ExchangeRate: rate,
+		Method:       method,
+		Reference:    req.Reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RecordPaymentResponse{
+		Payment:    result.Payment,
+		Status:     result.Bill.Status,
+		AmountPaid: result.Bill.AmountPaid,
+		AmountDue:  result.Bill.AmountDue(),
+		Credit:     result.Credit,
+	}, nil
+}
+
+type ListPaymentsResponse struct {
+	Payments []db.DbPayment `json:"payments"`
+}
+
+//encore:api public method=GET path=/bills/:billId/payments
+func (s *Service) ListPayments(ctx context.Context, billId string) (*ListPaymentsResponse, error) {
+	payments, err := db.GetBillPayments(ctx, billId)
+	if err != nil {
+		return nil, err
+	}
+	return &ListPaymentsResponse{Payments: payments}, nil
+}
@@ -0,0 +1,103 @@
+// Package period computes the billing periods of recurring bills.
+//
+// Periods are computed in the schedule's time zone from a fixed anchor, so
+// they keep their wall-clock start across daylight saving changes, and a
+// period anchored on the 31st starts on the last day of shorter months
+// without drifting to an earlier day afterwards.
+package period
+
+import (
+	"errors"
+	"time"
+	// embedded so schedules resolve the same time zones on every worker
+	_ "time/tzdata"
+)
+
+type Cadence string
+
+const (
+	Monthly   Cadence = "monthly"
+	Quarterly Cadence = "quarterly"
+	Annual    Cadence = "annual"
+	// Custom periods last a fixed number of calendar days
+	Custom Cadence = "custom"
+)
+
+type Schedule struct {
+	Cadence Cadence
+	// IntervalDays is the length of custom periods
+	IntervalDays int
+	// Anchor is the start of the first period. Later periods start on the
+	// same day of month, or the month's last day, at the same local time.
+	Anchor time.Time
+	// TimeZone is the IANA time zone periods are computed in, UTC if empty
+	TimeZone string
+}
+
+var (
+	ErrUnknownCadence  = errors.New("period: unknown cadence")
+	ErrInvalidInterval = errors.New("period: custom cadence requires a positive interval")
+)
+
+// Validate reports whether periods can be computed for the schedule.
+func (s Schedule) Validate() error {
+	switch s.Cadence {
+	case Monthly, Quarterly, Annual:
+	case Custom:
+		if s.IntervalDays <= 0 {
+			return ErrInvalidInterval
+		}
+	default:
+		return ErrUnknownCadence
+	}
+	_, err := s.location()
+	return err
+}
+
+// Period returns the start and end of the period with the given index, the
+// first period having index 0.
+func (s Schedule) Period(index int) (start, end time.Time, err error) {
+	if err := s.Validate(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	loc, _ := s.location()
+	return s.boundary(index, loc), s.boundary(index+1, loc), nil
+}
+
+func (s Schedule) location() (*time.Location, error) {
+	if s.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.TimeZone)
+}
+
+// boundary returns the start of period index.
+func (s Schedule) boundary(index int, loc *time.Location) time.Time {
+	anchor := s.Anchor.In(loc)
+	year, month, day := anchor.Date()
+	hour, min, sec := anchor.Clock()
+	nsec := anchor.Nanosecond()
+
+	var months int
+	switch s.Cadence {
+	case Monthly:
+		months = index
+	case Quarterly:
+		months = 3 * index
+	case Annual:
+		months = 12 * index
+	case Custom:
+		return time.Date(year, month, day+index*s.IntervalDays, hour, min, sec, nsec, loc)
+	}
+
+	// normalize the month first, then clamp the day to its length
+	first := time.Date(year, month+time.Month(months), 1, 0, 0, 0, 0, loc)
+	if last := daysIn(first.Year(), first.Month()); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, hour, min, sec, nsec, loc)
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
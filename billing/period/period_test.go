@@ -0,0 +1,81 @@
+package period_test
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/billing/period"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonthlyAnchoredAtMonthEnd(t *testing.T) {
+	s := period.Schedule{
+		Cadence: period.Monthly,
+		Anchor:  time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+	}
+
+	want := []time.Time{
+		time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.April, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, time.May, 31, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < len(want)-1; i++ {
+		start, end, err := s.Period(i)
+		require.NoError(t, err)
+		require.True(t, want[i].Equal(start), "period %d starts %s, want %s", i, start, want[i])
+		require.True(t, want[i+1].Equal(end), "period %d ends %s, want %s", i, end, want[i+1])
+	}
+}
+
+func TestQuarterlyAndAnnual(t *testing.T) {
+	anchor := time.Date(2023, time.November, 30, 12, 0, 0, 0, time.UTC)
+
+	_, end, err := period.Schedule{Cadence: period.Quarterly, Anchor: anchor}.Period(0)
+	require.NoError(t, err)
+	require.True(t, time.Date(2024, time.February, 29, 12, 0, 0, 0, time.UTC).Equal(end), "got %s", end)
+
+	leap := time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)
+	start, end, err := period.Schedule{Cadence: period.Annual, Anchor: leap}.Period(1)
+	require.NoError(t, err)
+	require.True(t, time.Date(2025, time.February, 28, 0, 0, 0, 0, time.UTC).Equal(start), "got %s", start)
+	require.True(t, time.Date(2026, time.February, 28, 0, 0, 0, 0, time.UTC).Equal(end), "got %s", end)
+}
+
+func TestPeriodsKeepLocalTimeAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	s := period.Schedule{
+		Cadence:  period.Monthly,
+		Anchor:   time.Date(2024, time.February, 1, 0, 0, 0, 0, loc),
+		TimeZone: "America/New_York",
+	}
+
+	// daylight saving starts on March 10th, the March period is an hour short
+	start, end, err := s.Period(1)
+	require.NoError(t, err)
+	require.Equal(t, 0, start.In(loc).Hour())
+	require.Equal(t, 0, end.In(loc).Hour())
+	require.Equal(t, 31*24*time.Hour-time.Hour, end.Sub(start))
+}
+
+func TestCustomInterval(t *testing.T) {
+	s := period.Schedule{
+		Cadence:      period.Custom,
+		IntervalDays: 14,
+		Anchor:       time.Date(2024, time.December, 23, 9, 30, 0, 0, time.UTC),
+	}
+
+	start, end, err := s.Period(1)
+	require.NoError(t, err)
+	require.True(t, time.Date(2025, time.January, 6, 9, 30, 0, 0, time.UTC).Equal(start), "got %s", start)
+	require.True(t, time.Date(2025, time.January, 20, 9, 30, 0, 0, time.UTC).Equal(end), "got %s", end)
+}
+
+func TestValidate(t *testing.T) {
+	require.ErrorIs(t, period.Schedule{Cadence: "weekly"}.Validate(), period.ErrUnknownCadence)
+	require.ErrorIs(t, period.Schedule{Cadence: period.Custom}.Validate(), period.ErrInvalidInterval)
+	require.Error(t, period.Schedule{Cadence: period.Monthly, TimeZone: "Mars/Olympus"}.Validate())
+	require.NoError(t, period.Schedule{Cadence: period.Monthly, TimeZone: "Europe/Berlin"}.Validate())
+}
@@ -0,0 +1,147 @@
+// Package pricing computes line item amounts from catalog prices.
+package pricing
+
+import (
+	"errors"
+
+	"github.com/shopspring/decimal"
+)
+
+type Model string
+
+const (
+	// Flat charges UnitAmount whatever the quantity
+	Flat Model = "flat"
+	// PerUnit charges UnitAmount for each unit
+	PerUnit Model = "per_unit"
+	// Graduated charges the units within each tier at that tier's price
+	Graduated Model = "graduated"
+	// Volume charges every unit at the price of the tier the total
+	// quantity falls in
+	Volume Model = "volume"
+	// Package charges UnitAmount for each started package of PackageSize
+	// units
+	Package Model = "package"
+)
+
+// Tier prices the units up to UpTo, the last tier having no upper bound.
+type Tier struct {
+	// UpTo is the inclusive upper bound of the tier, nil for the last tier
+	UpTo       *decimal.Decimal `json:"up_to"`
+	UnitAmount decimal.Decimal  `json:"unit_amount"`
+	// FlatAmount is charged once when any unit falls in the tier
+	FlatAmount decimal.Decimal `json:"flat_amount"`
+}
+
+type Price struct {
+	Model       Model           `json:"model"`
+	UnitAmount  decimal.Decimal `json:"unit_amount"`
+	PackageSize decimal.Decimal `json:"package_size"`
+	Tiers       []Tier          `json:"tiers"`
+}
+
+var (
+	ErrUnknownModel     = errors.New("pricing: unknown model")
+	ErrNegativeAmount   = errors.New("pricing: amounts cannot be negative")
+	ErrNoTiers          = errors.New("pricing: tiered prices require tiers")
+	ErrTierOrder        = errors.New("pricing: tiers must have increasing bounds and only the last must be unbounded")
+	ErrPackageSize      = errors.New("pricing: package size must be positive")
+	ErrNegativeQuantity = errors.New("pricing: quantity cannot be negative")
+)
+
+// Validate reports whether amounts can be computed for the price.
+func (p Price) Validate() error {
+	switch p.Model {
+	case Flat, PerUnit:
+		if p.UnitAmount.IsNegative() {
+			return ErrNegativeAmount
+		}
+	case Package:
+		if p.UnitAmount.IsNegative() {
+			return ErrNegativeAmount
+		}
+		if !p.PackageSize.IsPositive() {
+			return ErrPackageSize
+		}
+	case Graduated, Volume:
+		if len(p.Tiers) == 0 {
+			return ErrNoTiers
+		}
+		for i, tier := range p.Tiers {
+			if tier.UnitAmount.IsNegative() || tier.FlatAmount.IsNegative() {
+				return ErrNegativeAmount
+			}
+			// units past a bounded last tier would go unpriced
+			last := i == len(p.Tiers)-1
+			if tier.UpTo == nil {
+				if !last {
+					return ErrTierOrder
+				}
+				continue
+			}
+			if last || !tier.UpTo.IsPositive() || (i > 0 && !tier.UpTo.GreaterThan(*p.Tiers[i-1].UpTo)) {
+				return ErrTierOrder
+			}
+		}
+	default:
+		return ErrUnknownModel
+	}
+	return nil
+}
+
+// Amount returns the amount charged for quantity units.
+func (p Price) Amount(quantity decimal.Decimal) (decimal.Decimal, error) {
+	if err := p.Validate(); err != nil {
+		return decimal.Zero, err
+	}
+	if quantity.IsNegative() {
+		return decimal.Zero, ErrNegativeQuantity
+	}
+
+	switch p.Model {
+	case Flat:
+		return p.UnitAmount, nil
+	case PerUnit:
+		return quantity.Mul(p.UnitAmount), nil
+	case Package:
+		packages := quantity.Div(p.PackageSize).Ceil()
+		return packages.Mul(p.UnitAmount), nil
+	case Graduated:
+		return p.graduated(quantity), nil
+	default:
+		return p.volume(quantity), nil
+	}
+}
+
+func (p Price) graduated(quantity decimal.Decimal) decimal.Decimal {
+	amount := decimal.Zero
+	floor := decimal.Zero
+	for _, tier := range p.Tiers {
+		if !quantity.GreaterThan(floor) {
+			break
+		}
+		units := quantity.Sub(floor)
+		if tier.UpTo != nil && quantity.GreaterThan(*tier.UpTo) {
+			units = tier.UpTo.Sub(floor)
+		}
+		amount = amount.Add(units.Mul(tier.UnitAmount)).Add(tier.FlatAmount)
+		if tier.UpTo == nil {
+			break
+		}
+		floor = *tier.UpTo
+	}
+	return amount
+}
+
+func (p Price) volume(quantity decimal.Decimal) decimal.Decimal {
+	if quantity.IsZero() {
+		return decimal.Zero
+	}
+	for _, tier := range p.Tiers {
+		if tier.UpTo == nil || !quantity.GreaterThan(*tier.UpTo) {
+			return quantity.Mul(tier.UnitAmount).Add(tier.FlatAmount)
+		}
+	}
+	// unreachable for a valid price, whose last tier is unbounded
+	return decimal.Zero
+}
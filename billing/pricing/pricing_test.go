@@ -0,0 +1,77 @@
+package pricing_test
+
+import (
+	"testing"
+
+	"encore.app/billing/pricing"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func upTo(s string) *decimal.Decimal {
+	v := d(s)
+	return &v
+}
+
+var tiers = []pricing.Tier{
+	{UpTo: upTo("10"), UnitAmount: d("5")},
+	{UpTo: upTo("100"), UnitAmount: d("4"), FlatAmount: d("20")},
+	{UnitAmount: d("3")},
+}
+
+func TestAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		price    pricing.Price
+		quantity string
+		want     string
+	}{
+		{"flat ignores quantity", pricing.Price{Model: pricing.Flat, UnitAmount: d("99")}, "3", "99"},
+		{"per unit", pricing.Price{Model: pricing.PerUnit, UnitAmount: d("0.25")}, "10", "2.5"},
+		{"package rounds up", pricing.Price{Model: pricing.Package, UnitAmount: d("10"), PackageSize: d("100")}, "101", "20"},
+		{"package exact", pricing.Price{Model: pricing.Package, UnitAmount: d("10"), PackageSize: d("100")}, "200", "20"},
+		{"graduated first tier", pricing.Price{Model: pricing.Graduated, Tiers: tiers}, "4", "20"},
+		{"graduated tier boundary", pricing.Price{Model: pricing.Graduated, Tiers: tiers}, "10", "50"},
+		// 10*5 + (90*4 + 20) + 50*3
+		{"graduated all tiers", pricing.Price{Model: pricing.Graduated, Tiers: tiers}, "150", "580"},
+		{"volume first tier", pricing.Price{Model: pricing.Volume, Tiers: tiers}, "10", "50"},
+		{"volume second tier", pricing.Price{Model: pricing.Volume, Tiers: tiers}, "11", "64"},
+		{"volume last tier", pricing.Price{Model: pricing.Volume, Tiers: tiers}, "150", "450"},
+		{"volume zero", pricing.Price{Model: pricing.Volume, Tiers: tiers}, "0", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.price.Amount(d(tt.quantity))
+			require.NoError(t, err)
+			require.True(t, d(tt.want).Equal(got), "got %s, want %s", got, tt.want)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.ErrorIs(t, pricing.Price{Model: "free"}.Validate(), pricing.ErrUnknownModel)
+	require.ErrorIs(t, pricing.Price{Model: pricing.PerUnit, UnitAmount: d("-1")}.Validate(), pricing.ErrNegativeAmount)
+	require.ErrorIs(t, pricing.Price{Model: pricing.Package, UnitAmount: d("1")}.Validate(), pricing.ErrPackageSize)
+	require.ErrorIs(t, pricing.Price{Model: pricing.Graduated}.Validate(), pricing.ErrNoTiers)
+	require.ErrorIs(t, pricing.Price{Model: pricing.Volume, Tiers: []pricing.Tier{
+		{UnitAmount: d("1")},
+		{UpTo: upTo("10"), UnitAmount: d("1")},
+	}}.Validate(), pricing.ErrTierOrder)
+	require.ErrorIs(t, pricing.Price{Model: pricing.Volume, Tiers: []pricing.Tier{
+		{UpTo: upTo("10"), UnitAmount: d("1")},
+		{UpTo: upTo("5"), UnitAmount: d("1")},
+	}}.Validate(), pricing.ErrTierOrder)
+
+	// a bounded last tier would leave the units above it free
+	bounded := pricing.Price{Model: pricing.Graduated, Tiers: []pricing.Tier{{UpTo: upTo("100"), UnitAmount: d("1")}}}
+	require.ErrorIs(t, bounded.Validate(), pricing.ErrTierOrder)
+	_, err := bounded.Amount(d("150"))
+	require.ErrorIs(t, err, pricing.ErrTierOrder)
+
+	_, err = pricing.Price{Model: pricing.PerUnit, UnitAmount: d("1")}.Amount(d("-1"))
+	require.ErrorIs(t, err, pricing.ErrNegativeQuantity)
+}
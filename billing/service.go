@@ -3,8 +3,12 @@ package billing
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"encore.app/billing/activity"
+	"encore.app/billing/fx"
+	"encore.app/billing/tax"
+	"encore.app/billing/webhook"
 	"encore.app/billing/workflow"
 	"encore.dev"
 	"encore.dev/config"
@@ -14,6 +18,26 @@ import (
 
 type Config struct {
 	TemporalHost config.String
+	// PaymentTermsDays is how long after finalization a bill becomes overdue
+	PaymentTermsDays config.Int
+	// InvoiceNumbering is "global" for one invoice number series, or
+	// "account" for a series per account
+	InvoiceNumbering config.String
+	// Seller is the issuer printed on invoices
+	Seller PartyConfig
+}
+
+// PartyConfig is the legal name, address and Peppol electronic address of a
+// party to an invoice.
+type PartyConfig struct {
+	Name           config.String
+	VatId          config.String
+	EndpointId     config.String
+	EndpointScheme config.String
+	Street         config.String
+	City           config.String
+	PostalCode     config.String
+	Country        config.String
 }
 
 var (
@@ -36,9 +60,13 @@ func initService() (*Service, error) {
 	w := worker.New(c, BillingTaskQueue, worker.Options{})
 
 	w.RegisterWorkflow(workflow.CreateBillWorkflow)
-	w.RegisterActivity(activity.CreateBillActivity)
-	w.RegisterActivity(activity.AddLineItemActivity)
-	w.RegisterActivity(activity.CloseBillActivity)
+	w.RegisterWorkflow(workflow.SubscriptionWorkflow)
+	w.RegisterWorkflow(workflow.DeliverWebhookWorkflow)
+	w.RegisterActivity(&activity.Activities{
+		FX:   fx.PostgresProvider{},
+		HTTP: webhook.NewClient(10 * time.Second),
+		Tax:  tax.PostgresCalculator{},
+	})
 
 	err = w.Start()
 	if err != nil {
@@ -0,0 +1,134 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.app/billing/activity"
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.app/billing/period"
+	"encore.app/billing/workflow"
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+type CreateSubscriptionRequest struct {
+	AccountId string `json:"account_id"`
+	Currency  string `json:"currency"`
+	// Cadence is monthly, quarterly, annual or custom
+	Cadence string `json:"cadence"`
+	// IntervalDays is the length of custom periods
+	IntervalDays int `json:"interval_days"`
+	// Start is the start of the first period, defaults to now. Later periods
+	// start on the same day of month, or the month's last day.
+	Start time.Time `json:"start"`
+	// TimeZone is the IANA time zone periods are computed in, defaults to UTC
+	TimeZone string `json:"time_zone"`
+}
+
+type SubscriptionResponse struct {
+	Subscription *db.DbSubscription `json:"subscription"`
+}
+
+// CreateSubscription starts billing an account on a recurring schedule, one
+// bill per period.
+//
+//encore:api public method=POST path=/subscriptions
+func (s *Service) CreateSubscription(ctx context.Context, req *CreateSubscriptionRequest) (*SubscriptionResponse, error) {
+	settlement, ok := currency.Lookup(req.Currency)
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+	}
+	if req.AccountId == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Account ID is required"}
+	}
+
+	start := req.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	timeZone := req.TimeZone
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	schedule := period.Schedule{
+		Cadence:      period.Cadence(req.Cadence),
+		IntervalDays: req.IntervalDays,
+		Anchor:       start,
+		TimeZone:     timeZone,
+	}
+	if err := schedule.Validate(); err != nil {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Invalid schedule: " + err.Error()}
+	}
+
+	sub, err := db.InsertSubscription(ctx, uuid.New().String(), req.AccountId, settlement.Code, req.Cadence, req.IntervalDays, start, timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	options := client.StartWorkflowOptions{
+		ID:        subscriptionWorkflowId(sub.Id),
+		TaskQueue: BillingTaskQueue,
+	}
+	_, err = s.client.ExecuteWorkflow(ctx, options, workflow.SubscriptionWorkflow, workflow.SubscriptionWorkflowInput{
+		SubscriptionId: sub.Id,
+		AccountId:      sub.AccountId,
+		Currency:       sub.Currency,
+		Schedule:       schedule,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionResponse{Subscription: sub}, nil
+}
+
+type SubscriptionDetailsResponse struct {
+	Subscription *db.DbSubscription `json:"subscription"`
+	// Bills are the most recent bills of the subscription, newest first
+	Bills []db.DbBill `json:"bills"`
+}
+
+//encore:api public method=GET path=/subscriptions/:subscriptionId
+func (s *Service) GetSubscription(ctx context.Context, subscriptionId string) (*SubscriptionDetailsResponse, error) {
+	sub, err := db.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	bills, _, err := db.ListBills(ctx, db.BillFilter{
+		SubscriptionId: subscriptionId,
+		SortBy:         db.SortByPeriodStart,
+		Descending:     true,
+		Limit:          defaultListLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionDetailsResponse{Subscription: sub, Bills: bills}, nil
+}
+
+// CancelSubscription stops a subscription from opening further bills. The
+// current bill runs to the end of its period.
+//
+//encore:api public method=POST path=/subscriptions/:subscriptionId/cancel
+func (s *Service) CancelSubscription(ctx context.Context, subscriptionId string) (*SubscriptionResponse, error) {
+	sub, err := db.CancelSubscription(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.client.SignalWorkflow(ctx, subscriptionWorkflowId(subscriptionId), "", activity.CancelSubscriptionSignal, nil)
+	var notFound *serviceerror.NotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return nil, err
+	}
+	return &SubscriptionResponse{Subscription: sub}, nil
+}
+
+func subscriptionWorkflowId(subscriptionId string) string {
+	return "subscription-" + subscriptionId
+}
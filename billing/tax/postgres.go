@@ -0,0 +1,33 @@
+package tax
+
+import (
+	"context"
+
+	"encore.app/billing/db"
+)
+
+// PostgresCalculator calculates taxes from the rules in the tax_rule table.
+type PostgresCalculator struct{}
+
+var _ TaxCalculator = PostgresCalculator{}
+
+func (PostgresCalculator) Calculate(ctx context.Context, req Request) ([]Line, error) {
+	if req.Exempt {
+		return nil, nil
+	}
+	stored, err := db.GetTaxRules(ctx, req.Address.Country)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]Rule, len(stored))
+	for i, r := range stored {
+		rules[i] = Rule{
+			Jurisdiction: r.Jurisdiction,
+			Country:      r.Country,
+			Region:       r.Region,
+			Rate:         r.Rate,
+			Inclusive:    r.Inclusive,
+		}
+	}
+	return calculate(rules, req), nil
+}
@@ -0,0 +1,133 @@
+// Package tax calculates the taxes due on bill items.
+package tax
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"encore.app/billing/currency"
+	"github.com/shopspring/decimal"
+)
+
+// TaxCalculator returns the tax lines due on the items of a request.
+type TaxCalculator interface {
+	Calculate(ctx context.Context, req Request) ([]Line, error)
+}
+
+// Address locates the account taxes are calculated for.
+type Address struct {
+	// Country is an ISO 3166-1 alpha-2 code
+	Country string `json:"country"`
+	// Region is a state or province within the country, empty if unknown
+	Region string `json:"region"`
+}
+
+type Request struct {
+	AccountId string
+	Address   Address
+	// Exempt accounts are not charged any tax
+	Exempt bool
+	// Currency is the bill currency the item amounts are in
+	Currency string
+	Items    []Item
+}
+
+type Item struct {
+	ItemId int64
+	// Amount is in the bill currency; it includes the tax of inclusive rates
+	Amount decimal.Decimal
+	// Discount is the part of the bill's discounts taken off the item's net
+	// amount before it is taxed
+	Discount decimal.Decimal
+}
+
+// Line is the tax of one jurisdiction on one item.
+type Line struct {
+	ItemId       int64
+	Jurisdiction string
+	Rate         decimal.Decimal
+	// Inclusive taxes are part of the item amount rather than added to it
+	Inclusive     bool
+	TaxableAmount decimal.Decimal
+	Amount        decimal.Decimal
+}
+
+// Rule is the rate a jurisdiction levies in a country, or in one region of
+// it. Country-wide and regional rules both apply to addresses in the region.
+type Rule struct {
+	Jurisdiction string
+	Country      string
+	// Region limits the rule to one region, empty for the whole country
+	Region    string
+	Rate      decimal.Decimal
+	Inclusive bool
+}
+
+func (r Rule) applies(address Address) bool {
+	if !strings.EqualFold(r.Country, address.Country) {
+		return false
+	}
+	return r.Region == "" || strings.EqualFold(r.Region, address.Region)
+}
+
+// RuleCalculator calculates taxes from rates by country and region.
+type RuleCalculator struct {
+	rules []Rule
+}
+
+var _ TaxCalculator = (*RuleCalculator)(nil)
+
+func NewRuleCalculator(rules ...Rule) *RuleCalculator {
+	return &RuleCalculator{rules: rules}
+}
+
+func (c *RuleCalculator) Calculate(ctx context.Context, req Request) ([]Line, error) {
+	return calculate(c.rules, req), nil
+}
+
+// calculate applies the rules matching the request's address to each item.
+// Inclusive rates are backed out of the amount first, so every rate is
+// applied to the same net amount, less the item's discount.
+func calculate(rules []Rule, req Request) []Line {
+	if req.Exempt {
+		return nil
+	}
+
+	var matching []Rule
+	inclusiveRate := decimal.Zero
+	for _, rule := range rules {
+		if rule.applies(req.Address) {
+			matching = append(matching, rule)
+			if rule.Inclusive {
+				inclusiveRate = inclusiveRate.Add(rule.Rate)
+			}
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].Jurisdiction < matching[j].Jurisdiction })
+
+	round := func(d decimal.Decimal) decimal.Decimal { return d }
+	if c, ok := currency.Lookup(req.Currency); ok {
+		round = c.Round
+	}
+
+	var lines []Line
+	for _, item := range req.Items {
+		net := item.Amount
+		if inclusiveRate.IsPositive() {
+			net = item.Amount.DivRound(decimal.NewFromInt(1).Add(inclusiveRate), 18)
+		}
+		net = net.Sub(item.Discount)
+		for _, rule := range matching {
+			lines = append(lines, Line{
+				ItemId:        item.ItemId,
+				Jurisdiction:  rule.Jurisdiction,
+				Rate:          rule.Rate,
+				Inclusive:     rule.Inclusive,
+				TaxableAmount: net,
+				Amount:        round(net.Mul(rule.Rate)),
+			})
+		}
+	}
+	return lines
+}
@@ -0,0 +1,83 @@
+package tax_test
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/billing/tax"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+var calculator = tax.NewRuleCalculator(
+	tax.Rule{Jurisdiction: "CA", Country: "CA", Rate: d("0.05")},
+	tax.Rule{Jurisdiction: "CA-QC", Country: "CA", Region: "QC", Rate: d("0.09975")},
+	tax.Rule{Jurisdiction: "DE", Country: "DE", Rate: d("0.19"), Inclusive: true},
+)
+
+func TestCalculateExclusive(t *testing.T) {
+	lines, err := calculator.Calculate(context.Background(), tax.Request{
+		Address:  tax.Address{Country: "CA", Region: "QC"},
+		Currency: "CAD",
+		Items:    []tax.Item{{ItemId: 1, Amount: d("100")}},
+	})
+	require.NoError(t, err)
+	require.Len(t, lines, 2)
+	require.Equal(t, "CA", lines[0].Jurisdiction)
+	require.True(t, d("5").Equal(lines[0].Amount))
+	require.Equal(t, "CA-QC", lines[1].Jurisdiction)
+	require.True(t, d("9.98").Equal(lines[1].Amount), "rounded to the currency, got %s", lines[1].Amount)
+}
+
+func TestCalculateRegionOnlyAppliesInRegion(t *testing.T) {
+	lines, err := calculator.Calculate(context.Background(), tax.Request{
+		Address:  tax.Address{Country: "ca", Region: "ON"},
+		Currency: "CAD",
+		Items:    []tax.Item{{ItemId: 1, Amount: d("100")}},
+	})
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.Equal(t, "CA", lines[0].Jurisdiction)
+}
+
+func TestCalculateInclusive(t *testing.T) {
+	lines, err := calculator.Calculate(context.Background(), tax.Request{
+		Address:  tax.Address{Country: "DE"},
+		Currency: "EUR",
+		Items:    []tax.Item{{ItemId: 1, Amount: d("119")}},
+	})
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	require.True(t, lines[0].Inclusive)
+	require.True(t, d("100").Equal(lines[0].TaxableAmount))
+	require.True(t, d("19").Equal(lines[0].Amount))
+}
+
+func TestCalculateDiscounted(t *testing.T) {
+	lines, err := calculator.Calculate(context.Background(), tax.Request{
+		Address:  tax.Address{Country: "DE"},
+		Currency: "EUR",
+		Items:    []tax.Item{{ItemId: 1, Amount: d("119"), Discount: d("10")}, {ItemId: 2, Amount: d("119"), Discount: d("100")}},
+	})
+	require.NoError(t, err)
+	require.Len(t, lines, 2)
+	// the discount is taken off the net amount the rate applies to
+	require.True(t, d("90").Equal(lines[0].TaxableAmount), "got %s", lines[0].TaxableAmount)
+	require.True(t, d("17.1").Equal(lines[0].Amount))
+	require.True(t, lines[1].Amount.IsZero(), "fully discounted items owe no tax")
+}
+
+func TestCalculateExempt(t *testing.T) {
+	lines, err := calculator.Calculate(context.Background(), tax.Request{
+		Address:  tax.Address{Country: "CA", Region: "QC"},
+		Exempt:   true,
+		Currency: "CAD",
+		Items:    []tax.Item{{ItemId: 1, Amount: d("100")}},
+	})
+	require.NoError(t, err)
+	require.Empty(t, lines)
+}
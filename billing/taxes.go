@@ -0,0 +1,84 @@
+package billing
+
+import (
+	"context"
+	"strings"
+
+	"encore.app/billing/db"
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+type CreateTaxRuleRequest struct {
+	// Jurisdiction names the authority the tax is owed to, e.g. CA-QC
+	Jurisdiction string `json:"jurisdiction"`
+	Country      string `json:"country"`
+	// Region limits the rule to a state or province, empty for the country
+	Region string          `json:"region"`
+	Rate   decimal.Decimal `json:"rate"`
+	// Inclusive rates are part of item amounts rather than added to them
+	Inclusive bool `json:"inclusive"`
+}
+
+// CreateTaxRule adds a tax rate. Rates apply to items added afterwards and
+// to every item of a bill when it closes.
+//
+//encore:api public method=POST path=/tax-rules
+func (s *Service) CreateTaxRule(ctx context.Context, req *CreateTaxRuleRequest) (*db.DbTaxRule, error) {
+	if req.Jurisdiction == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Jurisdiction is required"}
+	}
+	country, err := countryCode(req.Country)
+	if err != nil {
+		return nil, err
+	}
+	if req.Rate.IsNegative() || req.Rate.GreaterThanOrEqual(decimal.NewFromInt(1)) {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Rate must be between 0 and 1"}
+	}
+	return db.InsertTaxRule(ctx, req.Jurisdiction, country, strings.ToUpper(req.Region), req.Rate, req.Inclusive)
+}
+
+type ListTaxRulesRequest struct {
+	Country string `query:"country"`
+}
+
+type ListTaxRulesResponse struct {
+	Rules []db.DbTaxRule `json:"rules"`
+}
+
+//encore:api public method=GET path=/tax-rules
+func (s *Service) ListTaxRules(ctx context.Context, req *ListTaxRulesRequest) (*ListTaxRulesResponse, error) {
+	rules, err := db.GetTaxRules(ctx, req.Country)
+	if err != nil {
+		return nil, err
+	}
+	return &ListTaxRulesResponse{Rules: rules}, nil
+}
+
+type SetTaxProfileRequest struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	// Exempt accounts are not charged tax
+	Exempt bool `json:"exempt"`
+}
+
+//encore:api public method=PUT path=/accounts/:accountId/tax-profile
+func (s *Service) SetTaxProfile(ctx context.Context, accountId string, req *SetTaxProfileRequest) (*db.DbTaxProfile, error) {
+	country, err := countryCode(req.Country)
+	if err != nil {
+		return nil, err
+	}
+	return db.UpsertTaxProfile(ctx, accountId, country, strings.ToUpper(req.Region), req.Exempt)
+}
+
+//encore:api public method=GET path=/accounts/:accountId/tax-profile
+func (s *Service) GetTaxProfile(ctx context.Context, accountId string) (*db.DbTaxProfile, error) {
+	return db.GetTaxProfile(ctx, accountId)
+}
+
+func countryCode(code string) (string, error) {
+	if len(code) != 2 {
+		return "", &errs.Error{Code: errs.InvalidArgument, Message: "Country must be an ISO 3166-1 alpha-2 code"}
+	}
+	return strings.ToUpper(code), nil
+}
@@ -0,0 +1,52 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"encore.app/billing/db"
+	"encore.app/billing/events"
+	"encore.dev/pubsub"
+)
+
+var BillOpenedEvents = pubsub.NewTopic[*events.BillOpened]("bill-opened", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var LineItemAddedEvents = pubsub.NewTopic[*events.LineItemAdded]("line-item-added", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var BillClosedEvents = pubsub.NewTopic[*events.BillClosed]("bill-closed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var BillVoidedEvents = pubsub.NewTopic[*events.BillVoided]("bill-voided", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// publishEvent publishes an outbox payload to the topic it was written for.
+func publishEvent(ctx context.Context, topic string, payload []byte) error {
+	switch topic {
+	case events.BillOpenedTopic:
+		return publish(ctx, BillOpenedEvents, payload)
+	case events.LineItemAddedTopic:
+		return publish(ctx, LineItemAddedEvents, payload)
+	case events.BillClosedTopic:
+		return publish(ctx, BillClosedEvents, payload)
+	case events.BillVoidedTopic:
+		return publish(ctx, BillVoidedEvents, payload)
+	default:
+		return fmt.Errorf("%w: unknown topic %q", db.ErrUnpublishable, topic)
+	}
+}
+
+func publish[T any](ctx context.Context, topic *pubsub.Topic[*T], payload []byte) error {
+	var event T
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("%w: %v", db.ErrUnpublishable, err)
+	}
+	_, err := topic.Publish(ctx, &event)
+	return err
+}
@@ -0,0 +1,268 @@
+package ubl
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"github.com/shopspring/decimal"
+)
+
+// PartyDetails identify the seller or buyer of an invoice.
+type PartyDetails struct {
+	Name string
+	// VatId is the party's VAT identifier, prefixed with its country code
+	VatId string
+	// EndpointId is the party's Peppol electronic address, in the ICD
+	// scheme EndpointScheme, e.g. 0088 for a GLN
+	EndpointId     string
+	EndpointScheme string
+	Street         string
+	City           string
+	PostalCode     string
+	// Country is an ISO 3166-1 alpha-2 code
+	Country string
+}
+
+// Bill is the content of a finalized bill exported as an invoice.
+type Bill struct {
+	Bill      db.DbBill
+	Items     []db.DbBillItem
+	TaxLines  []db.DbTaxLine
+	Discounts []db.DbBillDiscount
+	// Number and IssuedAt are those of the bill's invoice
+	Number   string
+	IssuedAt time.Time
+	Seller   PartyDetails
+	Buyer    PartyDetails
+	// Exempt marks untaxed items as exempt rather than zero rated
+	Exempt bool
+}
+
+// ExemptionReason is stated on exempt tax categories.
+const ExemptionReason = "Exempt from VAT"
+
+// group is the lines of one VAT category and rate.
+type group struct {
+	category CategoryCode
+	percent  decimal.Decimal
+	net      decimal.Decimal
+	// allowance is the part of the bill's discounts allocated to the group
+	allowance decimal.Decimal
+}
+
+// New maps a bill to a Peppol BIS Billing 3.0 invoice. Item amounts are
+// converted to the bill currency and stated net of inclusive tax, with the
+// tax of each item's jurisdictions combined into one VAT rate. Discounts
+// become document level allowances split across the VAT rates as they were
+// split across the items when they were taxed, and applied account credit is
+// prepaid. The tax of each rate is stated on the rate's taxable amount, and
+// its difference from the tax the bill summed per item is a payable rounding
+// amount, so the payable amount is the bill's amount due.
+func New(b Bill) *Invoice {
+	bill := b.Bill
+	amount := func(d decimal.Decimal) Amount {
+		return Amount{CurrencyID: bill.Currency, Value: round(bill.Currency, d).StringFixed(2)}
+	}
+
+	taxByItem := map[int64][]db.DbTaxLine{}
+	for _, l := range b.TaxLines {
+		taxByItem[l.ItemId] = append(taxByItem[l.ItemId], l)
+	}
+
+	inv := &Invoice{
+		CustomizationID:      CustomizationID,
+		ProfileID:            ProfileID,
+		ID:                   b.Number,
+		IssueDate:            b.IssuedAt.Format(time.DateOnly),
+		InvoiceTypeCode:      InvoiceTypeCommercial,
+		DocumentCurrencyCode: bill.Currency,
+		BuyerReference:       bill.Id,
+		InvoicePeriod: &Period{
+			StartDate: bill.PeriodStart.Format(time.DateOnly),
+			EndDate:   bill.PeriodEnd.Format(time.DateOnly),
+		},
+		Supplier: PartyWrapper{Party: party(b.Seller)},
+		Customer: PartyWrapper{Party: party(b.Buyer)},
+	}
+	if bill.DueAt != nil {
+		inv.DueDate = bill.DueAt.Format(time.DateOnly)
+	}
+
+	var groups []*group
+	groupOf := func(category CategoryCode, percent decimal.Decimal) *group {
+		for _, g := range groups {
+			if g.category == category && g.percent.Equal(percent) {
+				return g
+			}
+		}
+		g := &group{category: category, percent: percent}
+		groups = append(groups, g)
+		return g
+	}
+
+	var lineTotal, credit decimal.Decimal
+	itemGroups := make([]*group, len(b.Items))
+	for i, item := range b.Items {
+		converted := item.Amount.Mul(item.ExchangeRate)
+		if item.Type == db.ItemTypeAccountCredit {
+			credit = credit.Sub(converted)
+			continue
+		}
+
+		var rate decimal.Decimal
+		for _, l := range taxByItem[item.Id] {
+			rate = rate.Add(l.Rate)
+		}
+		category := CategoryStandard
+		switch {
+		case rate.IsPositive():
+		case b.Exempt:
+			category = CategoryExempt
+		default:
+			category = CategoryZero
+		}
+		percent := rate.Mul(decimal.NewFromInt(100))
+		net := round(bill.Currency, item.NetAmount(bill.Currency, taxByItem[item.Id]))
+
+		g := groupOf(category, percent)
+		itemGroups[i] = g
+		g.net = g.net.Add(net)
+		lineTotal = lineTotal.Add(net)
+
+		// prices are never negative, so credits are negative quantities
+		quantity := decimal.NewFromInt(1)
+		if item.Quantity.Valid && !item.Quantity.Decimal.IsZero() {
+			quantity = item.Quantity.Decimal.Abs()
+		}
+		if net.IsNegative() {
+			quantity = quantity.Neg()
+		}
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			ID:                  strconv.FormatInt(item.Id, 10),
+			InvoicedQuantity:    Quantity{UnitCode: UnitOne, Value: quantity.String()},
+			LineExtensionAmount: amount(net),
+			Item: Item{
+				Name:                  item.Description,
+				ClassifiedTaxCategory: taxCategory(category, percent),
+			},
+			Price: Price{PriceAmount: Amount{CurrencyID: bill.Currency, Value: net.Div(quantity).Round(8).String()}},
+		})
+	}
+
+	// each discount is allocated to the groups as it was to their items
+	// when they were taxed
+	var allowanceTotal decimal.Decimal
+	shares := db.DiscountShares(bill.Currency, b.Items, b.TaxLines, b.Discounts)
+	for i, d := range b.Discounts {
+		byGroup := map[*group]decimal.Decimal{}
+		for j, share := range shares[i] {
+			if g := itemGroups[j]; g != nil {
+				byGroup[g] = byGroup[g].Add(share)
+			}
+		}
+		for _, g := range groups {
+			share := byGroup[g]
+			if share.IsZero() {
+				continue
+			}
+			g.allowance = g.allowance.Add(share)
+			allowanceTotal = allowanceTotal.Add(share)
+			reason := d.Description
+			if reason == "" {
+				reason = d.CouponCode
+			}
+			inv.AllowanceCharges = append(inv.AllowanceCharges, AllowanceCharge{
+				ChargeIndicator: false,
+				Reason:          reason,
+				Amount:          amount(share),
+				TaxCategory:     taxCategory(g.category, g.percent),
+			})
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].category < groups[j].category })
+	var taxTotal decimal.Decimal
+	for _, g := range groups {
+		// the tax of a rate is stated on its taxable amount, not summed
+		// from its items' tax; the difference is rounding
+		tax := rateTax(g.net.Sub(g.allowance), g.percent)
+		taxTotal = taxTotal.Add(tax)
+		inv.TaxTotal.Subtotals = append(inv.TaxTotal.Subtotals, TaxSubtotal{
+			TaxableAmount: amount(g.net.Sub(g.allowance)),
+			TaxAmount:     amount(tax),
+			TaxCategory:   taxCategory(g.category, g.percent),
+		})
+	}
+	inv.TaxTotal.TaxAmount = amount(taxTotal)
+
+	taxExclusive := lineTotal.Sub(allowanceTotal)
+	taxInclusive := taxExclusive.Add(taxTotal)
+	prepaid := round(bill.Currency, credit.Add(bill.AmountPaid))
+	payable := round(bill.Currency, bill.AmountDue())
+	total := MonetaryTotal{
+		LineExtensionAmount: amount(lineTotal),
+		TaxExclusiveAmount:  amount(taxExclusive),
+		TaxInclusiveAmount:  amount(taxInclusive),
+		PayableAmount:       amount(payable),
+	}
+	if !allowanceTotal.IsZero() {
+		a := amount(allowanceTotal)
+		total.AllowanceTotalAmount = &a
+	}
+	if !prepaid.IsZero() {
+		a := amount(prepaid)
+		total.PrepaidAmount = &a
+	}
+	// the bill total was rounded once rather than per line, and its tax
+	// per item rather than per rate
+	if rounding := payable.Sub(taxInclusive.Sub(prepaid)); !rounding.IsZero() {
+		a := amount(rounding)
+		total.PayableRoundingAmount = &a
+	}
+	inv.LegalMonetaryTotal = total
+	return inv
+}
+
+func party(p PartyDetails) Party {
+	party := Party{
+		EndpointID: Identifier{SchemeID: p.EndpointScheme, Value: p.EndpointId},
+		PostalAddress: Address{
+			StreetName: p.Street,
+			CityName:   p.City,
+			PostalZone: p.PostalCode,
+			Country:    Country{IdentificationCode: p.Country},
+		},
+		LegalEntity: LegalEntity{RegistrationName: p.Name},
+	}
+	if p.Name != "" {
+		party.PartyName = &PartyName{Name: p.Name}
+	}
+	if p.VatId != "" {
+		party.TaxScheme = &PartyTaxScheme{CompanyID: p.VatId, TaxScheme: TaxScheme{ID: "VAT"}}
+	}
+	return party
+}
+
+func taxCategory(category CategoryCode, percent decimal.Decimal) TaxCategory {
+	c := TaxCategory{ID: category, Percent: percent.String(), TaxScheme: TaxScheme{ID: "VAT"}}
+	if category == CategoryExempt {
+		c.TaxExemptionReason = ExemptionReason
+	}
+	return c
+}
+
+// round rounds an amount to the currency's precision, and at most the two
+// decimals allowed in an invoice.
+func round(code string, d decimal.Decimal) decimal.Decimal {
+	c, ok := currency.Lookup(code)
+	if !ok {
+		return d.Round(2)
+	}
+	if c.MinorUnits > 2 {
+		c.MinorUnits = 2
+	}
+	return c.Round(d)
+}
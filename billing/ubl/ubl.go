@@ -0,0 +1,181 @@
+// Package ubl exports bills as UBL 2.1 invoices conforming to Peppol BIS
+// Billing 3.0, the structured e-invoice format used in Europe.
+package ubl
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+const (
+	CustomizationID = "urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0"
+	ProfileID       = "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0"
+
+	// InvoiceTypeCommercial is the UNTDID 1001 code of a commercial invoice
+	InvoiceTypeCommercial = "380"
+	// UnitOne is the UN/ECE recommendation 20 code for items counted in units
+	UnitOne = "C62"
+)
+
+// CategoryCode is a UNTDID 5305 VAT category code.
+type CategoryCode string
+
+const (
+	CategoryStandard CategoryCode = "S"
+	CategoryZero     CategoryCode = "Z"
+	CategoryExempt   CategoryCode = "E"
+)
+
+// Invoice is a UBL 2.1 Invoice document. Fields are declared in the order
+// the schema requires.
+type Invoice struct {
+	XMLName              xml.Name          `xml:"Invoice"`
+	Xmlns                string            `xml:"xmlns,attr"`
+	XmlnsCac             string            `xml:"xmlns:cac,attr"`
+	XmlnsCbc             string            `xml:"xmlns:cbc,attr"`
+	CustomizationID      string            `xml:"cbc:CustomizationID"`
+	ProfileID            string            `xml:"cbc:ProfileID"`
+	ID                   string            `xml:"cbc:ID"`
+	IssueDate            string            `xml:"cbc:IssueDate"`
+	DueDate              string            `xml:"cbc:DueDate,omitempty"`
+	InvoiceTypeCode      string            `xml:"cbc:InvoiceTypeCode"`
+	DocumentCurrencyCode string            `xml:"cbc:DocumentCurrencyCode"`
+	BuyerReference       string            `xml:"cbc:BuyerReference"`
+	InvoicePeriod        *Period           `xml:"cac:InvoicePeriod"`
+	Supplier             PartyWrapper      `xml:"cac:AccountingSupplierParty"`
+	Customer             PartyWrapper      `xml:"cac:AccountingCustomerParty"`
+	AllowanceCharges     []AllowanceCharge `xml:"cac:AllowanceCharge"`
+	TaxTotal             TaxTotal          `xml:"cac:TaxTotal"`
+	LegalMonetaryTotal   MonetaryTotal     `xml:"cac:LegalMonetaryTotal"`
+	Lines                []InvoiceLine     `xml:"cac:InvoiceLine"`
+}
+
+type Period struct {
+	StartDate string `xml:"cbc:StartDate"`
+	EndDate   string `xml:"cbc:EndDate"`
+}
+
+type PartyWrapper struct {
+	Party Party `xml:"cac:Party"`
+}
+
+type Party struct {
+	EndpointID    Identifier      `xml:"cbc:EndpointID"`
+	PartyName     *PartyName      `xml:"cac:PartyName"`
+	PostalAddress Address         `xml:"cac:PostalAddress"`
+	TaxScheme     *PartyTaxScheme `xml:"cac:PartyTaxScheme"`
+	LegalEntity   LegalEntity     `xml:"cac:PartyLegalEntity"`
+}
+
+type Identifier struct {
+	SchemeID string `xml:"schemeID,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type PartyName struct {
+	Name string `xml:"cbc:Name"`
+}
+
+type Address struct {
+	StreetName string  `xml:"cbc:StreetName,omitempty"`
+	CityName   string  `xml:"cbc:CityName,omitempty"`
+	PostalZone string  `xml:"cbc:PostalZone,omitempty"`
+	Country    Country `xml:"cac:Country"`
+}
+
+type Country struct {
+	IdentificationCode string `xml:"cbc:IdentificationCode"`
+}
+
+type PartyTaxScheme struct {
+	CompanyID string    `xml:"cbc:CompanyID"`
+	TaxScheme TaxScheme `xml:"cac:TaxScheme"`
+}
+
+type TaxScheme struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type LegalEntity struct {
+	RegistrationName string `xml:"cbc:RegistrationName"`
+}
+
+// Amount is a monetary amount with at most two decimals.
+type Amount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type AllowanceCharge struct {
+	ChargeIndicator bool        `xml:"cbc:ChargeIndicator"`
+	Reason          string      `xml:"cbc:AllowanceChargeReason,omitempty"`
+	Amount          Amount      `xml:"cbc:Amount"`
+	TaxCategory     TaxCategory `xml:"cac:TaxCategory"`
+}
+
+type TaxCategory struct {
+	ID                 CategoryCode `xml:"cbc:ID"`
+	Percent            string       `xml:"cbc:Percent"`
+	TaxExemptionReason string       `xml:"cbc:TaxExemptionReason,omitempty"`
+	TaxScheme          TaxScheme    `xml:"cac:TaxScheme"`
+}
+
+type TaxTotal struct {
+	TaxAmount Amount        `xml:"cbc:TaxAmount"`
+	Subtotals []TaxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type TaxSubtotal struct {
+	TaxableAmount Amount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     Amount      `xml:"cbc:TaxAmount"`
+	TaxCategory   TaxCategory `xml:"cac:TaxCategory"`
+}
+
+type MonetaryTotal struct {
+	LineExtensionAmount   Amount  `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount    Amount  `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount    Amount  `xml:"cbc:TaxInclusiveAmount"`
+	AllowanceTotalAmount  *Amount `xml:"cbc:AllowanceTotalAmount"`
+	PrepaidAmount         *Amount `xml:"cbc:PrepaidAmount"`
+	PayableRoundingAmount *Amount `xml:"cbc:PayableRoundingAmount"`
+	PayableAmount         Amount  `xml:"cbc:PayableAmount"`
+}
+
+type InvoiceLine struct {
+	ID                  string   `xml:"cbc:ID"`
+	InvoicedQuantity    Quantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount Amount   `xml:"cbc:LineExtensionAmount"`
+	Item                Item     `xml:"cac:Item"`
+	Price               Price    `xml:"cac:Price"`
+}
+
+type Quantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type Item struct {
+	Name                  string      `xml:"cbc:Name"`
+	ClassifiedTaxCategory TaxCategory `xml:"cac:ClassifiedTaxCategory"`
+}
+
+type Price struct {
+	PriceAmount Amount `xml:"cbc:PriceAmount"`
+}
+
+// Marshal encodes the invoice as an indented XML document.
+func Marshal(inv *Invoice) ([]byte, error) {
+	inv.Xmlns = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	inv.XmlnsCac = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	inv.XmlnsCbc = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(inv); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
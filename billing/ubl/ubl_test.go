@@ -0,0 +1,408 @@
+package ubl_test
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/billing/db"
+	"encore.app/billing/ubl"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+var (
+	seller = ubl.PartyDetails{
+		Name:           "Seller AB",
+		VatId:          "SE556677889901",
+		EndpointId:     "7300010000001",
+		EndpointScheme: "0088",
+		Street:         "Storgatan 1",
+		City:           "Stockholm",
+		PostalCode:     "11122",
+		Country:        "SE",
+	}
+	buyer = ubl.PartyDetails{
+		Name:           "Buyer GmbH",
+		VatId:          "DE123456789",
+		EndpointId:     "DE123456789",
+		EndpointScheme: "9930",
+		City:           "Berlin",
+		Country:        "DE",
+	}
+)
+
+func sampleBill() ubl.Bill {
+	issued := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	due := issued.AddDate(0, 0, 30)
+	one := decimal.NewFromInt(1)
+	return ubl.Bill{
+		Bill: db.DbBill{
+			Id:          "bill-1",
+			Currency:    "EUR",
+			AccountId:   "buyer",
+			PeriodStart: issued.AddDate(0, -1, 0),
+			PeriodEnd:   issued,
+			DueAt:       &due,
+			TotalAmount: decimal.NewNullDecimal(d("246.10")),
+		},
+		Items: []db.DbBillItem{
+			{Id: 1, Description: "Seats", Amount: d("100"), ExchangeRate: one, Quantity: decimal.NewNullDecimal(d("4")), UnitPrice: decimal.NewNullDecimal(d("25"))},
+			{Id: 2, Description: "Support", Amount: d("119"), ExchangeRate: one},
+			{Id: 3, Description: "Training", Amount: d("40"), ExchangeRate: one},
+			{Id: 4, Description: "Goodwill credit", Amount: d("-10"), ExchangeRate: one, Type: db.ItemTypeCredit},
+			{Id: 5, Description: "Account credit", Amount: d("-20"), ExchangeRate: one, Type: db.ItemTypeAccountCredit},
+		},
+		TaxLines: []db.DbTaxLine{
+			{ItemId: 1, Jurisdiction: "DE", Rate: d("0.19"), Amount: d("19")},
+			{ItemId: 2, Jurisdiction: "DE", Rate: d("0.19"), Amount: d("19"), Inclusive: true},
+			{ItemId: 4, Jurisdiction: "DE", Rate: d("0.19"), Amount: d("-1.90")},
+		},
+		Number:   "INV-000001",
+		IssuedAt: issued,
+		Seller:   seller,
+		Buyer:    buyer,
+	}
+}
+
+func TestNew(t *testing.T) {
+	inv := ubl.New(sampleBill())
+	require.Empty(t, ubl.Validate(inv))
+
+	require.Len(t, inv.Lines, 4, "account credit is prepaid rather than a line")
+	require.Equal(t, "4", inv.Lines[0].InvoicedQuantity.Value)
+	require.Equal(t, "25", inv.Lines[0].Price.PriceAmount.Value)
+	// inclusive tax is backed out of the line
+	require.Equal(t, "100.00", inv.Lines[1].LineExtensionAmount.Value)
+	// credits are negative quantities at a positive price
+	require.Equal(t, "-1", inv.Lines[3].InvoicedQuantity.Value)
+	require.Equal(t, "10", inv.Lines[3].Price.PriceAmount.Value)
+
+	require.Len(t, inv.TaxTotal.Subtotals, 2)
+	require.Equal(t, ubl.CategoryStandard, inv.TaxTotal.Subtotals[0].TaxCategory.ID)
+	require.Equal(t, "19", inv.TaxTotal.Subtotals[0].TaxCategory.Percent)
+	require.Equal(t, "190.00", inv.TaxTotal.Subtotals[0].TaxableAmount.Value)
+	require.Equal(t, "36.10", inv.TaxTotal.Subtotals[0].TaxAmount.Value)
+	require.Equal(t, ubl.CategoryZero, inv.TaxTotal.Subtotals[1].TaxCategory.ID)
+
+	total := inv.LegalMonetaryTotal
+	require.Equal(t, "230.00", total.LineExtensionAmount.Value)
+	require.Equal(t, "266.10", total.TaxInclusiveAmount.Value)
+	require.Equal(t, "20.00", total.PrepaidAmount.Value)
+	require.Equal(t, "246.10", total.PayableAmount.Value)
+	require.Nil(t, total.PayableRoundingAmount)
+}
+
+func TestNewSplitsDiscountsAcrossRates(t *testing.T) {
+	b := sampleBill()
+	b.Items = b.Items[:3]
+	// the discount is split 10, 10 and 4 across the items, which are taxed
+	// on their discounted net amounts
+	b.TaxLines = []db.DbTaxLine{
+		{ItemId: 1, Jurisdiction: "DE", Rate: d("0.19"), TaxableAmount: d("90"), Amount: d("17.10")},
+		{ItemId: 2, Jurisdiction: "DE", Rate: d("0.19"), TaxableAmount: d("90"), Amount: d("17.10"), Inclusive: true},
+	}
+	b.Discounts = []db.DbBillDiscount{{CouponCode: "SPRING", Amount: d("24")}}
+	b.Bill.TotalAmount = decimal.NewNullDecimal(d("250.20"))
+
+	inv := ubl.New(b)
+	require.Empty(t, ubl.Validate(inv))
+	require.Len(t, inv.AllowanceCharges, 2)
+	require.Equal(t, "20.00", inv.AllowanceCharges[0].Amount.Value)
+	require.Equal(t, "4.00", inv.AllowanceCharges[1].Amount.Value)
+	require.Equal(t, "24.00", inv.LegalMonetaryTotal.AllowanceTotalAmount.Value)
+	// the inclusive item's line is net of the tax it was priced with
+	require.Equal(t, "100.00", inv.Lines[1].LineExtensionAmount.Value)
+	require.Equal(t, "180.00", inv.TaxTotal.Subtotals[0].TaxableAmount.Value)
+	require.Equal(t, "34.20", inv.TaxTotal.Subtotals[0].TaxAmount.Value)
+}
+
+func TestNewFullyDiscounted(t *testing.T) {
+	b := sampleBill()
+	b.Items = b.Items[:2]
+	b.TaxLines = []db.DbTaxLine{
+		{ItemId: 1, Jurisdiction: "DE", Rate: d("0.19"), Amount: d("0")},
+		{ItemId: 2, Jurisdiction: "DE", Rate: d("0.19"), Amount: d("0"), Inclusive: true},
+	}
+	b.Discounts = []db.DbBillDiscount{{CouponCode: "FREE", Amount: d("200")}}
+	b.Bill.TotalAmount = decimal.NewNullDecimal(decimal.Zero)
+
+	inv := ubl.New(b)
+	require.Empty(t, ubl.Validate(inv))
+	require.Equal(t, "0.00", inv.TaxTotal.TaxAmount.Value, "a 100% discount leaves no tax owed")
+	require.Equal(t, "0.00", inv.LegalMonetaryTotal.PayableAmount.Value)
+}
+
+func TestNewRoundsTaxPerRate(t *testing.T) {
+	b := sampleBill()
+	one := decimal.NewFromInt(1)
+	b.Items = []db.DbBillItem{
+		{Id: 1, Description: "Call", Amount: d("0.13"), ExchangeRate: one},
+		{Id: 2, Description: "Call", Amount: d("0.13"), ExchangeRate: one},
+		{Id: 3, Description: "Call", Amount: d("0.13"), ExchangeRate: one},
+	}
+	// 0.0273 of tax per item, rounded to 0.03 each when the bill was taxed
+	b.TaxLines = []db.DbTaxLine{
+		{ItemId: 1, Jurisdiction: "NL", Rate: d("0.21"), Amount: d("0.03")},
+		{ItemId: 2, Jurisdiction: "NL", Rate: d("0.21"), Amount: d("0.03")},
+		{ItemId: 3, Jurisdiction: "NL", Rate: d("0.21"), Amount: d("0.03")},
+	}
+	b.Bill.TotalAmount = decimal.NewNullDecimal(d("0.48"))
+
+	inv := ubl.New(b)
+	require.Empty(t, ubl.Validate(inv))
+	require.Equal(t, "0.08", inv.TaxTotal.Subtotals[0].TaxAmount.Value)
+	total := inv.LegalMonetaryTotal
+	require.Equal(t, "0.47", total.TaxInclusiveAmount.Value)
+	require.Equal(t, "0.01", total.PayableRoundingAmount.Value)
+	require.Equal(t, "0.48", total.PayableAmount.Value)
+}
+
+func TestValidateRateTax(t *testing.T) {
+	rules := func(tax string) []string {
+		inv := ubl.New(sampleBill())
+		inv.TaxTotal.Subtotals[0].TaxAmount.Value = tax
+		inv.TaxTotal.TaxAmount.Value = tax
+		var rules []string
+		for _, v := range ubl.Validate(inv) {
+			if strings.HasPrefix(v.Rule, "BR-S-") || v.Rule == "BR-CO-17" {
+				rules = append(rules, v.Rule)
+			}
+		}
+		return rules
+	}
+	require.Empty(t, rules("36.10"))
+	// the tax of a standard rate is exact, while the general rule allows
+	// less than a unit of difference
+	require.Equal(t, []string{"BR-S-09"}, rules("36.11"))
+	require.Equal(t, []string{"BR-CO-17", "BR-S-09"}, rules("37.10"))
+}
+
+func TestNewExempt(t *testing.T) {
+	b := sampleBill()
+	b.TaxLines = nil
+	b.Exempt = true
+	b.Bill.TotalAmount = decimal.NewNullDecimal(d("229"))
+
+	inv := ubl.New(b)
+	require.Empty(t, ubl.Validate(inv))
+	require.Len(t, inv.TaxTotal.Subtotals, 1)
+	require.Equal(t, ubl.CategoryExempt, inv.TaxTotal.Subtotals[0].TaxCategory.ID)
+	require.Equal(t, ubl.ExemptionReason, inv.TaxTotal.Subtotals[0].TaxCategory.TaxExemptionReason)
+}
+
+func TestValidateMissingParty(t *testing.T) {
+	b := sampleBill()
+	b.Buyer = ubl.PartyDetails{}
+
+	var rules []string
+	for _, v := range ubl.Validate(ubl.New(b)) {
+		rules = append(rules, v.Rule)
+	}
+	require.Equal(t, []string{"BR-07", "BR-11", "PEPPOL-EN16931-R010"}, rules)
+}
+
+// element is a parsed XML element, addressed by local names.
+type element struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*element
+}
+
+func parse(t *testing.T, doc []byte) *element {
+	dec := xml.NewDecoder(strings.NewReader(string(doc)))
+	var stack []*element
+	var root *element
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			e := &element{name: tok.Name.Local, attrs: map[string]string{}}
+			for _, a := range tok.Attr {
+				e.attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, e)
+			} else {
+				root = e
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += strings.TrimSpace(string(tok))
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return root
+}
+
+// find returns the values at path, where a last segment starting with @
+// selects an attribute.
+func (e *element) find(path []string) []string {
+	if len(path) == 0 {
+		return []string{e.text}
+	}
+	if strings.HasPrefix(path[0], "@") {
+		if v, ok := e.attrs[path[0][1:]]; ok {
+			return []string{v}
+		}
+		return nil
+	}
+	var values []string
+	for _, c := range e.children {
+		if c.name == path[0] {
+			if len(path) == 1 && len(c.children) > 0 {
+				values = append(values, c.name)
+				continue
+			}
+			values = append(values, c.find(path[1:])...)
+		}
+	}
+	return values
+}
+
+// elements returns the elements at path.
+func (e *element) elements(path []string) []*element {
+	if len(path) == 0 {
+		return []*element{e}
+	}
+	var elements []*element
+	for _, c := range e.children {
+		if c.name == path[0] {
+			elements = append(elements, c.elements(path[1:])...)
+		}
+	}
+	return elements
+}
+
+// schematron is the part of a schematron schema the bundled rules use.
+type schematron struct {
+	Patterns []struct {
+		Rules []struct {
+			Context string `xml:"context,attr"`
+			Asserts []struct {
+				Id   string `xml:"id,attr"`
+				Test string `xml:"test,attr"`
+			} `xml:"assert"`
+		} `xml:"rule"`
+	} `xml:"pattern"`
+}
+
+// steps splits an XPath location path into local names.
+func steps(path string) []string {
+	var steps []string
+	for _, step := range strings.Split(path, "/") {
+		if i := strings.Index(step, ":"); i >= 0 {
+			step = step[i+1:]
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// contexts returns the elements a rule context selects. Relative contexts
+// in the bundle are children of the root.
+func contexts(root *element, context string) []*element {
+	var elements []*element
+	for _, alt := range strings.Split(context, "|") {
+		alt = strings.TrimSpace(alt)
+		if !strings.HasPrefix(alt, "/") {
+			elements = append(elements, root.elements(steps(alt))...)
+			continue
+		}
+		path := steps(alt[1:])
+		if path[0] == root.name {
+			elements = append(elements, root.elements(path[1:])...)
+		}
+	}
+	return elements
+}
+
+var (
+	existsTest     = regexp.MustCompile(`^exists\(([^()]+)\)$`)
+	nonEmptyTest   = regexp.MustCompile(`^\(([^()]+)\) != ''$`)
+	startsWithTest = regexp.MustCompile(`^starts-with\(normalize-space\(([^()]+)/text\(\)\), '([^']*)'\)$`)
+	matchesTest    = regexp.MustCompile(`^matches\(normalize-space\(([^()]+)\), '([^']*)'\)$`)
+	pathTest       = regexp.MustCompile(`^[\w:/@]+$`)
+)
+
+// holds evaluates an assertion test on e. Only the forms the bundle uses are
+// supported: disjunctions of presence, prefix and pattern tests.
+func holds(t *testing.T, e *element, test string) bool {
+	any := func(path string, ok func(string) bool) bool {
+		for _, v := range e.find(steps(path)) {
+			if ok(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, term := range strings.Split(test, " or ") {
+		var ok bool
+		if m := existsTest.FindStringSubmatch(term); m != nil {
+			ok = len(e.find(steps(m[1]))) > 0
+		} else if m := nonEmptyTest.FindStringSubmatch(term); m != nil {
+			ok = any(m[1], func(v string) bool { return v != "" })
+		} else if m := startsWithTest.FindStringSubmatch(term); m != nil {
+			ok = any(m[1], func(v string) bool { return strings.HasPrefix(v, m[2]) })
+		} else if m := matchesTest.FindStringSubmatch(term); m != nil {
+			ok = any(m[1], regexp.MustCompile(m[2]).MatchString)
+		} else if pathTest.MatchString(term) {
+			ok = len(e.find(steps(term))) > 0
+		} else {
+			t.Fatalf("unsupported test %q", term)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMarshalConformsToBundledRules(t *testing.T) {
+	b := sampleBill()
+	b.Discounts = []db.DbBillDiscount{{CouponCode: "SPRING", Description: "Spring promotion", Amount: d("0.10")}}
+	b.Bill.TotalAmount = decimal.NewNullDecimal(d("246.00"))
+	inv := ubl.New(b)
+	require.Empty(t, ubl.Validate(inv))
+
+	doc, err := ubl.Marshal(inv)
+	require.NoError(t, err)
+	root := parse(t, doc)
+	require.Equal(t, "Invoice", root.name)
+	require.Equal(t, "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2", root.attrs["xmlns"])
+
+	f, err := os.ReadFile("testdata/peppol-bis-3.0-rules.sch")
+	require.NoError(t, err)
+	var schema schematron
+	require.NoError(t, xml.Unmarshal(f, &schema))
+	require.NotEmpty(t, schema.Patterns)
+
+	for _, p := range schema.Patterns {
+		for _, r := range p.Rules {
+			elements := contexts(root, r.Context)
+			require.NotEmpty(t, elements, "%s selects nothing", r.Context)
+			for _, e := range elements {
+				for _, a := range r.Asserts {
+					require.True(t, holds(t, e, a.Test), "%s: %s", a.Id, a.Test)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package ubl
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/shopspring/decimal"
+)
+
+// Violation is an invoice breaking a business rule of EN 16931 or Peppol
+// BIS Billing 3.0, identified by the rule's id.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("%s: %s", v.Rule, v.Message)
+}
+
+var twoDecimals = regexp.MustCompile(`^-?\d+(\.\d{1,2})?$`)
+
+// rateTax is the tax of a VAT rate, percent of taxable rounded to two
+// decimals half up, as XPath's round rounds it in the rules.
+func rateTax(taxable, percent decimal.Decimal) decimal.Decimal {
+	return taxable.Mul(percent).Add(decimal.New(5, -1)).Floor().Shift(-2)
+}
+
+// Validate checks the invoice against the rules a bill export can break:
+// missing party data, amounts with more than two decimals and totals that
+// do not add up. It returns nil for a conformant invoice.
+func Validate(inv *Invoice) []Violation {
+	var violations []Violation
+	check := func(ok bool, rule, format string, args ...any) {
+		if !ok {
+			violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	// amounts that fail to parse are reported under BR-DEC and read as zero
+	value := func(rule string, a Amount) decimal.Decimal {
+		check(twoDecimals.MatchString(a.Value), rule, "amount %q must have at most two decimals", a.Value)
+		d, _ := decimal.NewFromString(a.Value)
+		return d
+	}
+	optional := func(rule string, a *Amount) decimal.Decimal {
+		if a == nil {
+			return decimal.Zero
+		}
+		return value(rule, *a)
+	}
+
+	check(inv.CustomizationID != "", "BR-01", "specification identifier is required")
+	check(inv.ID != "", "BR-02", "invoice number is required")
+	check(inv.IssueDate != "", "BR-03", "issue date is required")
+	check(inv.InvoiceTypeCode != "", "BR-04", "invoice type code is required")
+	check(inv.DocumentCurrencyCode != "", "BR-05", "currency is required")
+	check(inv.BuyerReference != "", "PEPPOL-EN16931-R003", "buyer reference is required")
+
+	seller, buyer := inv.Supplier.Party, inv.Customer.Party
+	check(seller.LegalEntity.RegistrationName != "", "BR-06", "seller name is required")
+	check(buyer.LegalEntity.RegistrationName != "", "BR-07", "buyer name is required")
+	check(seller.PostalAddress.Country.IdentificationCode != "", "BR-09", "seller country is required")
+	check(buyer.PostalAddress.Country.IdentificationCode != "", "BR-11", "buyer country is required")
+	check(seller.EndpointID.Value != "" && seller.EndpointID.SchemeID != "", "PEPPOL-EN16931-R020", "seller electronic address and scheme are required")
+	check(buyer.EndpointID.Value != "" && buyer.EndpointID.SchemeID != "", "PEPPOL-EN16931-R010", "buyer electronic address and scheme are required")
+	check(len(inv.Lines) > 0, "BR-16", "at least one invoice line is required")
+
+	var lineTotal decimal.Decimal
+	for _, l := range inv.Lines {
+		lineTotal = lineTotal.Add(value("BR-DEC-23", l.LineExtensionAmount))
+		check(l.Item.Name != "", "BR-25", "line %s item name is required", l.ID)
+		price, _ := decimal.NewFromString(l.Price.PriceAmount.Value)
+		check(!price.IsNegative(), "BR-27", "line %s price must not be negative", l.ID)
+	}
+
+	var allowanceTotal decimal.Decimal
+	allowances := map[TaxCategory]decimal.Decimal{}
+	for _, a := range inv.AllowanceCharges {
+		amount := value("BR-DEC-01", a.Amount)
+		allowanceTotal = allowanceTotal.Add(amount)
+		allowances[a.TaxCategory] = allowances[a.TaxCategory].Add(amount)
+	}
+
+	lines := map[TaxCategory]decimal.Decimal{}
+	for _, l := range inv.Lines {
+		d, _ := decimal.NewFromString(l.LineExtensionAmount.Value)
+		lines[l.Item.ClassifiedTaxCategory] = lines[l.Item.ClassifiedTaxCategory].Add(d)
+	}
+
+	var subtotalTax decimal.Decimal
+	for _, s := range inv.TaxTotal.Subtotals {
+		c := s.TaxCategory
+		taxable := value("BR-DEC-19", s.TaxableAmount)
+		tax := value("BR-DEC-20", s.TaxAmount)
+		subtotalTax = subtotalTax.Add(tax)
+		percent, _ := decimal.NewFromString(c.Percent)
+		rule := "BR-" + string(c.ID)
+
+		check(taxable.Equal(lines[c].Sub(allowances[c])), rule+"-08", "%s %s%% taxable amount %s must equal its lines less allowances", c.ID, c.Percent, taxable)
+		expected := rateTax(taxable, percent)
+		check(tax.Sub(expected).Abs().LessThan(decimal.NewFromInt(1)), "BR-CO-17", "%s %s%% tax %s must be within one unit of %s", c.ID, c.Percent, tax, expected)
+		switch c.ID {
+		case CategoryStandard:
+			check(percent.IsPositive(), rule+"-05", "standard rate must be positive")
+			check(tax.Equal(expected), rule+"-09", "%s%% tax %s must be %s%% of %s, %s", c.Percent, tax, c.Percent, taxable, expected)
+		case CategoryZero, CategoryExempt:
+			check(percent.IsZero(), rule+"-05", "%s rate must be zero", c.ID)
+			check(tax.IsZero(), rule+"-09", "%s tax must be zero", c.ID)
+		}
+		if c.ID == CategoryExempt {
+			check(c.TaxExemptionReason != "", "BR-E-10", "exemption reason is required")
+		}
+	}
+
+	total := inv.LegalMonetaryTotal
+	lineExtension := value("BR-DEC-09", total.LineExtensionAmount)
+	taxExclusive := value("BR-DEC-12", total.TaxExclusiveAmount)
+	taxInclusive := value("BR-DEC-14", total.TaxInclusiveAmount)
+	payable := value("BR-DEC-18", total.PayableAmount)
+	taxAmount := value("BR-DEC-13", inv.TaxTotal.TaxAmount)
+	allowanceAmount := optional("BR-DEC-10", total.AllowanceTotalAmount)
+	prepaid := optional("BR-DEC-16", total.PrepaidAmount)
+	rounding := optional("BR-DEC-17", total.PayableRoundingAmount)
+
+	check(lineExtension.Equal(lineTotal), "BR-CO-10", "line extension amount %s must equal the sum of lines %s", lineExtension, lineTotal)
+	check(allowanceAmount.Equal(allowanceTotal), "BR-CO-11", "allowance total %s must equal the sum of allowances %s", allowanceAmount, allowanceTotal)
+	check(taxExclusive.Equal(lineExtension.Sub(allowanceAmount)), "BR-CO-13", "tax exclusive amount %s must equal lines less allowances", taxExclusive)
+	check(taxAmount.Equal(subtotalTax), "BR-CO-14", "tax amount %s must equal the sum of tax subtotals %s", taxAmount, subtotalTax)
+	check(taxInclusive.Equal(taxExclusive.Add(taxAmount)), "BR-CO-15", "tax inclusive amount %s must equal the tax exclusive amount plus tax", taxInclusive)
+	check(payable.Equal(taxInclusive.Sub(prepaid).Add(rounding)), "BR-CO-16", "payable amount %s must equal the tax inclusive amount less prepaid plus rounding", payable)
+	return violations
+}
@@ -0,0 +1,176 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/billing/currency"
+	"encore.app/billing/db"
+	"encore.app/billing/metering"
+	"encore.dev/beta/errs"
+	"github.com/shopspring/decimal"
+)
+
+type CreateMeterRequest struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// Aggregation is sum, max, last or unique_count
+	Aggregation string          `json:"aggregation"`
+	UnitPrice   decimal.Decimal `json:"unit_price"`
+	Currency    string          `json:"currency"`
+}
+
+//encore:api public method=POST path=/meters
+func (s *Service) CreateMeter(ctx context.Context, req *CreateMeterRequest) (*db.DbMeter, error) {
+	if req.Key == "" || req.Name == "" {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Key and name are required"}
+	}
+	if !metering.Aggregation(req.Aggregation).IsValid() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown aggregation " + req.Aggregation}
+	}
+	if req.UnitPrice.IsNegative() {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unit price cannot be negative"}
+	}
+	c, ok := currency.Lookup(req.Currency)
+	if !ok {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown currency " + req.Currency}
+	}
+
+	return db.InsertMeter(ctx, req.Key, req.Name, req.Aggregation, req.UnitPrice, c.Code)
+}
+
+type ListMetersResponse struct {
+	Meters []db.DbMeter `json:"meters"`
+}
+
+//encore:api public method=GET path=/meters
+func (s *Service) ListMeters(ctx context.Context) (*ListMetersResponse, error) {
+	meters, err := db.GetMeters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ListMetersResponse{Meters: meters}, nil
+}
+
+type UsageEvent struct {
+	AccountId string          `json:"account_id"`
+	MeterKey  string          `json:"meter_key"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	// Value is counted by unique_count meters, e.g. a user id
+	Value string `json:"value"`
+	// Timestamp is when the usage happened, defaults to now
+	Timestamp time.Time `json:"timestamp"`
+	// IdempotencyKey deduplicates retried events per account
+	IdempotencyKey string `json:"idempotency_key"`
+	// SubscriptionId is the subscription whose bills bill the usage. It
+	// defaults to the account's active subscription; accounts with several
+	// must give it, and usage of accounts with none is billed on their bills
+	// outside subscriptions.
+	SubscriptionId string `json:"subscription_id"`
+}
+
+type IngestUsageRequest struct {
+	Events []UsageEvent `json:"events"`
+}
+
+type IngestUsageResponse struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+}
+
+// maxUsageBatch bounds the events ingested by one request.
+const maxUsageBatch = 1000
+
+// IngestUsage records raw usage events. Usage is billed when the bill of its
+// subscription for the period closes; events arriving after that are billed
+// on the subscription's next bill.
+//
+//encore:api public method=POST path=/usage
+func (s *Service) IngestUsage(ctx context.Context, req *IngestUsageRequest) (*IngestUsageResponse, error) {
+	if len(req.Events) == 0 || len(req.Events) > maxUsageBatch {
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Between 1 and %d events are required", maxUsageBatch)}
+	}
+
+	meters := map[string]bool{}
+	subscriptions := map[[2]string]*string{}
+	for i, e := range req.Events {
+		if e.AccountId == "" || e.IdempotencyKey == "" {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Event %d: account ID and idempotency key are required", i)}
+		}
+		if e.Quantity.IsNegative() {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Event %d: quantity cannot be negative", i)}
+		}
+		if !meters[e.MeterKey] {
+			if _, err := db.GetMeter(ctx, e.MeterKey); err != nil {
+				return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Event %d: unknown meter %s", i, e.MeterKey)}
+			}
+			meters[e.MeterKey] = true
+		}
+		key := [2]string{e.AccountId, e.SubscriptionId}
+		if _, ok := subscriptions[key]; !ok {
+			subscriptionId, err := usageSubscription(ctx, e.AccountId, e.SubscriptionId)
+			var invalid *errs.Error
+			if errors.As(err, &invalid) {
+				return nil, &errs.Error{Code: errs.InvalidArgument, Message: fmt.Sprintf("Event %d: %s", i, invalid.Message)}
+			}
+			if err != nil {
+				return nil, err
+			}
+			subscriptions[key] = subscriptionId
+		}
+	}
+
+	resp := &IngestUsageResponse{}
+	now := time.Now()
+	for _, e := range req.Events {
+		timestamp := e.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		subscriptionId := subscriptions[[2]string{e.AccountId, e.SubscriptionId}]
+		inserted, err := db.InsertUsageEvent(ctx, e.AccountId, subscriptionId, e.MeterKey, e.Quantity, e.Value, timestamp, e.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		if inserted {
+			resp.Accepted++
+		} else {
+			resp.Duplicates++
+		}
+	}
+	return resp, nil
+}
+
+// usageSubscription resolves the subscription usage is billed on, nil for
+// the account's bills outside subscriptions. Invalid subscriptions are
+// reported as *errs.Error.
+func usageSubscription(ctx context.Context, accountId, subscriptionId string) (*string, error) {
+	if subscriptionId != "" {
+		sub, err := db.GetSubscription(ctx, subscriptionId)
+		if errs.Code(err) == errs.NotFound {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "unknown subscription " + subscriptionId}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sub.AccountId != accountId {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "subscription " + subscriptionId + " belongs to another account"}
+		}
+		return &sub.Id, nil
+	}
+
+	ids, err := db.GetActiveSubscriptionIds(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	switch len(ids) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &ids[0], nil
+	default:
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "subscription ID is required for accounts with several subscriptions"}
+	}
+}
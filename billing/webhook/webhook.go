@@ -0,0 +1,130 @@
+// Package webhook delivers events to partner endpoints over HTTP.
+//
+// Every request carries the event id and type, and a signature header
+//
+//	Billing-Signature: t=<unix timestamp>,v1=<hex HMAC-SHA256>
+//
+// computed over "<timestamp>.<body>" with the endpoint's secret. Receivers
+// verify it with Verify and should reject stale timestamps to prevent replays.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "Billing-Signature"
+	EventIdHeader   = "Billing-Event-Id"
+	EventTypeHeader = "Billing-Event-Type"
+)
+
+var ErrInvalidSignature = errors.New("webhook: invalid signature")
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header value for body sent at timestamp.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// Verify checks a signature header produced by Sign, rejecting signatures
+// older than tolerance.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Sub(time.Unix(unix, 0)) > tolerance {
+		return ErrInvalidSignature
+	}
+
+	expected, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(expected, mac(secret, ts, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Delivery is a single event sent to an endpoint.
+type Delivery struct {
+	URL       string
+	Secret    string
+	EventId   string
+	EventType string
+	Payload   []byte
+}
+
+// Result is the outcome of a delivery attempt that reached the endpoint.
+type Result struct {
+	StatusCode int
+	// Body is the start of the response body, kept for the delivery log
+	Body string
+}
+
+// maxResponseBody bounds the response body kept in a Result.
+const maxResponseBody = 1024
+
+// Send posts the delivery, signed at the current time. It returns an error if
+// the endpoint cannot be reached or responds with a non-2xx status.
+func Send(ctx context.Context, client *http.Client, d Delivery) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIdHeader, d.EventId)
+	req.Header.Set(EventTypeHeader, d.EventType)
+	req.Header.Set(SignatureHeader, Sign(d.Secret, time.Now(), d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	result := &Result{StatusCode: resp.StatusCode, Body: string(body)}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result, fmt.Errorf("webhook: endpoint responded with status %d", resp.StatusCode)
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package webhook_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"encore.app/billing/webhook"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"bill_id":"bill-1"}`)
+	header := webhook.Sign("secret", now, body)
+
+	require.NoError(t, webhook.Verify("secret", header, body, 5*time.Minute, now))
+	require.ErrorIs(t, webhook.Verify("other", header, body, 5*time.Minute, now), webhook.ErrInvalidSignature)
+	require.ErrorIs(t, webhook.Verify("secret", header, []byte(`{}`), 5*time.Minute, now), webhook.ErrInvalidSignature)
+	require.ErrorIs(t, webhook.Verify("secret", header, body, 5*time.Minute, now.Add(time.Hour)), webhook.ErrInvalidSignature)
+	require.ErrorIs(t, webhook.Verify("secret", "garbage", body, 5*time.Minute, now), webhook.ErrInvalidSignature)
+}
+
+func TestSendSignsDelivery(t *testing.T) {
+	secret, err := webhook.NewSecret()
+	require.NoError(t, err)
+
+	var received http.Header
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	payload := []byte(`{"event_id":"evt-1","bill_id":"bill-1"}`)
+	result, err := webhook.Send(context.Background(), server.Client(), webhook.Delivery{
+		URL:       server.URL,
+		Secret:    secret,
+		EventId:   "evt-1",
+		EventType: "bill-closed",
+		Payload:   payload,
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, result.StatusCode)
+
+	require.Equal(t, payload, receivedBody)
+	require.Equal(t, "evt-1", received.Get(webhook.EventIdHeader))
+	require.Equal(t, "bill-closed", received.Get(webhook.EventTypeHeader))
+	require.NoError(t, webhook.Verify(secret, received.Get(webhook.SignatureHeader), receivedBody, time.Minute, time.Now()))
+}
+
+func TestSendFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	result, err := webhook.Send(context.Background(), server.Client(), webhook.Delivery{
+		URL:     server.URL,
+		Secret:  "secret",
+		Payload: []byte(`{}`),
+	})
+	require.Error(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+	require.Contains(t, result.Body, "unavailable")
+}
+
+func TestValidateURL(t *testing.T) {
+	require.NoError(t, webhook.ValidateURL("https://hooks.example.com/billing"))
+	require.ErrorIs(t, webhook.ValidateURL("http://hooks.example.com/billing"), webhook.ErrInsecureURL)
+	require.ErrorIs(t, webhook.ValidateURL("/billing"), webhook.ErrInsecureURL)
+	require.ErrorIs(t, webhook.ValidateURL("https://localhost:8443/"), webhook.ErrForbiddenAddress)
+	require.ErrorIs(t, webhook.ValidateURL("https://169.254.169.254/latest/meta-data"), webhook.ErrForbiddenAddress)
+	require.ErrorIs(t, webhook.ValidateURL("https://[::1]/"), webhook.ErrForbiddenAddress)
+}
+
+func TestIsPublic(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00:ec2::254", "fe80::1", "::ffff:127.0.0.1"} {
+		require.False(t, webhook.IsPublic(netip.MustParseAddr(addr)), addr)
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		require.True(t, webhook.IsPublic(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestClientRefusesPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// the test server listens on loopback
+	_, err := webhook.Send(context.Background(), webhook.NewClient(time.Second), webhook.Delivery{
+		URL:     server.URL,
+		Secret:  "secret",
+		Payload: []byte(`{}`),
+	})
+	require.ErrorIs(t, err, webhook.ErrForbiddenAddress)
+}
@@ -0,0 +1,216 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"encore.app/billing/activity"
+	"encore.app/billing/db"
+	"encore.app/billing/events"
+	"encore.app/billing/webhook"
+	"encore.app/billing/workflow"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+)
+
+// webhookEventTypes are the event types endpoints can subscribe to.
+var webhookEventTypes = map[string]bool{
+	events.BillOpenedTopic:    true,
+	events.LineItemAddedTopic: true,
+	events.BillClosedTopic:    true,
+	events.BillVoidedTopic:    true,
+}
+
+type CreateWebhookEndpointRequest struct {
+	URL string `json:"url"`
+	// EventTypes filters the events delivered, empty for all
+	EventTypes []string `json:"event_types"`
+}
+
+type CreateWebhookEndpointResponse struct {
+	Endpoint *db.DbWebhookEndpoint `json:"endpoint"`
+	// Secret signs deliveries to the endpoint. It is only returned once.
+	Secret string `json:"secret"`
+}
+
+//encore:api public method=POST path=/accounts/:accountId/webhooks
+func (s *Service) CreateWebhookEndpoint(ctx context.Context, accountId string, req *CreateWebhookEndpointRequest) (*CreateWebhookEndpointResponse, error) {
+	switch err := webhook.ValidateURL(req.URL); {
+	case errors.Is(err, webhook.ErrForbiddenAddress):
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "URL must not point to a private address"}
+	case err != nil:
+		return nil, &errs.Error{Code: errs.InvalidArgument, Message: "URL must be an absolute https URL"}
+	}
+	for _, eventType := range req.EventTypes {
+		if !webhookEventTypes[eventType] {
+			return nil, &errs.Error{Code: errs.InvalidArgument, Message: "Unknown event type " + eventType}
+		}
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := db.InsertWebhookEndpoint(ctx, accountId, req.URL, secret, req.EventTypes)
+	if err != nil {
+		return nil, err
+	}
+	return &CreateWebhookEndpointResponse{Endpoint: endpoint, Secret: secret}, nil
+}
+
+type ListWebhookEndpointsResponse struct {
+	Endpoints []db.DbWebhookEndpoint `json:"endpoints"`
+}
+
+//encore:api public method=GET path=/accounts/:accountId/webhooks
+func (s *Service) ListWebhookEndpoints(ctx context.Context, accountId string) (*ListWebhookEndpointsResponse, error) {
+	endpoints, err := db.GetWebhookEndpoints(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+	return &ListWebhookEndpointsResponse{Endpoints: endpoints}, nil
+}
+
+// DeleteWebhookEndpoint stops deliveries to an endpoint. Its delivery log is
+// kept.
+//
+//encore:api public method=DELETE path=/webhooks/:endpointId
+func (s *Service) DeleteWebhookEndpoint(ctx context.Context, endpointId int64) (*Response, error) {
+	err := db.DeactivateWebhookEndpoint(ctx, endpointId)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Message: "Webhook endpoint deleted"}, nil
+}
+
+type ListWebhookDeliveriesRequest struct {
+	Limit int `query:"limit"`
+}
+
+type ListWebhookDeliveriesResponse struct {
+	Deliveries []db.DbWebhookDelivery `json:"deliveries"`
+}
+
+// ListWebhookDeliveries returns the delivery log of an endpoint, newest first.
+//
+//encore:api public method=GET path=/webhooks/:endpointId/deliveries
+func (s *Service) ListWebhookDeliveries(ctx context.Context, endpointId int64, req *ListWebhookDeliveriesRequest) (*ListWebhookDeliveriesResponse, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > maxListLimit {
+		limit = defaultListLimit
+	}
+	if _, err := db.GetWebhookEndpoint(ctx, endpointId); err != nil {
+		return nil, err
+	}
+
+	deliveries, err := db.GetWebhookDeliveries(ctx, endpointId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &ListWebhookDeliveriesResponse{Deliveries: deliveries}, nil
+}
+
+// ReplayWebhookDelivery delivers an event again, restarting its retry
+// schedule. Deliveries still being retried cannot be replayed.
+//
+//encore:api public method=POST path=/webhook-deliveries/:deliveryId/replay
+func (s *Service) ReplayWebhookDelivery(ctx context.Context, deliveryId int64) (*db.DbWebhookDelivery, error) {
+	delivery, err := db.GetWebhookDelivery(ctx, deliveryId)
+	if err != nil {
+		return nil, err
+	}
+
+	// reset first so the delivery is not skipped as already succeeded
+	err = db.SetWebhookDeliveryStatus(ctx, delivery.Id, db.DeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.startWebhookDelivery(ctx, delivery.Id)
+	var started *serviceerror.WorkflowExecutionAlreadyStarted
+	if errors.As(err, &started) {
+		return nil, &errs.Error{Code: errs.FailedPrecondition, Message: "Delivery is already in progress"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.GetWebhookDelivery(ctx, delivery.Id)
+}
+
+func (s *Service) startWebhookDelivery(ctx context.Context, deliveryId int64) error {
+	options := client.StartWorkflowOptions{
+		ID:        workflow.WebhookDeliveryWorkflowId(deliveryId),
+		TaskQueue: BillingTaskQueue,
+	}
+	_, err := s.client.ExecuteWorkflow(ctx, options, workflow.DeliverWebhookWorkflow, activity.DeliverWebhookInput{
+		DeliveryId: deliveryId,
+	})
+	return err
+}
+
+// dispatchWebhooks records a delivery of the event to each endpoint of the
+// account subscribed to it and starts delivering it. Redelivered events reuse
+// the existing deliveries.
+func (s *Service) dispatchWebhooks(ctx context.Context, accountId, eventId, eventType string, event interface{}) error {
+	endpoints, err := db.GetWebhookEndpointsForEvent(ctx, accountId, eventType)
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		delivery, err := db.InsertWebhookDelivery(ctx, endpoint.Id, eventId, eventType, payload)
+		if err != nil {
+			return err
+		}
+		if delivery.Status != db.DeliveryPending {
+			continue
+		}
+
+		err = s.startWebhookDelivery(ctx, delivery.Id)
+		var started *serviceerror.WorkflowExecutionAlreadyStarted
+		if err != nil && !errors.As(err, &started) {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ = pubsub.NewSubscription(BillOpenedEvents, "bill-opened-webhooks", pubsub.SubscriptionConfig[*events.BillOpened]{
+	Handler: pubsub.MethodHandler((*Service).billOpenedWebhooks),
+})
+
+func (s *Service) billOpenedWebhooks(ctx context.Context, event *events.BillOpened) error {
+	return s.dispatchWebhooks(ctx, event.AccountId, event.EventId, events.BillOpenedTopic, event)
+}
+
+var _ = pubsub.NewSubscription(LineItemAddedEvents, "line-item-added-webhooks", pubsub.SubscriptionConfig[*events.LineItemAdded]{
+	Handler: pubsub.MethodHandler((*Service).lineItemAddedWebhooks),
+})
+
+func (s *Service) lineItemAddedWebhooks(ctx context.Context, event *events.LineItemAdded) error {
+	return s.dispatchWebhooks(ctx, event.AccountId, event.EventId, events.LineItemAddedTopic, event)
+}
+
+var _ = pubsub.NewSubscription(BillClosedEvents, "bill-closed-webhooks", pubsub.SubscriptionConfig[*events.BillClosed]{
+	Handler: pubsub.MethodHandler((*Service).billClosedWebhooks),
+})
+
+func (s *Service) billClosedWebhooks(ctx context.Context, event *events.BillClosed) error {
+	return s.dispatchWebhooks(ctx, event.AccountId, event.EventId, events.BillClosedTopic, event)
+}
+
+var _ = pubsub.NewSubscription(BillVoidedEvents, "bill-voided-webhooks", pubsub.SubscriptionConfig[*events.BillVoided]{
+	Handler: pubsub.MethodHandler((*Service).billVoidedWebhooks),
+})
+
+func (s *Service) billVoidedWebhooks(ctx context.Context, event *events.BillVoided) error {
+	return s.dispatchWebhooks(ctx, event.AccountId, event.EventId, events.BillVoidedTopic, event)
+}
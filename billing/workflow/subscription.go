@@ -0,0 +1,107 @@
+package workflow
+
+import (
+	"fmt"
+	"time"
+
+	activity "encore.app/billing/activity"
+	"encore.app/billing/period"
+	enums "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+type SubscriptionWorkflowInput struct {
+	SubscriptionId string
+	AccountId      string
+	Currency       string
+	Schedule       period.Schedule
+	// Index is the period billed by the current run, starting at 0
+	Index int
+}
+
+// subscriptionCloseGrace is how long after its period end a bill may take to
+// close before the subscription moves on without it.
+const subscriptionCloseGrace = time.Hour
+
+// SubscriptionBillId is the id of the bill for a subscription period, which
+// is also the id of the bill's workflow.
+func SubscriptionBillId(subscriptionId string, index int) string {
+	return fmt.Sprintf("%s-%d", subscriptionId, index)
+}
+
+// SubscriptionWorkflow bills a subscription one period per run: it runs the
+// period's CreateBillWorkflow as a child and continues as new with the next
+// period once that bill completes or the period ends, whichever is first. A
+// bill that fails or is still closing does not hold up the next period; the
+// failure is logged and left on the bill's workflow. The workflow history
+// stays bounded however long the subscription lasts.
+//
+// Cancelling the subscription stops it from opening further bills; the
+// current bill runs to the end of its period.
+func SubscriptionWorkflow(ctx workflow.Context, input SubscriptionWorkflowInput) error {
+	periodStart, periodEnd, err := input.Schedule.Period(input.Index)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), activity.InvalidScheduleError, err)
+	}
+
+	billId := SubscriptionBillId(input.SubscriptionId, input.Index)
+	childCtx := workflow.WithChildOptions(ctx, workflow.ChildWorkflowOptions{
+		WorkflowID: billId,
+		// the bill outlives a cancelled subscription
+		ParentClosePolicy: enums.PARENT_CLOSE_POLICY_ABANDON,
+	})
+	bill := workflow.ExecuteChildWorkflow(childCtx, CreateBillWorkflow, CreateBillWorkflowInput{
+		BillId:         billId,
+		AccountId:      input.AccountId,
+		Currency:       input.Currency,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		SubscriptionId: input.SubscriptionId,
+	})
+	// an abandoned child must have started before the parent completes
+	err = bill.GetChildWorkflowExecution().Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cancelCh := workflow.GetSignalChannel(ctx, activity.CancelSubscriptionSignal)
+	done, cancelled := false, false
+
+	selector := workflow.NewSelector(ctx)
+	selector.AddFuture(bill, func(f workflow.Future) {
+		if err := f.Get(ctx, nil); err != nil {
+			workflow.GetLogger(ctx).Error("subscription bill failed", "subscription_id", input.SubscriptionId, "bill_id", billId, "error", err)
+		}
+		done = true
+	})
+	// the bill closes itself at the period end; one stuck closing keeps
+	// running on its own while the next period starts
+	periodTimerCtx, cancelPeriodTimer := workflow.WithCancel(ctx)
+	defer cancelPeriodTimer()
+	selector.AddFuture(workflow.NewTimer(periodTimerCtx, periodEnd.Sub(workflow.Now(ctx))+subscriptionCloseGrace), func(f workflow.Future) {
+		if f.Get(ctx, nil) == nil {
+			workflow.GetLogger(ctx).Warn("subscription bill still running after its period, starting the next period", "subscription_id", input.SubscriptionId, "bill_id", billId)
+			done = true
+		}
+	})
+	selector.AddReceive(cancelCh, func(c workflow.ReceiveChannel, more bool) {
+		c.Receive(ctx, nil)
+		cancelled = true
+	})
+	for !done && !cancelled {
+		selector.Select(ctx)
+	}
+
+	if cancelled {
+		workflow.GetLogger(ctx).Info("subscription cancelled", "subscription_id", input.SubscriptionId, "bill_id", billId)
+		return nil
+	}
+	// a cancellation received as the bill closed
+	if cancelCh.ReceiveAsync(nil) {
+		return nil
+	}
+
+	input.Index++
+	return workflow.NewContinueAsNewError(ctx, SubscriptionWorkflow, input)
+}
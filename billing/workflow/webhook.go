@@ -0,0 +1,43 @@
+package workflow
+
+import (
+	"strconv"
+	"time"
+
+	activity "encore.app/billing/activity"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// webhookRetryPolicy retries a delivery with exponential backoff, from 30
+// seconds up to 6 hours between attempts, for about 3 days.
+var webhookRetryPolicy = &temporal.RetryPolicy{
+	InitialInterval:    30 * time.Second,
+	BackoffCoefficient: 2,
+	MaximumInterval:    6 * time.Hour,
+	MaximumAttempts:    18,
+}
+
+// WebhookDeliveryWorkflowId is the id of the workflow delivering a delivery,
+// so an event is never delivered to an endpoint by two workflows at once.
+func WebhookDeliveryWorkflowId(deliveryId int64) string {
+	return "webhook-delivery-" + strconv.FormatInt(deliveryId, 10)
+}
+
+// DeliverWebhookWorkflow delivers a webhook until the endpoint accepts it or
+// the retry schedule is exhausted, in which case the delivery is marked
+// failed.
+func DeliverWebhookWorkflow(ctx workflow.Context, input activity.DeliverWebhookInput) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 30 * time.Second,
+	})
+
+	deliverCtx := workflow.WithRetryPolicy(ctx, *webhookRetryPolicy)
+	err := workflow.ExecuteActivity(deliverCtx, activities.DeliverWebhookActivity, input).Get(ctx, nil)
+	if err == nil {
+		return nil
+	}
+	workflow.GetLogger(ctx).Warn("webhook delivery failed", "delivery_id", input.DeliveryId, "error", err)
+
+	return workflow.ExecuteActivity(ctx, activities.FailWebhookDeliveryActivity, input).Get(ctx, nil)
+}
@@ -1,9 +1,14 @@
 package workflow
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	activity "encore.app/billing/activity"
+	"encore.app/billing/db"
+	"github.com/shopspring/decimal"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/workflow"
 )
 
@@ -13,39 +18,451 @@ type CreateBillWorkflowInput struct {
 	Currency    string
 	PeriodStart time.Time
 	PeriodEnd   time.Time
+	// Resume continues an existing bill instead of creating it, used to
+	// deliver void and reopen signals once the original workflow has completed
+	// and to continue high-volume bills as new runs.
+	Resume bool
+	// SubscriptionId is set for the bills of recurring subscriptions
+	SubscriptionId string
 }
 
 type WorkflowResult struct {
 	BillId string
 }
 
+// BillState is the live view of a bill held by CreateBillWorkflow and
+// returned by the GetBillState query.
+type BillState struct {
+	BillId      string
+	AccountId   string
+	Currency    string
+	Status      db.Status
+	Items       []db.DbBillItem
+	Total       decimal.Decimal
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	CreatedAt   time.Time
+}
+
+func (b *BillState) addItem(item db.DbBillItem) {
+	b.Items = append(b.Items, item)
+	b.Total = b.Total.Add(item.Amount.Mul(item.ExchangeRate))
+}
+
+// activities is used to reference activity methods; the worker registers
+// the instance holding their dependencies.
+var activities *activity.Activities
+
+// minActivityTimeout bounds activity timeouts for bills whose period has
+// already ended, e.g. when resumed to void or reopen them.
+const minActivityTimeout = time.Minute
+
+// closeRetryPolicy retries the activities closing a bill, from a second up to
+// a minute between attempts. A bill whose close still fails stays in closing
+// and the close is retried after closeRetryDelay.
+var closeRetryPolicy = &temporal.RetryPolicy{
+	InitialInterval:    time.Second,
+	BackoffCoefficient: 2,
+	MaximumInterval:    time.Minute,
+	MaximumAttempts:    10,
+}
+
+const closeRetryDelay = time.Hour
+
+// lineItemRetryPolicy bounds the attempts to add a batch of line items, so a
+// failing batch does not hold up the bill's other signals. The batch stays
+// buffered and is retried after lineItemRetryDelay.
+var lineItemRetryPolicy = &temporal.RetryPolicy{
+	InitialInterval:    time.Second,
+	BackoffCoefficient: 2,
+	MaximumInterval:    time.Minute,
+	MaximumAttempts:    5,
+}
+
+const (
+	// maxLineItemBatch bounds the items inserted by one AddLineItemsActivity
+	maxLineItemBatch = 500
+	// maxHistoryLength is the history size past which an open bill continues
+	// as a new run, well below the server's limit
+	maxHistoryLength = 10000
+	// lineItemRetryDelay is how long a batch of line items that failed as a
+	// whole stays buffered before it is retried
+	lineItemRetryDelay = time.Minute
+)
+
+func newBillState(bill db.DbBill) *BillState {
+	return &BillState{
+		BillId:      bill.Id,
+		AccountId:   bill.AccountId,
+		Currency:    bill.Currency,
+		Status:      bill.Status,
+		Items:       []db.DbBillItem{},
+		Total:       decimal.Zero,
+		PeriodStart: bill.PeriodStart,
+		PeriodEnd:   bill.PeriodEnd,
+		CreatedAt:   bill.CreatedAt,
+	}
+}
+
 func CreateBillWorkflow(ctx workflow.Context, workflowInput CreateBillWorkflowInput) (*WorkflowResult, error) {
 
 	durationUntilEnd := workflowInput.PeriodEnd.Sub(workflow.Now(ctx))
 
+	activityTimeout := durationUntilEnd
+	if activityTimeout < minActivityTimeout {
+		activityTimeout = minActivityTimeout
+	}
 	ao := workflow.ActivityOptions{
-		StartToCloseTimeout: durationUntilEnd,
+		StartToCloseTimeout: activityTimeout,
 	}
 	ctx = workflow.WithActivityOptions(ctx, ao)
 
-	err := workflow.ExecuteActivity(ctx, activity.CreateBillActivity, workflowInput).Get(ctx, nil)
+	var state *BillState
+	// line items already persisted keyed by reference, used to answer replays
+	addedItems := map[string]*db.DbBillItem{}
+	// line items by id and the ids of items already reversed
+	itemsById := map[int64]*db.DbBillItem{}
+	reversedItems := map[int64]bool{}
+	trackItem := func(item *db.DbBillItem) {
+		addedItems[item.Reference] = item
+		itemsById[item.Id] = item
+		if item.ReversesItemId != nil {
+			reversedItems[*item.ReversesItemId] = true
+		}
+		state.addItem(*item)
+	}
+	durationUntilStart := workflowInput.PeriodStart.Sub(workflow.Now(ctx))
+
+	if workflowInput.Resume {
+		var loaded activity.LoadBillResult
+		err := workflow.ExecuteActivity(ctx, activities.LoadBillActivity, activity.LoadBillInput{BillId: workflowInput.BillId}).Get(ctx, &loaded)
+		if err != nil {
+			return nil, err
+		}
+		state = newBillState(loaded.Bill)
+		for i := range loaded.Items {
+			trackItem(&loaded.Items[i])
+		}
+	} else {
+		// bills for a period that has not started yet wait as drafts
+		status := db.StatusOpen
+		if durationUntilStart > 0 {
+			status = db.StatusDraft
+		}
+
+		err := workflow.ExecuteActivity(ctx, activities.CreateBillActivity, activity.CreateBillInput{
+			BillId:         workflowInput.BillId,
+			AccountId:      workflowInput.AccountId,
+			Currency:       workflowInput.Currency,
+			PeriodStart:    workflowInput.PeriodStart,
+			PeriodEnd:      workflowInput.PeriodEnd,
+			Status:         status,
+			SubscriptionId: workflowInput.SubscriptionId,
+		}).Get(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		state = newBillState(db.DbBill{
+			Id:          workflowInput.BillId,
+			AccountId:   workflowInput.AccountId,
+			Currency:    workflowInput.Currency,
+			Status:      status,
+			PeriodStart: workflowInput.PeriodStart,
+			PeriodEnd:   workflowInput.PeriodEnd,
+			CreatedAt:   workflow.Now(ctx),
+		})
+	}
+
+	err := workflow.SetQueryHandler(ctx, activity.GetBillStateQuery, func() (*BillState, error) {
+		return state, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	isDone := false
-	isEnded := false
+	// transition moves the bill to next, enforcing the lifecycle before
+	// touching the database
+	transition := func(ctx workflow.Context, next db.Status, fn interface{}, input interface{}) error {
+		if !state.Status.CanTransitionTo(next) {
+			return temporal.NewApplicationError("Bill cannot move from "+string(state.Status)+" to "+string(next), activity.IllegalTransitionError)
+		}
+		err := workflow.ExecuteActivity(ctx, fn, input).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+		state.Status = next
+		return nil
+	}
+
+	// prepareLineItem fills in the currencies of a validated item
+	prepareLineItem := func(input activity.AddLineItemSignalInput) activity.AddLineItemSignalInput {
+		input.BillCurrency = state.Currency
+		if input.Currency == "" {
+			input.Currency = state.Currency
+		}
+		if input.Type == db.ItemTypeReversal {
+			// a reversal negates the original item exactly
+			original := itemsById[input.ReversesItemId]
+			input.Amount = original.Amount.Neg()
+			input.Currency = original.Currency
+			input.ExchangeRate = original.ExchangeRate
+		}
+		return input
+	}
+
 	createBillSignalCh := workflow.GetSignalChannel(ctx, activity.CreateBillSignal)
 	lineItemSignalCh := workflow.GetSignalChannel(ctx, activity.AddLineItemSignal)
 	finalizeBillSignalCh := workflow.GetSignalChannel(ctx, activity.CloseBillSignal)
-	timerFuture := workflow.NewTimer(ctx, durationUntilEnd)
+	voidBillSignalCh := workflow.GetSignalChannel(ctx, activity.VoidBillSignal)
+	reopenBillSignalCh := workflow.GetSignalChannel(ctx, activity.ReopenBillSignal)
 	selector := workflow.NewSelector(ctx)
 
+	// line items received by signal or update and not yet persisted, in
+	// arrival order
+	var pendingItems []activity.AddLineItemSignalInput
+	pendingRefs := map[string]bool{}
+	// failedItems holds why the buffered items that could not be added
+	// failed, by reference, for the updates waiting on them
+	failedItems := map[string]error{}
+	bufferLineItem := func(input activity.AddLineItemSignalInput) error {
+		if !state.Status.AcceptsLineItems() {
+			return temporal.NewApplicationError("Bill is "+string(state.Status), activity.BillNotOpenError)
+		}
+		if _, ok := addedItems[input.Reference]; ok || pendingRefs[input.Reference] {
+			return nil
+		}
+		if err := validateLineItem(input, addedItems, itemsById, reversedItems); err != nil {
+			return err
+		}
+		delete(failedItems, input.Reference)
+		pendingRefs[input.Reference] = true
+		pendingItems = append(pendingItems, prepareLineItem(input))
+		return nil
+	}
+	receiveLineItem := func(input activity.AddLineItemSignalInput) {
+		if err := bufferLineItem(input); err != nil {
+			workflow.GetLogger(ctx).Error("Dropping line item", "BillId", state.BillId, "Reference", input.Reference, "Error", err)
+		}
+	}
+
+	// drainLineItems buffers the line item signals already received without
+	// blocking
+	drainLineItems := func() {
+		for received := true; received; {
+			var item activity.AddLineItemSignalInput
+			if received = lineItemSignalCh.ReceiveAsync(&item); received {
+				receiveLineItem(item)
+			}
+		}
+	}
+
+	// addBufferedLineItems persists the buffered items in batches. Signals
+	// and updates arriving during an insert are drained into the next batch,
+	// so a burst of them costs one activity per batch rather than one per
+	// item, and only one insert runs at a time. Items that cannot be added
+	// fail on their own; a batch that fails as a whole stays buffered and is
+	// retried after lineItemRetryDelay, unless the bill no longer takes items.
+	var addBufferedLineItems func(ctx workflow.Context)
+	addingLineItems := false
+	lineItemRetryPending := false
+	// the retry runs on its own so updates waiting on the items finish while
+	// the main loop awaits them, e.g. to close the bill
+	retryLineItems := func() {
+		if lineItemRetryPending {
+			return
+		}
+		lineItemRetryPending = true
+		workflow.Go(ctx, func(ctx workflow.Context) {
+			if err := workflow.Sleep(ctx, lineItemRetryDelay); err != nil {
+				return
+			}
+			lineItemRetryPending = false
+			addBufferedLineItems(ctx)
+		})
+	}
+	addBufferedLineItems = func(ctx workflow.Context) {
+		if addingLineItems {
+			// the running insert picks up the items buffered meanwhile
+			return
+		}
+		addingLineItems = true
+		defer func() { addingLineItems = false }()
+
+		for drainLineItems(); len(pendingItems) > 0; drainLineItems() {
+			batch := activity.AddLineItemsInput{BillId: state.BillId, Items: pendingItems}
+			if len(batch.Items) > maxLineItemBatch {
+				batch.Items = batch.Items[:maxLineItemBatch]
+			}
+			pendingItems = pendingItems[len(batch.Items):]
+
+			var results []activity.LineItemResult
+			batchCtx := workflow.WithRetryPolicy(workflow.WithActivityOptions(ctx, ao), *lineItemRetryPolicy)
+			err := workflow.ExecuteActivity(batchCtx, activities.AddLineItemsActivity, batch).Get(ctx, &results)
+			var appErr *temporal.ApplicationError
+			if err != nil && !(errors.As(err, &appErr) && appErr.NonRetryable()) {
+				workflow.GetLogger(ctx).Error("Failed to add line items, retrying", "BillId", state.BillId, "Items", len(batch.Items), "Error", err)
+				pendingItems = append(append([]activity.AddLineItemSignalInput{}, batch.Items...), pendingItems...)
+				retryLineItems()
+				return
+			}
+			if err != nil {
+				workflow.GetLogger(ctx).Error("Failed to add line items, dropping them", "BillId", state.BillId, "Items", len(batch.Items), "Error", err)
+				for _, item := range batch.Items {
+					delete(pendingRefs, item.Reference)
+					failedItems[item.Reference] = err
+				}
+				continue
+			}
+
+			var added int
+			for i, result := range results {
+				delete(pendingRefs, batch.Items[i].Reference)
+				if result.Item == nil {
+					workflow.GetLogger(ctx).Error("Failed to add line item", "BillId", state.BillId, "Reference", result.Reference, "Error", result.Error)
+					failedItems[result.Reference] = result.Err()
+					continue
+				}
+				added++
+				if _, ok := addedItems[result.Item.Reference]; !ok {
+					trackItem(result.Item)
+				}
+			}
+			workflow.GetLogger(ctx).Info("Added line items", "BillId", state.BillId, "Items", added)
+		}
+	}
+
+	// awaitLineItem waits until a buffered item is added or fails
+	awaitLineItem := func(ctx workflow.Context, reference string) (*db.DbBillItem, error) {
+		err := workflow.Await(ctx, func() bool {
+			_, added := addedItems[reference]
+			return added || failedItems[reference] != nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if item, ok := addedItems[reference]; ok {
+			return item, nil
+		}
+		return nil, failedItems[reference]
+	}
+
+	// addLineItem adds an item through the same buffer and batches as
+	// signalled items, returning it once persisted
+	addLineItem := func(ctx workflow.Context, input activity.AddLineItemSignalInput) (*db.DbBillItem, error) {
+		if item, ok := addedItems[input.Reference]; ok {
+			workflow.GetLogger(ctx).Info("Line item already added, skipping", "BillId", input.BillId, "Reference", input.Reference)
+			return item, nil
+		}
+		if err := bufferLineItem(input); err != nil {
+			return nil, err
+		}
+		addBufferedLineItems(ctx)
+		item, err := awaitLineItem(ctx, input.Reference)
+		if err != nil {
+			return nil, err
+		}
+		workflow.GetLogger(ctx).Info("Added line item", "BillId", input.BillId, "Description", input.Description)
+		return item, nil
+	}
+
+	err = workflow.SetUpdateHandlerWithOptions(ctx, activity.AddLineItemUpdate, addLineItem, workflow.UpdateHandlerOptions{
+		Validator: func(ctx workflow.Context, input activity.AddLineItemSignalInput) error {
+			if !state.Status.AcceptsLineItems() {
+				return temporal.NewApplicationError("Bill is "+string(state.Status), activity.BillNotOpenError)
+			}
+			return validateLineItem(input, addedItems, itemsById, reversedItems)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// addLineItems adds a batch of items through the buffer and returns the
+	// outcome of each in input order. Items whose reference is already used
+	// on the bill are returned as duplicates and items that are invalid or
+	// cannot be added fail on their own.
+	addLineItems := func(ctx workflow.Context, input activity.AddLineItemsInput) ([]activity.LineItemResult, error) {
+		results := make([]activity.LineItemResult, len(input.Items))
+		var buffered []int
+		for i, item := range input.Items {
+			results[i].Reference = item.Reference
+			_, added := addedItems[item.Reference]
+			results[i].Duplicate = added || pendingRefs[item.Reference]
+			if err := bufferLineItem(item); err != nil {
+				results[i].Fail(err)
+				continue
+			}
+			buffered = append(buffered, i)
+		}
+		addBufferedLineItems(ctx)
+
+		err := workflow.Await(ctx, func() bool {
+			for _, i := range buffered {
+				reference := results[i].Reference
+				if _, added := addedItems[reference]; !added && failedItems[reference] == nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range buffered {
+			if item, ok := addedItems[results[i].Reference]; ok {
+				results[i].Item = item
+			} else {
+				results[i].Fail(failedItems[results[i].Reference])
+			}
+		}
+		return results, nil
+	}
+
+	err = workflow.SetUpdateHandlerWithOptions(ctx, activity.AddLineItemsUpdate, addLineItems, workflow.UpdateHandlerOptions{
+		Validator: func(ctx workflow.Context, input activity.AddLineItemsInput) error {
+			if !state.Status.AcceptsLineItems() {
+				return temporal.NewApplicationError("Bill is "+string(state.Status), activity.BillNotOpenError)
+			}
+			if len(input.Items) > maxLineItemBatch {
+				return temporal.NewApplicationError(fmt.Sprintf("A batch is limited to %d items", maxLineItemBatch), activity.InvalidLineItemError)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// startPeriodTimer closes the bill at periodEnd, replacing any previous
+	// period timer
+	var cancelPeriodTimer workflow.CancelFunc
+	startPeriodTimer := func(periodEnd time.Time) {
+		if cancelPeriodTimer != nil {
+			cancelPeriodTimer()
+		}
+		timerCtx, cancel := workflow.WithCancel(ctx)
+		cancelPeriodTimer = cancel
+
+		selector.AddFuture(workflow.NewTimer(timerCtx, periodEnd.Sub(workflow.Now(ctx))), func(f workflow.Future) {
+			if err := f.Get(ctx, nil); err != nil {
+				// replaced by a later period end
+				return
+			}
+			workflow.GetLogger(ctx).Info("Billing period ended, closing the bill", "BillId", state.BillId)
+
+			workflowID := workflow.GetInfo(ctx).WorkflowExecution.ID
+			runID := workflow.GetInfo(ctx).WorkflowExecution.RunID
+
+			workflow.SignalExternalWorkflow(ctx, workflowID, runID, activity.CloseBillSignal, activity.CloseBillInput{BillId: state.BillId})
+		})
+	}
+
 	selector.AddReceive(createBillSignalCh, func(c workflow.ReceiveChannel, more bool) {
 		var input activity.CreateBillInput
 		c.Receive(ctx, &input)
 
-		err := workflow.ExecuteActivity(ctx, activity.CreateBillActivity, input).Get(ctx, nil)
+		err := workflow.ExecuteActivity(ctx, activities.CreateBillActivity, input).Get(ctx, nil)
 		if err != nil {
 			workflow.GetLogger(ctx).Error("Failed to create Bull", "Error", err)
 			return
@@ -56,49 +473,244 @@ func CreateBillWorkflow(ctx workflow.Context, workflowInput CreateBillWorkflowIn
 	selector.AddReceive(lineItemSignalCh, func(c workflow.ReceiveChannel, more bool) {
 		var input activity.AddLineItemSignalInput
 		c.Receive(ctx, &input)
-		workflow.GetLogger(ctx).Info("Received signal,adding item to bill", "BillId", input.BillId)
+		receiveLineItem(input)
+		addBufferedLineItems(ctx)
+	})
+
+	// closeBill prices the period's usage, applies account credit and closes
+	// the bill. A bill left in closing by a failed attempt resumes from there
+	// on the next close signal, and the close is retried after
+	// closeRetryDelay in any case.
+	var closeBill func(input activity.CloseBillInput)
+	closeRetryPending := false
+	retryClose := func(input activity.CloseBillInput) {
+		if closeRetryPending || (state.Status != db.StatusOpen && state.Status != db.StatusClosing) {
+			return
+		}
+		closeRetryPending = true
+		selector.AddFuture(workflow.NewTimer(ctx, closeRetryDelay), func(f workflow.Future) {
+			closeRetryPending = false
+			if state.Status == db.StatusOpen || state.Status == db.StatusClosing {
+				workflow.GetLogger(ctx).Info("Retrying to close the bill", "BillId", input.BillId)
+				closeBill(input)
+			}
+		})
+	}
+	closeBill = func(input activity.CloseBillInput) {
+		closeCtx := workflow.WithRetryPolicy(ctx, *closeRetryPolicy)
+
+		if state.Status != db.StatusClosing {
+			// add the items signalled before the close
+			if state.Status.AcceptsLineItems() {
+				addBufferedLineItems(ctx)
+			}
 
-		err := workflow.ExecuteActivity(ctx, activity.AddLineItemActivity, input).Get(ctx, nil)
+			// reject new updates and let in-flight ones finish before closing
+			err := transition(closeCtx, db.StatusClosing, activities.UpdateBillStatusActivity, activity.UpdateBillStatusInput{BillId: input.BillId, Status: db.StatusClosing})
+			if err != nil {
+				workflow.GetLogger(ctx).Error("Failed to start closing the bill", "Error", err)
+				retryClose(input)
+				return
+			}
+		}
+		err := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) })
 		if err != nil {
-			workflow.GetLogger(ctx).Error("Failed to add line item", "Error", err)
+			workflow.GetLogger(ctx).Error("Failed waiting for pending line items", "Error", err)
+			return
+		}
+		// items kept by a failed batch are added before the totals
+		addBufferedLineItems(ctx)
+		if len(pendingItems) > 0 {
+			workflow.GetLogger(ctx).Error("Line items are still pending, postponing the close", "BillId", input.BillId, "Items", len(pendingItems))
+			retryClose(input)
 			return
 		}
-		workflow.GetLogger(ctx).Info("Added line item", "BillId", input.BillId, "Description", input.Description)
-	})
+
+		// price the period's usage before the totals are computed
+		var items []db.DbBillItem
+		err = workflow.ExecuteActivity(closeCtx, activities.MaterializeUsageActivity, activity.MaterializeUsageInput{BillId: input.BillId}).Get(ctx, &items)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("Failed to bill usage", "Error", err)
+			retryClose(input)
+			return
+		}
+		for i := range items {
+			if _, ok := addedItems[items[i].Reference]; !ok {
+				trackItem(&items[i])
+			}
+		}
+
+		// draw the account's credit down against the bill's total
+		var credit *db.DbBillItem
+		err = workflow.ExecuteActivity(closeCtx, activities.ApplyCreditActivity, activity.ApplyCreditInput{BillId: input.BillId}).Get(ctx, &credit)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("Failed to apply account credit", "Error", err)
+			retryClose(input)
+			return
+		}
+		if credit != nil {
+			if _, ok := addedItems[credit.Reference]; !ok {
+				trackItem(credit)
+			}
+		}
+
+		err = transition(closeCtx, db.StatusClosed, activities.CloseBillActivity, input)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("Failed to finalize the bill", "Error", err)
+			retryClose(input)
+			return
+		}
+
+		workflow.GetLogger(ctx).Info("Successfully finalized the bill", "BillId", input.BillId)
+	}
 
 	selector.AddReceive(finalizeBillSignalCh, func(c workflow.ReceiveChannel, more bool) {
 		var input activity.CloseBillInput
 		c.Receive(ctx, &input)
 		workflow.GetLogger(ctx).Info("Received signal, closing the bill", "BillId", input.BillId)
+		closeBill(input)
+	})
 
-		err := workflow.ExecuteActivity(ctx, activity.CloseBillActivity, input).Get(ctx, nil)
+	// voidErr fails a run resumed to void a bill when the void is rejected,
+	// so the caller waiting on the run sees it. It is reset before each
+	// signal is handled.
+	var voidErr error
+	selector.AddReceive(voidBillSignalCh, func(c workflow.ReceiveChannel, more bool) {
+		var input activity.VoidBillInput
+		c.Receive(ctx, &input)
+		workflow.GetLogger(ctx).Info("Received signal, voiding the bill", "BillId", input.BillId, "Actor", input.Actor, "Reason", input.Reason)
+
+		if !state.Status.CanTransitionTo(db.StatusVoided) {
+			workflow.GetLogger(ctx).Error("Bill cannot be voided", "BillId", input.BillId, "Status", state.Status)
+			voidErr = temporal.NewApplicationError("Bill is "+string(state.Status), activity.IllegalTransitionError)
+			return
+		}
+		err := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) })
 		if err != nil {
-			workflow.GetLogger(ctx).Error("Failed to finalize the bill", "Error", err)
+			workflow.GetLogger(ctx).Error("Failed waiting for pending line items", "Error", err)
 			return
 		}
 
-		workflow.GetLogger(ctx).Info("Successfully finalized the bill", "BillId", input.BillId)
-		isDone = true
+		err = transition(ctx, db.StatusVoided, activities.VoidBillActivity, input)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("Failed to void the bill", "Error", err)
+			voidErr = err
+			return
+		}
+		workflow.GetLogger(ctx).Info("Voided the bill", "BillId", input.BillId)
 	})
 
-	selector.AddFuture(timerFuture, func(f workflow.Future) {
-		if isEnded {
+	selector.AddReceive(reopenBillSignalCh, func(c workflow.ReceiveChannel, more bool) {
+		var input activity.ReopenBillInput
+		c.Receive(ctx, &input)
+		workflow.GetLogger(ctx).Info("Received signal, reopening the bill", "BillId", input.BillId, "Actor", input.Actor, "Reason", input.Reason)
+
+		if input.PeriodEnd.IsZero() {
+			input.PeriodEnd = state.PeriodEnd
+		}
+		if !state.Status.CanTransitionTo(db.StatusOpen) {
+			workflow.GetLogger(ctx).Error("Bill cannot be reopened", "BillId", input.BillId, "Status", state.Status)
 			return
 		}
-		workflow.GetLogger(ctx).Info("Billing period ended, closing the bill", "BillId", workflowInput.BillId)
-
-		workflowID := workflow.GetInfo(ctx).WorkflowExecution.ID
-		runID := workflow.GetInfo(ctx).WorkflowExecution.RunID
+		var items []db.DbBillItem
+		err := workflow.ExecuteActivity(ctx, activities.ReopenBillActivity, input).Get(ctx, &items)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("Failed to reopen the bill", "Error", err)
+			return
+		}
+		state.Status = db.StatusOpen
+		// reopening releases the account credit, which is drawn again
+		// when the bill closes
+		for i := range items {
+			if _, ok := addedItems[items[i].Reference]; !ok {
+				trackItem(&items[i])
+			}
+		}
 
-		workflow.SignalExternalWorkflow(ctx, workflowID, runID, activity.CloseBillSignal, activity.CloseBillInput{BillId: workflowInput.BillId})
-		isEnded = true
+		state.PeriodEnd = input.PeriodEnd
+		startPeriodTimer(state.PeriodEnd)
+		workflow.GetLogger(ctx).Info("Reopened the bill", "BillId", input.BillId, "PeriodEnd", state.PeriodEnd)
 	})
 
+	if state.Status == db.StatusDraft {
+		startTimerFuture := workflow.NewTimer(ctx, durationUntilStart)
+		selector.AddFuture(startTimerFuture, func(f workflow.Future) {
+			workflow.GetLogger(ctx).Info("Billing period started, opening the bill", "BillId", workflowInput.BillId)
+
+			err := transition(ctx, db.StatusOpen, activities.UpdateBillStatusActivity, activity.UpdateBillStatusInput{BillId: workflowInput.BillId, Status: db.StatusOpen})
+			if err != nil {
+				workflow.GetLogger(ctx).Error("Failed to open the bill", "Error", err)
+			}
+		})
+	}
+
+	if state.Status.IsActive() {
+		startPeriodTimer(state.PeriodEnd)
+	}
+
+	// a resumed bill that is no longer active still handles the signal it was
+	// resumed with before completing
 	for {
+		voidErr = nil
 		selector.Select(ctx)
-		if isDone {
-			return nil, nil
+		if !state.Status.IsActive() {
+			return nil, voidErr
+		}
+
+		info := workflow.GetInfo(ctx)
+		if info.GetContinueAsNewSuggested() || info.GetCurrentHistoryLength() >= maxHistoryLength {
+			// the signals received so far are handled before the history is
+			// reset, and the new run reloads the bill's items
+			addBufferedLineItems(ctx)
+			if err := workflow.Await(ctx, func() bool { return workflow.AllHandlersFinished(ctx) }); err != nil {
+				return nil, err
+			}
+			if state.Status.IsActive() && !selector.HasPending() && len(pendingItems) == 0 {
+				workflowInput.Resume = true
+				workflowInput.PeriodEnd = state.PeriodEnd
+				return nil, workflow.NewContinueAsNewError(ctx, CreateBillWorkflow, workflowInput)
+			}
+		}
+	}
+}
+
+// validateLineItem checks a line item against the items already on the bill.
+// Replays of an existing reference are always accepted so that the original
+// item is returned.
+func validateLineItem(input activity.AddLineItemSignalInput, addedItems map[string]*db.DbBillItem, itemsById map[int64]*db.DbBillItem, reversedItems map[int64]bool) error {
+	if input.Reference == "" {
+		return temporal.NewApplicationError("Reference is required", activity.InvalidLineItemError)
+	}
+	if _, ok := addedItems[input.Reference]; ok {
+		return nil
+	}
+
+	switch input.Type {
+	case "", db.ItemTypeCharge:
+		if input.Amount.IsNegative() {
+			return temporal.NewApplicationError("Amount is negative", activity.InvalidLineItemError)
+		}
+	case db.ItemTypeCredit:
+		if !input.Amount.IsNegative() {
+			return temporal.NewApplicationError("Credit amount must be negative", activity.InvalidLineItemError)
+		}
+	case db.ItemTypeReversal:
+		original, ok := itemsById[input.ReversesItemId]
+		if !ok {
+			return temporal.NewApplicationError("Line item not found on bill", activity.LineItemNotFoundError)
+		}
+		if original.Type == db.ItemTypeReversal {
+			return temporal.NewApplicationError("Reversals cannot be reversed", activity.InvalidLineItemError)
+		}
+		if original.Type == db.ItemTypeAccountCredit {
+			// account credit is released by reopening the bill
+			return temporal.NewApplicationError("Account credit cannot be reversed", activity.InvalidLineItemError)
+		}
+		if reversedItems[input.ReversesItemId] {
+			return temporal.NewApplicationError("Line item is already reversed", activity.LineItemReversedError)
 		}
-		workflow.Sleep(ctx, time.Second*1)
+	default:
+		return temporal.NewApplicationError("Unknown line item type "+string(input.Type), activity.InvalidLineItemError)
 	}
+	return nil
 }
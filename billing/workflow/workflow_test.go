@@ -1,17 +1,57 @@
 package workflow
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"encore.app/billing/activity"
+	"encore.app/billing/db"
+	"encore.app/billing/period"
 	"github.com/google/go-cmp/cmp"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/workflow"
 )
 
+// updateCallbacks records the outcome of a workflow update in tests.
+type updateCallbacks struct {
+	accepted bool
+	rejected error
+	result   interface{}
+	err      error
+}
+
+func (u *updateCallbacks) Accept()          { u.accepted = true }
+func (u *updateCallbacks) Reject(err error) { u.rejected = err }
+func (u *updateCallbacks) Complete(result interface{}, err error) {
+	u.result = result
+	u.err = err
+}
+
+// lineItemResults reports each item of a batch as added.
+func lineItemResults(items ...db.DbBillItem) []activity.LineItemResult {
+	results := make([]activity.LineItemResult, len(items))
+	for i := range items {
+		results[i] = activity.LineItemResult{Reference: items[i].Reference, Item: &items[i]}
+	}
+	return results
+}
+
+// addLineItems stands in for AddLineItemsActivity, adding every item.
+func addLineItems(_ context.Context, input activity.AddLineItemsInput) ([]activity.LineItemResult, error) {
+	items := make([]db.DbBillItem, len(input.Items))
+	for i, in := range input.Items {
+		items[i] = db.DbBillItem{Id: int64(i + 1), Reference: in.Reference, Amount: in.Amount, Currency: in.Currency, ExchangeRate: decimal.NewFromInt(1)}
+	}
+	return lineItemResults(items...), nil
+}
+
 type UnitTestSuite struct {
 	suite.Suite
 	testsuite.WorkflowTestSuite
@@ -36,8 +76,11 @@ func (s *UnitTestSuite) SetupTest() {
 // Test to ensure bill creation
 func (s *UnitTestSuite) TestCreateBill() {
 	// Prepare
-	s.env.OnActivity(activity.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
-	s.env.OnActivity(activity.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
 
 	// Execute
 	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
@@ -51,8 +94,11 @@ func (s *UnitTestSuite) TestCreateBill() {
 // Test to verify workflow execution when finalizing a bill via signal
 func (s *UnitTestSuite) TestSignalFinalizeBill() {
 	// Prepare
-	s.env.OnActivity(activity.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
-	s.env.OnActivity(activity.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
 
 	s.env.RegisterDelayedCallback(func() {
 		s.env.SignalWorkflow(activity.CloseBillSignal, activity.CloseBillInput{BillId: s.workflowInput.BillId})
@@ -72,8 +118,11 @@ func (s *UnitTestSuite) TestSignalFinalizeBill() {
 // Test to verify workflow execution with a timer to finalize a bill
 func (s *UnitTestSuite) TestTimerFinalizeBill() {
 	// Prepare
-	s.env.OnActivity(activity.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
-	s.env.OnActivity(activity.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
 
 	// Execute
 	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
@@ -93,13 +142,99 @@ func (s *UnitTestSuite) TestAddLineItem() {
 		Amount:      decimal.NewFromFloat(100.00),
 		Currency:    "USD",
 	}
-	s.env.OnActivity(activity.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
-	s.env.OnActivity(activity.AddLineItemActivity, mock.Anything, mock.Anything).Return(nil)
-	s.env.OnActivity(activity.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(lineItemResults(db.DbBillItem{Id: 1, Reference: lineItem.Reference}), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 1)
+	expected := lineItem
+	expected.BillCurrency = s.workflowInput.Currency
+	s.env.AssertActivityCalled(s.T(), "AddLineItemsActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return len(input.Items) == 1 && cmp.Equal(input.Items[0], expected)
+	}))
+}
+
+// Test to verify a replayed line item signal is only persisted once
+func (s *UnitTestSuite) TestAddLineItemDuplicateReference() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{
+		Reference:   "REF001",
+		Description: "Service Fee",
+		Amount:      decimal.NewFromFloat(100.00),
+		Currency:    "USD",
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(lineItemResults(db.DbBillItem{Id: 1, Reference: lineItem.Reference}), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
 
 	s.env.RegisterDelayedCallback(func() {
 		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
 	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
+	}, time.Minute)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 1)
+}
+
+// Test to verify a batch of line items is validated and added in one activity
+func (s *UnitTestSuite) TestAddLineItemsUpdate() {
+	// Prepare
+	item := func(reference string, amount int64) activity.AddLineItemSignalInput {
+		return activity.AddLineItemSignalInput{BillId: s.workflowInput.BillId, Reference: reference, Amount: decimal.NewFromInt(amount), Currency: "USD"}
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(addLineItems)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	first := &updateCallbacks{}
+	second := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemsUpdate, "update-1", first, activity.AddLineItemsInput{
+			BillId: s.workflowInput.BillId,
+			// the repeated reference is a duplicate and the negative amount fails
+			Items: []activity.AddLineItemSignalInput{item("REF001", 100), item("REF002", 50), item("REF001", 100), item("REF003", -5)},
+		})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemsUpdate, "update-2", second, activity.AddLineItemsInput{
+			BillId: s.workflowInput.BillId,
+			Items:  []activity.AddLineItemSignalInput{item("REF001", 100), item("REF004", 10)},
+		})
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Len(state.Items, 3)
+		s.True(decimal.NewFromInt(160).Equal(state.Total))
+	}, time.Hour)
 
 	// Execute
 	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
@@ -107,10 +242,841 @@ func (s *UnitTestSuite) TestAddLineItem() {
 	// Assert
 	s.True(s.env.IsWorkflowCompleted())
 	s.NoError(s.env.GetWorkflowError())
-	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemActivity", 1)
-	s.env.AssertActivityCalled(s.T(), "AddLineItemActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemSignalInput) bool {
-		return cmp.Equal(input, lineItem)
+	s.NoError(first.err)
+	results := first.result.([]activity.LineItemResult)
+	s.Len(results, 4)
+	s.NotNil(results[0].Item)
+	s.False(results[0].Duplicate)
+	s.NotNil(results[1].Item)
+	s.True(results[2].Duplicate)
+	s.Equal(results[0].Item.Id, results[2].Item.Id)
+	s.Nil(results[3].Item)
+	s.Equal(activity.InvalidLineItemError, results[3].ErrorType)
+	s.NoError(second.err)
+	results = second.result.([]activity.LineItemResult)
+	s.True(results[0].Duplicate)
+	s.NotNil(results[1].Item)
+	s.False(results[1].Duplicate)
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 2)
+	s.env.AssertActivityCalled(s.T(), "AddLineItemsActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return len(input.Items) == 2 && input.Items[0].Reference == "REF001" && input.Items[1].Reference == "REF002" &&
+			input.Items[0].BillCurrency == s.workflowInput.Currency
 	}))
+	s.env.AssertActivityCalled(s.T(), "AddLineItemsActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return len(input.Items) == 1 && input.Items[0].Reference == "REF004"
+	}))
+}
+
+// Test to verify the update validator rejects batches over the limit
+func (s *UnitTestSuite) TestAddLineItemsUpdateRejectsLargeBatch() {
+	// Prepare
+	input := activity.AddLineItemsInput{BillId: s.workflowInput.BillId}
+	for i := 0; i <= maxLineItemBatch; i++ {
+		input.Items = append(input.Items, activity.AddLineItemSignalInput{BillId: s.workflowInput.BillId, Reference: fmt.Sprintf("REF%03d", i), Amount: decimal.NewFromInt(1), Currency: "USD"})
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	callbacks := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemsUpdate, "update-1", callbacks, input)
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.False(callbacks.accepted)
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(callbacks.rejected, &appErr)
+	s.Equal(activity.InvalidLineItemError, appErr.Type())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 0)
+}
+
+// Test to verify a burst of line item signals is added in one batch
+func (s *UnitTestSuite) TestAddLineItemSignalsAreBatched() {
+	// Prepare
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(addLineItems)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		for i := 1; i <= 50; i++ {
+			s.env.SignalWorkflow(activity.AddLineItemSignal, activity.AddLineItemSignalInput{
+				BillId:    s.workflowInput.BillId,
+				Reference: fmt.Sprintf("REF%03d", i),
+				Amount:    decimal.NewFromInt(2),
+				Currency:  "USD",
+			})
+		}
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	// the first signal starts an insert and the rest are buffered during it
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 2)
+	s.env.AssertActivityCalled(s.T(), "AddLineItemsActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return len(input.Items) == 49 && input.Items[0].Reference == "REF002" && input.Items[48].Reference == "REF050"
+	}))
+}
+
+// Test to verify the items of a batch fail on their own
+func (s *UnitTestSuite) TestAddLineItemsReportsFailedItems() {
+	// Prepare
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(func(ctx context.Context, input activity.AddLineItemsInput) ([]activity.LineItemResult, error) {
+		results, err := addLineItems(ctx, input)
+		for i := range results {
+			if input.Items[i].Currency == "XTS" {
+				results[i] = activity.LineItemResult{Reference: input.Items[i].Reference, ErrorType: activity.ExchangeRateNotFoundError, Error: "No exchange rate from XTS to USD"}
+			}
+		}
+		return results, err
+	})
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	callbacks := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemsUpdate, "update-1", callbacks, activity.AddLineItemsInput{
+			BillId: s.workflowInput.BillId,
+			Items: []activity.AddLineItemSignalInput{
+				{BillId: s.workflowInput.BillId, Reference: "REF001", Amount: decimal.NewFromInt(10), Currency: "USD"},
+				{BillId: s.workflowInput.BillId, Reference: "REF002", Amount: decimal.NewFromInt(10), Currency: "XTS"},
+			},
+		})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Len(state.Items, 1)
+		s.Equal("REF001", state.Items[0].Reference)
+	}, time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.NoError(callbacks.err)
+	results := callbacks.result.([]activity.LineItemResult)
+	s.NotNil(results[0].Item)
+	s.Nil(results[1].Item)
+	s.Equal(activity.ExchangeRateNotFoundError, results[1].ErrorType)
+	s.Equal("No exchange rate from XTS to USD", results[1].Error)
+}
+
+// Test to verify a batch that keeps failing stays buffered and is retried
+func (s *UnitTestSuite) TestFailedLineItemBatchIsRetried() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{BillId: s.workflowInput.BillId, Reference: "REF001", Amount: decimal.NewFromInt(100), Currency: "USD"}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(nil, errors.New("database is unavailable")).Times(int(lineItemRetryPolicy.MaximumAttempts))
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(addLineItems)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Len(state.Items, 1)
+	}, time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", int(lineItemRetryPolicy.MaximumAttempts)+1)
+	s.env.AssertActivityNumberOfCalls(s.T(), "CloseBillActivity", 1)
+}
+
+// Test to verify line items signalled just before the close are added to the bill
+func (s *UnitTestSuite) TestAddLineItemSignalBeforeClose() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{BillId: s.workflowInput.BillId, Reference: "REF001", Amount: decimal.NewFromInt(100), Currency: "USD"}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(lineItemResults(db.DbBillItem{Id: 1, Reference: lineItem.Reference}), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
+		s.env.SignalWorkflow(activity.CloseBillSignal, activity.CloseBillInput{BillId: s.workflowInput.BillId})
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 1)
+	s.env.AssertActivityNumberOfCalls(s.T(), "CloseBillActivity", 1)
+}
+
+// Test to verify adding a line item via update returns the persisted item
+func (s *UnitTestSuite) TestAddLineItemUpdate() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{
+		BillId:      s.workflowInput.BillId,
+		Reference:   "REF001",
+		Description: "Service Fee",
+		Amount:      decimal.NewFromFloat(100.00),
+		Currency:    "USD",
+	}
+	dbItem := &db.DbBillItem{Id: 1, BillId: lineItem.BillId, Reference: lineItem.Reference, Amount: lineItem.Amount, Currency: lineItem.Currency}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(lineItemResults(*dbItem), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	first := &updateCallbacks{}
+	replay := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-1", first, lineItem)
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-2", replay, lineItem)
+	}, time.Minute)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.True(first.accepted)
+	s.NoError(first.err)
+	s.Equal(dbItem.Id, first.result.(*db.DbBillItem).Id)
+	s.True(dbItem.Amount.Equal(first.result.(*db.DbBillItem).Amount))
+	s.True(replay.accepted)
+	s.NoError(replay.err)
+	s.Equal(dbItem.Id, replay.result.(*db.DbBillItem).Id)
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 1)
+}
+
+// Test to verify the update validator rejects negative amounts
+func (s *UnitTestSuite) TestAddLineItemUpdateRejectsNegativeAmount() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{
+		BillId:    s.workflowInput.BillId,
+		Reference: "REF001",
+		Amount:    decimal.NewFromInt(-1),
+		Currency:  "USD",
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	callbacks := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-1", callbacks, lineItem)
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.False(callbacks.accepted)
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(callbacks.rejected, &appErr)
+	s.Equal(activity.InvalidLineItemError, appErr.Type())
+	s.env.AssertActivityNumberOfCalls(s.T(), "AddLineItemsActivity", 0)
+}
+
+// Test to verify the update validator rejects items once the bill is closing
+func (s *UnitTestSuite) TestAddLineItemUpdateRejectsClosedBill() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{
+		BillId:    s.workflowInput.BillId,
+		Reference: "REF001",
+		Amount:    decimal.NewFromInt(1),
+		Currency:  "USD",
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).After(time.Minute).Return(nil)
+
+	callbacks := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.CloseBillSignal, activity.CloseBillInput{BillId: s.workflowInput.BillId})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-1", callbacks, lineItem)
+	}, 2*time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.False(callbacks.accepted)
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(callbacks.rejected, &appErr)
+	s.Equal(activity.BillNotOpenError, appErr.Type())
+}
+
+// Test to verify the bill state query reflects added items and closing
+func (s *UnitTestSuite) TestGetBillStateQuery() {
+	// Prepare
+	lineItem := activity.AddLineItemSignalInput{
+		BillId:    s.workflowInput.BillId,
+		Reference: "REF001",
+		Amount:    decimal.NewFromInt(100),
+		Currency:  "EUR",
+	}
+	dbItem := &db.DbBillItem{Id: 1, BillId: lineItem.BillId, Reference: lineItem.Reference, Amount: lineItem.Amount, Currency: lineItem.Currency, ExchangeRate: decimal.RequireFromString("1.5")}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.Anything).Return(lineItemResults(*dbItem), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.AddLineItemSignal, lineItem)
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Equal(db.StatusOpen, state.Status)
+		s.Len(state.Items, 1)
+		s.True(decimal.NewFromInt(150).Equal(state.Total))
+		s.True(s.workflowInput.PeriodEnd.Equal(state.PeriodEnd))
+	}, time.Minute)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+	s.NoError(err)
+	var state BillState
+	s.NoError(value.Get(&state))
+	s.Equal(db.StatusClosed, state.Status)
+}
+
+// Test that usage is billed when the bill closes
+func (s *UnitTestSuite) TestCloseBillMaterializesUsage() {
+	// Prepare
+	usageItem := db.DbBillItem{Id: 7, BillId: s.workflowInput.BillId, Reference: "usage:api_calls:1", Type: db.ItemTypeUsage, Amount: decimal.NewFromInt(12), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, activity.MaterializeUsageInput{BillId: s.workflowInput.BillId}).Return([]db.DbBillItem{usageItem}, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+	s.NoError(err)
+	var state BillState
+	s.NoError(value.Get(&state))
+	s.Equal(db.StatusClosed, state.Status)
+	s.Len(state.Items, 1)
+	s.True(decimal.NewFromInt(12).Equal(state.Total))
+}
+
+// Test that account credit is applied after usage and before the totals
+func (s *UnitTestSuite) TestCloseBillAppliesAccountCredit() {
+	// Prepare
+	usageItem := db.DbBillItem{Id: 7, BillId: s.workflowInput.BillId, Reference: "usage:api_calls:1", Type: db.ItemTypeUsage, Amount: decimal.NewFromInt(12), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)}
+	creditItem := &db.DbBillItem{Id: 8, BillId: s.workflowInput.BillId, Reference: "account-credit", Type: db.ItemTypeAccountCredit, Amount: decimal.NewFromInt(-5), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return([]db.DbBillItem{usageItem}, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, activity.ApplyCreditInput{BillId: s.workflowInput.BillId}).Return(creditItem, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "ApplyCreditActivity", 1)
+	value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+	s.NoError(err)
+	var state BillState
+	s.NoError(value.Get(&state))
+	s.Equal(db.StatusClosed, state.Status)
+	s.Len(state.Items, 2)
+	s.True(decimal.NewFromInt(7).Equal(state.Total))
+}
+
+// Test to verify a bill for a future period starts as a draft and opens when the period starts
+func (s *UnitTestSuite) TestDraftBillOpensAtPeriodStart() {
+	// Prepare
+	s.workflowInput.PeriodStart = time.Now().Add(time.Hour)
+	s.workflowInput.PeriodEnd = s.workflowInput.PeriodStart.Add(24 * time.Hour)
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Equal(db.StatusDraft, state.Status)
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Equal(db.StatusOpen, state.Status)
+	}, 2*time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityCalled(s.T(), "CreateBillActivity", mock.Anything, mock.MatchedBy(func(input activity.CreateBillInput) bool {
+		return input.Status == db.StatusDraft
+	}))
+	s.env.AssertActivityCalled(s.T(), "UpdateBillStatusActivity", mock.Anything, activity.UpdateBillStatusInput{BillId: s.workflowInput.BillId, Status: db.StatusOpen})
+	s.env.AssertActivityCalled(s.T(), "UpdateBillStatusActivity", mock.Anything, activity.UpdateBillStatusInput{BillId: s.workflowInput.BillId, Status: db.StatusClosing})
+}
+
+// Test to verify voiding an open bill via signal completes the workflow
+func (s *UnitTestSuite) TestSignalVoidBill() {
+	// Prepare
+	input := activity.VoidBillInput{BillId: s.workflowInput.BillId, Actor: "ops@example.com", Reason: "created by mistake"}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.VoidBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.VoidBillSignal, input)
+	}, time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityCalled(s.T(), "VoidBillActivity", mock.Anything, input)
+	s.env.AssertActivityNotCalled(s.T(), "CloseBillActivity", mock.Anything, mock.Anything)
+}
+
+// Test to verify a bill left closing by a failed close is closed by a repeated signal
+func (s *UnitTestSuite) TestRepeatedCloseSignalResumesClosing() {
+	// Prepare
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, temporal.NewNonRetryableApplicationError("usage unavailable", "Usage", nil)).Once()
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.CloseBillSignal, activity.CloseBillInput{BillId: s.workflowInput.BillId})
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Equal(db.StatusClosing, state.Status)
+		s.env.SignalWorkflow(activity.CloseBillSignal, activity.CloseBillInput{BillId: s.workflowInput.BillId})
+	}, time.Minute)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	// the bill is opened and moved to closing once
+	s.env.AssertActivityNumberOfCalls(s.T(), "UpdateBillStatusActivity", 2)
+	s.env.AssertActivityNumberOfCalls(s.T(), "MaterializeUsageActivity", 2)
+	s.env.AssertActivityNumberOfCalls(s.T(), "CloseBillActivity", 1)
+}
+
+// Test to verify a failed close is retried without another signal
+func (s *UnitTestSuite) TestFailedCloseIsRetried() {
+	// Prepare
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(temporal.NewNonRetryableApplicationError("database unavailable", "Close", nil)).Once()
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "CloseBillActivity", 2)
+}
+
+// Test to verify a resumed run fails when its bill cannot be voided
+func (s *UnitTestSuite) TestResumeVoidPaidBillRejected() {
+	// Prepare
+	s.workflowInput.PeriodEnd = time.Now().Add(-time.Hour)
+	s.workflowInput.Resume = true
+	loaded := &activity.LoadBillResult{
+		Bill: db.DbBill{Id: s.workflowInput.BillId, Status: db.StatusPaid, Currency: "USD", PeriodEnd: s.workflowInput.PeriodEnd},
+	}
+	s.env.OnActivity(activities.LoadBillActivity, mock.Anything, mock.Anything).Return(loaded, nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.VoidBillSignal, activity.VoidBillInput{BillId: s.workflowInput.BillId, Actor: "ops@example.com", Reason: "too late"})
+	}, 0)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(s.env.GetWorkflowError(), &appErr)
+	s.Equal(activity.IllegalTransitionError, appErr.Type())
+	s.env.AssertActivityNotCalled(s.T(), "VoidBillActivity", mock.Anything, mock.Anything)
+}
+
+// Test to verify a resumed closed bill is reopened and closes again at the new period end
+func (s *UnitTestSuite) TestResumeReopenBill() {
+	// Prepare
+	periodEnd := time.Now().Add(-time.Hour)
+	newPeriodEnd := time.Now().Add(48 * time.Hour)
+	s.workflowInput.PeriodEnd = periodEnd
+	s.workflowInput.Resume = true
+	loaded := &activity.LoadBillResult{
+		Bill: db.DbBill{Id: s.workflowInput.BillId, Status: db.StatusClosed, Currency: "USD", PeriodStart: s.workflowInput.PeriodStart, PeriodEnd: periodEnd},
+		Items: []db.DbBillItem{
+			{Id: 1, BillId: s.workflowInput.BillId, Reference: "REF001", Amount: decimal.NewFromInt(10), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+			{Id: 2, BillId: s.workflowInput.BillId, Reference: "account-credit", Type: db.ItemTypeAccountCredit, Amount: decimal.NewFromInt(-4), Currency: "USD", ExchangeRate: decimal.NewFromInt(1)},
+		},
+	}
+	// reopening releases the account credit applied when the bill closed
+	creditId := int64(2)
+	reopened := append(loaded.Items, db.DbBillItem{Id: 3, BillId: s.workflowInput.BillId, Reference: "account-credit:release:2", Type: db.ItemTypeAccountCredit, Amount: decimal.NewFromInt(4), Currency: "USD", ExchangeRate: decimal.NewFromInt(1), ReversesItemId: &creditId})
+	input := activity.ReopenBillInput{BillId: s.workflowInput.BillId, Actor: "ops@example.com", Reason: "closed early", PeriodEnd: newPeriodEnd}
+	s.env.OnActivity(activities.LoadBillActivity, mock.Anything, mock.Anything).Return(loaded, nil)
+	s.env.OnActivity(activities.ReopenBillActivity, mock.Anything, mock.Anything).Return(reopened, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.ReopenBillSignal, input)
+	}, 0)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Equal(db.StatusOpen, state.Status)
+		s.Len(state.Items, 3)
+		s.True(decimal.NewFromInt(10).Equal(state.Total), "released credit no longer reduces the total, got %s", state.Total)
+	}, time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNotCalled(s.T(), "CreateBillActivity", mock.Anything, mock.Anything)
+	s.env.AssertActivityCalled(s.T(), "ReopenBillActivity", mock.Anything, mock.MatchedBy(func(actual activity.ReopenBillInput) bool {
+		return actual.Reason == input.Reason && actual.PeriodEnd.Equal(newPeriodEnd)
+	}))
+	s.env.AssertActivityNumberOfCalls(s.T(), "CloseBillActivity", 1)
+}
+
+// Test to verify a resumed finalized bill rejects reopening and completes
+func (s *UnitTestSuite) TestResumeReopenFinalizedBillRejected() {
+	// Prepare
+	s.workflowInput.PeriodEnd = time.Now().Add(-time.Hour)
+	s.workflowInput.Resume = true
+	loaded := &activity.LoadBillResult{
+		Bill: db.DbBill{Id: s.workflowInput.BillId, Status: db.StatusInvoiced, Currency: "USD", PeriodEnd: s.workflowInput.PeriodEnd},
+	}
+	s.env.OnActivity(activities.LoadBillActivity, mock.Anything, mock.Anything).Return(loaded, nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.ReopenBillSignal, activity.ReopenBillInput{BillId: s.workflowInput.BillId, Actor: "ops@example.com", Reason: "too late"})
+	}, 0)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNotCalled(s.T(), "ReopenBillActivity", mock.Anything, mock.Anything)
+}
+
+// Test to verify reversing an item negates it and a second reversal is rejected
+func (s *UnitTestSuite) TestReverseLineItemUpdate() {
+	// Prepare
+	charge := activity.AddLineItemSignalInput{
+		BillId:    s.workflowInput.BillId,
+		Reference: "REF001",
+		Amount:    decimal.NewFromInt(100),
+		Currency:  "EUR",
+	}
+	reversal := activity.AddLineItemSignalInput{
+		BillId:         s.workflowInput.BillId,
+		Reference:      "reversal:1",
+		Type:           db.ItemTypeReversal,
+		ReversesItemId: 1,
+	}
+	secondReversal := reversal
+	secondReversal.Reference = "reversal:1:again"
+	chargeItem := &db.DbBillItem{Id: 1, BillId: charge.BillId, Reference: charge.Reference, Type: db.ItemTypeCharge, Amount: charge.Amount, Currency: "EUR", ExchangeRate: decimal.RequireFromString("1.1")}
+	reversesItemId := int64(1)
+	reversalItem := &db.DbBillItem{Id: 2, BillId: charge.BillId, Reference: reversal.Reference, Type: db.ItemTypeReversal, Amount: charge.Amount.Neg(), Currency: "EUR", ExchangeRate: decimal.RequireFromString("1.1"), ReversesItemId: &reversesItemId}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return input.Items[0].Type == ""
+	})).Return(lineItemResults(*chargeItem), nil)
+	s.env.OnActivity(activities.AddLineItemsActivity, mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		return input.Items[0].Type == db.ItemTypeReversal
+	})).Return(lineItemResults(*reversalItem), nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	second := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-1", &updateCallbacks{}, charge)
+	}, time.Second)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-2", &updateCallbacks{}, reversal)
+	}, time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-3", second, secondReversal)
+	}, 2*time.Minute)
+	s.env.RegisterDelayedCallback(func() {
+		value, err := s.env.QueryWorkflow(activity.GetBillStateQuery)
+		s.NoError(err)
+		var state BillState
+		s.NoError(value.Get(&state))
+		s.Len(state.Items, 2)
+		s.True(state.Total.IsZero())
+	}, 3*time.Minute)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(second.rejected, &appErr)
+	s.Equal(activity.LineItemReversedError, appErr.Type())
+	s.env.AssertActivityCalled(s.T(), "AddLineItemsActivity", mock.Anything, mock.MatchedBy(func(input activity.AddLineItemsInput) bool {
+		item := input.Items[0]
+		return item.Type == db.ItemTypeReversal && item.Amount.Equal(decimal.NewFromInt(-100)) && item.ExchangeRate.Equal(chargeItem.ExchangeRate)
+	}))
+}
+
+// Test to verify credits must carry a negative amount
+func (s *UnitTestSuite) TestCreditUpdateRequiresNegativeAmount() {
+	// Prepare
+	credit := activity.AddLineItemSignalInput{
+		BillId:    s.workflowInput.BillId,
+		Reference: "CREDIT001",
+		Type:      db.ItemTypeCredit,
+		Amount:    decimal.NewFromInt(5),
+		Currency:  "USD",
+	}
+	s.env.OnActivity(activities.CreateBillActivity, mock.Anything, mock.Anything).Return(s.workflowInput.BillId, nil)
+	s.env.OnActivity(activities.UpdateBillStatusActivity, mock.Anything, mock.Anything).Return(nil)
+	s.env.OnActivity(activities.MaterializeUsageActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.ApplyCreditActivity, mock.Anything, mock.Anything).Return(nil, nil)
+	s.env.OnActivity(activities.CloseBillActivity, mock.Anything, mock.Anything).Return(nil)
+
+	callbacks := &updateCallbacks{}
+	s.env.RegisterDelayedCallback(func() {
+		s.env.UpdateWorkflow(activity.AddLineItemUpdate, "update-1", callbacks, credit)
+	}, time.Second)
+
+	// Execute
+	s.env.ExecuteWorkflow(CreateBillWorkflow, s.workflowInput)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(callbacks.rejected, &appErr)
+	s.Equal(activity.InvalidLineItemError, appErr.Type())
+}
+
+// Test that a webhook is delivered once the endpoint accepts it
+func (s *UnitTestSuite) TestDeliverWebhookRetriesUntilAccepted() {
+	// Prepare
+	input := activity.DeliverWebhookInput{DeliveryId: 42}
+	s.env.OnActivity(activities.DeliverWebhookActivity, mock.Anything, input).Return(errors.New("endpoint responded with status 503")).Times(2)
+	s.env.OnActivity(activities.DeliverWebhookActivity, mock.Anything, input).Return(nil).Once()
+
+	// Execute
+	s.env.ExecuteWorkflow(DeliverWebhookWorkflow, input)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "DeliverWebhookActivity", 3)
+	s.env.AssertActivityNotCalled(s.T(), "FailWebhookDeliveryActivity", mock.Anything, mock.Anything)
+}
+
+// Test that a webhook is marked failed once its retries are exhausted
+func (s *UnitTestSuite) TestDeliverWebhookMarksFailedWhenRetriesExhausted() {
+	// Prepare
+	input := activity.DeliverWebhookInput{DeliveryId: 42}
+	s.env.OnActivity(activities.DeliverWebhookActivity, mock.Anything, input).Return(errors.New("endpoint responded with status 503"))
+	s.env.OnActivity(activities.FailWebhookDeliveryActivity, mock.Anything, input).Return(nil)
+
+	// Execute
+	s.env.ExecuteWorkflow(DeliverWebhookWorkflow, input)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+	s.env.AssertActivityNumberOfCalls(s.T(), "DeliverWebhookActivity", int(webhookRetryPolicy.MaximumAttempts))
+	s.env.AssertActivityCalled(s.T(), "FailWebhookDeliveryActivity", mock.Anything, input)
+}
+
+func (s *UnitTestSuite) subscriptionInput() SubscriptionWorkflowInput {
+	return SubscriptionWorkflowInput{
+		SubscriptionId: "sub-1",
+		AccountId:      "account123",
+		Currency:       "USD",
+		Schedule: period.Schedule{
+			Cadence: period.Monthly,
+			Anchor:  time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC),
+		},
+		Index: 1,
+	}
+}
+
+// Test that a subscription bills its period and continues with the next one
+func (s *UnitTestSuite) TestSubscriptionContinuesWithNextPeriod() {
+	// Prepare
+	input := s.subscriptionInput()
+	expected := CreateBillWorkflowInput{
+		BillId:         "sub-1-1",
+		AccountId:      "account123",
+		Currency:       "USD",
+		PeriodStart:    time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:      time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC),
+		SubscriptionId: "sub-1",
+	}
+	s.env.RegisterWorkflow(CreateBillWorkflow)
+	s.env.OnWorkflow(CreateBillWorkflow, mock.Anything, mock.MatchedBy(func(in CreateBillWorkflowInput) bool {
+		return in.BillId == expected.BillId && in.SubscriptionId == expected.SubscriptionId &&
+			in.PeriodStart.Equal(expected.PeriodStart) && in.PeriodEnd.Equal(expected.PeriodEnd)
+	})).Return(&WorkflowResult{BillId: expected.BillId}, nil)
+
+	// Execute
+	s.env.ExecuteWorkflow(SubscriptionWorkflow, input)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	s.ErrorAs(s.env.GetWorkflowError(), &continueAsNew)
+	s.env.AssertWorkflowNumberOfCalls(s.T(), "CreateBillWorkflow", 1)
+}
+
+// Test that a failed bill does not end the subscription
+func (s *UnitTestSuite) TestSubscriptionContinuesAfterFailedBill() {
+	// Prepare
+	s.env.RegisterWorkflow(CreateBillWorkflow)
+	s.env.OnWorkflow(CreateBillWorkflow, mock.Anything, mock.Anything).Return(nil, errors.New("bill failed"))
+
+	// Execute
+	s.env.ExecuteWorkflow(SubscriptionWorkflow, s.subscriptionInput())
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	var continueAsNew *workflow.ContinueAsNewError
+	s.ErrorAs(s.env.GetWorkflowError(), &continueAsNew)
+}
+
+// Test that a cancelled subscription stops without opening the next period
+func (s *UnitTestSuite) TestSubscriptionCancel() {
+	// Prepare
+	s.env.RegisterWorkflow(CreateBillWorkflow)
+	s.env.OnWorkflow(CreateBillWorkflow, mock.Anything, mock.Anything).After(24*time.Hour).Return(&WorkflowResult{}, nil)
+
+	s.env.RegisterDelayedCallback(func() {
+		s.env.SignalWorkflow(activity.CancelSubscriptionSignal, nil)
+	}, time.Hour)
+
+	// Execute
+	s.env.ExecuteWorkflow(SubscriptionWorkflow, s.subscriptionInput())
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	s.NoError(s.env.GetWorkflowError())
+}
+
+// Test that an invalid schedule fails without retrying
+func (s *UnitTestSuite) TestSubscriptionInvalidSchedule() {
+	// Prepare
+	input := s.subscriptionInput()
+	input.Schedule.Cadence = "weekly"
+
+	// Execute
+	s.env.ExecuteWorkflow(SubscriptionWorkflow, input)
+
+	// Assert
+	s.True(s.env.IsWorkflowCompleted())
+	var appErr *temporal.ApplicationError
+	s.ErrorAs(s.env.GetWorkflowError(), &appErr)
+	s.Equal(activity.InvalidScheduleError, appErr.Type())
 }
 
 func TestUnitTestSuite(t *testing.T) {